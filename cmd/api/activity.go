@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/saarwasserman/users/internal/data"
+)
+
+// reasons attached to Unauthenticated errors so clients can tell an idle or
+// too old session from a bad token
+const (
+	reasonSessionIdle    = "SESSION_IDLE_TIMEOUT"
+	reasonSessionExpired = "SESSION_MAX_LIFETIME_EXCEEDED"
+)
+
+var errActivityNotFound = errors.New("activity not found")
+
+type activity struct {
+	LastSeen time.Time
+}
+
+// activityStore keeps the activity of sessions, keyed by a hash of their token
+type activityStore interface {
+	Get(ctx context.Context, key string) (*activity, error)
+	Set(ctx context.Context, key string, a activity, expiry time.Time) error
+}
+
+// activityKey identifies the activity of a session by the hash of its current
+// access token, so a token moved to another session never inherits it
+func activityKey(session *data.Session) string {
+	return "session:" + hex.EncodeToString(session.TokenHash)
+}
+
+// touchSession rejects a session idle for longer than the inactivity time or
+// older than the max lifetime, and otherwise slides its inactivity window.
+// the lifetime counts from the creation of the session, which the activity
+// store can't lose
+func (app *application) touchSession(ctx context.Context, session *data.Session) error {
+	now := time.Now()
+
+	if now.Sub(session.CreatedAt) > app.config.session.maxLifetime {
+		return sessionError(reasonSessionExpired, "session exceeded its maximum lifetime")
+	}
+
+	err := app.checkIdle(ctx, session, now)
+	if err != nil {
+		return err
+	}
+
+	err = app.recordActivity(ctx, session, now)
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return status.Error(codes.Internal, "failed to record session activity")
+	}
+
+	return nil
+}
+
+// checkIdle rejects a session idle for longer than the inactivity time
+func (app *application) checkIdle(ctx context.Context, session *data.Session, now time.Time) error {
+	lastSeen, err := app.lastSeen(ctx, session)
+	switch {
+	case errors.Is(err, errActivityNotFound):
+		// entries expire once their session is idle. one lost along with the
+		// local store leaves no way to tell, so the session is treated as idle
+		return sessionError(reasonSessionIdle, "session expired due to inactivity")
+	case err != nil:
+		app.logger.PrintError(err, nil)
+		return status.Error(codes.Internal, "failed to check session activity")
+	}
+
+	// a rejected session is not touched again, so it stays rejected
+	if now.Sub(lastSeen) > time.Duration(app.config.session.inactivityTime)*time.Minute {
+		return sessionError(reasonSessionIdle, "session expired due to inactivity")
+	}
+
+	return nil
+}
+
+// lastSeen returns when the session was last used, as the activity store is
+// the only place that is recorded
+func (app *application) lastSeen(ctx context.Context, session *data.Session) (time.Time, error) {
+	a, err := app.activity.Get(ctx, activityKey(session))
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return a.LastSeen, nil
+}
+
+// recordActivity slides the inactivity window of the session. the entry
+// expires with the window, or with the session if that comes first
+func (app *application) recordActivity(ctx context.Context, session *data.Session, now time.Time) error {
+	expiry := now.Add(time.Duration(app.config.session.inactivityTime) * time.Minute)
+	if session.Expiry.Before(expiry) {
+		expiry = session.Expiry
+	}
+
+	return app.activity.Set(ctx, activityKey(session), activity{LastSeen: now}, expiry)
+}
+
+func sessionError(reason, message string) error {
+	st, err := status.New(codes.Unauthenticated, message).WithDetails(&errdetails.ErrorInfo{
+		Reason: reason,
+		Domain: "users",
+	})
+	if err != nil {
+		return status.Error(codes.Unauthenticated, message)
+	}
+
+	return st.Err()
+}
+
+type memoryActivityStore struct {
+	mu      sync.Mutex
+	entries map[string]memoryActivity
+}
+
+type memoryActivity struct {
+	activity
+	expiry time.Time
+}
+
+func newMemoryActivityStore() *memoryActivityStore {
+	return &memoryActivityStore{entries: make(map[string]memoryActivity)}
+}
+
+func (s *memoryActivityStore) Get(ctx context.Context, key string) (*activity, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.entries[key]
+	if !ok || time.Now().After(entry.expiry) {
+		return nil, errActivityNotFound
+	}
+
+	a := entry.activity
+	return &a, nil
+}
+
+func (s *memoryActivityStore) Set(ctx context.Context, key string, a activity, expiry time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.entries[key] = memoryActivity{activity: a, expiry: expiry}
+	return nil
+}
+
+// evictExpired drops the entries of idle or expired sessions
+func (s *memoryActivityStore) evictExpired() {
+	for {
+		time.Sleep(time.Minute)
+
+		s.mu.Lock()
+
+		for key, entry := range s.entries {
+			if time.Now().After(entry.expiry) {
+				delete(s.entries, key)
+			}
+		}
+
+		s.mu.Unlock()
+	}
+}
+
+// redisActivityStore shares session activity between api replicas
+type redisActivityStore struct {
+	client *redis.Client
+}
+
+func (s redisActivityStore) Get(ctx context.Context, key string) (*activity, error) {
+	value, err := s.client.HGet(ctx, key, "last_seen").Result()
+	if err != nil {
+		switch {
+		case errors.Is(err, redis.Nil):
+			return nil, errActivityNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	lastSeen, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	return &activity{
+		LastSeen: time.UnixMilli(lastSeen),
+	}, nil
+}
+
+func (s redisActivityStore) Set(ctx context.Context, key string, a activity, expiry time.Time) error {
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, key, "last_seen", a.LastSeen.UnixMilli())
+		pipe.ExpireAt(ctx, key, expiry)
+		return nil
+	})
+
+	return err
+}
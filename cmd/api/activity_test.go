@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/saarwasserman/users/internal/data"
+)
+
+// sessionErrorReason returns the reason attached to a session error
+func sessionErrorReason(err error) string {
+	for _, detail := range status.Convert(err).Details() {
+		if info, ok := detail.(*errdetails.ErrorInfo); ok {
+			return info.Reason
+		}
+	}
+
+	return ""
+}
+
+func TestTouchSession(t *testing.T) {
+	ctx := context.Background()
+
+	newSession := func(createdAt time.Time) *data.Session {
+		return &data.Session{
+			ID:        1,
+			UserID:    1,
+			TokenHash: []byte("token hash"),
+			CreatedAt: createdAt,
+			Expiry:    createdAt.Add(24 * time.Hour),
+		}
+	}
+
+	t.Run("Active", func(t *testing.T) {
+		app, _ := newTestApplication(t)
+		session := newSession(time.Now().Add(-time.Hour))
+
+		err := app.recordActivity(ctx, session, time.Now().Add(-time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = app.touchSession(ctx, session)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the window slid forward
+		lastSeen, err := app.lastSeen(ctx, session)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if time.Since(lastSeen) > time.Second {
+			t.Fatalf("last seen %s ago, want just now", time.Since(lastSeen))
+		}
+	})
+
+	t.Run("Idle", func(t *testing.T) {
+		app, _ := newTestApplication(t)
+		session := newSession(time.Now().Add(-time.Hour))
+
+		err := app.activity.Set(ctx, activityKey(session), activity{LastSeen: time.Now().Add(-6 * time.Minute)}, time.Now().Add(time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = app.touchSession(ctx, session)
+		if status.Code(err) != codes.Unauthenticated || sessionErrorReason(err) != reasonSessionIdle {
+			t.Fatalf("got %v, want an idle session error", err)
+		}
+
+		// a rejected session stays rejected
+		err = app.touchSession(ctx, session)
+		if sessionErrorReason(err) != reasonSessionIdle {
+			t.Fatalf("got %v on the second touch, want an idle session error", err)
+		}
+	})
+
+	t.Run("NoActivity", func(t *testing.T) {
+		app, _ := newTestApplication(t)
+		session := newSession(time.Now().Add(-time.Hour))
+
+		err := app.touchSession(ctx, session)
+		if sessionErrorReason(err) != reasonSessionIdle {
+			t.Fatalf("got %v, want an idle session error", err)
+		}
+	})
+
+	t.Run("MaxLifetime", func(t *testing.T) {
+		app, _ := newTestApplication(t)
+		session := newSession(time.Now().Add(-25 * time.Hour))
+
+		err := app.recordActivity(ctx, session, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = app.touchSession(ctx, session)
+		if status.Code(err) != codes.Unauthenticated || sessionErrorReason(err) != reasonSessionExpired {
+			t.Fatalf("got %v, want an expired session error", err)
+		}
+	})
+
+	t.Run("NewToken", func(t *testing.T) {
+		app, _ := newTestApplication(t)
+		session := newSession(time.Now().Add(-time.Hour))
+
+		err := app.recordActivity(ctx, session, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// activity is kept by token, a session moved to another token
+		// doesn't carry over what was recorded for the old one
+		session.TokenHash = []byte("another token hash")
+
+		_, err = app.lastSeen(ctx, session)
+		if !errors.Is(err, errActivityNotFound) {
+			t.Fatalf("got %v, want errActivityNotFound", err)
+		}
+	})
+}
+
+func TestMemoryActivityStore(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryActivityStore()
+
+	err := store.Set(ctx, "live", activity{LastSeen: time.Now()}, time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = store.Set(ctx, "expired", activity{LastSeen: time.Now()}, time.Now().Add(-time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = store.Get(ctx, "live")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = store.Get(ctx, "expired")
+	if !errors.Is(err, errActivityNotFound) {
+		t.Fatalf("got %v, want errActivityNotFound", err)
+	}
+}
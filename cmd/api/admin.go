@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/saarwasserman/users/internal/data"
+	"github.com/saarwasserman/users/internal/validator"
+	"github.com/saarwasserman/users/protogen/users"
+)
+
+func (app *application) ListUsers(ctx context.Context, req *users.ListUsersRequest) (*users.ListUsersResponse, error) {
+	v := validator.New()
+
+	listFilters := data.UserListFilters{
+		Activated: req.Activated,
+		Search:    req.Search,
+	}
+
+	// timestamps are unix milliseconds, zero means unset
+	if req.CreatedAfter != 0 {
+		createdAfter := time.UnixMilli(req.CreatedAfter)
+		listFilters.CreatedAfter = &createdAfter
+	}
+
+	if req.CreatedBefore != 0 {
+		createdBefore := time.UnixMilli(req.CreatedBefore)
+		listFilters.CreatedBefore = &createdBefore
+	}
+
+	filters := data.Filters{
+		Sort:         req.Sort,
+		SortSafelist: []string{"created_at", "-created_at"},
+		PageSize:     int(req.PageSize),
+		Cursor:       req.Cursor,
+	}
+
+	if filters.Sort == "" {
+		filters.Sort = "created_at"
+	}
+
+	if filters.PageSize == 0 {
+		filters.PageSize = data.DefaultPageSize
+	}
+
+	v.Check(len(listFilters.Search) <= 500, "search", "must not be more than 500 bytes long")
+
+	if listFilters.CreatedAfter != nil && listFilters.CreatedBefore != nil {
+		v.Check(listFilters.CreatedAfter.Before(*listFilters.CreatedBefore), "created_after", "must be before created_before")
+	}
+
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		return nil, status.Errorf(codes.InvalidArgument, "error %s", v.Errors)
+	}
+
+	list, nextCursor, err := app.models.Users.ListContext(ctx, listFilters, filters)
+	if err != nil {
+		return nil, queryError(err)
+	}
+
+	res := &users.ListUsersResponse{
+		Users:      make([]*users.UserDetailsResponse, 0, len(list)),
+		NextCursor: nextCursor,
+	}
+
+	for _, user := range list {
+		res.Users = append(res.Users, &users.UserDetailsResponse{
+			Id:        user.ID,
+			Email:     user.Email,
+			Name:      user.Name,
+			CreatedAt: user.CreatedAt.UnixMilli(),
+			Activated: user.Activated,
+			Version:   int32(user.Version),
+		})
+	}
+
+	return res, nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/saarwasserman/users/internal/data"
+	"github.com/saarwasserman/users/protogen/users"
+)
+
+func TestListUsers(t *testing.T) {
+	ctx := context.Background()
+
+	// newApp returns an application with five users, the odd ones activated.
+	// they are inserted within the same second, so pages are told apart by id
+	newApp := func(t *testing.T) *application {
+		app, _ := newTestApplication(t)
+
+		for i := 1; i <= 5; i++ {
+			err := app.models.Users.InsertContext(ctx, &data.User{
+				Name:      fmt.Sprintf("User %d", i),
+				Email:     fmt.Sprintf("user%d@dinghy.test", i),
+				Activated: i%2 == 1,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		return app
+	}
+
+	// listAll follows the cursors through every page of the listing
+	listAll := func(t *testing.T, app *application, req *users.ListUsersRequest) []int64 {
+		t.Helper()
+
+		ids := []int64{}
+
+		for range 10 {
+			res, err := app.ListUsers(ctx, req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(res.Users) > int(req.PageSize) {
+				t.Fatalf("got a page of %d users, want at most %d", len(res.Users), req.PageSize)
+			}
+
+			for _, user := range res.Users {
+				ids = append(ids, user.Id)
+			}
+
+			if res.NextCursor == "" {
+				return ids
+			}
+
+			req.Cursor = res.NextCursor
+		}
+
+		t.Fatal("listing never ended")
+		return nil
+	}
+
+	t.Run("Ascending", func(t *testing.T) {
+		app := newApp(t)
+
+		ids := listAll(t, app, &users.ListUsersRequest{PageSize: 2})
+		if !slices.Equal(ids, []int64{1, 2, 3, 4, 5}) {
+			t.Fatalf("got %v, want every user once in order", ids)
+		}
+	})
+
+	t.Run("Descending", func(t *testing.T) {
+		app := newApp(t)
+
+		ids := listAll(t, app, &users.ListUsersRequest{Sort: "-created_at", PageSize: 2})
+		if !slices.Equal(ids, []int64{5, 4, 3, 2, 1}) {
+			t.Fatalf("got %v, want every user once in reverse order", ids)
+		}
+	})
+
+	t.Run("Filtered", func(t *testing.T) {
+		app := newApp(t)
+
+		activated := true
+
+		ids := listAll(t, app, &users.ListUsersRequest{Activated: &activated, PageSize: 1})
+		if !slices.Equal(ids, []int64{1, 3, 5}) {
+			t.Fatalf("got %v, want the activated users", ids)
+		}
+
+		ids = listAll(t, app, &users.ListUsersRequest{Search: "USER4", PageSize: 2})
+		if !slices.Equal(ids, []int64{4}) {
+			t.Fatalf("got %v, want the matching user", ids)
+		}
+	})
+
+	t.Run("CursorOfOtherSort", func(t *testing.T) {
+		app := newApp(t)
+
+		res, err := app.ListUsers(ctx, &users.ListUsersRequest{PageSize: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = app.ListUsers(ctx, &users.ListUsersRequest{Sort: "-created_at", PageSize: 2, Cursor: res.NextCursor})
+		if status.Code(err) != codes.InvalidArgument {
+			t.Fatalf("got %v, want InvalidArgument", err)
+		}
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		app := newApp(t)
+
+		tests := []struct {
+			name string
+			req  *users.ListUsersRequest
+		}{
+			{"PageSize", &users.ListUsersRequest{PageSize: data.MaxPageSize + 1}},
+			{"Sort", &users.ListUsersRequest{Sort: "name"}},
+			{"CreatedRange", &users.ListUsersRequest{CreatedAfter: 2000, CreatedBefore: 1000}},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				_, err := app.ListUsers(ctx, tt.req)
+				if status.Code(err) != codes.InvalidArgument {
+					t.Fatalf("got %v, want InvalidArgument", err)
+				}
+			})
+		}
+	})
+}
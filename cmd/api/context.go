@@ -6,7 +6,10 @@ import (
 
 type ContextKey string
 
-const userIdContextKey = ContextKey("userId")
+const (
+	userIdContextKey    = ContextKey("userId")
+	sessionIdContextKey = ContextKey("sessionId")
+)
 
 func (app *application) contextSetUserId(ctx context.Context, userId int64) context.Context {
 	ctx = context.WithValue(ctx, userIdContextKey, userId)
@@ -21,3 +24,24 @@ func (app *application) contextGetUserId(ctx context.Context) int64 {
 
 	return userId
 }
+
+// contextLookupUserId is like contextGetUserId for code that also runs for
+// unauthenticated calls
+func (app *application) contextLookupUserId(ctx context.Context) (int64, bool) {
+	userId, ok := ctx.Value(userIdContextKey).(int64)
+	return userId, ok
+}
+
+func (app *application) contextSetSessionId(ctx context.Context, sessionId int64) context.Context {
+	ctx = context.WithValue(ctx, sessionIdContextKey, sessionId)
+	return ctx
+}
+
+func (app *application) contextGetSessionId(ctx context.Context) int64 {
+	sessionId, ok := ctx.Value(sessionIdContextKey).(int64)
+	if !ok {
+		panic("missing sessionId value in request context")
+	}
+
+	return sessionId
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/saarwasserman/users/internal/data"
+	"github.com/saarwasserman/users/protogen/auth"
+	"github.com/saarwasserman/users/protogen/users"
+)
+
+// max number of accounts hard deleted in one purge round, and how long a
+// round has to purge them before other replicas may take them over
+const (
+	purgeBatchSize = 100
+	purgeTimeout   = 10 * time.Second
+	purgeLease     = 2 * purgeBatchSize * purgeTimeout
+)
+
+func (app *application) DeleteAccount(ctx context.Context, req *users.DeleteAccountRequest) (*users.DeleteAccountResponse, error) {
+	userId := app.contextGetUserId(ctx)
+
+	user, err := app.models.Users.GetByUserIdContext(ctx, userId)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return nil, status.Error(codes.Internal, "user not found")
+		default:
+			return nil, queryError(err)
+		}
+	}
+
+	err = app.reauthenticate(ctx, user, reauthentication{
+		password:     req.Password,
+		code:         req.Code,
+		recoveryCode: req.RecoveryCode,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = app.models.Users.SoftDeleteContext(ctx, user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			return nil, status.Error(codes.Aborted, "unable to update the record due to an edit conflict, please try again")
+		default:
+			return nil, queryError(err)
+		}
+	}
+
+	err = app.models.EmailChanges.DeleteForUser(user.ID)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	err = app.revokeAllTokens(ctx, user.ID)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &users.DeleteAccountResponse{
+		Message: "your account is scheduled for deletion, login before it is purged to cancel",
+		PurgeAt: user.DeletedAt.Add(app.config.deletion.gracePeriod).UnixMilli(),
+	}, nil
+}
+
+// purgeDeletedUsers periodically hard deletes accounts whose deletion grace
+// period is over, along with what the auth service keeps for them. each
+// replica purges the accounts it claimed, so they never purge the same one
+func (app *application) purgeDeletedUsers() {
+	ticker := time.NewTicker(app.config.deletion.purgeInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		userIds, err := app.models.Users.ClaimDeletedBeforeContext(context.Background(), time.Now().Add(-app.config.deletion.gracePeriod), purgeBatchSize, purgeLease)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+			continue
+		}
+
+		for _, userId := range userIds {
+			err := app.purgeUser(userId)
+			if err != nil {
+				app.logger.PrintError(err, map[string]string{"user_id": strconv.FormatInt(userId, 10)})
+				continue
+			}
+
+			app.logger.PrintInfo("account purged", map[string]string{"user_id": strconv.FormatInt(userId, 10)})
+		}
+	}
+}
+
+func (app *application) purgeUser(userId int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), purgeTimeout)
+	defer cancel()
+
+	// auth service records go first, if any of them fails the row is still
+	// there and the purge is retried on the next round
+	err := app.revokeAllTokens(ctx, userId)
+	if err != nil {
+		return err
+	}
+
+	_, err = app.auth.DeletePassword(ctx, &auth.PasswordDeletionRequest{UserId: userId})
+	if err != nil {
+		return err
+	}
+
+	_, err = app.auth.DeleteAllPermissionsForUser(ctx, &auth.PermissionsDeletionRequest{UserId: userId})
+	if err != nil {
+		return err
+	}
+
+	err = app.models.Users.DeleteContext(ctx, userId)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		return err
+	}
+
+	return nil
+}
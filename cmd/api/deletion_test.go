@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/saarwasserman/users/internal/data"
+	"github.com/saarwasserman/users/protogen/users"
+)
+
+// deleteTestUser soft deletes the user as if they had deleted their account
+func deleteTestUser(t *testing.T, app *application, user *data.User) {
+	t.Helper()
+
+	err := app.models.Users.SoftDeleteContext(context.Background(), user)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDeleteAccount(t *testing.T) {
+	t.Run("Delete", func(t *testing.T) {
+		app, fake := newTestApplication(t)
+
+		user, _ := insertTestUser(t, app, fake)
+		ctx, _ := startTestSession(t, app, user.ID)
+		_, other := startTestSession(t, app, user.ID)
+
+		err := app.models.EmailChanges.Upsert(&data.EmailChange{UserID: user.ID, NewEmail: "alicia@dinghy.test", Expiry: time.Now().Add(time.Hour)})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := app.DeleteAccount(ctx, &users.DeleteAccountRequest{Password: testPassword})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = app.models.Users.GetByUserIdContext(ctx, user.ID)
+		if err != data.ErrRecordNotFound {
+			t.Fatalf("got %v for the deleted user, want %v", err, data.ErrRecordNotFound)
+		}
+
+		deleted, err := app.models.Users.GetPendingDeletionContext(ctx, user.ID, time.Now().Add(-app.config.deletion.gracePeriod))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		purgeAt := deleted.DeletedAt.Add(app.config.deletion.gracePeriod)
+		if res.PurgeAt != purgeAt.UnixMilli() {
+			t.Errorf("got purge at %d, want %d", res.PurgeAt, purgeAt.UnixMilli())
+		}
+
+		// nothing the account had going is left usable
+		_, err = app.models.Sessions.Get(other.ID)
+		if err != data.ErrRecordNotFound {
+			t.Errorf("got %v for a session, want %v", err, data.ErrRecordNotFound)
+		}
+
+		_, err = app.models.EmailChanges.GetForUser(user.ID)
+		if err != data.ErrRecordNotFound {
+			t.Errorf("got %v for the email change, want %v", err, data.ErrRecordNotFound)
+		}
+	})
+
+	t.Run("IncorrectPassword", func(t *testing.T) {
+		app, fake := newTestApplication(t)
+
+		user, _ := insertTestUser(t, app, fake)
+		ctx, _ := startTestSession(t, app, user.ID)
+
+		_, err := app.DeleteAccount(ctx, &users.DeleteAccountRequest{Password: "wr0ng-pa55word"})
+		if status.Code(err) != codes.InvalidArgument {
+			t.Fatalf("got %v, want %v", err, codes.InvalidArgument)
+		}
+
+		_, err = app.models.Users.GetByUserIdContext(ctx, user.ID)
+		if err != nil {
+			t.Errorf("got %v, want the user kept", err)
+		}
+	})
+
+	t.Run("RecentSession", func(t *testing.T) {
+		app, _ := newTestApplication(t)
+
+		// signed up with an identity provider, so there is no password
+		user := &data.User{Name: "Alice", Email: "alice@dinghy.test", Activated: true}
+		err := app.models.Users.InsertContext(context.Background(), user)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, _ := startTestSession(t, app, user.ID)
+
+		_, err = app.DeleteAccount(ctx, &users.DeleteAccountRequest{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("StaleSession", func(t *testing.T) {
+		app, fake := newTestApplication(t)
+
+		user, _ := insertTestUser(t, app, fake)
+		ctx, session := startTestSession(t, app, user.ID)
+
+		sessions := app.models.Sessions.(*fakeSessions)
+		sessions.mu.Lock()
+		sessions.sessions[session.ID].CreatedAt = time.Now().Add(-reauthenticationWindow - time.Minute)
+		sessions.mu.Unlock()
+
+		_, err := app.DeleteAccount(ctx, &users.DeleteAccountRequest{})
+		if status.Code(err) != codes.InvalidArgument {
+			t.Fatalf("got %v, want %v", err, codes.InvalidArgument)
+		}
+	})
+
+	t.Run("Restore", func(t *testing.T) {
+		app, fake := newTestApplication(t)
+
+		user, _ := insertTestUser(t, app, fake)
+		deleteTestUser(t, app, user)
+
+		// logging in during the grace period cancels the deletion
+		_, err := app.Login(context.Background(), &users.LoginRequest{Email: user.Email, Password: testPassword})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		restored, err := app.models.Users.GetByUserIdContext(context.Background(), user.ID)
+		if err != nil {
+			t.Fatalf("got %v, want the user restored", err)
+		}
+
+		if restored.DeletedAt != nil {
+			t.Errorf("got deleted at %v, want none", restored.DeletedAt)
+		}
+	})
+}
+
+func TestPurgeDeletedUsers(t *testing.T) {
+	t.Run("Purge", func(t *testing.T) {
+		app, fake := newTestApplication(t)
+
+		// every deleted account is past its grace period
+		app.config.deletion.gracePeriod = 0
+		app.config.deletion.purgeInterval = 10 * time.Millisecond
+
+		user, ctx := insertTestUser(t, app, fake)
+		deleteTestUser(t, app, user)
+
+		kept := &data.User{Name: "Bob", Email: "bob@dinghy.test", Activated: true}
+		err := app.models.Users.InsertContext(ctx, kept)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		go app.purgeDeletedUsers()
+
+		waitFor(t, func() bool {
+			_, err := app.models.Users.GetPendingDeletionContext(ctx, user.ID, time.Time{})
+			return err == data.ErrRecordNotFound
+		})
+
+		// the auth service forgets the account too
+		if checkTestPassword(t, fake, user.ID, testPassword) {
+			t.Error("got the password of the purged user kept")
+		}
+
+		_, err = app.models.Users.GetByUserIdContext(ctx, kept.ID)
+		if err != nil {
+			t.Errorf("got %v for a user that wasn't deleted, want it kept", err)
+		}
+	})
+
+	t.Run("AuthUnavailable", func(t *testing.T) {
+		app, fake := newTestApplication(t)
+
+		user, ctx := insertTestUser(t, app, fake)
+		deleteTestUser(t, app, user)
+
+		fake.failures["DeletePassword"] = status.Error(codes.Unavailable, "auth is down")
+
+		// the row stays so the next round retries the purge
+		err := app.purgeUser(user.ID)
+		if err == nil {
+			t.Fatal("got no error, want the purge to fail")
+		}
+
+		_, err = app.models.Users.GetPendingDeletionContext(ctx, user.ID, time.Time{})
+		if err != nil {
+			t.Fatalf("got %v, want the user kept", err)
+		}
+
+		delete(fake.failures, "DeletePassword")
+
+		err = app.purgeUser(user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = app.models.Users.GetPendingDeletionContext(ctx, user.ID, time.Time{})
+		if err != data.ErrRecordNotFound {
+			t.Errorf("got %v, want %v", err, data.ErrRecordNotFound)
+		}
+	})
+}
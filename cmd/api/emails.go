@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	"github.com/saarwasserman/users/internal/data"
+	"github.com/saarwasserman/users/internal/validator"
+	"github.com/saarwasserman/users/protogen/auth"
+	"github.com/saarwasserman/users/protogen/notifications"
+	"github.com/saarwasserman/users/protogen/users"
+)
+
+const emailChangeTTL = 24 * time.Hour
+
+func (app *application) RequestEmailChange(ctx context.Context, req *users.RequestEmailChangeRequest) (*users.RequestEmailChangeResponse, error) {
+	userId := app.contextGetUserId(ctx)
+
+	v := validator.New()
+
+	if data.ValidateEmail(v, req.NewEmail); !v.Valid() {
+		return nil, status.Errorf(codes.InvalidArgument, "error %s", v.Errors)
+	}
+
+	user, err := app.models.Users.GetByUserIdContext(ctx, userId)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return nil, status.Error(codes.Internal, "user not found")
+		default:
+			return nil, queryError(err)
+		}
+	}
+
+	// emails are case insensitive (citext)
+	if strings.EqualFold(user.Email, req.NewEmail) {
+		v.AddError("email", "must be different from the current email address")
+		return nil, status.Errorf(codes.InvalidArgument, "error %s", v.Errors)
+	}
+
+	_, err = app.models.Users.GetByEmailContext(ctx, req.NewEmail)
+	switch {
+	case err == nil:
+		v.AddError("email", "a user with this email address already exists")
+		return nil, status.Errorf(codes.InvalidArgument, "error %s", v.Errors)
+	case !errors.Is(err, data.ErrRecordNotFound):
+		return nil, queryError(err)
+	}
+
+	// tokens of an earlier request must not confirm or cancel this one
+	err = app.deleteEmailChangeTokens(ctx, user.ID)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	confirmToken, err := app.auth.CreateToken(ctx, &auth.TokenCreationRequest{
+		Scope:  data.ScopeEmailChange,
+		UserId: user.ID,
+		Ttl:    durationpb.New(emailChangeTTL),
+	})
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	cancelToken, err := app.auth.CreateToken(ctx, &auth.TokenCreationRequest{
+		Scope:  data.ScopeEmailChangeCancel,
+		UserId: user.ID,
+		Ttl:    durationpb.New(emailChangeTTL),
+	})
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	confirmation, err := app.newOutboxMessage(outboxEmailChangeConfirmationEmail, user.ID, &notifications.SendEmailChangeConfirmationEmailRequest{
+		Recipient: req.NewEmail,
+		UserId:    strconv.FormatInt(user.ID, 10),
+		Token:     confirmToken.TokenPlaintext,
+	})
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	notice, err := app.newOutboxMessage(outboxEmailChangeNoticeEmail, user.ID, &notifications.SendEmailChangeNoticeEmailRequest{
+		Recipient: user.Email,
+		UserId:    strconv.FormatInt(user.ID, 10),
+		NewEmail:  req.NewEmail,
+		Token:     cancelToken.TokenPlaintext,
+	})
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	// the pending change and the emails about it are stored together, so
+	// neither is ever there without the other
+	err = app.models.EmailChanges.Upsert(&data.EmailChange{
+		UserID:   user.ID,
+		NewEmail: req.NewEmail,
+		Expiry:   time.Now().Add(emailChangeTTL),
+	}, confirmation, notice)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &users.RequestEmailChangeResponse{
+		Message: "a confirmation email was sent to the new email address",
+	}, nil
+}
+
+func (app *application) ConfirmEmailChange(ctx context.Context, req *users.ConfirmEmailChangeRequest) (*users.UserDetailsResponse, error) {
+	v := validator.New()
+
+	if data.ValidateTokenPlaintext(v, req.TokenPlaintext); !v.Valid() {
+		return nil, status.Errorf(codes.InvalidArgument, "error %s", v.Errors)
+	}
+
+	authRes, err := app.auth.Authenticate(ctx, &auth.AuthenticationRequest{
+		TokenScope:     data.ScopeEmailChange,
+		TokenPlaintext: req.TokenPlaintext,
+	})
+	if err != nil {
+		switch {
+		case isInvalidTokenError(err):
+			v.AddError("token", "invalid or expired email change token")
+			return nil, status.Errorf(codes.InvalidArgument, "error %s", v.Errors)
+		default:
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	change, err := app.models.EmailChanges.GetForUser(authRes.UserId)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired email change token")
+			return nil, status.Errorf(codes.InvalidArgument, "error %s", v.Errors)
+		default:
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	user, err := app.models.Users.GetByUserIdContext(ctx, change.UserID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired email change token")
+			return nil, status.Errorf(codes.InvalidArgument, "error %s", v.Errors)
+		default:
+			return nil, queryError(err)
+		}
+	}
+
+	user.Email = change.NewEmail
+
+	err = app.models.Users.UpdateContext(ctx, user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateEmail):
+			// someone registered or switched to the address after the change was requested
+			if err := app.clearEmailChange(ctx, user.ID); err != nil {
+				app.logger.PrintError(err, nil)
+			}
+			v.AddError("email", "a user with this email address already exists")
+			return nil, status.Errorf(codes.InvalidArgument, "error %s", v.Errors)
+		case errors.Is(err, data.ErrEditConflict):
+			return nil, status.Error(codes.Aborted, "unable to update the record due to an edit conflict, please try again")
+		default:
+			return nil, queryError(err)
+		}
+	}
+
+	err = app.clearEmailChange(ctx, user.ID)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &users.UserDetailsResponse{
+		Id:        user.ID,
+		Email:     user.Email,
+		Name:      user.Name,
+		CreatedAt: user.CreatedAt.UnixMilli(),
+		Activated: user.Activated,
+		Version:   int32(user.Version),
+	}, nil
+}
+
+func (app *application) CancelEmailChange(ctx context.Context, req *users.CancelEmailChangeRequest) (*users.CancelEmailChangeResponse, error) {
+	v := validator.New()
+
+	if data.ValidateTokenPlaintext(v, req.TokenPlaintext); !v.Valid() {
+		return nil, status.Errorf(codes.InvalidArgument, "error %s", v.Errors)
+	}
+
+	authRes, err := app.auth.Authenticate(ctx, &auth.AuthenticationRequest{
+		TokenScope:     data.ScopeEmailChangeCancel,
+		TokenPlaintext: req.TokenPlaintext,
+	})
+	if err != nil {
+		switch {
+		case isInvalidTokenError(err):
+			v.AddError("token", "invalid or expired email change token")
+			return nil, status.Errorf(codes.InvalidArgument, "error %s", v.Errors)
+		default:
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	err = app.clearEmailChange(ctx, authRes.UserId)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &users.CancelEmailChangeResponse{
+		Message: "the email change was cancelled",
+	}, nil
+}
+
+// clearEmailChange drops the pending change and every token that could act on it
+func (app *application) clearEmailChange(ctx context.Context, userId int64) error {
+	err := app.models.EmailChanges.DeleteForUser(userId)
+	if err != nil {
+		return err
+	}
+
+	return app.deleteEmailChangeTokens(ctx, userId)
+}
+
+func (app *application) deleteEmailChangeTokens(ctx context.Context, userId int64) error {
+	for _, scope := range []string{data.ScopeEmailChange, data.ScopeEmailChangeCancel} {
+		_, err := app.auth.DeleteAllTokensForUser(ctx, &auth.TokensDeletionRequest{
+			Scope:  scope,
+			UserId: userId,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
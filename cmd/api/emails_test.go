@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/saarwasserman/users/internal/data"
+	"github.com/saarwasserman/users/protogen/notifications"
+	"github.com/saarwasserman/users/protogen/users"
+)
+
+func TestEmailChange(t *testing.T) {
+	const newEmail = "alice@sloop.test"
+
+	// setup inserts a user and returns the context of a call made by them
+	setup := func(t *testing.T) (*application, *data.User, context.Context) {
+		t.Helper()
+
+		app, _ := newTestApplication(t)
+
+		user := &data.User{Name: "Alice", Email: "alice@dinghy.test", Activated: true}
+		err := app.models.Users.InsertContext(context.Background(), user)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return app, user, app.contextSetUserId(context.Background(), user.ID)
+	}
+
+	// request asks for the change and returns the tokens of the latest
+	// confirmation and notice emails
+	request := func(t *testing.T, app *application, ctx context.Context, user *data.User, email string) (string, string) {
+		t.Helper()
+
+		_, err := app.RequestEmailChange(ctx, &users.RequestEmailChangeRequest{NewEmail: email})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		messages, err := app.models.Outbox.GetAllForUser(user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var confirmation notifications.SendEmailChangeConfirmationEmailRequest
+		var notice notifications.SendEmailChangeNoticeEmailRequest
+
+		for _, message := range messages {
+			switch message.Kind {
+			case outboxEmailChangeConfirmationEmail:
+				openOutboxPayload(t, app, app.models.Outbox.(*fakeOutbox).Get(message.ID), &confirmation)
+			case outboxEmailChangeNoticeEmail:
+				openOutboxPayload(t, app, app.models.Outbox.(*fakeOutbox).Get(message.ID), &notice)
+			}
+		}
+
+		if confirmation.Recipient != email || notice.Recipient != user.Email || notice.NewEmail != email {
+			t.Fatalf("got confirmation to %q and notice to %q, want them sent to %q and %q", confirmation.Recipient, notice.Recipient, email, user.Email)
+		}
+
+		return confirmation.Token, notice.Token
+	}
+
+	t.Run("Confirm", func(t *testing.T) {
+		app, user, ctx := setup(t)
+
+		confirmToken, cancelToken := request(t, app, ctx, user, newEmail)
+
+		res, err := app.ConfirmEmailChange(context.Background(), &users.ConfirmEmailChangeRequest{TokenPlaintext: confirmToken})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if res.Email != newEmail {
+			t.Fatalf("got email %q, want %q", res.Email, newEmail)
+		}
+
+		_, err = app.models.EmailChanges.GetForUser(user.ID)
+		if !errors.Is(err, data.ErrRecordNotFound) {
+			t.Fatalf("got %v, want the change cleared", err)
+		}
+
+		_, err = app.CancelEmailChange(context.Background(), &users.CancelEmailChangeRequest{TokenPlaintext: cancelToken})
+		if status.Code(err) != codes.InvalidArgument {
+			t.Fatalf("got %v, want the cancel token revoked", err)
+		}
+	})
+
+	t.Run("Cancel", func(t *testing.T) {
+		app, user, ctx := setup(t)
+
+		confirmToken, cancelToken := request(t, app, ctx, user, newEmail)
+
+		_, err := app.CancelEmailChange(context.Background(), &users.CancelEmailChangeRequest{TokenPlaintext: cancelToken})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = app.ConfirmEmailChange(context.Background(), &users.ConfirmEmailChangeRequest{TokenPlaintext: confirmToken})
+		if status.Code(err) != codes.InvalidArgument {
+			t.Fatalf("got %v, want the cancelled change not confirmed", err)
+		}
+
+		stored, err := app.models.Users.GetByUserIdContext(context.Background(), user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if stored.Email != user.Email {
+			t.Fatalf("got email %q, want it unchanged", stored.Email)
+		}
+	})
+
+	t.Run("Replaced", func(t *testing.T) {
+		app, user, ctx := setup(t)
+
+		firstToken, _ := request(t, app, ctx, user, "alice@ketch.test")
+		confirmToken, _ := request(t, app, ctx, user, newEmail)
+
+		_, err := app.ConfirmEmailChange(context.Background(), &users.ConfirmEmailChangeRequest{TokenPlaintext: firstToken})
+		if status.Code(err) != codes.InvalidArgument {
+			t.Fatalf("got %v, want the earlier request's token rejected", err)
+		}
+
+		res, err := app.ConfirmEmailChange(context.Background(), &users.ConfirmEmailChangeRequest{TokenPlaintext: confirmToken})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if res.Email != newEmail {
+			t.Fatalf("got email %q, want %q", res.Email, newEmail)
+		}
+	})
+
+	t.Run("SameEmail", func(t *testing.T) {
+		app, _, ctx := setup(t)
+
+		_, err := app.RequestEmailChange(ctx, &users.RequestEmailChangeRequest{NewEmail: "Alice@Dinghy.test"})
+		if status.Code(err) != codes.InvalidArgument {
+			t.Fatalf("got %v, want InvalidArgument", err)
+		}
+	})
+
+	t.Run("Taken", func(t *testing.T) {
+		app, _, ctx := setup(t)
+
+		err := app.models.Users.InsertContext(context.Background(), &data.User{Name: "Bob", Email: newEmail})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = app.RequestEmailChange(ctx, &users.RequestEmailChangeRequest{NewEmail: newEmail})
+		if status.Code(err) != codes.InvalidArgument {
+			t.Fatalf("got %v, want InvalidArgument", err)
+		}
+	})
+
+	t.Run("TakenBeforeConfirmation", func(t *testing.T) {
+		app, user, ctx := setup(t)
+
+		confirmToken, _ := request(t, app, ctx, user, newEmail)
+
+		err := app.models.Users.InsertContext(context.Background(), &data.User{Name: "Bob", Email: newEmail})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = app.ConfirmEmailChange(context.Background(), &users.ConfirmEmailChangeRequest{TokenPlaintext: confirmToken})
+		if status.Code(err) != codes.InvalidArgument {
+			t.Fatalf("got %v, want InvalidArgument", err)
+		}
+
+		_, err = app.models.EmailChanges.GetForUser(user.ID)
+		if !errors.Is(err, data.ErrRecordNotFound) {
+			t.Fatalf("got %v, want the change cleared", err)
+		}
+	})
+}
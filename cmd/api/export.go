@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/saarwasserman/users/internal/data"
+	"github.com/saarwasserman/users/internal/validator"
+	"github.com/saarwasserman/users/protogen/users"
+)
+
+// keeps every message well below the default 4MB gRPC limit
+const exportChunkSize = 64 * 1024
+
+func (app *application) ExportMyData(req *users.ExportMyDataRequest, stream users.Users_ExportMyDataServer) error {
+	userId := app.contextGetUserId(stream.Context())
+
+	return app.streamUserExport(stream.Context(), userId, stream)
+}
+
+func (app *application) ExportUserData(req *users.ExportUserDataRequest, stream users.Users_ExportUserDataServer) error {
+	v := validator.New()
+
+	if v.Check(req.UserId > 0, "user_id", "must be provided"); !v.Valid() {
+		return status.Errorf(codes.InvalidArgument, "error %s", v.Errors)
+	}
+
+	app.logger.PrintInfo("user data exported by admin", map[string]string{
+		"admin_id": strconv.FormatInt(app.contextGetUserId(stream.Context()), 10),
+		"user_id":  strconv.FormatInt(req.UserId, 10),
+	})
+
+	return app.streamUserExport(stream.Context(), req.UserId, stream)
+}
+
+type exportChunkSender interface {
+	Send(*users.ExportDataChunk) error
+}
+
+func (app *application) streamUserExport(ctx context.Context, userId int64, stream exportChunkSender) error {
+	export, err := app.models.ExportUser(ctx, userId)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return status.Error(codes.NotFound, "user not found")
+		default:
+			return queryError(err)
+		}
+	}
+
+	js, err := json.MarshalIndent(export, "", "\t")
+	if err != nil {
+		return queryError(err)
+	}
+
+	for start := 0; start < len(js); start += exportChunkSize {
+		end := min(start+exportChunkSize, len(js))
+
+		err = stream.Send(&users.ExportDataChunk{Data: js[start:end]})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/saarwasserman/users/internal/data"
+	"github.com/saarwasserman/users/protogen/notifications"
+	"github.com/saarwasserman/users/protogen/users"
+)
+
+// exportTestStream collects the chunks of an export
+type exportTestStream struct {
+	grpc.ServerStream
+	ctx    context.Context
+	chunks [][]byte
+}
+
+func (s *exportTestStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *exportTestStream) Send(chunk *users.ExportDataChunk) error {
+	s.chunks = append(s.chunks, chunk.Data)
+	return nil
+}
+
+// decode joins the chunks and decodes the export they make up
+func (s *exportTestStream) decode(t *testing.T) *data.UserExport {
+	t.Helper()
+
+	var export data.UserExport
+
+	err := json.Unmarshal(bytes.Join(s.chunks, nil), &export)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &export
+}
+
+func TestExportMyData(t *testing.T) {
+	t.Run("Export", func(t *testing.T) {
+		app, fake := newTestApplication(t)
+
+		user, _ := insertTestUser(t, app, fake)
+		ctx, _ := startTestSession(t, app, user.ID)
+
+		secret, recoveryCodes := enrollTOTP(t, app, ctx)
+
+		app.recordLoginFailure(user.Email, user, "198.51.100.1")
+
+		err := app.enqueueEmail(outboxPasswordChangedEmail, user.ID, &notifications.SendPasswordChangedEmailRequest{Recipient: user.Email})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		stream := &exportTestStream{ctx: ctx}
+
+		err = app.ExportMyData(&users.ExportMyDataRequest{}, stream)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		export := stream.decode(t)
+
+		if export.FormatVersion != data.ExportFormatVersion || export.User.ID != user.ID || export.User.Email != user.Email {
+			t.Fatalf("got version %d of user %d <%s>, want version %d of user %d <%s>", export.FormatVersion, export.User.ID, export.User.Email, data.ExportFormatVersion, user.ID, user.Email)
+		}
+
+		if len(export.Sessions) != 1 {
+			t.Errorf("got %d sessions, want 1", len(export.Sessions))
+		}
+
+		if export.TOTP == nil {
+			t.Error("got no two-factor credential")
+		}
+
+		if len(export.RecoveryCodes) != len(recoveryCodes) {
+			t.Errorf("got %d recovery codes, want %d", len(export.RecoveryCodes), len(recoveryCodes))
+		}
+
+		if export.LoginThrottle == nil || export.LoginThrottle.Failures != 1 {
+			t.Errorf("got login throttle %+v, want 1 failure", export.LoginThrottle)
+		}
+
+		found := false
+		for _, message := range export.OutboxMessages {
+			found = found || message.Kind == outboxPasswordChangedEmail
+		}
+
+		if !found {
+			t.Errorf("got %d outbox messages, want the password changed email among them", len(export.OutboxMessages))
+		}
+
+		// what the export describes, not the secrets themselves
+		js := bytes.Join(stream.chunks, nil)
+		for _, s := range append(recoveryCodes, base64.StdEncoding.EncodeToString(secret)) {
+			if bytes.Contains(js, []byte(s)) {
+				t.Errorf("got secret %q in the export", s)
+			}
+		}
+	})
+
+	t.Run("Chunked", func(t *testing.T) {
+		app, fake := newTestApplication(t)
+
+		user, _ := insertTestUser(t, app, fake)
+
+		ctx, _ := startTestSession(t, app, user.ID)
+
+		for i := range 500 {
+			err := app.models.Sessions.Insert(&data.Session{UserID: user.ID, Expiry: time.Now().Add(time.Hour)}, fmt.Sprintf("chunked-%d", i))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		stream := &exportTestStream{ctx: ctx}
+
+		err := app.ExportMyData(&users.ExportMyDataRequest{}, stream)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(stream.chunks) < 2 {
+			t.Fatalf("got %d chunks, want the export split", len(stream.chunks))
+		}
+
+		for _, chunk := range stream.chunks {
+			if len(chunk) > exportChunkSize {
+				t.Errorf("got a chunk of %d bytes, want at most %d", len(chunk), exportChunkSize)
+			}
+		}
+
+		stream.decode(t)
+	})
+}
+
+func TestExportUserData(t *testing.T) {
+	t.Run("PendingDeletion", func(t *testing.T) {
+		app, fake := newTestApplication(t)
+
+		user, _ := insertTestUser(t, app, fake)
+		deleteTestUser(t, app, user)
+
+		// data is kept until the purge, so it is exported until then
+		stream := &exportTestStream{ctx: adminContext(app)}
+
+		err := app.ExportUserData(&users.ExportUserDataRequest{UserId: user.ID}, stream)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		export := stream.decode(t)
+
+		if export.User.ID != user.ID || export.User.DeletedAt == nil {
+			t.Errorf("got user %d deleted at %v, want user %d pending deletion", export.User.ID, export.User.DeletedAt, user.ID)
+		}
+	})
+
+	t.Run("NotFound", func(t *testing.T) {
+		app, _ := newTestApplication(t)
+
+		err := app.ExportUserData(&users.ExportUserDataRequest{UserId: 999}, &exportTestStream{ctx: adminContext(app)})
+		if status.Code(err) != codes.NotFound {
+			t.Errorf("got %v, want %v", err, codes.NotFound)
+		}
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		app, _ := newTestApplication(t)
+
+		err := app.ExportUserData(&users.ExportUserDataRequest{}, &exportTestStream{ctx: adminContext(app)})
+		if status.Code(err) != codes.InvalidArgument {
+			t.Errorf("got %v, want %v", err, codes.InvalidArgument)
+		}
+	})
+}
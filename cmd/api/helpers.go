@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"github.com/saarwasserman/users/internal/data"
+	"github.com/saarwasserman/users/protogen/auth"
+)
+
+// background runs fn in its own goroutine, recovering and logging any panic
+// so a failing side task cannot take the server down
+func (app *application) background(fn func()) {
+	go func() {
+		defer func() {
+			if err := recover(); err != nil {
+				app.logger.PrintError(fmt.Errorf("%s", err), nil)
+			}
+		}()
+
+		fn()
+	}()
+}
+
+// isInvalidTokenError reports whether an error returned by the auth service
+// Authenticate call means the token is unknown, expired or of another scope,
+// as opposed to the auth service itself failing
+func isInvalidTokenError(err error) bool {
+	switch status.Code(err) {
+	case codes.Unauthenticated, codes.NotFound, codes.InvalidArgument:
+		return true
+	default:
+		return false
+	}
+}
+
+// queryError returns the status of a failed query. one cut short because the
+// caller went away or ran out of time is reported as such, not as a failure
+func queryError(err error) error {
+	switch {
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, "request was canceled")
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, "request deadline exceeded")
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
+
+// revokeAllTokens drops every token of the user, whatever its scope, and ends all its sessions
+func (app *application) revokeAllTokens(ctx context.Context, userId int64) error {
+	for _, scope := range data.Scopes {
+		_, err := app.auth.DeleteAllTokensForUser(ctx, &auth.TokensDeletionRequest{
+			Scope:  scope,
+			UserId: userId,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return app.models.Sessions.DeleteAllForUser(userId, 0)
+}
+
+// clientIP returns the address of the caller, or an empty string if unknown
+func clientIP(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+
+	ip, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+
+	return ip
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+
+	"github.com/saarwasserman/users/internal/data"
+	"github.com/saarwasserman/users/internal/validator"
+)
+
+// methods that change state and can be retried safely with an idempotency
+// key. responses are stored as they are, so methods returning tokens or
+// secrets are left out
+var idempotentMethods = []string{
+	"RegisterUser",
+	"ActivateUser",
+	"ResendActivationEmail",
+	"RequestPasswordReset",
+	"ResetPassword",
+	"ConfirmEmailChange",
+	"CancelEmailChange",
+	"RequestMagicLink",
+	"UpdateUser",
+	"RequestEmailChange",
+	"DeleteAccount",
+	"RevokeSession",
+	"RevokeOtherSessions",
+	"FinishPasskeyRegistration",
+	"CompleteIdentityLink",
+	"UnlinkIdentity",
+	"UnlockUser",
+}
+
+// a key whose call hasn't completed for this long belongs to a call that
+// died, and is free to be used again
+const idempotencyKeyStaleAfter = time.Minute
+
+// UnaryIdempotency replays the stored response of a call to a state changing
+// method when it is retried with the same idempotency-key metadata. it runs
+// after authorization so rejected calls never take a key
+func (app *application) UnaryIdempotency(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	method := path.Base(info.FullMethod)
+	if !slices.Contains(idempotentMethods, method) {
+		return handler(ctx, req)
+	}
+
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return handler(ctx, req)
+	}
+
+	values := md.Get("idempotency-key")
+	if len(values) == 0 {
+		return handler(ctx, req)
+	}
+
+	v := validator.New()
+
+	if data.ValidateIdempotencyKey(v, values[0]); !v.Valid() {
+		return nil, status.Errorf(codes.InvalidArgument, "error %s", v.Errors)
+	}
+
+	requestHash, err := app.idempotencyRequestHash(method, req)
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return nil, status.Error(codes.Internal, "failed to process idempotency key")
+	}
+
+	// zero for unauthenticated calls
+	userId, _ := app.contextLookupUserId(ctx)
+
+	keyName := values[0]
+	if userId == 0 {
+		keyName = app.anonymousIdempotencyKey(keyName, requestHash)
+	}
+
+	key := &data.IdempotencyKey{
+		UserID:      userId,
+		Key:         keyName,
+		Method:      method,
+		RequestHash: requestHash,
+		Expiry:      time.Now().Add(app.config.idempotency.keyTTL),
+	}
+
+	err = app.models.IdempotencyKeys.Reserve(key, idempotencyKeyStaleAfter)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateIdempotencyKey):
+			return app.replayResponse(key)
+		default:
+			app.logger.PrintError(err, nil)
+			return nil, status.Error(codes.Internal, "failed to process idempotency key")
+		}
+	}
+
+	res, err := handler(ctx, req)
+	if err != nil {
+		// failed calls may be retried with the same key
+		releaseErr := app.models.IdempotencyKeys.Release(key.UserID, key.Key)
+		if releaseErr != nil {
+			app.logger.PrintError(releaseErr, nil)
+		}
+
+		return nil, err
+	}
+
+	response, err := marshalResponse(res)
+	if err == nil {
+		err = app.models.IdempotencyKeys.Complete(key.UserID, key.Key, response)
+	}
+
+	// the call itself succeeded, so it is not failed over the key. a retry
+	// runs it again once the key is stale
+	if err != nil {
+		app.logger.PrintError(err, map[string]string{"method": method})
+	}
+
+	return res, nil
+}
+
+// replayResponse returns the stored response of the earlier call with the
+// key, as long as it was a call of the same method with the same request
+func (app *application) replayResponse(key *data.IdempotencyKey) (any, error) {
+	stored, err := app.models.IdempotencyKeys.Get(key.UserID, key.Key)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			// released or expired in the meantime
+			return nil, status.Error(codes.Aborted, "a request with this idempotency key just finished, try again")
+		default:
+			app.logger.PrintError(err, nil)
+			return nil, status.Error(codes.Internal, "failed to process idempotency key")
+		}
+	}
+
+	if stored.Method != key.Method || !bytes.Equal(stored.RequestHash, key.RequestHash) {
+		return nil, status.Error(codes.FailedPrecondition, "idempotency key was already used with a different request")
+	}
+
+	if stored.Response == nil {
+		return nil, status.Error(codes.Aborted, "a request with this idempotency key is still in progress")
+	}
+
+	var response anypb.Any
+
+	err = proto.Unmarshal(stored.Response, &response)
+	if err == nil {
+		var res proto.Message
+
+		res, err = response.UnmarshalNew()
+		if err == nil {
+			return res, nil
+		}
+	}
+
+	app.logger.PrintError(err, nil)
+	return nil, status.Error(codes.Internal, "failed to replay response")
+}
+
+// idempotencyRequestHash identifies a call by its method and its request. it
+// is keyed with a server secret, requests carry passwords and a plain hash of
+// one could be brute forced from a leaked table
+func (app *application) idempotencyRequestHash(method string, req any) ([]byte, error) {
+	message, ok := req.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("request of %s is not a protobuf message", method)
+	}
+
+	encoded, err := proto.MarshalOptions{Deterministic: true}.Marshal(message)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := hmac.New(sha256.New, app.idempotencyHashKey)
+	hash.Write([]byte(method))
+	hash.Write([]byte{0})
+	hash.Write(encoded)
+
+	return hash.Sum(nil), nil
+}
+
+// anonymousIdempotencyKey scopes a key of an unauthenticated call to the
+// request it was sent with. anonymous callers all share user 0, so a bare key
+// would let one client replay or block the calls of another that picked the
+// same key. the request carries what only the caller knows, its password,
+// email or token, so a retry still finds the key and nobody else does. the
+// flip side is that reusing a key with a different request isn't detected,
+// it is just another call
+func (app *application) anonymousIdempotencyKey(key string, requestHash []byte) string {
+	hash := hmac.New(sha256.New, app.idempotencyHashKey)
+	hash.Write([]byte(key))
+	hash.Write([]byte{0})
+	hash.Write(requestHash)
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// marshalResponse encodes a response along with its type, so it can be
+// decoded without knowing what method it came from
+func marshalResponse(res any) ([]byte, error) {
+	message, ok := res.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("response of type %T is not a protobuf message", res)
+	}
+
+	response, err := anypb.New(message)
+	if err != nil {
+		return nil, err
+	}
+
+	return proto.Marshal(response)
+}
+
+func (app *application) deleteExpiredIdempotencyKeys() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		err := app.models.IdempotencyKeys.DeleteExpired()
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+	}
+}
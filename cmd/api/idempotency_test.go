@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestUnaryIdempotency(t *testing.T) {
+	info := &grpc.UnaryServerInfo{FullMethod: "/users.Users/UpdateUser"}
+
+	// call makes a call with the idempotency key as the user, counting the
+	// calls that reached the handler. the handler fails with failure if set
+	call := func(app *application, userId int64, key string, req proto.Message, calls *int, failure error) (any, error) {
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("idempotency-key", key))
+		ctx = app.contextSetUserId(ctx, userId)
+
+		return app.UnaryIdempotency(ctx, req, info, func(ctx context.Context, req any) (any, error) {
+			*calls++
+
+			if failure != nil {
+				return nil, failure
+			}
+
+			return wrapperspb.String("call " + strconv.Itoa(*calls)), nil
+		})
+	}
+
+	newApp := func(t *testing.T) *application {
+		app, _ := newTestApplication(t)
+		app.config.idempotency.keyTTL = time.Hour
+		return app
+	}
+
+	t.Run("Replays", func(t *testing.T) {
+		app := newApp(t)
+
+		var calls int
+
+		first, err := call(app, 1, "key", wrapperspb.String("Alice"), &calls, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		second, err := call(app, 1, "key", wrapperspb.String("Alice"), &calls, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if calls != 1 {
+			t.Fatalf("handler ran %d times, want once", calls)
+		}
+
+		if !proto.Equal(first.(proto.Message), second.(proto.Message)) {
+			t.Fatalf("got %v, want the first response %v", second, first)
+		}
+	})
+
+	t.Run("DifferentRequest", func(t *testing.T) {
+		app := newApp(t)
+
+		var calls int
+
+		_, err := call(app, 1, "key", wrapperspb.String("Alice"), &calls, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = call(app, 1, "key", wrapperspb.String("Bob"), &calls, nil)
+		if status.Code(err) != codes.FailedPrecondition {
+			t.Fatalf("got %v, want FailedPrecondition", err)
+		}
+
+		if calls != 1 {
+			t.Fatalf("handler ran %d times, want once", calls)
+		}
+	})
+
+	t.Run("ScopedToUser", func(t *testing.T) {
+		app := newApp(t)
+
+		var calls int
+
+		_, err := call(app, 1, "key", wrapperspb.String("Alice"), &calls, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the same key chosen by another user is theirs
+		_, err = call(app, 2, "key", wrapperspb.String("Alice"), &calls, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if calls != 2 {
+			t.Fatalf("handler ran %d times, want twice", calls)
+		}
+	})
+
+	t.Run("AnonymousScopedToRequest", func(t *testing.T) {
+		app := newApp(t)
+
+		var calls int
+
+		_, err := call(app, 0, "key", wrapperspb.String("alice@dinghy.test"), &calls, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// another client that picked the same key makes its own call
+		_, err = call(app, 0, "key", wrapperspb.String("bob@dinghy.test"), &calls, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// while a retry of the first one is replayed
+		_, err = call(app, 0, "key", wrapperspb.String("alice@dinghy.test"), &calls, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if calls != 2 {
+			t.Fatalf("handler ran %d times, want twice", calls)
+		}
+	})
+
+	t.Run("ReleasesFailedCall", func(t *testing.T) {
+		app := newApp(t)
+
+		var calls int
+
+		_, err := call(app, 1, "key", wrapperspb.String("Alice"), &calls, errors.New("database is down"))
+		if err == nil {
+			t.Fatal("failed call succeeded")
+		}
+
+		_, err = call(app, 1, "key", wrapperspb.String("Alice"), &calls, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if calls != 2 {
+			t.Fatalf("handler ran %d times, want twice", calls)
+		}
+	})
+}
+
+func TestIdempotencyRequestHash(t *testing.T) {
+	first, _ := newTestApplication(t)
+	second, _ := newTestApplication(t)
+
+	req := wrapperspb.String("pa55word1234")
+
+	a, err := first.idempotencyRequestHash("ResetPassword", req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := second.idempotencyRequestHash("ResetPassword", req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// without the server's key the hash of a request can't be recomputed
+	if bytes.Equal(a, b) {
+		t.Fatal("hashes under different keys are equal")
+	}
+}
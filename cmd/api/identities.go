@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/saarwasserman/users/internal/data"
+	"github.com/saarwasserman/users/internal/idp"
+	"github.com/saarwasserman/users/internal/validator"
+	"github.com/saarwasserman/users/protogen/users"
+)
+
+// time the user has to sign in at the provider and come back
+const oidcStateTTL = 10 * time.Minute
+
+func randomURLString() (string, error) {
+	randomBytes := make([]byte, 32)
+
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(randomBytes), nil
+}
+
+// deleteExpiredOIDCStates periodically drops the states of sign-ins that
+// were never completed
+func (app *application) deleteExpiredOIDCStates() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		err := app.models.Identities.DeleteExpiredStates()
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+	}
+}
+
+// beginOIDC stores a new sign-in with the provider and returns the URL to
+// send the user to. userId is set when linking the provider to an account
+func (app *application) beginOIDC(ctx context.Context, providerName string, userId int64) (string, error) {
+	provider, ok := app.providers[providerName]
+	if !ok {
+		return "", status.Error(codes.InvalidArgument, "unknown identity provider")
+	}
+
+	statePlaintext, err := randomURLString()
+	if err != nil {
+		return "", status.Error(codes.Internal, err.Error())
+	}
+
+	nonce, err := randomURLString()
+	if err != nil {
+		return "", status.Error(codes.Internal, err.Error())
+	}
+
+	state := &data.OIDCState{
+		Provider:     providerName,
+		Nonce:        nonce,
+		CodeVerifier: oauth2.GenerateVerifier(),
+		UserID:       userId,
+	}
+
+	authURL, err := provider.AuthCodeURL(ctx, statePlaintext, state.Nonce, state.CodeVerifier)
+	if err != nil {
+		app.logger.PrintError(err, map[string]string{"provider": providerName})
+		return "", status.Error(codes.Unavailable, "identity provider is unavailable")
+	}
+
+	err = app.models.Identities.InsertState(statePlaintext, state, oidcStateTTL)
+	if err != nil {
+		return "", status.Error(codes.Internal, err.Error())
+	}
+
+	return authURL, nil
+}
+
+// completeOIDC redeems the code the provider redirected the user back with,
+// and returns the stored sign-in and the identity the provider asserts
+func (app *application) completeOIDC(ctx context.Context, statePlaintext, code string) (*data.OIDCState, *idp.Identity, error) {
+	v := validator.New()
+
+	v.Check(statePlaintext != "", "state", "must be provided")
+	v.Check(code != "", "code", "must be provided")
+
+	if !v.Valid() {
+		return nil, nil, status.Errorf(codes.InvalidArgument, "error %s", v.Errors)
+	}
+
+	state, err := app.models.Identities.ConsumeState(statePlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return nil, nil, status.Error(codes.Unauthenticated, "invalid or expired state")
+		default:
+			return nil, nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	provider, ok := app.providers[state.Provider]
+	if !ok {
+		return nil, nil, status.Error(codes.FailedPrecondition, "identity provider is no longer configured")
+	}
+
+	identity, err := provider.Exchange(ctx, code, state.CodeVerifier, state.Nonce)
+	if err != nil {
+		switch {
+		case errors.Is(err, idp.ErrInvalidResponse):
+			app.logger.PrintInfo("identity provider sign-in rejected", map[string]string{
+				"provider": state.Provider,
+				"reason":   err.Error(),
+			})
+			return nil, nil, status.Error(codes.Unauthenticated, "identity provider sign-in failed")
+		default:
+			app.logger.PrintError(err, map[string]string{"provider": state.Provider})
+			return nil, nil, status.Error(codes.Unavailable, "identity provider is unavailable")
+		}
+	}
+
+	if identity.Subject == "" {
+		return nil, nil, status.Error(codes.Unauthenticated, "identity provider sign-in failed")
+	}
+
+	return state, identity, nil
+}
+
+// registerFromIdentity creates an activated account for a provider account
+// seen for the first time, the provider vouching for the email address.
+// accounts already using that address are never linked implicitly, the
+// provider account could belong to someone else. it runs as a registration,
+// so a failed step doesn't leave a user without the identity behind
+func (app *application) registerFromIdentity(ctx context.Context, providerName string, identity *idp.Identity) (*data.User, error) {
+	if identity.Email == "" || !identity.EmailVerified {
+		return nil, status.Error(codes.FailedPrecondition, "the identity provider did not share a verified email address")
+	}
+
+	user := &data.User{
+		Name:      identity.Name,
+		Email:     identity.Email,
+		Activated: false,
+	}
+
+	if user.Name == "" {
+		user.Name, _, _ = strings.Cut(identity.Email, "@")
+	}
+
+	v := validator.New()
+
+	if data.ValidateUser(v, user); !v.Valid() {
+		return nil, status.Errorf(codes.InvalidArgument, "error %s", v.Errors)
+	}
+
+	registration, err := app.models.Registrations.Start(ctx, user, data.RegistrationKindIdentity, registrationStepUserCreated)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateEmail):
+			return nil, status.Error(codes.FailedPrecondition, "an account with this email address already exists, login to it and link the identity provider")
+		default:
+			return nil, queryError(err)
+		}
+	}
+
+	steps := app.identityRegistrationSteps(providerName, identity)
+
+	err = app.runRegistration(ctx, registration, steps)
+	if err != nil {
+		properties := map[string]string{
+			"registration_id": strconv.FormatInt(registration.ID, 10),
+			"user_id":         strconv.FormatInt(user.ID, 10),
+			"provider":        providerName,
+		}
+
+		app.logger.PrintError(err, properties)
+
+		compensationCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+
+		registration.Error = err.Error()
+
+		compensationErr := app.compensateRegistration(compensationCtx, registration, steps)
+		if compensationErr != nil {
+			app.logger.PrintError(compensationErr, properties)
+		}
+
+		if errors.Is(err, data.ErrDuplicateIdentity) {
+			return nil, status.Error(codes.AlreadyExists, "the identity provider account is linked already")
+		}
+
+		return nil, registrationError(err)
+	}
+
+	return app.models.Users.GetByUserIdContext(ctx, user.ID)
+}
+
+func (app *application) BeginOIDCLogin(ctx context.Context, req *users.BeginOIDCLoginRequest) (*users.BeginOIDCLoginResponse, error) {
+	authURL, err := app.beginOIDC(ctx, req.Provider, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return &users.BeginOIDCLoginResponse{AuthorizationUrl: authURL}, nil
+}
+
+// CompleteOIDCLogin signs in with the provider account, registering a new
+// user when the account isn't linked to one yet
+func (app *application) CompleteOIDCLogin(ctx context.Context, req *users.CompleteOIDCLoginRequest) (*users.LoginResponse, error) {
+	state, identity, err := app.completeOIDC(ctx, req.State, req.Code)
+	if err != nil {
+		return nil, err
+	}
+
+	if state.UserID != 0 {
+		return nil, status.Error(codes.InvalidArgument, "state was issued for linking an account, complete it with CompleteIdentityLink")
+	}
+
+	var user *data.User
+
+	linked, err := app.models.Identities.Get(state.Provider, identity.Subject)
+	switch {
+	case errors.Is(err, data.ErrRecordNotFound):
+		user, err = app.registerFromIdentity(ctx, state.Provider, identity)
+		if err != nil {
+			return nil, err
+		}
+	case err != nil:
+		return nil, status.Error(codes.Internal, err.Error())
+	default:
+		user, err = app.models.Users.GetByUserIdContext(ctx, linked.UserID)
+		if errors.Is(err, data.ErrRecordNotFound) {
+			user, err = app.models.Users.GetPendingDeletionContext(ctx, linked.UserID, time.Now().Add(-app.config.deletion.gracePeriod))
+		}
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				return nil, status.Error(codes.Unauthenticated, "identity provider sign-in failed")
+			default:
+				return nil, queryError(err)
+			}
+		}
+	}
+
+	if !user.Activated {
+		return nil, status.Error(codes.PermissionDenied, "your user account must be activated to login")
+	}
+
+	// the provider stands in for the password only
+	return app.finishFirstFactor(ctx, user)
+}
+
+func (app *application) BeginIdentityLink(ctx context.Context, req *users.BeginIdentityLinkRequest) (*users.BeginIdentityLinkResponse, error) {
+	authURL, err := app.beginOIDC(ctx, req.Provider, app.contextGetUserId(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	return &users.BeginIdentityLinkResponse{AuthorizationUrl: authURL}, nil
+}
+
+func (app *application) CompleteIdentityLink(ctx context.Context, req *users.CompleteIdentityLinkRequest) (*users.CompleteIdentityLinkResponse, error) {
+	userId := app.contextGetUserId(ctx)
+
+	state, identity, err := app.completeOIDC(ctx, req.State, req.Code)
+	if err != nil {
+		return nil, err
+	}
+
+	if state.UserID != userId {
+		return nil, status.Error(codes.PermissionDenied, "state was not issued for linking this account")
+	}
+
+	err = app.models.Identities.Insert(&data.Identity{
+		Provider: state.Provider,
+		Subject:  identity.Subject,
+		UserID:   userId,
+		Email:    identity.Email,
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateIdentity):
+			return nil, status.Error(codes.AlreadyExists, "the identity provider account is linked already, or another account of this provider is linked to yours")
+		default:
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	return &users.CompleteIdentityLinkResponse{
+		Message: "the identity provider was linked to your account",
+	}, nil
+}
+
+func (app *application) ListIdentities(ctx context.Context, req *users.ListIdentitiesRequest) (*users.ListIdentitiesResponse, error) {
+	identities, err := app.models.Identities.GetAllForUser(app.contextGetUserId(ctx))
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	res := &users.ListIdentitiesResponse{
+		Identities: make([]*users.IdentityDetails, 0, len(identities)),
+	}
+
+	for _, identity := range identities {
+		res.Identities = append(res.Identities, &users.IdentityDetails{
+			Provider:  identity.Provider,
+			Email:     identity.Email,
+			CreatedAt: identity.CreatedAt.UnixMilli(),
+		})
+	}
+
+	return res, nil
+}
+
+// UnlinkIdentity removes a provider from the account. users registered
+// through a provider have no password, but can still login with a magic link
+// or set a password through a reset
+func (app *application) UnlinkIdentity(ctx context.Context, req *users.UnlinkIdentityRequest) (*users.UnlinkIdentityResponse, error) {
+	v := validator.New()
+
+	if v.Check(req.Provider != "", "provider", "must be provided"); !v.Valid() {
+		return nil, status.Errorf(codes.InvalidArgument, "error %s", v.Errors)
+	}
+
+	err := app.models.Identities.Delete(app.contextGetUserId(ctx), req.Provider)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return nil, status.Error(codes.NotFound, "identity provider is not linked")
+		default:
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	return &users.UnlinkIdentityResponse{
+		Message: "the identity provider was unlinked from your account",
+	}, nil
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/saarwasserman/users/internal/data"
+	"github.com/saarwasserman/users/internal/idp"
+	"github.com/saarwasserman/users/protogen/users"
+)
+
+func TestRegisterFromIdentity(t *testing.T) {
+	ctx := context.Background()
+
+	identity := &idp.Identity{
+		Subject:       "1234",
+		Email:         "alice@dinghy.test",
+		EmailVerified: true,
+	}
+
+	t.Run("Completes", func(t *testing.T) {
+		app, _ := newTestApplication(t)
+
+		user, err := app.registerFromIdentity(ctx, "google", identity)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !user.Activated || user.Name != "alice" {
+			t.Fatalf("got user %+v, want an activated user named after the email", user)
+		}
+
+		linked, err := app.models.Identities.Get("google", identity.Subject)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if linked.UserID != user.ID {
+			t.Fatalf("identity is linked to user %d, want %d", linked.UserID, user.ID)
+		}
+	})
+
+	t.Run("UnverifiedEmail", func(t *testing.T) {
+		app, _ := newTestApplication(t)
+
+		_, err := app.registerFromIdentity(ctx, "google", &idp.Identity{Subject: "1234", Email: identity.Email})
+		if status.Code(err) != codes.FailedPrecondition {
+			t.Fatalf("got %v, want FailedPrecondition", err)
+		}
+	})
+
+	t.Run("LinkedSubject", func(t *testing.T) {
+		app, _ := newTestApplication(t)
+
+		err := app.models.Identities.Insert(&data.Identity{Provider: "google", Subject: identity.Subject, UserID: 100})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = app.registerFromIdentity(ctx, "google", identity)
+		if status.Code(err) != codes.AlreadyExists {
+			t.Fatalf("got %v, want AlreadyExists", err)
+		}
+
+		_, err = app.models.Users.GetByEmailContext(ctx, identity.Email)
+		if !errors.Is(err, data.ErrRecordNotFound) {
+			t.Fatalf("got %v, want the user deleted", err)
+		}
+	})
+
+	t.Run("RollsBack", func(t *testing.T) {
+		app, fake := newTestApplication(t)
+		registrations := app.models.Registrations.(*data.MemoryRegistrationRepository)
+
+		fake.failures["AddPermissionForUser"] = status.Error(codes.Unavailable, "auth is down")
+
+		_, err := app.registerFromIdentity(ctx, "google", identity)
+		if status.Code(err) != codes.Unavailable {
+			t.Fatalf("got %v, want the status of the failed step", err)
+		}
+
+		_, err = app.models.Users.GetByEmailContext(ctx, identity.Email)
+		if !errors.Is(err, data.ErrRecordNotFound) {
+			t.Fatalf("got %v, want the user deleted", err)
+		}
+
+		registration, err := registrations.Get(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if registration.Kind != data.RegistrationKindIdentity || registration.Status != data.RegistrationRolledBack {
+			t.Fatalf("got %s registration %s, want an identity registration rolled back", registration.Kind, registration.Status)
+		}
+	})
+
+	t.Run("ExistingEmail", func(t *testing.T) {
+		app, _ := newTestApplication(t)
+
+		err := app.models.Users.InsertContext(ctx, &data.User{Name: "Alice", Email: identity.Email})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = app.registerFromIdentity(ctx, "google", identity)
+		if status.Code(err) != codes.FailedPrecondition {
+			t.Fatalf("got %v, want FailedPrecondition", err)
+		}
+	})
+}
+
+func TestCompleteOIDC(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("UnknownState", func(t *testing.T) {
+		app, _ := newTestApplication(t)
+
+		_, _, err := app.completeOIDC(ctx, "state", "code")
+		if status.Code(err) != codes.Unauthenticated {
+			t.Fatalf("got %v, want Unauthenticated", err)
+		}
+	})
+
+	t.Run("StateUsedOnce", func(t *testing.T) {
+		app, _ := newTestApplication(t)
+
+		err := app.models.Identities.InsertState("state", &data.OIDCState{Provider: "google"}, oidcStateTTL)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the provider was removed from the configuration meanwhile
+		_, _, err = app.completeOIDC(ctx, "state", "code")
+		if status.Code(err) != codes.FailedPrecondition {
+			t.Fatalf("got %v, want FailedPrecondition", err)
+		}
+
+		_, _, err = app.completeOIDC(ctx, "state", "code")
+		if status.Code(err) != codes.Unauthenticated {
+			t.Fatalf("got %v, want the state consumed", err)
+		}
+	})
+
+	t.Run("UnknownProvider", func(t *testing.T) {
+		app, _ := newTestApplication(t)
+
+		_, err := app.BeginOIDCLogin(ctx, &users.BeginOIDCLoginRequest{Provider: "google"})
+		if status.Code(err) != codes.InvalidArgument {
+			t.Fatalf("got %v, want InvalidArgument", err)
+		}
+	})
+}
+
+func TestLinkedIdentities(t *testing.T) {
+	// setup links a google account to a user and returns the context of a
+	// call made by them
+	setup := func(t *testing.T) (*application, context.Context) {
+		t.Helper()
+
+		app, _ := newTestApplication(t)
+
+		err := app.models.Identities.Insert(&data.Identity{Provider: "google", Subject: "1234", UserID: 1, Email: "alice@dinghy.test"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = app.models.Identities.Insert(&data.Identity{Provider: "google", Subject: "5678", UserID: 2, Email: "bob@dinghy.test"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return app, app.contextSetUserId(context.Background(), 1)
+	}
+
+	t.Run("List", func(t *testing.T) {
+		app, ctx := setup(t)
+
+		res, err := app.ListIdentities(ctx, &users.ListIdentitiesRequest{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(res.Identities) != 1 || res.Identities[0].Email != "alice@dinghy.test" {
+			t.Fatalf("got %d identities, want only the user's own", len(res.Identities))
+		}
+	})
+
+	t.Run("Unlink", func(t *testing.T) {
+		app, ctx := setup(t)
+
+		_, err := app.UnlinkIdentity(ctx, &users.UnlinkIdentityRequest{Provider: "google"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = app.models.Identities.Get("google", "1234")
+		if !errors.Is(err, data.ErrRecordNotFound) {
+			t.Fatalf("got %v, want the identity unlinked", err)
+		}
+
+		_, err = app.models.Identities.Get("google", "5678")
+		if err != nil {
+			t.Fatalf("another user's identity was unlinked: %v", err)
+		}
+
+		_, err = app.UnlinkIdentity(ctx, &users.UnlinkIdentityRequest{Provider: "google"})
+		if status.Code(err) != codes.NotFound {
+			t.Fatalf("got %v, want NotFound", err)
+		}
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		app, ctx := setup(t)
+
+		_, err := app.UnlinkIdentity(ctx, &users.UnlinkIdentityRequest{})
+		if status.Code(err) != codes.InvalidArgument {
+			t.Fatalf("got %v, want InvalidArgument", err)
+		}
+	})
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"math"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// methods that guess or spam credentials and emails get their own, stricter bucket
+var sensitiveMethods = []string{
+	"Login",
+	"RegisterUser",
+	"ResendActivationEmail",
+	"RequestPasswordReset",
+	"ResetPassword",
+	"VerifyMFA",
+	"DisableTOTP",
+	"FinishPasskeyLogin",
+	"RequestMagicLink",
+	"LoginWithMagicLink",
+	"CompleteOIDCLogin",
+}
+
+var rateLimitRejections = expvar.NewMap("rate_limit_rejections")
+
+type rateLimiter struct {
+	mu      sync.Mutex
+	clients map[string]*client
+
+	limit          rate.Limit
+	burst          int
+	sensitiveLimit rate.Limit
+	sensitiveBurst int
+}
+
+type client struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newRateLimiter(cfg config) *rateLimiter {
+	return &rateLimiter{
+		clients:        make(map[string]*client),
+		limit:          rate.Limit(cfg.limiter.rps),
+		burst:          cfg.limiter.burst,
+		sensitiveLimit: rate.Limit(cfg.limiter.sensitiveRps),
+		sensitiveBurst: cfg.limiter.sensitiveBurst,
+	}
+}
+
+// evictIdle drops the buckets of clients that weren't seen for a while
+func (l *rateLimiter) evictIdle() {
+	for {
+		time.Sleep(time.Minute)
+
+		l.mu.Lock()
+
+		for key, client := range l.clients {
+			if time.Since(client.lastSeen) > 3*time.Minute {
+				delete(l.clients, key)
+			}
+		}
+
+		l.mu.Unlock()
+	}
+}
+
+// reserve takes a token from the bucket of the key, and for sensitive methods
+// from the key's bucket for that method as well. it returns how long the
+// caller has to wait when a bucket is empty, in which case no token is taken
+// from either bucket
+func (l *rateLimiter) reserve(key, method string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+
+	reservation, delay := l.take(key, l.limit, l.burst, now)
+	if delay > 0 {
+		return delay
+	}
+
+	if slices.Contains(sensitiveMethods, method) {
+		_, delay = l.take(key+"|"+method, l.sensitiveLimit, l.sensitiveBurst, now)
+		if delay > 0 {
+			reservation.CancelAt(now)
+			return delay
+		}
+	}
+
+	return 0
+}
+
+// take reserves a token of the key's bucket. the reservation is cancelled
+// already when the caller has to wait
+func (l *rateLimiter) take(key string, limit rate.Limit, burst int, now time.Time) (*rate.Reservation, time.Duration) {
+	if _, found := l.clients[key]; !found {
+		l.clients[key] = &client{limiter: rate.NewLimiter(limit, burst)}
+	}
+
+	client := l.clients[key]
+	client.lastSeen = now
+
+	reservation := client.limiter.ReserveN(now, 1)
+	if !reservation.OK() {
+		// only happens with a zero burst, which never lets anything through
+		return reservation, time.Minute
+	}
+
+	delay := reservation.DelayFrom(now)
+	if delay > 0 {
+		reservation.CancelAt(now)
+	}
+
+	return reservation, delay
+}
+
+// RateLimitByIP limits all calls by the client address. it runs before
+// authentication so it also covers anonymous callers
+func (app *application) RateLimitByIP(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	if !app.config.limiter.enabled {
+		return handler(ctx, req)
+	}
+
+	ip := clientIP(ctx)
+	if ip == "" {
+		return handler(ctx, req)
+	}
+
+	err := app.rateLimit(ctx, "ip:"+ip, path.Base(info.FullMethod))
+	if err != nil {
+		return nil, err
+	}
+
+	return handler(ctx, req)
+}
+
+// StreamRateLimitByIP limits streaming calls by the client address, as
+// RateLimitByIP does unary ones
+func (app *application) StreamRateLimitByIP(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if !app.config.limiter.enabled {
+		return handler(srv, stream)
+	}
+
+	ip := clientIP(stream.Context())
+	if ip == "" {
+		return handler(srv, stream)
+	}
+
+	err := app.rateLimit(stream.Context(), "ip:"+ip, path.Base(info.FullMethod))
+	if err != nil {
+		return err
+	}
+
+	return handler(srv, stream)
+}
+
+// RateLimitByUser limits authenticated calls by user, so one account can't
+// spread its calls over many addresses
+func (app *application) RateLimitByUser(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	if !app.config.limiter.enabled {
+		return handler(ctx, req)
+	}
+
+	userId, ok := app.contextLookupUserId(ctx)
+	if !ok {
+		return handler(ctx, req)
+	}
+
+	err := app.rateLimit(ctx, "user:"+strconv.FormatInt(userId, 10), path.Base(info.FullMethod))
+	if err != nil {
+		return nil, err
+	}
+
+	return handler(ctx, req)
+}
+
+// StreamRateLimitByUser limits authenticated streaming calls by user, as
+// RateLimitByUser does unary ones
+func (app *application) StreamRateLimitByUser(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if !app.config.limiter.enabled {
+		return handler(srv, stream)
+	}
+
+	userId, ok := app.contextLookupUserId(stream.Context())
+	if !ok {
+		return handler(srv, stream)
+	}
+
+	err := app.rateLimit(stream.Context(), "user:"+strconv.FormatInt(userId, 10), path.Base(info.FullMethod))
+	if err != nil {
+		return err
+	}
+
+	return handler(srv, stream)
+}
+
+// rateLimitByEmail limits calls by the email address they act on, whoever
+// makes them, so one inbox can't be flooded from many addresses. it guards
+// against sending mail rather than against load, so it applies even with
+// the limiter disabled
+func (app *application) rateLimitByEmail(ctx context.Context, email, method string) error {
+	return app.rateLimit(ctx, "email:"+strings.ToLower(email), method)
+}
+
+func (app *application) rateLimit(ctx context.Context, key, method string) error {
+	delay := app.limiter.reserve(key, method)
+	if delay == 0 {
+		return nil
+	}
+
+	rateLimitRejections.Add(method, 1)
+
+	retryAfter := int64(math.Ceil(delay.Seconds()))
+
+	err := grpc.SetHeader(ctx, metadata.Pairs("retry-after", strconv.FormatInt(retryAfter, 10)))
+	if err != nil {
+		app.logger.PrintError(err, nil)
+	}
+
+	return status.Error(codes.ResourceExhausted, "rate limit exceeded")
+}
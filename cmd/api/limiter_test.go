@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// newLimitedApplication returns an application whose buckets never refill
+// during a test
+func newLimitedApplication(t *testing.T, burst, sensitiveBurst int) *application {
+	t.Helper()
+
+	app, _ := newTestApplication(t)
+
+	app.config.limiter.enabled = true
+	app.config.limiter.rps = 0.001
+	app.config.limiter.burst = burst
+	app.config.limiter.sensitiveRps = 0.001
+	app.config.limiter.sensitiveBurst = sensitiveBurst
+	app.limiter = newRateLimiter(app.config)
+
+	return app
+}
+
+func TestRateLimiterReserve(t *testing.T) {
+	t.Run("Burst", func(t *testing.T) {
+		app := newLimitedApplication(t, 2, 2)
+
+		for i := range 2 {
+			if delay := app.limiter.reserve("ip:192.0.2.1", "GetUser"); delay != 0 {
+				t.Fatalf("call %d was delayed by %s", i+1, delay)
+			}
+		}
+
+		if delay := app.limiter.reserve("ip:192.0.2.1", "GetUser"); delay == 0 {
+			t.Fatal("call past the burst went through")
+		}
+
+		// other clients have their own bucket
+		if delay := app.limiter.reserve("ip:192.0.2.2", "GetUser"); delay != 0 {
+			t.Fatalf("another client was delayed by %s", delay)
+		}
+	})
+
+	t.Run("Sensitive", func(t *testing.T) {
+		app := newLimitedApplication(t, 5, 1)
+
+		if delay := app.limiter.reserve("ip:192.0.2.1", "Login"); delay != 0 {
+			t.Fatalf("first login was delayed by %s", delay)
+		}
+
+		if delay := app.limiter.reserve("ip:192.0.2.1", "Login"); delay == 0 {
+			t.Fatal("login past the sensitive burst went through")
+		}
+
+		// the rejected login didn't use up a token of the client's bucket
+		for i := range 4 {
+			if delay := app.limiter.reserve("ip:192.0.2.1", "GetUser"); delay != 0 {
+				t.Fatalf("call %d was delayed by %s", i+1, delay)
+			}
+		}
+	})
+}
+
+func TestRateLimitByIP(t *testing.T) {
+	info := &grpc.UnaryServerInfo{FullMethod: "/users.Users/GetUser"}
+
+	handler := func(ctx context.Context, req any) (any, error) {
+		return "ok", nil
+	}
+
+	ctx := peer.NewContext(context.Background(), &peer.Peer{
+		Addr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5000},
+	})
+
+	t.Run("Limited", func(t *testing.T) {
+		app := newLimitedApplication(t, 1, 1)
+
+		_, err := app.RateLimitByIP(ctx, nil, info, handler)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = app.RateLimitByIP(ctx, nil, info, handler)
+		if status.Code(err) != codes.ResourceExhausted {
+			t.Fatalf("got %v, want ResourceExhausted", err)
+		}
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		app := newLimitedApplication(t, 1, 1)
+		app.config.limiter.enabled = false
+
+		for range 3 {
+			_, err := app.RateLimitByIP(ctx, nil, info, handler)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestRateLimitByUser(t *testing.T) {
+	app := newLimitedApplication(t, 1, 1)
+
+	info := &grpc.UnaryServerInfo{FullMethod: "/users.Users/GetUser"}
+
+	handler := func(ctx context.Context, req any) (any, error) {
+		return "ok", nil
+	}
+
+	call := func(userId int64) error {
+		_, err := app.RateLimitByUser(app.contextSetUserId(context.Background(), userId), nil, info, handler)
+		return err
+	}
+
+	if err := call(1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := call(1); status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("got %v, want ResourceExhausted", err)
+	}
+
+	if err := call(2); err != nil {
+		t.Fatalf("another user was limited: %v", err)
+	}
+}
+
+func TestRateLimitByEmail(t *testing.T) {
+	app := newLimitedApplication(t, 5, 1)
+
+	// it guards inboxes, so it applies with the limiter disabled too
+	app.config.limiter.enabled = false
+
+	err := app.rateLimitByEmail(context.Background(), "alice@dinghy.test", "RequestMagicLink")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = app.rateLimitByEmail(context.Background(), "Alice@Dinghy.test", "RequestMagicLink")
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("got %v, want ResourceExhausted", err)
+	}
+}
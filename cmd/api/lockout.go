@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/saarwasserman/users/internal/data"
+	"github.com/saarwasserman/users/internal/validator"
+	"github.com/saarwasserman/users/protogen/notifications"
+	"github.com/saarwasserman/users/protogen/users"
+)
+
+// lockouts grow progressively but never beyond this
+const maxLockoutDuration = 24 * time.Hour
+
+// checkLoginThrottles refuses a login attempt while the account or the client
+// address is locked, or while the account is still in its backoff delay after
+// a failed attempt. the account's throttle doesn't apply to addresses it
+// already signed in from, so others failing to log in can't lock its owner out
+func (app *application) checkLoginThrottles(ctx context.Context, email, ip string) error {
+	now := time.Now()
+
+	known, err := app.isKnownAddress(email, ip)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	if !known {
+		throttle, err := app.models.LoginThrottles.Get(data.ThrottleKindEmail, strings.ToLower(email))
+		if err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+
+		if throttle.LockedUntil != nil && now.Before(*throttle.LockedUntil) {
+			app.setUnlockAtHeader(ctx, *throttle.LockedUntil)
+			return status.Errorf(codes.PermissionDenied, "account is temporarily locked, try again after %s", throttle.LockedUntil.UTC().Format(time.RFC3339))
+		}
+
+		if throttle.Failures > 0 {
+			nextAttempt := throttle.LastFailureAt.Add(app.loginBackoff(throttle.Failures))
+			if now.Before(nextAttempt) {
+				app.setUnlockAtHeader(ctx, nextAttempt)
+				return status.Errorf(codes.ResourceExhausted, "too many failed login attempts, try again after %s", nextAttempt.UTC().Format(time.RFC3339))
+			}
+		}
+	}
+
+	if ip == "" {
+		return nil
+	}
+
+	throttle, err := app.models.LoginThrottles.Get(data.ThrottleKindIP, ip)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	if throttle.LockedUntil != nil && now.Before(*throttle.LockedUntil) {
+		app.setUnlockAtHeader(ctx, *throttle.LockedUntil)
+		return status.Errorf(codes.ResourceExhausted, "too many failed login attempts, try again after %s", throttle.LockedUntil.UTC().Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+// recordLoginFailure counts a failed attempt against the email and the client
+// address and locks them once they reach their threshold. failures from
+// addresses the account already signed in from only count against the
+// address. user is nil when the email isn't registered
+func (app *application) recordLoginFailure(email string, user *data.User, ip string) {
+	known, err := app.isKnownAddress(email, ip)
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return
+	}
+
+	if !known {
+		throttle, err := app.models.LoginThrottles.RecordFailure(data.ThrottleKindEmail, strings.ToLower(email), app.config.lockout.window)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+			return
+		}
+
+		if throttle.Failures >= app.config.lockout.threshold {
+			err = app.lock(throttle, user)
+			if err != nil {
+				app.logger.PrintError(err, nil)
+				return
+			}
+		}
+	}
+
+	if ip == "" {
+		return
+	}
+
+	throttle, err := app.models.LoginThrottles.RecordFailure(data.ThrottleKindIP, ip, app.config.lockout.window)
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return
+	}
+
+	if throttle.Failures >= app.config.lockout.ipThreshold {
+		err = app.lock(throttle, nil)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+	}
+}
+
+// isKnownAddress reports whether the account of the email has a session from ip
+func (app *application) isKnownAddress(email, ip string) (bool, error) {
+	if ip == "" {
+		return false, nil
+	}
+
+	return app.models.Sessions.IsKnownAddress(email, ip)
+}
+
+// recordLoginSuccess clears the failures and lockouts of the account. the
+// address keeps its count so one valid account can't be used to reset it
+func (app *application) recordLoginSuccess(email string) {
+	err := app.models.LoginThrottles.Delete(data.ThrottleKindEmail, strings.ToLower(email))
+	if err != nil {
+		app.logger.PrintError(err, nil)
+	}
+}
+
+// lock locks the throttle, letting the owner of the account know when the
+// throttle is of a registered email
+func (app *application) lock(throttle *data.LoginThrottle, user *data.User) error {
+	duration := app.config.lockout.duration * time.Duration(math.Pow(2, float64(throttle.Lockouts)))
+	if duration <= 0 || duration > maxLockoutDuration {
+		duration = maxLockoutDuration
+	}
+
+	lockedUntil := time.Now().Add(duration)
+
+	var messages []*data.OutboxMessage
+
+	if user != nil {
+		message, err := app.newOutboxMessage(outboxAccountLockedEmail, user.ID, &notifications.SendAccountLockedEmailRequest{
+			Recipient:   user.Email,
+			UserId:      strconv.FormatInt(user.ID, 10),
+			LockedUntil: lockedUntil.UTC().Format(time.RFC3339),
+		})
+		if err != nil {
+			return err
+		}
+
+		messages = append(messages, message)
+	}
+
+	err := app.models.LoginThrottles.Lock(throttle, lockedUntil, messages...)
+	if err != nil {
+		return err
+	}
+
+	// emails are kept out of the logs, locked accounts are logged by id
+	properties := map[string]string{
+		"kind":         throttle.Kind,
+		"locked_until": lockedUntil.UTC().Format(time.RFC3339),
+	}
+
+	switch {
+	case throttle.Kind == data.ThrottleKindIP:
+		properties["ip"] = throttle.Subject
+	case user != nil:
+		properties["user_id"] = strconv.FormatInt(user.ID, 10)
+	}
+
+	app.logger.PrintInfo("login locked", properties)
+
+	return nil
+}
+
+// loginBackoff is the delay required after the given number of consecutive
+// failures, doubling with each failure
+func (app *application) loginBackoff(failures int) time.Duration {
+	backoff := app.config.lockout.backoff * time.Duration(math.Pow(2, float64(failures-1)))
+	if backoff <= 0 || backoff > app.config.lockout.duration {
+		return app.config.lockout.duration
+	}
+
+	return backoff
+}
+
+// deleteInactiveLoginThrottles forgets the failures and lockouts of accounts
+// and addresses that have been quiet for the reset period, so lockouts don't
+// keep growing over failures months apart
+func (app *application) deleteInactiveLoginThrottles() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		err := app.models.LoginThrottles.DeleteInactive(time.Now().Add(-app.config.lockout.resetAfter))
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+	}
+}
+
+func (app *application) setUnlockAtHeader(ctx context.Context, unlockAt time.Time) {
+	err := grpc.SetHeader(ctx, metadata.Pairs(
+		"unlock-at", unlockAt.UTC().Format(time.RFC3339),
+		"retry-after", strconv.FormatInt(int64(math.Ceil(time.Until(unlockAt).Seconds())), 10),
+	))
+	if err != nil {
+		app.logger.PrintError(err, nil)
+	}
+}
+
+func (app *application) UnlockUser(ctx context.Context, req *users.UnlockUserRequest) (*users.UnlockUserResponse, error) {
+	v := validator.New()
+
+	if v.Check(req.UserId > 0, "user_id", "must be provided"); !v.Valid() {
+		return nil, status.Errorf(codes.InvalidArgument, "error %s", v.Errors)
+	}
+
+	user, err := app.models.Users.GetByUserIdContext(ctx, req.UserId)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return nil, status.Error(codes.NotFound, "user not found")
+		default:
+			return nil, queryError(err)
+		}
+	}
+
+	err = app.models.LoginThrottles.Delete(data.ThrottleKindEmail, strings.ToLower(user.Email))
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	app.logger.PrintInfo("user unlocked by admin", map[string]string{
+		"admin_id": strconv.FormatInt(app.contextGetUserId(ctx), 10),
+		"user_id":  strconv.FormatInt(user.ID, 10),
+	})
+
+	return &users.UnlockUserResponse{
+		Message: fmt.Sprintf("user %d was unlocked", user.ID),
+	}, nil
+}
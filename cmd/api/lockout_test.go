@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/saarwasserman/users/internal/data"
+	"github.com/saarwasserman/users/protogen/users"
+)
+
+// insertLockoutTestUser inserts a user with a session from the known address
+func insertLockoutTestUser(t *testing.T, app *application, knownIP string) *data.User {
+	t.Helper()
+
+	user := &data.User{Name: "Alice", Email: "alice@dinghy.test", Activated: true}
+	err := app.models.Users.InsertContext(context.Background(), user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = app.models.Sessions.Insert(&data.Session{
+		UserID:   user.ID,
+		Expiry:   time.Now().Add(time.Hour),
+		ClientIP: knownIP,
+	}, "known-session-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return user
+}
+
+func TestLoginBackoff(t *testing.T) {
+	app, _ := newTestApplication(t)
+
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{failures: 1, want: time.Second},
+		{failures: 2, want: 2 * time.Second},
+		{failures: 3, want: 4 * time.Second},
+		{failures: 10, want: 512 * time.Second},
+		{failures: 11, want: 15 * time.Minute},
+		{failures: 20, want: 15 * time.Minute},
+	}
+
+	for _, tt := range tests {
+		if got := app.loginBackoff(tt.failures); got != tt.want {
+			t.Errorf("loginBackoff(%d) = %s, want %s", tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestLock(t *testing.T) {
+	// lockedFor locks the throttle after the given number of lockouts and
+	// returns how long it is locked for
+	lockedFor := func(t *testing.T, app *application, lockouts int, user *data.User) time.Duration {
+		t.Helper()
+
+		throttle, err := app.models.LoginThrottles.RecordFailure(data.ThrottleKindEmail, "alice@dinghy.test", time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		throttle.Lockouts = lockouts
+
+		err = app.lock(throttle, user)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return time.Until(*throttle.LockedUntil).Round(time.Minute)
+	}
+
+	t.Run("Doubles", func(t *testing.T) {
+		app, _ := newTestApplication(t)
+
+		for lockouts, want := range []time.Duration{15 * time.Minute, 30 * time.Minute, time.Hour, 2 * time.Hour} {
+			if got := lockedFor(t, app, lockouts, nil); got != want {
+				t.Errorf("lock after %d lockouts lasts %s, want %s", lockouts, got, want)
+			}
+		}
+	})
+
+	t.Run("Capped", func(t *testing.T) {
+		app, _ := newTestApplication(t)
+
+		for _, lockouts := range []int{7, 20, 100} {
+			if got := lockedFor(t, app, lockouts, nil); got != maxLockoutDuration {
+				t.Errorf("lock after %d lockouts lasts %s, want %s", lockouts, got, maxLockoutDuration)
+			}
+		}
+	})
+
+	t.Run("NotifiesOwner", func(t *testing.T) {
+		app, _ := newTestApplication(t)
+
+		lockedFor(t, app, 0, &data.User{ID: 1, Email: "alice@dinghy.test"})
+
+		messages, err := app.models.Outbox.GetAllForUser(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(messages) != 1 || messages[0].Kind != outboxAccountLockedEmail {
+			t.Fatalf("got %d messages, want the account locked email", len(messages))
+		}
+	})
+}
+
+func TestLoginThrottles(t *testing.T) {
+	const (
+		email   = "alice@dinghy.test"
+		ip      = "198.51.100.1"
+		knownIP = "192.0.2.1"
+	)
+
+	ctx := context.Background()
+
+	t.Run("Backoff", func(t *testing.T) {
+		app, _ := newTestApplication(t)
+
+		app.recordLoginFailure(email, nil, ip)
+
+		err := app.checkLoginThrottles(ctx, email, ip)
+		if status.Code(err) != codes.ResourceExhausted {
+			t.Fatalf("got %v, want ResourceExhausted", err)
+		}
+	})
+
+	t.Run("Lockout", func(t *testing.T) {
+		app, _ := newTestApplication(t)
+
+		user := insertLockoutTestUser(t, app, knownIP)
+
+		for range app.config.lockout.threshold {
+			app.recordLoginFailure(email, user, ip)
+		}
+
+		err := app.checkLoginThrottles(ctx, email, ip)
+		if status.Code(err) != codes.PermissionDenied {
+			t.Fatalf("got %v, want PermissionDenied", err)
+		}
+
+		// another address is locked out of the account just the same
+		err = app.checkLoginThrottles(ctx, email, "203.0.113.1")
+		if status.Code(err) != codes.PermissionDenied {
+			t.Fatalf("got %v, want PermissionDenied", err)
+		}
+
+		// but not the one its owner signed in from
+		err = app.checkLoginThrottles(ctx, email, knownIP)
+		if err != nil {
+			t.Fatalf("got %v, want the known address let through", err)
+		}
+
+		messages, err := app.models.Outbox.GetAllForUser(user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(messages) != 1 || messages[0].Kind != outboxAccountLockedEmail {
+			t.Fatalf("got %d messages, want the account locked email", len(messages))
+		}
+	})
+
+	t.Run("UnknownEmail", func(t *testing.T) {
+		app, _ := newTestApplication(t)
+
+		for range app.config.lockout.threshold {
+			app.recordLoginFailure("nobody@dinghy.test", nil, ip)
+		}
+
+		err := app.checkLoginThrottles(ctx, "nobody@dinghy.test", ip)
+		if status.Code(err) != codes.PermissionDenied {
+			t.Fatalf("got %v, want PermissionDenied", err)
+		}
+	})
+
+	t.Run("KnownAddress", func(t *testing.T) {
+		app, _ := newTestApplication(t)
+
+		user := insertLockoutTestUser(t, app, knownIP)
+
+		for range app.config.lockout.threshold {
+			app.recordLoginFailure(email, user, knownIP)
+		}
+
+		throttle, err := app.models.LoginThrottles.Get(data.ThrottleKindEmail, email)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if throttle.Failures != 0 || throttle.Lockouts != 0 {
+			t.Fatalf("failures from a known address counted against the account: %+v", throttle)
+		}
+
+		throttle, err = app.models.LoginThrottles.Get(data.ThrottleKindIP, knownIP)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if throttle.Failures != app.config.lockout.threshold {
+			t.Fatalf("got %d failures of the address, want %d", throttle.Failures, app.config.lockout.threshold)
+		}
+	})
+
+	t.Run("Address", func(t *testing.T) {
+		app, _ := newTestApplication(t)
+
+		for i := range app.config.lockout.ipThreshold {
+			app.recordLoginFailure(string(rune('a'+i))+"@dinghy.test", nil, ip)
+		}
+
+		err := app.checkLoginThrottles(ctx, email, ip)
+		if status.Code(err) != codes.ResourceExhausted {
+			t.Fatalf("got %v, want the address locked", err)
+		}
+
+		err = app.checkLoginThrottles(ctx, email, "203.0.113.1")
+		if err != nil {
+			t.Fatalf("got %v, want another address let through", err)
+		}
+	})
+
+	t.Run("Success", func(t *testing.T) {
+		app, _ := newTestApplication(t)
+
+		app.recordLoginFailure(email, nil, ip)
+		app.recordLoginSuccess(email)
+
+		err := app.checkLoginThrottles(ctx, email, ip)
+		if err != nil {
+			t.Fatalf("got %v, want the failures cleared", err)
+		}
+	})
+}
+
+func TestUnlockUser(t *testing.T) {
+	t.Run("Locked", func(t *testing.T) {
+		app, _ := newTestApplication(t)
+		ctx := adminContext(app)
+
+		user := insertLockoutTestUser(t, app, "192.0.2.1")
+
+		for range app.config.lockout.threshold {
+			app.recordLoginFailure(user.Email, user, "")
+		}
+
+		_, err := app.UnlockUser(ctx, &users.UnlockUserRequest{UserId: user.ID})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = app.checkLoginThrottles(ctx, user.Email, "")
+		if err != nil {
+			t.Fatalf("got %v, want the account unlocked", err)
+		}
+	})
+
+	t.Run("NotFound", func(t *testing.T) {
+		app, _ := newTestApplication(t)
+		ctx := adminContext(app)
+
+		_, err := app.UnlockUser(ctx, &users.UnlockUserRequest{UserId: 1})
+		if status.Code(err) != codes.NotFound {
+			t.Fatalf("got %v, want NotFound", err)
+		}
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		app, _ := newTestApplication(t)
+		ctx := adminContext(app)
+
+		_, err := app.UnlockUser(ctx, &users.UnlockUserRequest{})
+		if status.Code(err) != codes.InvalidArgument {
+			t.Fatalf("got %v, want InvalidArgument", err)
+		}
+	})
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	"github.com/saarwasserman/users/internal/data"
+	"github.com/saarwasserman/users/internal/validator"
+	"github.com/saarwasserman/users/protogen/auth"
+	"github.com/saarwasserman/users/protogen/notifications"
+	"github.com/saarwasserman/users/protogen/users"
+)
+
+// magic links sign in whoever holds them, so they don't live long
+const magicLinkTokenTTL = 15 * time.Minute
+
+func (app *application) RequestMagicLink(ctx context.Context, req *users.RequestMagicLinkRequest) (*users.RequestMagicLinkResponse, error) {
+	v := validator.New()
+
+	if data.ValidateEmail(v, req.Email); !v.Valid() {
+		return nil, status.Errorf(codes.InvalidArgument, "error %s", v.Errors)
+	}
+
+	err := app.rateLimitByEmail(ctx, req.Email, "RequestMagicLink")
+	if err != nil {
+		return nil, err
+	}
+
+	// done in the background for the same reason as RequestPasswordReset
+	app.background(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		user, err := app.models.Users.GetByEmailContext(ctx, req.Email)
+		if errors.Is(err, data.ErrRecordNotFound) {
+			// accounts pending deletion are restored by signing in during the grace period
+			user, err = app.models.Users.GetPendingDeletionByEmailContext(ctx, req.Email, time.Now().Add(-app.config.deletion.gracePeriod))
+		}
+		if err != nil {
+			if !errors.Is(err, data.ErrRecordNotFound) {
+				app.logger.PrintError(err, nil)
+			}
+			return
+		}
+
+		tokenResponse, err := app.auth.CreateToken(ctx, &auth.TokenCreationRequest{
+			Scope:  data.ScopeMagicLink,
+			UserId: user.ID,
+			Ttl:    durationpb.New(magicLinkTokenTTL),
+		})
+		if err != nil {
+			app.logger.PrintError(err, nil)
+			return
+		}
+
+		err = app.enqueueEmail(outboxMagicLinkEmail, user.ID, &notifications.SendMagicLinkEmailRequest{
+			Recipient: user.Email,
+			UserId:    strconv.FormatInt(user.ID, 10),
+			Token:     tokenResponse.TokenPlaintext,
+		})
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+	})
+
+	return &users.RequestMagicLinkResponse{
+		Message: "an email will be sent to you containing a sign in link",
+	}, nil
+}
+
+// LoginWithMagicLink signs in with a link sent by RequestMagicLink. following
+// the link proves the user owns the address, so it activates the account too
+func (app *application) LoginWithMagicLink(ctx context.Context, req *users.LoginWithMagicLinkRequest) (*users.LoginResponse, error) {
+	v := validator.New()
+
+	if data.ValidateTokenPlaintext(v, req.TokenPlaintext); !v.Valid() {
+		return nil, status.Errorf(codes.InvalidArgument, "error %s", v.Errors)
+	}
+
+	authRes, err := app.auth.Authenticate(ctx, &auth.AuthenticationRequest{
+		TokenScope:     data.ScopeMagicLink,
+		TokenPlaintext: req.TokenPlaintext,
+	})
+	if err != nil {
+		switch {
+		case isInvalidTokenError(err):
+			return nil, status.Error(codes.Unauthenticated, "invalid or expired sign in link")
+		default:
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	// signing in to an account pending deletion restores it, as with a password
+	user, err := app.models.Users.GetByUserIdContext(ctx, authRes.UserId)
+	if errors.Is(err, data.ErrRecordNotFound) {
+		user, err = app.models.Users.GetPendingDeletionContext(ctx, authRes.UserId, time.Now().Add(-app.config.deletion.gracePeriod))
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return nil, status.Error(codes.Unauthenticated, "invalid or expired sign in link")
+		default:
+			return nil, queryError(err)
+		}
+	}
+
+	// the link is single use
+	_, err = app.auth.DeleteAllTokensForUser(ctx, &auth.TokensDeletionRequest{
+		Scope:  data.ScopeMagicLink,
+		UserId: user.ID,
+	})
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	if !user.Activated {
+		user.Activated = true
+
+		err = app.models.Users.UpdateContext(ctx, user)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrEditConflict):
+				return nil, status.Error(codes.Aborted, "unable to update the record due to an edit conflict, please try again")
+			default:
+				return nil, queryError(err)
+			}
+		}
+
+		_, err = app.auth.DeleteAllTokensForUser(ctx, &auth.TokensDeletionRequest{
+			Scope:  data.ScopeActivation,
+			UserId: user.ID,
+		})
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	// the link stands in for the password only
+	return app.finishFirstFactor(ctx, user)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/saarwasserman/users/internal/data"
+	"github.com/saarwasserman/users/protogen/auth"
+	"github.com/saarwasserman/users/protogen/notifications"
+	"github.com/saarwasserman/users/protogen/users"
+)
+
+func TestRequestMagicLink(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("PendingDeletion", func(t *testing.T) {
+		app, _ := newTestApplication(t)
+		outbox := app.models.Outbox.(*fakeOutbox)
+
+		user := &data.User{Name: "Alice", Email: "alice@dinghy.test", Activated: true}
+
+		err := app.models.Users.InsertContext(ctx, user)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = app.models.Users.SoftDeleteContext(ctx, user)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = app.RequestMagicLink(ctx, &users.RequestMagicLinkRequest{Email: user.Email})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		waitFor(t, func() bool { return outbox.Get(1) != nil })
+
+		message := outbox.Get(1)
+		if message.Kind != outboxMagicLinkEmail || message.UserID != user.ID {
+			t.Fatalf("got %s for user %d, want a magic link email for user %d", message.Kind, message.UserID, user.ID)
+		}
+	})
+}
+
+// createMagicLink returns the token of a magic link for the user
+func createMagicLink(t *testing.T, fake *fakeAuth, userId int64) string {
+	t.Helper()
+
+	res, err := fake.CreateToken(context.Background(), &auth.TokenCreationRequest{Scope: data.ScopeMagicLink, UserId: userId})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return res.TokenPlaintext
+}
+
+func TestLoginWithMagicLink(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Login", func(t *testing.T) {
+		app, fake := newTestApplication(t)
+		outbox := app.models.Outbox.(*fakeOutbox)
+
+		user := &data.User{Name: "Alice", Email: "alice@dinghy.test"}
+		err := app.models.Users.InsertContext(ctx, user)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		activation, err := fake.CreateToken(ctx, &auth.TokenCreationRequest{Scope: data.ScopeActivation, UserId: user.ID})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = app.RequestMagicLink(ctx, &users.RequestMagicLinkRequest{Email: user.Email})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		waitFor(t, func() bool { return outbox.Get(1) != nil })
+
+		var payload notifications.SendMagicLinkEmailRequest
+		openOutboxPayload(t, app, outbox.Get(1), &payload)
+
+		req := &users.LoginWithMagicLinkRequest{TokenPlaintext: payload.Token}
+
+		res, err := app.LoginWithMagicLink(ctx, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		session, err := app.models.Sessions.GetForToken(res.TokenPlaintext)
+		if err != nil || session.UserID != user.ID {
+			t.Fatalf("got session %v, %v for the access token, want a session of user %d", session, err, user.ID)
+		}
+
+		// following the link proves the address, so the account is activated
+		stored, err := app.models.Users.GetByUserIdContext(ctx, user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !stored.Activated {
+			t.Error("got the account not activated")
+		}
+
+		_, err = fake.Authenticate(ctx, &auth.AuthenticationRequest{TokenScope: data.ScopeActivation, TokenPlaintext: activation.TokenPlaintext})
+		if err == nil {
+			t.Error("got the activation token still valid")
+		}
+
+		// the link is single use
+		_, err = app.LoginWithMagicLink(ctx, req)
+		if status.Code(err) != codes.Unauthenticated {
+			t.Errorf("got %v following the link again, want %v", err, codes.Unauthenticated)
+		}
+	})
+
+	t.Run("MFA", func(t *testing.T) {
+		app, fake := newTestApplication(t)
+
+		user, userCtx := insertTestUser(t, app, fake)
+		enrollTOTP(t, app, userCtx)
+
+		// the link stands in for the password, not the second factor
+		res, err := app.LoginWithMagicLink(ctx, &users.LoginWithMagicLinkRequest{TokenPlaintext: createMagicLink(t, fake, user.ID)})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !res.MfaRequired || res.MfaToken == "" || res.TokenPlaintext != "" {
+			t.Errorf("got %+v, want an mfa challenge only", res)
+		}
+	})
+
+	t.Run("PendingDeletion", func(t *testing.T) {
+		app, fake := newTestApplication(t)
+
+		user, _ := insertTestUser(t, app, fake)
+		deleteTestUser(t, app, user)
+
+		_, err := app.LoginWithMagicLink(ctx, &users.LoginWithMagicLinkRequest{TokenPlaintext: createMagicLink(t, fake, user.ID)})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = app.models.Users.GetByUserIdContext(ctx, user.ID)
+		if err != nil {
+			t.Errorf("got %v, want the account restored", err)
+		}
+	})
+
+	t.Run("InvalidToken", func(t *testing.T) {
+		app, fake := newTestApplication(t)
+
+		user, _ := insertTestUser(t, app, fake)
+
+		// a token of another scope isn't a sign in link
+		activation, err := fake.CreateToken(ctx, &auth.TokenCreationRequest{Scope: data.ScopeActivation, UserId: user.ID})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = app.LoginWithMagicLink(ctx, &users.LoginWithMagicLinkRequest{TokenPlaintext: activation.TokenPlaintext})
+		if status.Code(err) != codes.Unauthenticated {
+			t.Errorf("got %v, want %v", err, codes.Unauthenticated)
+		}
+
+		_, err = app.LoginWithMagicLink(ctx, &users.LoginWithMagicLinkRequest{TokenPlaintext: "short"})
+		if status.Code(err) != codes.InvalidArgument {
+			t.Errorf("got %v for a malformed token, want %v", err, codes.InvalidArgument)
+		}
+	})
+}
@@ -2,7 +2,9 @@ package main
 
 import (
 	"context"
+	"crypto/cipher"
 	"database/sql"
+	"errors"
 	"expvar"
 	"flag"
 	"fmt"
@@ -16,9 +18,12 @@ import (
 	"google.golang.org/grpc/credentials/insecure"
 
 	_ "github.com/lib/pq"
+	"github.com/redis/go-redis/v9"
 	"github.com/saarwasserman/users/internal/data"
+	"github.com/saarwasserman/users/internal/idp"
 	"github.com/saarwasserman/users/internal/jsonlog"
 	"github.com/saarwasserman/users/internal/vcs"
+	"github.com/saarwasserman/users/internal/webauthn"
 	"google.golang.org/grpc"
 
 	middlewareAuth "github.com/grpc-ecosystem/go-grpc-middleware/v2/interceptors/auth"
@@ -37,17 +42,61 @@ type config struct {
 	env     string
 	session struct {
 		inactivityTime int
+		maxLifetime    time.Duration
+		accessTokenTTL time.Duration
+	}
+	authorization struct {
+		policyFile          string
+		permissionsCacheTTL time.Duration
+	}
+	lockout struct {
+		threshold   int
+		ipThreshold int
+		window      time.Duration
+		backoff     time.Duration
+		duration    time.Duration
+		resetAfter  time.Duration
+	}
+	mfa struct {
+		encryptionKey string
+		issuer        string
+		skew          int
+	}
+	webauthn struct {
+		rpId    string
+		rpName  string
+		origins []string
+	}
+	identityProviders struct {
+		file string
+	}
+	idempotency struct {
+		keyTTL  time.Duration
+		hashKey string
+	}
+	outbox struct {
+		encryptionKey string
+		maxAttempts   int
+		backoff       time.Duration
+		pollInterval  time.Duration
+	}
+	deletion struct {
+		gracePeriod   time.Duration
+		purgeInterval time.Duration
 	}
 	db struct {
 		dsn          string
 		maxOpenConns int
 		maxIdleConns int
 		maxIdleTime  string
+		queryTimeout time.Duration
 	}
 	limiter struct {
-		rps     float64
-		burst   int
-		enabled bool
+		rps            float64
+		burst          int
+		sensitiveRps   float64
+		sensitiveBurst int
+		enabled        bool
 	}
 	notificationsService struct {
 		host string
@@ -67,11 +116,21 @@ type config struct {
 
 type application struct {
 	users.UnimplementedUsersServer
-	config   config
-	logger   *jsonlog.Logger
-	models   data.Models
-	notifier notifications.EMailServiceClient
-	auth     auth.AuthenticationClient
+	config             config
+	logger             *jsonlog.Logger
+	models             data.Models
+	notifier           notifications.EMailServiceClient
+	auth               auth.AuthenticationClient
+	passwords          passwordVerifier
+	policies           map[string]methodPolicy
+	permissions        *permissionCache
+	limiter            *rateLimiter
+	activity           activityStore
+	secrets            cipher.AEAD
+	outboxCipher       cipher.AEAD
+	idempotencyHashKey []byte
+	webauthn           webauthn.RelyingParty
+	providers          map[string]*idp.Provider
 }
 
 func main() {
@@ -83,16 +142,63 @@ func main() {
 
 	// session
 	flag.IntVar(&cfg.session.inactivityTime, "session-inactivity-time", 5, "User inactivity duration in minutes")
+	flag.DurationVar(&cfg.session.accessTokenTTL, "access-token-ttl", 15*time.Minute, "Lifetime of access tokens, refreshed with the session's refresh token")
+	flag.DurationVar(&cfg.session.maxLifetime, "session-max-lifetime", 24*time.Hour, "Maximum session duration regardless of activity")
+
+	// authorization
+	flag.StringVar(&cfg.authorization.policyFile, "policy-file", "", "Method policy table (JSON), defaults to the embedded policy.json")
+	flag.DurationVar(&cfg.authorization.permissionsCacheTTL, "permissions-cache-ttl", 30*time.Second, "Time user permissions are cached for")
+
+	// brute force protection
+	flag.IntVar(&cfg.lockout.threshold, "lockout-threshold", 5, "Failed logins of an account before it is temporarily locked")
+	flag.IntVar(&cfg.lockout.ipThreshold, "lockout-ip-threshold", 20, "Failed logins from an address before it is temporarily locked")
+	flag.DurationVar(&cfg.lockout.window, "lockout-window", time.Hour, "Time after which failed logins are forgotten")
+	flag.DurationVar(&cfg.lockout.backoff, "lockout-backoff", time.Second, "Delay required after the first failed login, doubled for each further failure")
+	flag.DurationVar(&cfg.lockout.duration, "lockout-duration", 15*time.Minute, "Duration of the first lockout, doubled for each further lockout")
+	flag.DurationVar(&cfg.lockout.resetAfter, "lockout-reset-after", 24*time.Hour, "Time without failed logins or lockouts after which lockouts start over from the first")
+
+	// two-factor authentication
+	flag.StringVar(&cfg.mfa.encryptionKey, "mfa-encryption-key", os.Getenv("MFA_ENCRYPTION_KEY"), "Hex encoded 32 byte key TOTP secrets are encrypted with, two-factor authentication is disabled when not set and required once users enabled it")
+	flag.StringVar(&cfg.mfa.issuer, "mfa-issuer", "Dinghy", "Issuer shown in authenticator apps")
+	flag.IntVar(&cfg.mfa.skew, "mfa-skew", 1, "Time steps before and after the current one in which TOTP codes are accepted, to tolerate clock drift")
+
+	// passkeys
+	flag.StringVar(&cfg.webauthn.rpId, "webauthn-rp-id", "localhost", "WebAuthn relying party id, the domain passkeys are bound to")
+	flag.StringVar(&cfg.webauthn.rpName, "webauthn-rp-name", "Dinghy", "WebAuthn relying party name shown by authenticators")
+	flag.Func("webauthn-origins", "Origins passkey ceremonies may run on (space separated), defaults to the trusted CORS origins", func(val string) error {
+		cfg.webauthn.origins = strings.Fields(val)
+		return nil
+	})
+
+	// identity providers
+	flag.StringVar(&cfg.identityProviders.file, "identity-providers-file", "", "OpenID Connect providers users can login with (JSON), none when not set")
+
+	// idempotency keys
+	flag.DurationVar(&cfg.idempotency.keyTTL, "idempotency-key-ttl", 24*time.Hour, "Time the response of a call made with an idempotency key is replayed for")
+	flag.StringVar(&cfg.idempotency.hashKey, "idempotency-hash-key", os.Getenv("IDEMPOTENCY_HASH_KEY"), "Hex encoded 32 byte key the requests made with an idempotency key are hashed with, required outside development")
+
+	// notification emails
+	flag.StringVar(&cfg.outbox.encryptionKey, "outbox-encryption-key", os.Getenv("OUTBOX_ENCRYPTION_KEY"), "Hex encoded 32 byte key queued emails are encrypted with, required outside development")
+	flag.IntVar(&cfg.outbox.maxAttempts, "outbox-max-attempts", 10, "Attempts to deliver an email before it is moved to the dead letters")
+	flag.DurationVar(&cfg.outbox.backoff, "outbox-backoff", time.Second, "Delay before retrying a failed email, doubled for each further failure")
+	flag.DurationVar(&cfg.outbox.pollInterval, "outbox-poll-interval", time.Second, "Interval between checks for emails to deliver")
+
+	// account deletion
+	flag.DurationVar(&cfg.deletion.gracePeriod, "deletion-grace-period", 30*24*time.Hour, "Time a deleted account can still be restored by logging in")
+	flag.DurationVar(&cfg.deletion.purgeInterval, "deletion-purge-interval", time.Hour, "Interval between purges of accounts past the deletion grace period")
 
 	// db
 	flag.StringVar(&cfg.db.dsn, "db-dsn", os.Getenv("USERS_DB_DSN"), "PostgreSQL DSN")
 	flag.IntVar(&cfg.db.maxOpenConns, "db-max-open-conns", 25, "PostgreSQL max open connections")
 	flag.IntVar(&cfg.db.maxIdleConns, "db-max-idle-conns", 25, "PostgreSQL max idle connections")
 	flag.StringVar(&cfg.db.maxIdleTime, "db-max-idle-time", "15m", "PostgreSQL max connection idle time")
+	flag.DurationVar(&cfg.db.queryTimeout, "db-query-timeout", data.DefaultQueryTimeout, "Maximum duration of a user query, shortened by the deadline of the request it runs for")
 
 	// limiter
 	flag.Float64Var(&cfg.limiter.rps, "limiter-rps", 2, "Rate limiter maximum requests per second")
 	flag.IntVar(&cfg.limiter.burst, "limiter-burst", 4, "Rate limiter maximum burst")
+	flag.Float64Var(&cfg.limiter.sensitiveRps, "limiter-sensitive-rps", 0.2, "Rate limiter maximum requests per second for login, registration, password reset and mfa codes")
+	flag.IntVar(&cfg.limiter.sensitiveBurst, "limiter-sensitive-burst", 5, "Rate limiter maximum burst for login, registration, password reset and mfa codes")
 	flag.BoolVar(&cfg.limiter.enabled, "limiter-enabled", true, "Enable rate limiter")
 
 	// notifications service
@@ -167,12 +273,131 @@ func main() {
 	app := &application{
 		config:   cfg,
 		logger:   logger,
-		models:   data.NewModels(db),
+		models:   data.NewModels(db, cfg.db.queryTimeout),
 		notifier: notifications.NewEMailServiceClient(conn),
 		auth:     auth.NewAuthenticationClient(authConn),
-		//cache: cache,
 	}
 
+	if cfg.cache.endpoint != "" {
+		cache := redis.NewClient(&redis.Options{Addr: cfg.cache.endpoint})
+		defer cache.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err = cache.Ping(ctx).Err()
+		cancel()
+		if err != nil {
+			logger.PrintFatal(err, nil)
+			return
+		}
+
+		logger.PrintInfo("cache connection established", nil)
+		app.activity = redisActivityStore{client: cache}
+	} else {
+		store := newMemoryActivityStore()
+		app.background(store.evictExpired)
+		app.activity = store
+	}
+
+	app.passwords = authPasswordVerifier{client: app.auth}
+
+	if cfg.mfa.encryptionKey != "" {
+		app.secrets, err = newSecretsCipher("mfa encryption", cfg.mfa.encryptionKey)
+		if err != nil {
+			app.logger.PrintFatal(err, nil)
+			return
+		}
+	} else {
+		// users who enabled two-factor authentication could no longer log in
+		enrolled, err := app.models.TOTP.AnyConfirmed()
+		if err != nil {
+			app.logger.PrintFatal(err, nil)
+			return
+		}
+
+		if enrolled {
+			app.logger.PrintFatal(errors.New("mfa encryption key is required, users have two-factor authentication enabled"), nil)
+			return
+		}
+	}
+
+	switch {
+	case cfg.outbox.encryptionKey != "":
+		app.outboxCipher, err = newSecretsCipher("outbox encryption", cfg.outbox.encryptionKey)
+	case cfg.env == "development":
+		// emails queued before a restart are not delivered
+		app.outboxCipher, err = newEphemeralCipher()
+		app.logger.PrintInfo("outbox encryption key not set, using an ephemeral one", nil)
+	default:
+		err = errors.New("outbox encryption key is required outside development")
+	}
+	if err != nil {
+		app.logger.PrintFatal(err, nil)
+		return
+	}
+
+	switch {
+	case cfg.idempotency.hashKey != "":
+		app.idempotencyHashKey, err = decodeKey("idempotency hash", cfg.idempotency.hashKey)
+	case cfg.env == "development":
+		// retries across a restart are taken for different requests
+		app.idempotencyHashKey, err = randomKey()
+		app.logger.PrintInfo("idempotency hash key not set, using an ephemeral one", nil)
+	default:
+		err = errors.New("idempotency hash key is required outside development")
+	}
+	if err != nil {
+		app.logger.PrintFatal(err, nil)
+		return
+	}
+
+	app.policies, err = loadPolicies(cfg.authorization.policyFile)
+	if err != nil {
+		app.logger.PrintFatal(err, nil)
+		return
+	}
+
+	app.permissions = newPermissionCache(cfg.authorization.permissionsCacheTTL)
+
+	app.limiter = newRateLimiter(cfg)
+	app.background(app.limiter.evictIdle)
+
+	app.background(app.purgeDeletedUsers)
+	app.background(app.recoverRegistrations)
+	app.background(app.deleteFinishedRegistrations)
+	app.background(app.dispatchOutbox)
+	app.background(app.purgeDeadOutboxMessages)
+	app.background(app.deleteInactiveLoginThrottles)
+
+	app.webauthn = webauthn.RelyingParty{
+		ID:                      cfg.webauthn.rpId,
+		Name:                    cfg.webauthn.rpName,
+		Origins:                 cfg.webauthn.origins,
+		RequireUserVerification: true,
+	}
+
+	if len(app.webauthn.Origins) == 0 {
+		app.webauthn.Origins = cfg.cors.trustedOrigins
+	}
+
+	app.background(app.deleteExpiredPasskeyChallenges)
+
+	app.providers = make(map[string]*idp.Provider)
+
+	if cfg.identityProviders.file != "" {
+		providerConfigs, err := idp.LoadConfigs(cfg.identityProviders.file)
+		if err != nil {
+			app.logger.PrintFatal(err, nil)
+			return
+		}
+
+		for _, providerConfig := range providerConfigs {
+			app.providers[providerConfig.Name] = idp.NewProvider(providerConfig)
+		}
+	}
+
+	app.background(app.deleteExpiredOIDCStates)
+	app.background(app.deleteExpiredIdempotencyKeys)
+
 	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", app.config.port))
 	if err != nil {
 		app.logger.PrintFatal(err, nil)
@@ -180,15 +405,42 @@ func main() {
 	}
 
 	serviceRegistrar := grpc.NewServer(grpc.ChainUnaryInterceptor(
+		// rate limiting of all callers
+		app.RateLimitByIP,
 		// authentication
 		selector.UnaryServerInterceptor(
 			middlewareAuth.UnaryServerInterceptor(app.Authenticator),
 			selector.MatchFunc(app.AuthMatcher),
 		),
+		// rate limiting of authenticated callers
+		app.RateLimitByUser,
+		// authorization
+		app.UnaryAuthorizer,
+		// replay of retried calls
+		app.UnaryIdempotency,
+	), grpc.ChainStreamInterceptor(
+		// rate limiting of all callers
+		app.StreamRateLimitByIP,
+		// authentication
+		selector.StreamServerInterceptor(
+			middlewareAuth.StreamServerInterceptor(app.Authenticator),
+			selector.MatchFunc(app.AuthMatcher),
+		),
+		// rate limiting of authenticated callers
+		app.StreamRateLimitByUser,
+		// authorization
+		app.StreamAuthorizer,
 	))
 
-	app.logger.PrintInfo(fmt.Sprintf("listening on %s", listener.Addr().String()), nil)
 	users.RegisterUsersServer(serviceRegistrar, app)
+
+	err = checkPolicies(serviceRegistrar, app.policies)
+	if err != nil {
+		app.logger.PrintFatal(err, nil)
+		return
+	}
+
+	app.logger.PrintInfo(fmt.Sprintf("listening on %s", listener.Addr().String()), nil)
 	err = serviceRegistrar.Serve(listener)
 	if err != nil {
 		log.Fatalf("cannot serve %s", err)
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	"github.com/saarwasserman/users/internal/data"
+	"github.com/saarwasserman/users/internal/totp"
+	"github.com/saarwasserman/users/internal/validator"
+	"github.com/saarwasserman/users/protogen/auth"
+	"github.com/saarwasserman/users/protogen/users"
+)
+
+// time a user has to enter their code after the password step of a login
+const mfaChallengeTTL = 5 * time.Minute
+
+const invalidMFACodeMessage = "invalid two-factor authentication code"
+
+// decodeKey decodes the hex encoded 256 bit key of the given name
+func decodeKey(name, hexKey string) ([]byte, error) {
+	key, err := hex.DecodeString(hexKey)
+	if err != nil {
+		return nil, fmt.Errorf("%s key must be hex encoded: %w", name, err)
+	}
+
+	if len(key) != 32 {
+		return nil, fmt.Errorf("%s key must be 32 bytes long", name)
+	}
+
+	return key, nil
+}
+
+// randomKey returns a random 256 bit key, for keys that don't need to survive
+// a restart in development
+func randomKey() ([]byte, error) {
+	key := make([]byte, 32)
+
+	_, err := rand.Read(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// newSecretsCipher returns a cipher encrypting data at rest, e.g. TOTP
+// secrets, from the hex encoded 256 bit key of the given name
+func newSecretsCipher(name, hexKey string) (cipher.AEAD, error) {
+	key, err := decodeKey(name, hexKey)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// the user id is authenticated along with the secret, so a secret copied to
+// another user's row doesn't decrypt
+func secretAdditionalData(userId int64) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(userId))
+}
+
+func (app *application) encryptSecret(userId int64, secret []byte) ([]byte, error) {
+	nonce := make([]byte, app.secrets.NonceSize())
+
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	return app.secrets.Seal(nonce, nonce, secret, secretAdditionalData(userId)), nil
+}
+
+func (app *application) decryptSecret(userId int64, ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < app.secrets.NonceSize() {
+		return nil, errors.New("malformed totp secret")
+	}
+
+	nonce, ciphertext := ciphertext[:app.secrets.NonceSize()], ciphertext[app.secrets.NonceSize():]
+
+	return app.secrets.Open(nil, nonce, ciphertext, secretAdditionalData(userId))
+}
+
+// verifyTOTP checks the code against the user's secret and burns its time
+// step. a code that is wrong or was already used is reported as not ok
+func (app *application) verifyTOTP(credential *data.TOTPCredential, code string) (bool, error) {
+	step, ok, err := app.checkTOTP(credential, code)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	err = app.models.TOTP.UseStep(credential, step)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			// used concurrently by another request
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// checkTOTP returns the time step of the code if it matches the user's secret
+// and its step wasn't used yet, without burning it
+func (app *application) checkTOTP(credential *data.TOTPCredential, code string) (int64, bool, error) {
+	if app.secrets == nil {
+		return 0, false, errors.New("mfa encryption key is not configured")
+	}
+
+	secret, err := app.decryptSecret(credential.UserID, credential.SecretCiphertext)
+	if err != nil {
+		return 0, false, err
+	}
+
+	step, ok := totp.Validate(secret, code, time.Now(), app.config.mfa.skew)
+	if !ok || step <= credential.LastUsedStep {
+		return 0, false, nil
+	}
+
+	return step, true, nil
+}
+
+// mfaChallenge answers the password step of a login of a user with
+// two-factor authentication, instead of starting a session
+func (app *application) mfaChallenge(ctx context.Context, userId int64) (*users.LoginResponse, error) {
+	challenge, err := app.auth.CreateToken(ctx, &auth.TokenCreationRequest{
+		Scope:  data.ScopeMFAChallenge,
+		UserId: userId,
+		Ttl:    durationpb.New(mfaChallengeTTL),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &users.LoginResponse{
+		MfaRequired: true,
+		MfaToken:    challenge.TokenPlaintext,
+	}, nil
+}
+
+func (app *application) BeginTOTPEnrollment(ctx context.Context, req *users.BeginTOTPEnrollmentRequest) (*users.BeginTOTPEnrollmentResponse, error) {
+	if app.secrets == nil {
+		return nil, status.Error(codes.FailedPrecondition, "two-factor authentication is not configured")
+	}
+
+	user, err := app.models.Users.GetByUserIdContext(ctx, app.contextGetUserId(ctx))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return nil, status.Error(codes.NotFound, "user not found")
+		default:
+			return nil, queryError(err)
+		}
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	ciphertext, err := app.encryptSecret(user.ID, secret)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	err = app.models.TOTP.Upsert(&data.TOTPCredential{
+		UserID:           user.ID,
+		SecretCiphertext: ciphertext,
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			return nil, status.Error(codes.AlreadyExists, "two-factor authentication is already enabled")
+		default:
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	return &users.BeginTOTPEnrollmentResponse{
+		Secret: totp.EncodeSecret(secret),
+		Uri:    totp.URI(app.config.mfa.issuer, user.Email, secret),
+	}, nil
+}
+
+func (app *application) ConfirmTOTPEnrollment(ctx context.Context, req *users.ConfirmTOTPEnrollmentRequest) (*users.ConfirmTOTPEnrollmentResponse, error) {
+	v := validator.New()
+
+	if data.ValidateTOTPCode(v, req.Code); !v.Valid() {
+		return nil, status.Errorf(codes.InvalidArgument, "error %s", v.Errors)
+	}
+
+	credential, err := app.models.TOTP.GetForUser(app.contextGetUserId(ctx))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return nil, status.Error(codes.FailedPrecondition, "no two-factor authentication enrollment in progress")
+		default:
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	if credential.Confirmed {
+		return nil, status.Error(codes.AlreadyExists, "two-factor authentication is already enabled")
+	}
+
+	step, ok, err := app.checkTOTP(credential, req.Code)
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return nil, status.Error(codes.Internal, "failed to verify code")
+	}
+
+	if !ok {
+		return nil, status.Error(codes.InvalidArgument, invalidMFACodeMessage)
+	}
+
+	recoveryCodes, err := generateRecoveryCodes()
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return nil, status.Error(codes.Internal, "failed to generate recovery codes")
+	}
+
+	// the secret is only enabled along with the recovery codes
+	err = app.models.TOTP.Confirm(credential, step, recoveryCodes)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			// confirmed or the code used concurrently by another request
+			return nil, status.Error(codes.InvalidArgument, invalidMFACodeMessage)
+		default:
+			app.logger.PrintError(err, nil)
+			return nil, status.Error(codes.Internal, "failed to enable two-factor authentication")
+		}
+	}
+
+	return &users.ConfirmTOTPEnrollmentResponse{
+		Message:       "two-factor authentication is enabled, store the recovery codes somewhere safe",
+		RecoveryCodes: recoveryCodes,
+	}, nil
+}
+
+// DisableTOTP turns two-factor authentication off. it takes a current code,
+// so a stolen session alone can't remove the second factor
+func (app *application) DisableTOTP(ctx context.Context, req *users.DisableTOTPRequest) (*users.DisableTOTPResponse, error) {
+	v := validator.New()
+
+	if data.ValidateTOTPCode(v, req.Code); !v.Valid() {
+		return nil, status.Errorf(codes.InvalidArgument, "error %s", v.Errors)
+	}
+
+	credential, err := app.models.TOTP.GetForUser(app.contextGetUserId(ctx))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return nil, status.Error(codes.FailedPrecondition, "two-factor authentication is not enabled")
+		default:
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	if !credential.Confirmed {
+		return nil, status.Error(codes.FailedPrecondition, "two-factor authentication is not enabled")
+	}
+
+	ok, err := app.verifyTOTP(credential, req.Code)
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return nil, status.Error(codes.Internal, "failed to verify code")
+	}
+
+	if !ok {
+		return nil, status.Error(codes.InvalidArgument, invalidMFACodeMessage)
+	}
+
+	err = app.models.TOTP.Delete(credential.UserID)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &users.DisableTOTPResponse{
+		Message: "two-factor authentication is disabled",
+	}, nil
+}
+
+// VerifyMFA completes a login started with a password by exchanging the mfa
+// token and a code, or one of the user's recovery codes, for a session
+func (app *application) VerifyMFA(ctx context.Context, req *users.VerifyMFARequest) (*users.LoginResponse, error) {
+	v := validator.New()
+
+	data.ValidateTokenPlaintext(v, req.MfaToken)
+
+	if req.RecoveryCode != "" {
+		v.Check(req.Code == "", "code", "must not be provided along with a recovery code")
+		data.ValidateRecoveryCode(v, req.RecoveryCode)
+	} else {
+		data.ValidateTOTPCode(v, req.Code)
+	}
+
+	if !v.Valid() {
+		return nil, status.Errorf(codes.InvalidArgument, "error %s", v.Errors)
+	}
+
+	authRes, err := app.auth.Authenticate(ctx, &auth.AuthenticationRequest{
+		TokenScope:     data.ScopeMFAChallenge,
+		TokenPlaintext: req.MfaToken,
+	})
+	if err != nil {
+		switch {
+		case isInvalidTokenError(err):
+			return nil, status.Error(codes.Unauthenticated, "invalid or expired mfa token")
+		default:
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	user, err := app.models.Users.GetByUserIdContext(ctx, authRes.UserId)
+	if errors.Is(err, data.ErrRecordNotFound) {
+		user, err = app.models.Users.GetPendingDeletionContext(ctx, authRes.UserId, time.Now().Add(-app.config.deletion.gracePeriod))
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return nil, status.Error(codes.Unauthenticated, "invalid or expired mfa token")
+		default:
+			return nil, queryError(err)
+		}
+	}
+
+	// codes are guessed against the same throttles as passwords
+	ip := clientIP(ctx)
+
+	err = app.checkLoginThrottles(ctx, user.Email, ip)
+	if err != nil {
+		return nil, err
+	}
+
+	credential, err := app.models.TOTP.GetForUser(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return nil, status.Error(codes.FailedPrecondition, "two-factor authentication is not enabled")
+		default:
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	if !credential.Confirmed {
+		return nil, status.Error(codes.FailedPrecondition, "two-factor authentication is not enabled")
+	}
+
+	var ok bool
+	if req.RecoveryCode != "" {
+		ok, err = app.useRecoveryCode(user, req.RecoveryCode)
+	} else {
+		ok, err = app.verifyTOTP(credential, req.Code)
+	}
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return nil, status.Error(codes.Internal, "failed to verify code")
+	}
+
+	if !ok {
+		app.recordLoginFailure(user.Email, user, ip)
+		return nil, status.Error(codes.Unauthenticated, invalidMFACodeMessage)
+	}
+
+	// the challenge is single use
+	_, err = app.auth.DeleteAllTokensForUser(ctx, &auth.TokensDeletionRequest{
+		Scope:  data.ScopeMFAChallenge,
+		UserId: user.ID,
+	})
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return app.completeLogin(ctx, user)
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"encoding/base32"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/saarwasserman/users/internal/data"
+	"github.com/saarwasserman/users/internal/totp"
+	"github.com/saarwasserman/users/protogen/users"
+)
+
+// enrollTOTP turns two-factor authentication on for the user of the context
+// and returns the secret along with the recovery codes
+func enrollTOTP(t *testing.T, app *application, ctx context.Context) ([]byte, []string) {
+	t.Helper()
+
+	begin, err := app.BeginTOTPEnrollment(ctx, &users.BeginTOTPEnrollmentRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secret := decodeTOTPSecret(t, begin.Secret)
+
+	confirm, err := app.ConfirmTOTPEnrollment(ctx, &users.ConfirmTOTPEnrollmentRequest{
+		Code: totp.Code(secret, totp.Step(time.Now())),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return secret, confirm.RecoveryCodes
+}
+
+// decodeTOTPSecret decodes the secret the way an authenticator app does
+func decodeTOTPSecret(t *testing.T, encoded string) []byte {
+	t.Helper()
+
+	secret, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return secret
+}
+
+// nextTOTPCode returns a code of the step after the current one, which is
+// still accepted but wasn't used by the enrollment
+func nextTOTPCode(secret []byte) string {
+	return totp.Code(secret, totp.Step(time.Now())+1)
+}
+
+func TestTOTPEnrollment(t *testing.T) {
+	t.Run("Confirm", func(t *testing.T) {
+		app, fake := newTestApplication(t)
+		user, ctx := insertTestUser(t, app, fake)
+
+		_, recoveryCodes := enrollTOTP(t, app, ctx)
+
+		enabled, err := app.models.TOTP.IsEnabled(user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !enabled {
+			t.Fatal("two-factor authentication is not enabled")
+		}
+
+		if len(recoveryCodes) != recoveryCodeCount {
+			t.Fatalf("got %d recovery codes, want %d", len(recoveryCodes), recoveryCodeCount)
+		}
+
+		unused, err := app.models.RecoveryCodes.CountUnused(user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if unused != recoveryCodeCount {
+			t.Fatalf("got %d stored recovery codes, want %d", unused, recoveryCodeCount)
+		}
+	})
+
+	t.Run("WrongCode", func(t *testing.T) {
+		app, fake := newTestApplication(t)
+		user, ctx := insertTestUser(t, app, fake)
+
+		begin, err := app.BeginTOTPEnrollment(ctx, &users.BeginTOTPEnrollmentRequest{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		secret := decodeTOTPSecret(t, begin.Secret)
+
+		// a code from long ago
+		_, err = app.ConfirmTOTPEnrollment(ctx, &users.ConfirmTOTPEnrollmentRequest{Code: totp.Code(secret, 1)})
+		if status.Code(err) != codes.InvalidArgument {
+			t.Fatalf("got %v, want InvalidArgument", err)
+		}
+
+		enabled, err := app.models.TOTP.IsEnabled(user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if enabled {
+			t.Fatal("two-factor authentication was enabled")
+		}
+	})
+
+	t.Run("AlreadyEnabled", func(t *testing.T) {
+		app, fake := newTestApplication(t)
+		_, ctx := insertTestUser(t, app, fake)
+
+		enrollTOTP(t, app, ctx)
+
+		_, err := app.BeginTOTPEnrollment(ctx, &users.BeginTOTPEnrollmentRequest{})
+		if status.Code(err) != codes.AlreadyExists {
+			t.Fatalf("got %v, want AlreadyExists", err)
+		}
+	})
+
+	t.Run("NotStarted", func(t *testing.T) {
+		app, fake := newTestApplication(t)
+		_, ctx := insertTestUser(t, app, fake)
+
+		_, err := app.ConfirmTOTPEnrollment(ctx, &users.ConfirmTOTPEnrollmentRequest{Code: "123456"})
+		if status.Code(err) != codes.FailedPrecondition {
+			t.Fatalf("got %v, want FailedPrecondition", err)
+		}
+	})
+
+	t.Run("NotConfigured", func(t *testing.T) {
+		app, fake := newTestApplication(t)
+		_, ctx := insertTestUser(t, app, fake)
+
+		app.secrets = nil
+
+		_, err := app.BeginTOTPEnrollment(ctx, &users.BeginTOTPEnrollmentRequest{})
+		if status.Code(err) != codes.FailedPrecondition {
+			t.Fatalf("got %v, want FailedPrecondition", err)
+		}
+	})
+}
+
+func TestDisableTOTP(t *testing.T) {
+	t.Run("Disable", func(t *testing.T) {
+		app, fake := newTestApplication(t)
+		user, ctx := insertTestUser(t, app, fake)
+
+		secret, _ := enrollTOTP(t, app, ctx)
+
+		_, err := app.DisableTOTP(ctx, &users.DisableTOTPRequest{Code: nextTOTPCode(secret)})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		enabled, err := app.models.TOTP.IsEnabled(user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if enabled {
+			t.Fatal("two-factor authentication is still enabled")
+		}
+
+		unused, err := app.models.RecoveryCodes.CountUnused(user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if unused != 0 {
+			t.Fatalf("got %d recovery codes left, want none", unused)
+		}
+	})
+
+	t.Run("UsedCode", func(t *testing.T) {
+		app, fake := newTestApplication(t)
+		user, ctx := insertTestUser(t, app, fake)
+
+		secret, _ := enrollTOTP(t, app, ctx)
+
+		credential, err := app.models.TOTP.GetForUser(user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the code that confirmed the enrollment
+		_, err = app.DisableTOTP(ctx, &users.DisableTOTPRequest{Code: totp.Code(secret, credential.LastUsedStep)})
+		if status.Code(err) != codes.InvalidArgument {
+			t.Fatalf("got %v, want InvalidArgument", err)
+		}
+	})
+}
+
+func TestVerifyMFA(t *testing.T) {
+	// login signs in with the password and returns the mfa token
+	login := func(t *testing.T, app *application, user *data.User) string {
+		t.Helper()
+
+		res, err := app.Login(context.Background(), &users.LoginRequest{Email: user.Email, Password: testPassword})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !res.MfaRequired || res.TokenPlaintext != "" {
+			t.Fatal("login with a password alone started a session")
+		}
+
+		return res.MfaToken
+	}
+
+	t.Run("Code", func(t *testing.T) {
+		app, fake := newTestApplication(t)
+		user, ctx := insertTestUser(t, app, fake)
+
+		secret, _ := enrollTOTP(t, app, ctx)
+		mfaToken := login(t, app, user)
+
+		res, err := app.VerifyMFA(context.Background(), &users.VerifyMFARequest{MfaToken: mfaToken, Code: nextTOTPCode(secret)})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = app.getSession(context.Background(), res.TokenPlaintext)
+		if err != nil {
+			t.Fatalf("no session was started: %v", err)
+		}
+
+		// the challenge is single use
+		_, err = app.VerifyMFA(context.Background(), &users.VerifyMFARequest{MfaToken: mfaToken, Code: nextTOTPCode(secret)})
+		if status.Code(err) != codes.Unauthenticated {
+			t.Fatalf("got %v, want Unauthenticated", err)
+		}
+	})
+
+	t.Run("UsedCode", func(t *testing.T) {
+		app, fake := newTestApplication(t)
+		user, ctx := insertTestUser(t, app, fake)
+
+		secret, _ := enrollTOTP(t, app, ctx)
+		code := nextTOTPCode(secret)
+
+		_, err := app.VerifyMFA(context.Background(), &users.VerifyMFARequest{MfaToken: login(t, app, user), Code: code})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = app.VerifyMFA(context.Background(), &users.VerifyMFARequest{MfaToken: login(t, app, user), Code: code})
+		if status.Code(err) != codes.Unauthenticated {
+			t.Fatalf("got %v, want a code accepted only once", err)
+		}
+	})
+
+	t.Run("WrongCode", func(t *testing.T) {
+		app, fake := newTestApplication(t)
+		user, ctx := insertTestUser(t, app, fake)
+
+		secret, _ := enrollTOTP(t, app, ctx)
+		mfaToken := login(t, app, user)
+
+		_, err := app.VerifyMFA(context.Background(), &users.VerifyMFARequest{MfaToken: mfaToken, Code: totp.Code(secret, 1)})
+		if status.Code(err) != codes.Unauthenticated {
+			t.Fatalf("got %v, want Unauthenticated", err)
+		}
+
+		// codes are guessed against the login throttles
+		throttle, err := app.models.LoginThrottles.Get(data.ThrottleKindEmail, user.Email)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if throttle.Failures != 1 {
+			t.Fatalf("got %d failures, want the wrong code counted", throttle.Failures)
+		}
+	})
+
+	t.Run("NotEnabled", func(t *testing.T) {
+		app, fake := newTestApplication(t)
+		user, _ := insertTestUser(t, app, fake)
+
+		mfa, err := app.mfaChallenge(context.Background(), user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = app.VerifyMFA(context.Background(), &users.VerifyMFARequest{MfaToken: mfa.MfaToken, Code: "123456"})
+		if status.Code(err) != codes.FailedPrecondition {
+			t.Fatalf("got %v, want FailedPrecondition", err)
+		}
+	})
+}
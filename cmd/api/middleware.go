@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"slices"
 
 	"github.com/grpc-ecosystem/go-grpc-middleware/v2/interceptors"
 	interceptorsAuth "github.com/grpc-ecosystem/go-grpc-middleware/v2/interceptors/auth"
@@ -30,12 +29,25 @@ func (app *application) Authenticator(ctx context.Context) (context.Context, err
 		return ctx, status.Error(codes.Unauthenticated, err.Error())
 	}
 
+	session, err := app.getSession(ctx, token_plaintext)
+	if err != nil {
+		return ctx, err
+	}
+
+	err = app.touchSession(ctx, session)
+	if err != nil {
+		return ctx, err
+	}
+
 	ctx = app.contextSetUserId(ctx, authResponse.UserId)
+	ctx = app.contextSetSessionId(ctx, session.ID)
 
 	return ctx, nil
 }
 
+// AuthMatcher selects the methods that need an authenticated caller, i.e.
+// all methods not marked public in the policy table
 func (app *application) AuthMatcher(ctx context.Context, callMeta interceptors.CallMeta) bool {
-	methods := []string{"GetUser", "Logout"}
-	return slices.Contains(methods, callMeta.Method)
+	policy, ok := app.policies[callMeta.Method]
+	return !ok || !policy.Public
 }
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"crypto/cipher"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math"
+	"strconv"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/saarwasserman/users/internal/data"
+	"github.com/saarwasserman/users/protogen/notifications"
+)
+
+// kinds of outbox messages, named after the notifications service method
+// that delivers them
+const (
+	outboxActivationEmail              = "SendActivationEmail"
+	outboxPasswordResetEmail           = "SendPasswordResetEmail"
+	outboxPasswordChangedEmail         = "SendPasswordChangedEmail"
+	outboxEmailChangeConfirmationEmail = "SendEmailChangeConfirmationEmail"
+	outboxEmailChangeNoticeEmail       = "SendEmailChangeNoticeEmail"
+	outboxAccountLockedEmail           = "SendAccountLockedEmail"
+	outboxRecoveryCodeUsedEmail        = "SendRecoveryCodeUsedEmail"
+	outboxMagicLinkEmail               = "SendMagicLinkEmail"
+)
+
+// max number of messages claimed at once, and how long each may take to be
+// delivered. the lease covers delivering a whole batch
+const (
+	outboxBatchSize   = 10
+	outboxSendTimeout = 5 * time.Second
+	outboxLease       = 2 * outboxBatchSize * outboxSendTimeout
+)
+
+// failed deliveries are retried at most this far apart
+const maxOutboxBackoff = time.Hour
+
+// dead messages are kept this long for inspection
+const outboxDeadRetention = 7 * 24 * time.Hour
+
+// errUnknownOutboxKind is never retried, no later attempt would know the kind either
+var errUnknownOutboxKind = errors.New("unknown outbox message kind")
+
+// outboxSender delivers the encoded payload of an outbox message
+type outboxSender func(ctx context.Context, payload []byte) error
+
+// sendEmail adapts a notifications service method to an outboxSender
+func sendEmail[T any](send func(context.Context, *T, ...grpc.CallOption) (*notifications.SendEmailResponse, error)) outboxSender {
+	return func(ctx context.Context, payload []byte) error {
+		var req T
+
+		err := json.Unmarshal(payload, &req)
+		if err != nil {
+			return err
+		}
+
+		_, err = send(ctx, &req)
+		return err
+	}
+}
+
+func (app *application) outboxSenders() map[string]outboxSender {
+	return map[string]outboxSender{
+		outboxActivationEmail:              sendEmail(app.notifier.SendActivationEmail),
+		outboxPasswordResetEmail:           sendEmail(app.notifier.SendPasswordResetEmail),
+		outboxPasswordChangedEmail:         sendEmail(app.notifier.SendPasswordChangedEmail),
+		outboxEmailChangeConfirmationEmail: sendEmail(app.notifier.SendEmailChangeConfirmationEmail),
+		outboxEmailChangeNoticeEmail:       sendEmail(app.notifier.SendEmailChangeNoticeEmail),
+		outboxAccountLockedEmail:           sendEmail(app.notifier.SendAccountLockedEmail),
+		outboxRecoveryCodeUsedEmail:        sendEmail(app.notifier.SendRecoveryCodeUsedEmail),
+		outboxMagicLinkEmail:               sendEmail(app.notifier.SendMagicLinkEmail),
+	}
+}
+
+// newEphemeralCipher returns a cipher with a random key, for development
+func newEphemeralCipher() (cipher.AEAD, error) {
+	key, err := randomKey()
+	if err != nil {
+		return nil, err
+	}
+
+	return newSecretsCipher("outbox encryption", hex.EncodeToString(key))
+}
+
+// newOutboxMessage returns a message about the user with the payload encrypted
+// by the outbox key
+func (app *application) newOutboxMessage(kind string, userId int64, req any) (*data.OutboxMessage, error) {
+	return data.NewOutboxMessage(app.outboxCipher, kind, userId, req)
+}
+
+// enqueueEmail writes an email about the user that doesn't go along with a
+// change of this service's own data
+func (app *application) enqueueEmail(kind string, userId int64, req any) error {
+	message, err := app.newOutboxMessage(kind, userId, req)
+	if err != nil {
+		return err
+	}
+
+	return app.models.Outbox.Enqueue(message)
+}
+
+// dispatchOutbox delivers due outbox messages until the server stops. a batch
+// as large as the limit means more may be due, so it goes on without waiting
+func (app *application) dispatchOutbox() {
+	ticker := time.NewTicker(app.config.outbox.pollInterval)
+	defer ticker.Stop()
+
+	senders := app.outboxSenders()
+
+	for {
+		for app.dispatchDueMessages(senders) == outboxBatchSize {
+		}
+
+		<-ticker.C
+	}
+}
+
+func (app *application) dispatchDueMessages(senders map[string]outboxSender) int {
+	messages, err := app.models.Outbox.ClaimDue(outboxBatchSize, outboxLease)
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return 0
+	}
+
+	for _, message := range messages {
+		app.deliver(senders, message)
+	}
+
+	return len(messages)
+}
+
+func (app *application) deliver(senders map[string]outboxSender, message *data.OutboxMessage) {
+	properties := map[string]string{
+		"outbox_id":       strconv.FormatInt(message.ID, 10),
+		"kind":            message.Kind,
+		"idempotency_key": message.IdempotencyKey,
+	}
+
+	send, ok := senders[message.Kind]
+	if !ok {
+		app.buryOutboxMessage(message, errUnknownOutboxKind, properties)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), outboxSendTimeout)
+	defer cancel()
+
+	ctx = metadata.AppendToOutgoingContext(ctx, "idempotency-key", message.IdempotencyKey)
+
+	// no later attempt would decrypt it either, e.g. after the key changed
+	payload, err := message.OpenPayload(app.outboxCipher)
+	if err != nil {
+		app.buryOutboxMessage(message, err, properties)
+		return
+	}
+
+	err = send(ctx, payload)
+	if err != nil {
+		var syntaxErr *json.SyntaxError
+		var unmarshalErr *json.UnmarshalTypeError
+
+		switch {
+		case errors.As(err, &syntaxErr), errors.As(err, &unmarshalErr):
+			app.buryOutboxMessage(message, err, properties)
+		case message.Attempts+1 >= app.config.outbox.maxAttempts:
+			app.buryOutboxMessage(message, err, properties)
+		default:
+			err = app.models.Outbox.Fail(message, err.Error(), time.Now().Add(app.outboxBackoff(message.Attempts+1)))
+			if err != nil {
+				app.logger.PrintError(err, properties)
+			}
+		}
+		return
+	}
+
+	// failing here only means the message is delivered again, which the
+	// idempotency key makes harmless
+	err = app.models.Outbox.Delete(message.ID)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.logger.PrintError(err, properties)
+	}
+}
+
+func (app *application) buryOutboxMessage(message *data.OutboxMessage, cause error, properties map[string]string) {
+	err := app.models.Outbox.Bury(message, cause.Error())
+	if err != nil {
+		app.logger.PrintError(err, properties)
+		return
+	}
+
+	properties["attempts"] = strconv.Itoa(message.Attempts)
+	app.logger.PrintError(cause, properties)
+}
+
+// purgeDeadOutboxMessages deletes the dead messages past their retention,
+// periodically
+func (app *application) purgeDeadOutboxMessages() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		err := app.models.Outbox.DeleteDead(time.Now().Add(-outboxDeadRetention))
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+	}
+}
+
+// outboxBackoff returns the delay after the given number of failed attempts
+func (app *application) outboxBackoff(attempts int) time.Duration {
+	backoff := app.config.outbox.backoff * time.Duration(math.Pow(2, float64(attempts-1)))
+	if backoff <= 0 || backoff > maxOutboxBackoff {
+		return maxOutboxBackoff
+	}
+
+	return backoff
+}
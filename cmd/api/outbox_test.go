@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/saarwasserman/users/internal/data"
+)
+
+func TestOutboxBackoff(t *testing.T) {
+	app := &application{}
+	app.config.outbox.backoff = time.Second
+
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{attempts: 1, want: time.Second},
+		{attempts: 2, want: 2 * time.Second},
+		{attempts: 5, want: 16 * time.Second},
+		{attempts: 13, want: maxOutboxBackoff},
+		// overflows
+		{attempts: 100, want: maxOutboxBackoff},
+	}
+
+	for _, tt := range tests {
+		if got := app.outboxBackoff(tt.attempts); got != tt.want {
+			t.Errorf("outboxBackoff(%d) = %s, want %s", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+func TestDeliver(t *testing.T) {
+	type payload struct {
+		Token string
+	}
+
+	// enqueue writes a message and returns it along with the outbox
+	enqueue := func(t *testing.T, app *application, kind string) (*fakeOutbox, *data.OutboxMessage) {
+		t.Helper()
+
+		app.config.outbox.maxAttempts = 3
+		app.config.outbox.backoff = time.Second
+
+		err := app.enqueueEmail(kind, 1, &payload{Token: "activation-1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		outbox := app.models.Outbox.(*fakeOutbox)
+		return outbox, outbox.Get(1)
+	}
+
+	t.Run("Delivers", func(t *testing.T) {
+		app, _ := newTestApplication(t)
+		outbox, message := enqueue(t, app, outboxActivationEmail)
+
+		var got payload
+
+		senders := map[string]outboxSender{
+			outboxActivationEmail: func(ctx context.Context, encoded []byte) error {
+				return json.Unmarshal(encoded, &got)
+			},
+		}
+
+		if app.dispatchDueMessages(senders) != 1 {
+			t.Fatal("want one message dispatched")
+		}
+
+		if got.Token != "activation-1" {
+			t.Fatalf("got token %q, want the decrypted payload", got.Token)
+		}
+
+		if outbox.Get(message.ID) != nil {
+			t.Fatal("delivered message was not deleted")
+		}
+	})
+
+	t.Run("Encrypted", func(t *testing.T) {
+		app, _ := newTestApplication(t)
+		_, message := enqueue(t, app, outboxActivationEmail)
+
+		if json.Valid(message.Payload) {
+			t.Fatal("payload is stored in plaintext")
+		}
+	})
+
+	t.Run("Retries", func(t *testing.T) {
+		app, _ := newTestApplication(t)
+		_, message := enqueue(t, app, outboxActivationEmail)
+
+		senders := map[string]outboxSender{
+			outboxActivationEmail: func(ctx context.Context, encoded []byte) error {
+				return errors.New("notifications is down")
+			},
+		}
+
+		app.dispatchDueMessages(senders)
+
+		if message.Status != data.OutboxPending || message.Attempts != 1 {
+			t.Fatalf("got %s after %d attempts, want pending after 1", message.Status, message.Attempts)
+		}
+
+		if message.NextAttemptAt.Before(time.Now()) {
+			t.Fatal("retry was not postponed")
+		}
+
+		app.dispatchDueMessages(senders)
+		app.dispatchDueMessages(senders)
+
+		if message.Status != data.OutboxDead || message.Attempts != 3 {
+			t.Fatalf("got %s after %d attempts, want dead after 3", message.Status, message.Attempts)
+		}
+
+		if message.Payload != nil {
+			t.Fatal("dead message kept its payload")
+		}
+	})
+
+	t.Run("UnknownKind", func(t *testing.T) {
+		app, _ := newTestApplication(t)
+		_, message := enqueue(t, app, "SendCarrierPigeon")
+
+		app.dispatchDueMessages(map[string]outboxSender{})
+
+		if message.Status != data.OutboxDead {
+			t.Fatalf("got %s, want dead", message.Status)
+		}
+	})
+
+	t.Run("Undecryptable", func(t *testing.T) {
+		app, _ := newTestApplication(t)
+		_, message := enqueue(t, app, outboxActivationEmail)
+
+		// the key changed since the message was written
+		var err error
+
+		app.outboxCipher, err = newEphemeralCipher()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		senders := map[string]outboxSender{
+			outboxActivationEmail: func(ctx context.Context, encoded []byte) error {
+				t.Fatal("undecryptable message was sent")
+				return nil
+			},
+		}
+
+		app.dispatchDueMessages(senders)
+
+		if message.Status != data.OutboxDead {
+			t.Fatalf("got %s, want dead", message.Status)
+		}
+	})
+}
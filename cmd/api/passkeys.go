@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"strconv"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/saarwasserman/users/internal/data"
+	"github.com/saarwasserman/users/internal/validator"
+	"github.com/saarwasserman/users/internal/webauthn"
+	"github.com/saarwasserman/users/protogen/users"
+)
+
+// time the client has to answer a passkey challenge
+const passkeyChallengeTTL = 5 * time.Minute
+
+const invalidPasskeyMessage = "invalid passkey"
+
+// userHandle identifies the user to authenticators, it is handed back on
+// sign-in with a discoverable credential
+func userHandle(userId int64) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(userId))
+}
+
+// deleteExpiredPasskeyChallenges periodically drops the challenges of
+// ceremonies that were never finished
+func (app *application) deleteExpiredPasskeyChallenges() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		err := app.models.Passkeys.DeleteExpiredChallenges()
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+	}
+}
+
+func (app *application) BeginPasskeyRegistration(ctx context.Context, req *users.BeginPasskeyRegistrationRequest) (*users.BeginPasskeyRegistrationResponse, error) {
+	user, err := app.models.Users.GetByUserIdContext(ctx, app.contextGetUserId(ctx))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return nil, status.Error(codes.NotFound, "user not found")
+		default:
+			return nil, queryError(err)
+		}
+	}
+
+	challenge, err := webauthn.NewChallenge()
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	err = app.models.Passkeys.InsertChallenge(challenge, data.CeremonyRegistration, user.ID, passkeyChallengeTTL)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	// authenticators refuse to register a second passkey for the same account
+	passkeys, err := app.models.Passkeys.GetAllForUser(user.ID)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	res := &users.BeginPasskeyRegistrationResponse{
+		Challenge:       challenge,
+		RpId:            app.webauthn.ID,
+		RpName:          app.webauthn.Name,
+		UserHandle:      userHandle(user.ID),
+		UserName:        user.Email,
+		UserDisplayName: user.Name,
+		TimeoutMs:       passkeyChallengeTTL.Milliseconds(),
+	}
+
+	for _, alg := range webauthn.SupportedAlgorithms {
+		res.Algorithms = append(res.Algorithms, int32(alg))
+	}
+
+	for _, passkey := range passkeys {
+		res.ExcludeCredentialIds = append(res.ExcludeCredentialIds, passkey.CredentialID)
+	}
+
+	return res, nil
+}
+
+func (app *application) FinishPasskeyRegistration(ctx context.Context, req *users.FinishPasskeyRegistrationRequest) (*users.FinishPasskeyRegistrationResponse, error) {
+	userId := app.contextGetUserId(ctx)
+
+	v := validator.New()
+
+	v.Check(len(req.ClientDataJson) > 0, "client_data_json", "must be provided")
+	v.Check(len(req.AttestationObject) > 0, "attestation_object", "must be provided")
+	v.Check(len(req.Name) <= 100, "name", "must not be more than 100 bytes long")
+
+	if !v.Valid() {
+		return nil, status.Errorf(codes.InvalidArgument, "error %s", v.Errors)
+	}
+
+	challenge, err := webauthn.ParseChallenge(req.ClientDataJson)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	err = app.models.Passkeys.ConsumeChallenge(challenge, data.CeremonyRegistration, userId)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return nil, status.Error(codes.FailedPrecondition, "passkey challenge is invalid or expired")
+		default:
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	credential, err := app.webauthn.VerifyRegistration(challenge, req.ClientDataJson, req.AttestationObject)
+	if err != nil {
+		switch {
+		case errors.Is(err, webauthn.ErrVerification):
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		default:
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	passkey := &data.Passkey{
+		UserID:       userId,
+		CredentialID: credential.ID,
+		PublicKey:    credential.PublicKey,
+		SignCount:    credential.SignCount,
+		Name:         req.Name,
+	}
+
+	if passkey.Name == "" {
+		passkey.Name = "passkey"
+	}
+
+	err = app.models.Passkeys.Insert(passkey)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicatePasskey):
+			return nil, status.Error(codes.AlreadyExists, "passkey is already registered")
+		default:
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	return &users.FinishPasskeyRegistrationResponse{
+		CredentialId: passkey.CredentialID,
+	}, nil
+}
+
+// BeginPasskeyLogin starts a sign-in with a discoverable credential, the user
+// is picked on the authenticator and only known once it answers
+func (app *application) BeginPasskeyLogin(ctx context.Context, req *users.BeginPasskeyLoginRequest) (*users.BeginPasskeyLoginResponse, error) {
+	challenge, err := webauthn.NewChallenge()
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	err = app.models.Passkeys.InsertChallenge(challenge, data.CeremonyAuthentication, 0, passkeyChallengeTTL)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &users.BeginPasskeyLoginResponse{
+		Challenge: challenge,
+		RpId:      app.webauthn.ID,
+		TimeoutMs: passkeyChallengeTTL.Milliseconds(),
+	}, nil
+}
+
+// FinishPasskeyLogin starts a session like Login does. a passkey verifies the
+// user on the authenticator, so it stands in for the password and the second
+// factor alike
+func (app *application) FinishPasskeyLogin(ctx context.Context, req *users.FinishPasskeyLoginRequest) (*users.LoginResponse, error) {
+	v := validator.New()
+
+	v.Check(len(req.CredentialId) > 0, "credential_id", "must be provided")
+	v.Check(len(req.ClientDataJson) > 0, "client_data_json", "must be provided")
+	v.Check(len(req.AuthenticatorData) > 0, "authenticator_data", "must be provided")
+	v.Check(len(req.Signature) > 0, "signature", "must be provided")
+	v.Check(len(req.UserHandle) == 8, "user_handle", "must be 8 bytes long")
+
+	if !v.Valid() {
+		return nil, status.Errorf(codes.InvalidArgument, "error %s", v.Errors)
+	}
+
+	challenge, err := webauthn.ParseChallenge(req.ClientDataJson)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	err = app.models.Passkeys.ConsumeChallenge(challenge, data.CeremonyAuthentication, 0)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return nil, status.Error(codes.Unauthenticated, "passkey challenge is invalid or expired")
+		default:
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	userId := int64(binary.BigEndian.Uint64(req.UserHandle))
+
+	passkey, err := app.models.Passkeys.Get(userId, req.CredentialId)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return nil, status.Error(codes.Unauthenticated, invalidPasskeyMessage)
+		default:
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	signCount, err := app.webauthn.VerifyAssertion(&webauthn.Credential{
+		ID:        passkey.CredentialID,
+		PublicKey: passkey.PublicKey,
+		SignCount: passkey.SignCount,
+	}, challenge, req.ClientDataJson, req.AuthenticatorData, req.Signature)
+	if err != nil {
+		switch {
+		case errors.Is(err, webauthn.ErrVerification):
+			app.logger.PrintInfo("passkey login rejected", map[string]string{
+				"user_id": strconv.FormatInt(userId, 10),
+				"reason":  err.Error(),
+			})
+			return nil, status.Error(codes.Unauthenticated, invalidPasskeyMessage)
+		default:
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	err = app.models.Passkeys.UpdateSignCount(passkey, signCount)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			return nil, status.Error(codes.Unauthenticated, invalidPasskeyMessage)
+		default:
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	user, err := app.models.Users.GetByUserIdContext(ctx, userId)
+	if errors.Is(err, data.ErrRecordNotFound) {
+		user, err = app.models.Users.GetPendingDeletionContext(ctx, userId, time.Now().Add(-app.config.deletion.gracePeriod))
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return nil, status.Error(codes.Unauthenticated, invalidPasskeyMessage)
+		default:
+			return nil, queryError(err)
+		}
+	}
+
+	if !user.Activated {
+		return nil, status.Error(codes.PermissionDenied, "your user account must be activated to login")
+	}
+
+	return app.completeLogin(ctx, user)
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/saarwasserman/users/internal/webauthn"
+	"github.com/saarwasserman/users/protogen/users"
+)
+
+const passkeyTestOrigin = "https://dinghy.test"
+
+// passkeyTestAuthenticator is a software ES256 authenticator verifying its
+// user, answering the ceremonies like a platform authenticator would
+type passkeyTestAuthenticator struct {
+	t            *testing.T
+	key          *ecdsa.PrivateKey
+	credentialId []byte
+	signCount    uint32
+}
+
+func newPasskeyTestAuthenticator(t *testing.T) *passkeyTestAuthenticator {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	credentialId := make([]byte, 16)
+	rand.Read(credentialId)
+
+	return &passkeyTestAuthenticator{t: t, key: key, credentialId: credentialId}
+}
+
+func (a *passkeyTestAuthenticator) clientData(ceremony string, challenge []byte) []byte {
+	clientDataJSON, err := json.Marshal(map[string]any{
+		"type":      ceremony,
+		"challenge": base64.RawURLEncoding.EncodeToString(challenge),
+		"origin":    passkeyTestOrigin,
+	})
+	if err != nil {
+		a.t.Fatal(err)
+	}
+
+	return clientDataJSON
+}
+
+// authenticatorData has the user present and verified flags set, and the
+// attested credential data flag when attested is given
+func (a *passkeyTestAuthenticator) authenticatorData(rpId string, attested []byte) []byte {
+	rpIdHash := sha256.Sum256([]byte(rpId))
+
+	flags := byte(0x01 | 0x04)
+	if attested != nil {
+		flags |= 0x40
+	}
+
+	authData := append(rpIdHash[:], flags)
+	authData = binary.BigEndian.AppendUint32(authData, a.signCount)
+
+	return append(authData, attested...)
+}
+
+func (a *passkeyTestAuthenticator) create(rpId string, challenge []byte) *users.FinishPasskeyRegistrationRequest {
+	x := make([]byte, 32)
+	y := make([]byte, 32)
+	a.key.X.FillBytes(x)
+	a.key.Y.FillBytes(y)
+
+	publicKey, err := cbor.Marshal(map[int]any{1: 2, 3: webauthn.AlgES256, -1: 1, -2: x, -3: y})
+	if err != nil {
+		a.t.Fatal(err)
+	}
+
+	attested := make([]byte, 16) // zero aaguid
+	attested = binary.BigEndian.AppendUint16(attested, uint16(len(a.credentialId)))
+	attested = append(attested, a.credentialId...)
+	attested = append(attested, publicKey...)
+
+	attestation, err := cbor.Marshal(map[string]any{
+		"fmt":      "none",
+		"attStmt":  map[string]any{},
+		"authData": a.authenticatorData(rpId, attested),
+	})
+	if err != nil {
+		a.t.Fatal(err)
+	}
+
+	return &users.FinishPasskeyRegistrationRequest{
+		ClientDataJson:    a.clientData("webauthn.create", challenge),
+		AttestationObject: attestation,
+		Name:              "laptop",
+	}
+}
+
+func (a *passkeyTestAuthenticator) get(rpId string, challenge []byte, handle []byte) *users.FinishPasskeyLoginRequest {
+	a.signCount++
+
+	clientDataJSON := a.clientData("webauthn.get", challenge)
+	authData := a.authenticatorData(rpId, nil)
+
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		a.t.Fatal(err)
+	}
+
+	return &users.FinishPasskeyLoginRequest{
+		CredentialId:      a.credentialId,
+		ClientDataJson:    clientDataJSON,
+		AuthenticatorData: authData,
+		Signature:         signature,
+		UserHandle:        handle,
+	}
+}
+
+// registerPasskey runs the registration ceremony for the user of the context
+func registerPasskey(t *testing.T, app *application, ctx context.Context, authenticator *passkeyTestAuthenticator) *users.BeginPasskeyRegistrationResponse {
+	t.Helper()
+
+	begin, err := app.BeginPasskeyRegistration(ctx, &users.BeginPasskeyRegistrationRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = app.FinishPasskeyRegistration(ctx, authenticator.create(begin.RpId, begin.Challenge))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return begin
+}
+
+func TestPasskeyRegistration(t *testing.T) {
+	t.Run("Register", func(t *testing.T) {
+		app, fake := newTestApplication(t)
+		user, ctx := insertTestUser(t, app, fake)
+
+		authenticator := newPasskeyTestAuthenticator(t)
+		begin := registerPasskey(t, app, ctx, authenticator)
+
+		if begin.RpId != "dinghy.test" || begin.UserName != user.Email || len(begin.ExcludeCredentialIds) != 0 {
+			t.Fatalf("got options %+v, want them for %s on dinghy.test", begin, user.Email)
+		}
+
+		// the registered passkey is excluded from further registrations
+		begin, err := app.BeginPasskeyRegistration(ctx, &users.BeginPasskeyRegistrationRequest{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(begin.ExcludeCredentialIds) != 1 || string(begin.ExcludeCredentialIds[0]) != string(authenticator.credentialId) {
+			t.Fatal("the registered passkey is not excluded")
+		}
+
+		// registering it again anyway
+		_, err = app.FinishPasskeyRegistration(ctx, authenticator.create(begin.RpId, begin.Challenge))
+		if status.Code(err) != codes.AlreadyExists {
+			t.Fatalf("got %v, want AlreadyExists", err)
+		}
+	})
+
+	t.Run("OtherUsersChallenge", func(t *testing.T) {
+		app, fake := newTestApplication(t)
+		_, ctx := insertTestUser(t, app, fake)
+
+		begin, err := app.BeginPasskeyRegistration(ctx, &users.BeginPasskeyRegistrationRequest{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		other := app.contextSetUserId(context.Background(), 100)
+
+		_, err = app.FinishPasskeyRegistration(other, newPasskeyTestAuthenticator(t).create(begin.RpId, begin.Challenge))
+		if status.Code(err) != codes.FailedPrecondition {
+			t.Fatalf("got %v, want FailedPrecondition", err)
+		}
+	})
+
+	t.Run("OtherRelyingParty", func(t *testing.T) {
+		app, fake := newTestApplication(t)
+		_, ctx := insertTestUser(t, app, fake)
+
+		begin, err := app.BeginPasskeyRegistration(ctx, &users.BeginPasskeyRegistrationRequest{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = app.FinishPasskeyRegistration(ctx, newPasskeyTestAuthenticator(t).create("evil.test", begin.Challenge))
+		if status.Code(err) != codes.InvalidArgument {
+			t.Fatalf("got %v, want InvalidArgument", err)
+		}
+	})
+}
+
+func TestPasskeyLogin(t *testing.T) {
+	t.Run("Login", func(t *testing.T) {
+		app, fake := newTestApplication(t)
+		user, ctx := insertTestUser(t, app, fake)
+
+		authenticator := newPasskeyTestAuthenticator(t)
+		registerPasskey(t, app, ctx, authenticator)
+
+		// a passkey stands in for the second factor too
+		enrollTOTP(t, app, ctx)
+
+		begin, err := app.BeginPasskeyLogin(context.Background(), &users.BeginPasskeyLoginRequest{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		answer := authenticator.get(begin.RpId, begin.Challenge, userHandle(user.ID))
+
+		res, err := app.FinishPasskeyLogin(context.Background(), answer)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if res.MfaRequired {
+			t.Fatal("a passkey login asked for a second factor")
+		}
+
+		_, err = app.getSession(context.Background(), res.TokenPlaintext)
+		if err != nil {
+			t.Fatalf("no session was started: %v", err)
+		}
+
+		// the challenge is single use
+		_, err = app.FinishPasskeyLogin(context.Background(), answer)
+		if status.Code(err) != codes.Unauthenticated {
+			t.Fatalf("got %v, want the answer replayed refused", err)
+		}
+	})
+
+	t.Run("OtherUsersHandle", func(t *testing.T) {
+		app, fake := newTestApplication(t)
+		user, ctx := insertTestUser(t, app, fake)
+
+		authenticator := newPasskeyTestAuthenticator(t)
+		registerPasskey(t, app, ctx, authenticator)
+
+		begin, err := app.BeginPasskeyLogin(context.Background(), &users.BeginPasskeyLoginRequest{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = app.FinishPasskeyLogin(context.Background(), authenticator.get(begin.RpId, begin.Challenge, userHandle(user.ID+1)))
+		if status.Code(err) != codes.Unauthenticated {
+			t.Fatalf("got %v, want Unauthenticated", err)
+		}
+	})
+
+	t.Run("UnknownKey", func(t *testing.T) {
+		app, fake := newTestApplication(t)
+		user, ctx := insertTestUser(t, app, fake)
+
+		authenticator := newPasskeyTestAuthenticator(t)
+		registerPasskey(t, app, ctx, authenticator)
+
+		begin, err := app.BeginPasskeyLogin(context.Background(), &users.BeginPasskeyLoginRequest{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the registered credential id signed with another key
+		impostor := newPasskeyTestAuthenticator(t)
+		impostor.credentialId = authenticator.credentialId
+
+		_, err = app.FinishPasskeyLogin(context.Background(), impostor.get(begin.RpId, begin.Challenge, userHandle(user.ID)))
+		if status.Code(err) != codes.Unauthenticated {
+			t.Fatalf("got %v, want Unauthenticated", err)
+		}
+	})
+}
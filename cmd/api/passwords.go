@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	"github.com/saarwasserman/users/internal/data"
+	"github.com/saarwasserman/users/internal/validator"
+	"github.com/saarwasserman/users/protogen/auth"
+	"github.com/saarwasserman/users/protogen/notifications"
+	"github.com/saarwasserman/users/protogen/users"
+)
+
+const passwordResetTokenTTL = 45 * time.Minute
+
+// same cost the auth service uses for stored password hashes, so a dummy
+// comparison takes roughly as long as a real one
+const passwordHashCost = 12
+
+type passwordVerifier interface {
+	Verify(ctx context.Context, userId int64, password string) (bool, error)
+}
+
+type authPasswordVerifier struct {
+	client auth.AuthenticationClient
+}
+
+func (v authPasswordVerifier) Verify(ctx context.Context, userId int64, password string) (bool, error) {
+	res, err := v.client.CheckPassword(ctx, &auth.CheckPasswordRequest{
+		UserId:   userId,
+		Password: password,
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return res.Matches, nil
+}
+
+var dummyPasswordHash []byte
+
+func init() {
+	hash, err := bcrypt.GenerateFromPassword([]byte("dummy-password-for-timing"), passwordHashCost)
+	if err != nil {
+		panic(err)
+	}
+
+	dummyPasswordHash = hash
+}
+
+// dummyPasswordCheck burns the same amount of time as a real password check.
+// used when there is no account to check against so response times don't
+// reveal which emails are registered
+func dummyPasswordCheck(password string) {
+	_ = bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+}
+
+func (app *application) RequestPasswordReset(ctx context.Context, req *users.RequestPasswordResetRequest) (*users.RequestPasswordResetResponse, error) {
+	v := validator.New()
+
+	if data.ValidateEmail(v, req.Email); !v.Valid() {
+		return nil, status.Errorf(codes.InvalidArgument, "error %s", v.Errors)
+	}
+
+	// the lookup and the email are done in the background so neither the
+	// response nor its timing tell the caller whether the email is registered
+	app.background(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		user, err := app.models.Users.GetByEmailContext(ctx, req.Email)
+		if err != nil {
+			if !errors.Is(err, data.ErrRecordNotFound) {
+				app.logger.PrintError(err, nil)
+			}
+			return
+		}
+
+		if !user.Activated {
+			return
+		}
+
+		tokenResponse, err := app.auth.CreateToken(ctx, &auth.TokenCreationRequest{
+			Scope:  data.ScopePasswordReset,
+			UserId: user.ID,
+			Ttl:    durationpb.New(passwordResetTokenTTL),
+		})
+		if err != nil {
+			app.logger.PrintError(err, nil)
+			return
+		}
+
+		err = app.enqueueEmail(outboxPasswordResetEmail, user.ID, &notifications.SendPasswordResetEmailRequest{
+			Recipient: user.Email,
+			UserId:    strconv.FormatInt(user.ID, 10),
+			Token:     tokenResponse.TokenPlaintext,
+		})
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+	})
+
+	return &users.RequestPasswordResetResponse{
+		Message: "an email will be sent to you containing password reset instructions",
+	}, nil
+}
+
+func (app *application) ResetPassword(ctx context.Context, req *users.ResetPasswordRequest) (*users.ResetPasswordResponse, error) {
+	v := validator.New()
+
+	data.ValidatePlaintextPassword(v, req.Password)
+	data.ValidateTokenPlaintext(v, req.TokenPlaintext)
+
+	if !v.Valid() {
+		return nil, status.Errorf(codes.InvalidArgument, "error %s", v.Errors)
+	}
+
+	authRes, err := app.auth.Authenticate(ctx, &auth.AuthenticationRequest{
+		TokenScope:     data.ScopePasswordReset,
+		TokenPlaintext: req.TokenPlaintext,
+	})
+	if err != nil {
+		switch {
+		case isInvalidTokenError(err):
+			v.AddError("token", "invalid or expired password reset token")
+			return nil, status.Errorf(codes.InvalidArgument, "error %s", v.Errors)
+		default:
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	user, err := app.models.Users.GetByUserIdContext(ctx, authRes.UserId)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired password reset token")
+			return nil, status.Errorf(codes.InvalidArgument, "error %s", v.Errors)
+		default:
+			return nil, queryError(err)
+		}
+	}
+
+	_, err = app.auth.SetPassword(ctx, &auth.SetPasswordRequest{
+		UserId:   user.ID,
+		Password: req.Password,
+	})
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to set new password")
+	}
+
+	// the reset token is single use, and whoever held the old password must
+	// not keep a session after the owner took the account back
+	for _, scope := range []string{data.ScopePasswordReset, data.ScopeAuthentication} {
+		_, err = app.auth.DeleteAllTokensForUser(ctx, &auth.TokensDeletionRequest{
+			Scope:  scope,
+			UserId: user.ID,
+		})
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	err = app.models.Sessions.DeleteAllForUser(user.ID, 0)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &users.ResetPasswordResponse{
+		Message: "your password was successfully reset",
+	}, nil
+}
+
+func (app *application) ChangePassword(ctx context.Context, req *users.ChangePasswordRequest) (*users.ChangePasswordResponse, error) {
+	userId := app.contextGetUserId(ctx)
+
+	v := validator.New()
+
+	v.Check(req.CurrentPassword != "", "current_password", "must be provided")
+	data.ValidatePlaintextPassword(v, req.NewPassword)
+	v.Check(req.NewPassword != req.CurrentPassword, "password", "must be different from the current password")
+
+	if !v.Valid() {
+		return nil, status.Errorf(codes.InvalidArgument, "error %s", v.Errors)
+	}
+
+	user, err := app.models.Users.GetByUserIdContext(ctx, userId)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return nil, status.Error(codes.Internal, "user not found")
+		default:
+			return nil, queryError(err)
+		}
+	}
+
+	match, err := app.passwords.Verify(ctx, user.ID, req.CurrentPassword)
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return nil, status.Error(codes.Internal, "failed to verify credentials")
+	}
+
+	if !match {
+		v.AddError("current_password", "is incorrect")
+		return nil, status.Errorf(codes.InvalidArgument, "error %s", v.Errors)
+	}
+
+	_, err = app.auth.SetPassword(ctx, &auth.SetPasswordRequest{
+		UserId:   user.ID,
+		Password: req.NewPassword,
+	})
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to set new password")
+	}
+
+	res := &users.ChangePasswordResponse{
+		Message: "your password was changed",
+	}
+
+	// whoever may have known the old password is signed out everywhere, the
+	// caller included, and the caller gets a fresh token to carry on with
+	if req.RevokeOtherSessions {
+		session, err := app.models.Sessions.Get(app.contextGetSessionId(ctx))
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+
+		err = app.models.Sessions.DeleteAllForUser(user.ID, session.ID)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+
+		res.TokenPlaintext, err = app.rotateAccessToken(ctx, session)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	// the password is changed already, a lost notice is not worth failing for
+	err = app.enqueueEmail(outboxPasswordChangedEmail, user.ID, &notifications.SendPasswordChangedEmailRequest{
+		Recipient: user.Email,
+		UserId:    strconv.FormatInt(user.ID, 10),
+	})
+	if err != nil {
+		app.logger.PrintError(err, nil)
+	}
+
+	return res, nil
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/saarwasserman/users/internal/data"
+	"github.com/saarwasserman/users/protogen/auth"
+	"github.com/saarwasserman/users/protogen/notifications"
+	"github.com/saarwasserman/users/protogen/users"
+)
+
+// checkTestPassword reports whether password is the one the auth service
+// holds for the user
+func checkTestPassword(t *testing.T, fake *fakeAuth, userId int64, password string) bool {
+	t.Helper()
+
+	res, err := fake.CheckPassword(context.Background(), &auth.CheckPasswordRequest{UserId: userId, Password: password})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return res.Matches
+}
+
+func TestPasswordReset(t *testing.T) {
+	t.Run("Reset", func(t *testing.T) {
+		app, fake := newTestApplication(t)
+		outbox := app.models.Outbox.(*fakeOutbox)
+
+		user, _ := insertTestUser(t, app, fake)
+		_, session := startTestSession(t, app, user.ID)
+
+		_, err := app.RequestPasswordReset(context.Background(), &users.RequestPasswordResetRequest{Email: user.Email})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		waitFor(t, func() bool { return outbox.Get(1) != nil })
+
+		message := outbox.Get(1)
+		if message.Kind != outboxPasswordResetEmail || message.UserID != user.ID {
+			t.Fatalf("got %s for user %d, want a password reset email for user %d", message.Kind, message.UserID, user.ID)
+		}
+
+		var payload notifications.SendPasswordResetEmailRequest
+		openOutboxPayload(t, app, message, &payload)
+
+		if payload.Recipient != user.Email {
+			t.Errorf("got recipient %q, want %q", payload.Recipient, user.Email)
+		}
+
+		req := &users.ResetPasswordRequest{TokenPlaintext: payload.Token, Password: "n3w-pa55word"}
+
+		_, err = app.ResetPassword(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !checkTestPassword(t, fake, user.ID, "n3w-pa55word") {
+			t.Error("the new password doesn't match")
+		}
+
+		// whoever held the old password is signed out
+		_, err = app.models.Sessions.Get(session.ID)
+		if err != data.ErrRecordNotFound {
+			t.Errorf("got %v for the old session, want %v", err, data.ErrRecordNotFound)
+		}
+
+		// the token is single use
+		req.Password = "an0ther-pa55word"
+		_, err = app.ResetPassword(context.Background(), req)
+		if status.Code(err) != codes.InvalidArgument {
+			t.Errorf("got %v reusing the token, want %v", err, codes.InvalidArgument)
+		}
+	})
+
+	t.Run("NotActivated", func(t *testing.T) {
+		app, _ := newTestApplication(t)
+		outbox := app.models.Outbox.(*fakeOutbox)
+
+		ctx := context.Background()
+
+		user := &data.User{Name: "Alice", Email: "alice@dinghy.test"}
+		err := app.models.Users.InsertContext(ctx, user)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := app.RequestPasswordReset(ctx, &users.RequestPasswordResetRequest{Email: user.Email})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the response doesn't tell an unknown email from a known one
+		unknown, err := app.RequestPasswordReset(ctx, &users.RequestPasswordResetRequest{Email: "carol@dinghy.test"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if res.Message != unknown.Message {
+			t.Errorf("got %q and %q, want the same message", res.Message, unknown.Message)
+		}
+
+		// bob is activated, so once his reset email is queued alice's
+		// lookup has had the same chance to queue one
+		bob := &data.User{Name: "Bob", Email: "bob@dinghy.test", Activated: true}
+		err = app.models.Users.InsertContext(ctx, bob)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = app.RequestPasswordReset(ctx, &users.RequestPasswordResetRequest{Email: bob.Email})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		waitFor(t, func() bool {
+			messages, _ := outbox.GetAllForUser(bob.ID)
+			return len(messages) == 1
+		})
+
+		messages, err := outbox.GetAllForUser(user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(messages) != 0 {
+			t.Errorf("got %d emails for an account that isn't activated, want none", len(messages))
+		}
+	})
+
+	t.Run("InvalidToken", func(t *testing.T) {
+		app, fake := newTestApplication(t)
+
+		user, ctx := insertTestUser(t, app, fake)
+
+		// a token of another scope doesn't reset the password
+		activation, err := fake.CreateToken(ctx, &auth.TokenCreationRequest{Scope: data.ScopeActivation, UserId: user.ID})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, token := range []string{activation.TokenPlaintext, "ABCDEFGHIJKLMNOPQRSTUVWXYZ"} {
+			_, err = app.ResetPassword(context.Background(), &users.ResetPasswordRequest{TokenPlaintext: token, Password: "n3w-pa55word"})
+			if status.Code(err) != codes.InvalidArgument {
+				t.Errorf("got %v, want %v", err, codes.InvalidArgument)
+			}
+		}
+
+		if !checkTestPassword(t, fake, user.ID, testPassword) {
+			t.Error("the password changed")
+		}
+	})
+
+	t.Run("Validation", func(t *testing.T) {
+		app, _ := newTestApplication(t)
+
+		_, err := app.RequestPasswordReset(context.Background(), &users.RequestPasswordResetRequest{Email: "not-an-email"})
+		if status.Code(err) != codes.InvalidArgument {
+			t.Errorf("got %v for an invalid email, want %v", err, codes.InvalidArgument)
+		}
+
+		_, err = app.ResetPassword(context.Background(), &users.ResetPasswordRequest{TokenPlaintext: "short", Password: "short"})
+		if status.Code(err) != codes.InvalidArgument {
+			t.Errorf("got %v for an invalid request, want %v", err, codes.InvalidArgument)
+		}
+	})
+}
+
+func TestChangePassword(t *testing.T) {
+	t.Run("Change", func(t *testing.T) {
+		app, fake := newTestApplication(t)
+		outbox := app.models.Outbox.(*fakeOutbox)
+
+		user, _ := insertTestUser(t, app, fake)
+		ctx, _ := startTestSession(t, app, user.ID)
+		_, other := startTestSession(t, app, user.ID)
+
+		res, err := app.ChangePassword(ctx, &users.ChangePasswordRequest{CurrentPassword: testPassword, NewPassword: "n3w-pa55word"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !checkTestPassword(t, fake, user.ID, "n3w-pa55word") {
+			t.Error("the new password doesn't match")
+		}
+
+		// sessions are kept unless the caller asks otherwise
+		if res.TokenPlaintext != "" {
+			t.Errorf("got token %q, want none", res.TokenPlaintext)
+		}
+
+		_, err = app.models.Sessions.Get(other.ID)
+		if err != nil {
+			t.Errorf("got %v for the other session, want it kept", err)
+		}
+
+		message := outbox.Get(1)
+		if message == nil || message.Kind != outboxPasswordChangedEmail || message.UserID != user.ID {
+			t.Fatalf("got %v, want a password changed email for user %d", message, user.ID)
+		}
+
+		var payload notifications.SendPasswordChangedEmailRequest
+		openOutboxPayload(t, app, message, &payload)
+
+		if payload.Recipient != user.Email {
+			t.Errorf("got recipient %q, want %q", payload.Recipient, user.Email)
+		}
+	})
+
+	t.Run("RevokeOtherSessions", func(t *testing.T) {
+		app, fake := newTestApplication(t)
+
+		user, _ := insertTestUser(t, app, fake)
+		ctx, current := startTestSession(t, app, user.ID)
+		_, other := startTestSession(t, app, user.ID)
+
+		res, err := app.ChangePassword(ctx, &users.ChangePasswordRequest{
+			CurrentPassword:     testPassword,
+			NewPassword:         "n3w-pa55word",
+			RevokeOtherSessions: true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = app.models.Sessions.Get(other.ID)
+		if err != data.ErrRecordNotFound {
+			t.Errorf("got %v for the other session, want %v", err, data.ErrRecordNotFound)
+		}
+
+		// the caller carries on with a fresh token for the same session
+		session, err := app.models.Sessions.GetForToken(res.TokenPlaintext)
+		if err != nil {
+			t.Fatalf("the new token doesn't belong to a session: %v", err)
+		}
+
+		if session.ID != current.ID {
+			t.Errorf("got session %d for the new token, want %d", session.ID, current.ID)
+		}
+	})
+
+	t.Run("IncorrectPassword", func(t *testing.T) {
+		app, fake := newTestApplication(t)
+		outbox := app.models.Outbox.(*fakeOutbox)
+
+		_, ctx := insertTestUser(t, app, fake)
+
+		_, err := app.ChangePassword(ctx, &users.ChangePasswordRequest{CurrentPassword: "wr0ng-pa55word", NewPassword: "n3w-pa55word"})
+		if status.Code(err) != codes.InvalidArgument {
+			t.Fatalf("got %v, want %v", err, codes.InvalidArgument)
+		}
+
+		if outbox.Get(1) != nil {
+			t.Error("got a password changed email for a password that didn't change")
+		}
+	})
+
+	t.Run("Validation", func(t *testing.T) {
+		app, fake := newTestApplication(t)
+
+		_, ctx := insertTestUser(t, app, fake)
+
+		tests := []struct {
+			name string
+			req  *users.ChangePasswordRequest
+		}{
+			{"NoCurrentPassword", &users.ChangePasswordRequest{NewPassword: "n3w-pa55word"}},
+			{"ShortPassword", &users.ChangePasswordRequest{CurrentPassword: testPassword, NewPassword: "short"}},
+			{"SamePassword", &users.ChangePasswordRequest{CurrentPassword: testPassword, NewPassword: testPassword}},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				_, err := app.ChangePassword(ctx, tt.req)
+				if status.Code(err) != codes.InvalidArgument {
+					t.Errorf("got %v, want %v", err, codes.InvalidArgument)
+				}
+			})
+		}
+	})
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/saarwasserman/users/protogen/auth"
+)
+
+//go:embed policy.json
+var defaultPolicies []byte
+
+// methodPolicy says who may call an RPC. public methods skip authentication,
+// the others need an authenticated caller holding all the listed permissions
+type methodPolicy struct {
+	Public      bool     `json:"public"`
+	Permissions []string `json:"permissions"`
+}
+
+// loadPolicies reads the method policy table from the given file, or the
+// embedded policy.json when no file is given
+func loadPolicies(file string) (map[string]methodPolicy, error) {
+	js := defaultPolicies
+
+	if file != "" {
+		var err error
+
+		js, err = os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var policies map[string]methodPolicy
+
+	err := json.Unmarshal(js, &policies)
+	if err != nil {
+		return nil, fmt.Errorf("invalid policy table: %w", err)
+	}
+
+	for method, policy := range policies {
+		if policy.Public && len(policy.Permissions) > 0 {
+			return nil, fmt.Errorf("invalid policy for %s: a public method can't require permissions", method)
+		}
+	}
+
+	return policies, nil
+}
+
+// checkPolicies makes sure every method registered on the server has a policy,
+// so a new RPC can't be exposed without deciding who may call it
+func checkPolicies(server *grpc.Server, policies map[string]methodPolicy) error {
+	for service, info := range server.GetServiceInfo() {
+		for _, method := range info.Methods {
+			if _, ok := policies[method.Name]; !ok {
+				return fmt.Errorf("no policy for method %s/%s", service, method.Name)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (app *application) UnaryAuthorizer(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	err := app.authorize(ctx, path.Base(info.FullMethod))
+	if err != nil {
+		return nil, err
+	}
+
+	return handler(ctx, req)
+}
+
+func (app *application) StreamAuthorizer(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	err := app.authorize(stream.Context(), path.Base(info.FullMethod))
+	if err != nil {
+		return err
+	}
+
+	return handler(srv, stream)
+}
+
+func (app *application) authorize(ctx context.Context, method string) error {
+	policy, ok := app.policies[method]
+	if !ok {
+		// checkPolicies runs at startup, this is only reachable for methods
+		// of services that aren't ours
+		return status.Error(codes.PermissionDenied, "access denied")
+	}
+
+	if policy.Public || len(policy.Permissions) == 0 {
+		return nil
+	}
+
+	userId := app.contextGetUserId(ctx)
+
+	permissions, err := app.getPermissions(ctx, userId)
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return status.Error(codes.Internal, "failed to fetch permissions")
+	}
+
+	for _, code := range policy.Permissions {
+		if !slices.Contains(permissions, code) {
+			return status.Error(codes.PermissionDenied, "your user account doesn't have the necessary permissions to access this resource")
+		}
+	}
+
+	return nil
+}
+
+func (app *application) getPermissions(ctx context.Context, userId int64) ([]string, error) {
+	if permissions, ok := app.permissions.get(userId); ok {
+		return permissions, nil
+	}
+
+	res, err := app.auth.GetPermissionsForUser(ctx, &auth.GetPermissionsForUserRequest{
+		UserId: userId,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	app.permissions.set(userId, res.Codes)
+
+	return res.Codes, nil
+}
+
+// permissionCache keeps users' permissions for a short while so authorizing
+// a call doesn't always cost a round trip to the auth service
+type permissionCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[int64]cachedPermissions
+}
+
+type cachedPermissions struct {
+	codes  []string
+	expiry time.Time
+}
+
+func newPermissionCache(ttl time.Duration) *permissionCache {
+	return &permissionCache{
+		ttl:     ttl,
+		entries: make(map[int64]cachedPermissions),
+	}
+}
+
+func (c *permissionCache) get(userId int64) ([]string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[userId]
+	if !ok || time.Now().After(entry.expiry) {
+		return nil, false
+	}
+
+	return entry.codes, true
+}
+
+func (c *permissionCache) set(userId int64, codes []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+
+	c.entries[userId] = cachedPermissions{codes: codes, expiry: now.Add(c.ttl)}
+
+	// expired entries are dropped lazily, when the map grows
+	if len(c.entries) > 10000 {
+		for id, entry := range c.entries {
+			if now.After(entry.expiry) {
+				delete(c.entries, id)
+			}
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/saarwasserman/users/protogen/users"
+)
+
+func TestLoadPolicies(t *testing.T) {
+	t.Run("CoversEveryMethod", func(t *testing.T) {
+		app, _ := newTestApplication(t)
+
+		policies, err := loadPolicies("")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		server := grpc.NewServer()
+		users.RegisterUsersServer(server, app)
+
+		err = checkPolicies(server, policies)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("MissingMethod", func(t *testing.T) {
+		app, _ := newTestApplication(t)
+
+		policies, err := loadPolicies("")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		delete(policies, "ListUsers")
+
+		server := grpc.NewServer()
+		users.RegisterUsersServer(server, app)
+
+		err = checkPolicies(server, policies)
+		if err == nil {
+			t.Fatal("a method without a policy was accepted")
+		}
+	})
+
+	t.Run("PublicWithPermissions", func(t *testing.T) {
+		file := filepath.Join(t.TempDir(), "policy.json")
+
+		err := os.WriteFile(file, []byte(`{"Login": {"public": true, "permissions": ["users:admin"]}}`), 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = loadPolicies(file)
+		if err == nil {
+			t.Fatal("a public method requiring permissions was accepted")
+		}
+	})
+}
+
+func TestAuthorize(t *testing.T) {
+	app, fake := newTestApplication(t)
+
+	policies, err := loadPolicies("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app.policies = policies
+
+	fake.permissions[1] = []string{"users:admin"}
+
+	tests := []struct {
+		name   string
+		method string
+		userId int64
+		code   codes.Code
+	}{
+		{"Public", "Login", 0, codes.OK},
+		{"NoPermissions", "GetUser", 2, codes.OK},
+		{"Admin", "ListUsers", 1, codes.OK},
+		{"NotAdmin", "ListUsers", 2, codes.PermissionDenied},
+		{"UnknownMethod", "DropTables", 1, codes.PermissionDenied},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := app.contextSetUserId(context.Background(), tt.userId)
+
+			err := app.authorize(ctx, tt.method)
+			if status.Code(err) != tt.code {
+				t.Fatalf("got %v, want %s", err, tt.code)
+			}
+		})
+	}
+
+	t.Run("CachesPermissions", func(t *testing.T) {
+		app, fake := newTestApplication(t)
+		app.policies = policies
+
+		fake.permissions[1] = []string{"users:admin"}
+
+		ctx := app.contextSetUserId(context.Background(), 1)
+
+		for range 3 {
+			err := app.authorize(ctx, "ListUsers")
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		calls := slices.DeleteFunc(fake.Calls(), func(method string) bool {
+			return method != "GetPermissionsForUser"
+		})
+
+		if len(calls) != 1 {
+			t.Fatalf("permissions were fetched %d times, want once", len(calls))
+		}
+	})
+}
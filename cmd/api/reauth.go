@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/saarwasserman/users/internal/data"
+	"github.com/saarwasserman/users/internal/validator"
+)
+
+// a session started this recently counts as proof the caller just signed in,
+// e.g. again with their identity provider when the account has no password
+const reauthenticationWindow = 5 * time.Minute
+
+// reauthentication is what the caller sends to prove they are the owner of
+// the account, not just someone holding one of its sessions
+type reauthentication struct {
+	password     string
+	code         string
+	recoveryCode string
+}
+
+// reauthenticate checks the password, a two-factor or recovery code, or
+// failing those that the caller's session was started just now. accounts
+// signed up with an identity provider have no password, so they use one of
+// the others
+func (app *application) reauthenticate(ctx context.Context, user *data.User, proof reauthentication) error {
+	v := validator.New()
+
+	switch {
+	case proof.password != "":
+		match, err := app.passwords.Verify(ctx, user.ID, proof.password)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+			return status.Error(codes.Internal, "failed to verify credentials")
+		}
+
+		if !match {
+			v.AddError("password", "is incorrect")
+			return status.Errorf(codes.InvalidArgument, "error %s", v.Errors)
+		}
+
+		return nil
+
+	case proof.code != "" || proof.recoveryCode != "":
+		return app.reauthenticateMFA(ctx, user, proof)
+	}
+
+	session, err := app.models.Sessions.Get(app.contextGetSessionId(ctx))
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	if time.Since(session.CreatedAt) > reauthenticationWindow {
+		v.AddError("password", "must be provided, or a two-factor code, or sign in again")
+		return status.Errorf(codes.InvalidArgument, "error %s", v.Errors)
+	}
+
+	return nil
+}
+
+func (app *application) reauthenticateMFA(ctx context.Context, user *data.User, proof reauthentication) error {
+	v := validator.New()
+
+	if proof.recoveryCode != "" {
+		v.Check(proof.code == "", "code", "must not be provided along with a recovery code")
+		data.ValidateRecoveryCode(v, proof.recoveryCode)
+	} else {
+		data.ValidateTOTPCode(v, proof.code)
+	}
+
+	if !v.Valid() {
+		return status.Errorf(codes.InvalidArgument, "error %s", v.Errors)
+	}
+
+	// codes are guessed against the same throttles as passwords
+	ip := clientIP(ctx)
+
+	err := app.checkLoginThrottles(ctx, user.Email, ip)
+	if err != nil {
+		return err
+	}
+
+	credential, err := app.models.TOTP.GetForUser(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return status.Error(codes.FailedPrecondition, "two-factor authentication is not enabled")
+		default:
+			return status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	if !credential.Confirmed {
+		return status.Error(codes.FailedPrecondition, "two-factor authentication is not enabled")
+	}
+
+	var ok bool
+	if proof.recoveryCode != "" {
+		ok, err = app.useRecoveryCode(user, proof.recoveryCode)
+	} else {
+		ok, err = app.verifyTOTP(credential, proof.code)
+	}
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return status.Error(codes.Internal, "failed to verify code")
+	}
+
+	if !ok {
+		app.recordLoginFailure(user.Email, user, ip)
+		return status.Error(codes.InvalidArgument, invalidMFACodeMessage)
+	}
+
+	return nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/saarwasserman/users/internal/data"
+)
+
+func TestReauthenticate(t *testing.T) {
+	ctx := context.Background()
+
+	app, fake := newTestApplication(t)
+
+	user := &data.User{ID: 1, Name: "Alice", Email: "alice@dinghy.test", Activated: true}
+	fake.passwords[user.ID] = "pa55word1234"
+
+	tests := []struct {
+		name  string
+		proof reauthentication
+		code  codes.Code
+	}{
+		{"Password", reauthentication{password: "pa55word1234"}, codes.OK},
+		{"WrongPassword", reauthentication{password: "wrong-password"}, codes.InvalidArgument},
+		{"MalformedCode", reauthentication{code: "12"}, codes.InvalidArgument},
+		{"CodeAndRecoveryCode", reauthentication{code: "123456", recoveryCode: "abcde-fghij"}, codes.InvalidArgument},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := app.reauthenticate(ctx, user, tt.proof)
+			if status.Code(err) != tt.code {
+				t.Fatalf("got %v, want %s", err, tt.code)
+			}
+		})
+	}
+}
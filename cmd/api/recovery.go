@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/saarwasserman/users/internal/data"
+	"github.com/saarwasserman/users/protogen/notifications"
+	"github.com/saarwasserman/users/protogen/users"
+)
+
+// number of recovery codes a user holds after enrolling or regenerating
+const recoveryCodeCount = 10
+
+// generateRecoveryCodes returns codes of 50 random bits, displayed as two
+// groups of five characters
+func generateRecoveryCodes() ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+
+	for i := range codes {
+		randomBytes := make([]byte, 7)
+
+		_, err := rand.Read(randomBytes)
+		if err != nil {
+			return nil, err
+		}
+
+		code := strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes))[:data.RecoveryCodeLength]
+		codes[i] = code[:5] + "-" + code[5:]
+	}
+
+	return codes, nil
+}
+
+// issueRecoveryCodes replaces the recovery codes of the user with new ones,
+// which are returned in the clear this one time only
+func (app *application) issueRecoveryCodes(userId int64) ([]string, error) {
+	codes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	err = app.models.RecoveryCodes.Replace(userId, codes)
+	if err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// useRecoveryCode consumes the code and lets the user know one of their codes
+// was used. a code that is wrong or was already used is reported as not ok
+func (app *application) useRecoveryCode(user *data.User, code string) (bool, error) {
+	err := app.models.RecoveryCodes.Use(user.ID, code)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+
+	remaining, err := app.models.RecoveryCodes.CountUnused(user.ID)
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return true, nil
+	}
+
+	err = app.enqueueEmail(outboxRecoveryCodeUsedEmail, user.ID, &notifications.SendRecoveryCodeUsedEmailRequest{
+		Recipient:      user.Email,
+		UserId:         strconv.FormatInt(user.ID, 10),
+		RemainingCodes: strconv.Itoa(remaining),
+	})
+	if err != nil {
+		app.logger.PrintError(err, nil)
+	}
+
+	return true, nil
+}
+
+func (app *application) RegenerateRecoveryCodes(ctx context.Context, req *users.RegenerateRecoveryCodesRequest) (*users.RegenerateRecoveryCodesResponse, error) {
+	userId := app.contextGetUserId(ctx)
+
+	mfaEnabled, err := app.models.TOTP.IsEnabled(userId)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	if !mfaEnabled {
+		return nil, status.Error(codes.FailedPrecondition, "two-factor authentication is not enabled")
+	}
+
+	user, err := app.models.Users.GetByUserIdContext(ctx, userId)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return nil, status.Error(codes.Internal, "user not found")
+		default:
+			return nil, queryError(err)
+		}
+	}
+
+	err = app.reauthenticate(ctx, user, reauthentication{
+		password:     req.Password,
+		code:         req.Code,
+		recoveryCode: req.RecoveryCode,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	recoveryCodes, err := app.issueRecoveryCodes(userId)
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return nil, status.Error(codes.Internal, "failed to generate recovery codes")
+	}
+
+	return &users.RegenerateRecoveryCodesResponse{
+		RecoveryCodes: recoveryCodes,
+	}, nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/saarwasserman/users/internal/data"
+	"github.com/saarwasserman/users/internal/validator"
+	"github.com/saarwasserman/users/protogen/notifications"
+	"github.com/saarwasserman/users/protogen/users"
+)
+
+func TestGenerateRecoveryCodes(t *testing.T) {
+	codes, err := generateRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(codes) != recoveryCodeCount {
+		t.Fatalf("got %d codes, want %d", len(codes), recoveryCodeCount)
+	}
+
+	seen := make(map[string]bool)
+
+	for _, code := range codes {
+		v := validator.New()
+		if data.ValidateRecoveryCode(v, code); !v.Valid() {
+			t.Errorf("code %q is not valid: %v", code, v.Errors)
+		}
+
+		if len(code) != data.RecoveryCodeLength+1 || code[5] != '-' {
+			t.Errorf("code %q is not shown as two groups of five", code)
+		}
+
+		if seen[code] {
+			t.Errorf("code %q was generated twice", code)
+		}
+		seen[code] = true
+	}
+}
+
+func TestVerifyMFARecoveryCode(t *testing.T) {
+	// challenge starts a login of the user and returns the mfa token
+	challenge := func(t *testing.T, app *application, user *data.User) string {
+		t.Helper()
+
+		res, err := app.mfaChallenge(context.Background(), user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return res.MfaToken
+	}
+
+	t.Run("Use", func(t *testing.T) {
+		app, fake := newTestApplication(t)
+		user, ctx := insertTestUser(t, app, fake)
+
+		_, recoveryCodes := enrollTOTP(t, app, ctx)
+
+		// codes are accepted regardless of case and separators
+		code := strings.ToUpper(strings.ReplaceAll(recoveryCodes[0], "-", ""))
+
+		_, err := app.VerifyMFA(context.Background(), &users.VerifyMFARequest{MfaToken: challenge(t, app, user), RecoveryCode: code})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		messages, err := app.models.Outbox.GetAllForUser(user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(messages) != 1 || messages[0].Kind != outboxRecoveryCodeUsedEmail {
+			t.Fatalf("got %d messages, want the recovery code used email", len(messages))
+		}
+
+		var payload notifications.SendRecoveryCodeUsedEmailRequest
+		openOutboxPayload(t, app, messages[0], &payload)
+
+		if payload.RemainingCodes != "9" {
+			t.Fatalf("got %s remaining codes, want 9", payload.RemainingCodes)
+		}
+
+		_, err = app.VerifyMFA(context.Background(), &users.VerifyMFARequest{MfaToken: challenge(t, app, user), RecoveryCode: recoveryCodes[0]})
+		if status.Code(err) != codes.Unauthenticated {
+			t.Fatalf("got %v, want a used code refused", err)
+		}
+	})
+
+	t.Run("AlongWithCode", func(t *testing.T) {
+		app, fake := newTestApplication(t)
+		user, ctx := insertTestUser(t, app, fake)
+
+		secret, recoveryCodes := enrollTOTP(t, app, ctx)
+
+		_, err := app.VerifyMFA(context.Background(), &users.VerifyMFARequest{
+			MfaToken:     challenge(t, app, user),
+			Code:         nextTOTPCode(secret),
+			RecoveryCode: recoveryCodes[0],
+		})
+		if status.Code(err) != codes.InvalidArgument {
+			t.Fatalf("got %v, want InvalidArgument", err)
+		}
+	})
+}
+
+func TestRegenerateRecoveryCodes(t *testing.T) {
+	t.Run("Regenerate", func(t *testing.T) {
+		app, fake := newTestApplication(t)
+		user, ctx := insertTestUser(t, app, fake)
+
+		_, previous := enrollTOTP(t, app, ctx)
+
+		res, err := app.RegenerateRecoveryCodes(ctx, &users.RegenerateRecoveryCodesRequest{Password: testPassword})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(res.RecoveryCodes) != recoveryCodeCount {
+			t.Fatalf("got %d codes, want %d", len(res.RecoveryCodes), recoveryCodeCount)
+		}
+
+		// the previous codes stop working
+		ok, err := app.useRecoveryCode(user, previous[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if ok {
+			t.Fatal("a previous code was accepted")
+		}
+
+		ok, err = app.useRecoveryCode(user, res.RecoveryCodes[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !ok {
+			t.Fatal("a new code was refused")
+		}
+	})
+
+	t.Run("WithRecoveryCode", func(t *testing.T) {
+		app, fake := newTestApplication(t)
+		user, ctx := insertTestUser(t, app, fake)
+
+		_, previous := enrollTOTP(t, app, ctx)
+
+		_, err := app.RegenerateRecoveryCodes(ctx, &users.RegenerateRecoveryCodesRequest{RecoveryCode: previous[0]})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		unused, err := app.models.RecoveryCodes.CountUnused(user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if unused != recoveryCodeCount {
+			t.Fatalf("got %d unused codes, want a full new set", unused)
+		}
+	})
+
+	t.Run("WrongPassword", func(t *testing.T) {
+		app, fake := newTestApplication(t)
+		_, ctx := insertTestUser(t, app, fake)
+
+		enrollTOTP(t, app, ctx)
+
+		_, err := app.RegenerateRecoveryCodes(ctx, &users.RegenerateRecoveryCodesRequest{Password: "wrong password"})
+		if status.Code(err) != codes.InvalidArgument {
+			t.Fatalf("got %v, want InvalidArgument", err)
+		}
+	})
+
+	t.Run("NotEnabled", func(t *testing.T) {
+		app, fake := newTestApplication(t)
+		_, ctx := insertTestUser(t, app, fake)
+
+		_, err := app.RegenerateRecoveryCodes(ctx, &users.RegenerateRecoveryCodesRequest{Password: testPassword})
+		if status.Code(err) != codes.FailedPrecondition {
+			t.Fatalf("got %v, want FailedPrecondition", err)
+		}
+	})
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strconv"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/saarwasserman/users/internal/data"
+	"github.com/saarwasserman/users/internal/idp"
+	"github.com/saarwasserman/users/protogen/auth"
+	"github.com/saarwasserman/users/protogen/notifications"
+)
+
+// steps of a registration, in order
+const (
+	registrationStepUserCreated      = "user_created"
+	registrationStepPasswordSet      = "password_set"
+	registrationStepPermissionsAdded = "permissions_added"
+	registrationStepActivationSent   = "activation_sent"
+	registrationStepIdentityLinked   = "identity_linked"
+	registrationStepActivated        = "activated"
+)
+
+// registrations not updated for this long were interrupted, no request is
+// working on them anymore
+const registrationStaleAfter = 2 * time.Minute
+
+// max number of interrupted registrations recovered in one round
+const registrationRecoveryBatchSize = 100
+
+// finished registrations are kept this long, to look into failed ones
+const registrationRetention = 7 * 24 * time.Hour
+
+// the password is never stored, a registration interrupted before it was set
+// can only be rolled back
+var errPasswordUnavailable = errors.New("password is not available to resume the registration")
+
+// neither is the provider account, a registration interrupted before linking
+// it can only be rolled back
+var errIdentityUnavailable = errors.New("identity is not available to resume the registration")
+
+// registrationStep runs one step of a registration. the messages it returns
+// are written along with the step's completion
+type registrationStep struct {
+	name       string
+	run        func(ctx context.Context, userId int64) ([]*data.OutboxMessage, error)
+	compensate func(ctx context.Context, userId int64) error
+}
+
+// registrationSteps returns the steps of registering a user. the user row is
+// inserted along with the registration, and deleted when rolling it back
+func (app *application) registrationSteps(password string) []registrationStep {
+	return []registrationStep{
+		{
+			name: registrationStepUserCreated,
+		},
+		{
+			name: registrationStepPasswordSet,
+			run: func(ctx context.Context, userId int64) ([]*data.OutboxMessage, error) {
+				if password == "" {
+					return nil, errPasswordUnavailable
+				}
+
+				_, err := app.auth.SetPassword(ctx, &auth.SetPasswordRequest{
+					UserId:   userId,
+					Password: password,
+				})
+				return nil, err
+			},
+			compensate: func(ctx context.Context, userId int64) error {
+				_, err := app.auth.DeletePassword(ctx, &auth.PasswordDeletionRequest{UserId: userId})
+				return err
+			},
+		},
+		{
+			name: registrationStepPermissionsAdded,
+			run: func(ctx context.Context, userId int64) ([]*data.OutboxMessage, error) {
+				_, err := app.auth.AddPermissionForUser(ctx, &auth.AddPermissionForUserRequest{
+					UserId: userId,
+					Codes:  initialPermissions,
+				})
+				return nil, err
+			},
+			compensate: func(ctx context.Context, userId int64) error {
+				_, err := app.auth.DeleteAllPermissionsForUser(ctx, &auth.PermissionsDeletionRequest{UserId: userId})
+				return err
+			},
+		},
+		{
+			name: registrationStepActivationSent,
+			run: func(ctx context.Context, userId int64) ([]*data.OutboxMessage, error) {
+				message, err := app.activationEmail(ctx, userId)
+				if err != nil {
+					return nil, err
+				}
+
+				return []*data.OutboxMessage{message}, nil
+			},
+			compensate: func(ctx context.Context, userId int64) error {
+				_, err := app.auth.DeleteAllTokensForUser(ctx, &auth.TokensDeletionRequest{
+					Scope:  data.ScopeActivation,
+					UserId: userId,
+				})
+				return err
+			},
+		},
+	}
+}
+
+// identityRegistrationSteps returns the steps of registering a user signing up
+// with an account at an identity provider. the user is inserted unactivated
+// and activated last, so rolling back deletes it as for a password sign-up
+func (app *application) identityRegistrationSteps(providerName string, identity *idp.Identity) []registrationStep {
+	return []registrationStep{
+		{
+			name: registrationStepUserCreated,
+		},
+		{
+			name: registrationStepPermissionsAdded,
+			run: func(ctx context.Context, userId int64) ([]*data.OutboxMessage, error) {
+				_, err := app.auth.AddPermissionForUser(ctx, &auth.AddPermissionForUserRequest{
+					UserId: userId,
+					Codes:  initialPermissions,
+				})
+				return nil, err
+			},
+			compensate: func(ctx context.Context, userId int64) error {
+				_, err := app.auth.DeleteAllPermissionsForUser(ctx, &auth.PermissionsDeletionRequest{UserId: userId})
+				return err
+			},
+		},
+		{
+			name: registrationStepIdentityLinked,
+			run: func(ctx context.Context, userId int64) ([]*data.OutboxMessage, error) {
+				if identity == nil {
+					return nil, errIdentityUnavailable
+				}
+
+				return nil, app.models.Identities.Insert(&data.Identity{
+					Provider: providerName,
+					Subject:  identity.Subject,
+					UserID:   userId,
+					Email:    identity.Email,
+				})
+			},
+			// the identity is deleted along with the user, when rolling back
+			compensate: func(ctx context.Context, userId int64) error {
+				return nil
+			},
+		},
+		{
+			name: registrationStepActivated,
+			run: func(ctx context.Context, userId int64) ([]*data.OutboxMessage, error) {
+				return nil, app.setActivated(ctx, userId, true)
+			},
+			compensate: func(ctx context.Context, userId int64) error {
+				err := app.setActivated(ctx, userId, false)
+				if errors.Is(err, data.ErrRecordNotFound) {
+					return nil
+				}
+				return err
+			},
+		},
+	}
+}
+
+// kindRegistrationSteps returns the steps of a kind of registration, without
+// the request's data, for recovering interrupted ones
+func (app *application) kindRegistrationSteps(kind string) []registrationStep {
+	switch kind {
+	case data.RegistrationKindIdentity:
+		return app.identityRegistrationSteps("", nil)
+	default:
+		return app.registrationSteps("")
+	}
+}
+
+func (app *application) setActivated(ctx context.Context, userId int64, activated bool) error {
+	user, err := app.models.Users.GetByUserIdContext(ctx, userId)
+	if err != nil {
+		return err
+	}
+
+	if user.Activated == activated {
+		return nil
+	}
+
+	user.Activated = activated
+
+	return app.models.Users.UpdateContext(ctx, user)
+}
+
+func registrationStepIndex(steps []registrationStep, name string) int {
+	return slices.IndexFunc(steps, func(step registrationStep) bool {
+		return step.name == name
+	})
+}
+
+// activationEmail replaces the activation tokens of the user with a new one
+// and returns the email carrying it, so running it again is harmless
+func (app *application) activationEmail(ctx context.Context, userId int64) (*data.OutboxMessage, error) {
+	user, err := app.models.Users.GetByUserIdContext(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = app.auth.DeleteAllTokensForUser(ctx, &auth.TokensDeletionRequest{
+		Scope:  data.ScopeActivation,
+		UserId: userId,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	tokenResponse, err := app.auth.CreateToken(ctx, &auth.TokenCreationRequest{
+		Scope:  data.ScopeActivation,
+		UserId: userId,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return app.newOutboxMessage(outboxActivationEmail, user.ID, &notifications.SendActivationEmailRequest{
+		Recipient: user.Email,
+		UserId:    strconv.FormatInt(user.ID, 10),
+		Token:     tokenResponse.TokenPlaintext,
+	})
+}
+
+// runRegistration runs the steps after the last completed one, recording
+// each as it completes. a step that fails, or whose completion isn't
+// recorded, may have taken effect anyway, so registration.Step is left at it
+// for compensateRegistration to undo it too
+func (app *application) runRegistration(ctx context.Context, registration *data.Registration, steps []registrationStep) error {
+	for _, step := range steps[registrationStepIndex(steps, registration.Step)+1:] {
+		registration.Step = step.name
+
+		messages, err := step.run(ctx, registration.UserID)
+		if err != nil {
+			return err
+		}
+
+		err = app.models.Registrations.Update(registration, messages...)
+		if err != nil {
+			return err
+		}
+	}
+
+	registration.Status = data.RegistrationCompleted
+	registration.Error = ""
+
+	return app.models.Registrations.Update(registration)
+}
+
+// compensateRegistration undoes the steps in reverse order, starting from the
+// one registration.Step is at, then deletes the user. a failed compensation is left for recoverRegistrations
+// to retry from where it stopped
+func (app *application) compensateRegistration(ctx context.Context, registration *data.Registration, steps []registrationStep) error {
+	registration.Status = data.RegistrationCompensating
+
+	err := app.models.Registrations.Update(registration)
+	if err != nil {
+		return err
+	}
+
+	for i := registrationStepIndex(steps, registration.Step); i > 0; i-- {
+		err = steps[i].compensate(ctx, registration.UserID)
+		// undone already, by an earlier attempt
+		if err != nil && status.Code(err) != codes.NotFound {
+			return err
+		}
+
+		registration.Step = steps[i-1].name
+
+		err = app.models.Registrations.Update(registration)
+		if err != nil {
+			return err
+		}
+	}
+
+	return app.models.Registrations.RollBack(registration)
+}
+
+// recoverRegistrations finishes or rolls back the registrations interrupted
+// by a crash or a restart. it runs on startup and then periodically
+func (app *application) recoverRegistrations() {
+	ticker := time.NewTicker(registrationStaleAfter)
+	defer ticker.Stop()
+
+	for {
+		app.recoverStaleRegistrations()
+		<-ticker.C
+	}
+}
+
+func (app *application) recoverStaleRegistrations() {
+	registrations, err := app.models.Registrations.GetUnfinished(time.Now().Add(-registrationStaleAfter), registrationRecoveryBatchSize)
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return
+	}
+
+	for _, registration := range registrations {
+		properties := map[string]string{
+			"registration_id": strconv.FormatInt(registration.ID, 10),
+			"user_id":         strconv.FormatInt(registration.UserID, 10),
+		}
+
+		err := app.models.Registrations.Claim(registration)
+		if err != nil {
+			if !errors.Is(err, data.ErrEditConflict) {
+				app.logger.PrintError(err, properties)
+			}
+			continue
+		}
+
+		steps := app.kindRegistrationSteps(registration.Kind)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+
+		// pending registrations are finished if they are past the steps
+		// needing the request's data, e.g. the password
+		if registration.Status == data.RegistrationPending {
+			err = app.runRegistration(ctx, registration, steps)
+			if err == nil {
+				cancel()
+				app.logger.PrintInfo("registration resumed", properties)
+				continue
+			}
+
+			registration.Error = err.Error()
+		}
+
+		err = app.compensateRegistration(ctx, registration, steps)
+		cancel()
+
+		if err != nil {
+			app.logger.PrintError(err, properties)
+			continue
+		}
+
+		app.logger.PrintInfo("registration rolled back", properties)
+	}
+}
+
+// deleteFinishedRegistrations prunes registrations that completed or were
+// rolled back, periodically
+func (app *application) deleteFinishedRegistrations() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		err := app.models.Registrations.DeleteFinished(time.Now().Add(-registrationRetention))
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+	}
+}
+
+// registrationError is what the caller of a registration that failed and was
+// rolled back gets. a step that failed with a status, e.g. a password the
+// auth service rejected, keeps it
+func registrationError(err error) error {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return queryError(err)
+	}
+
+	if st, ok := status.FromError(err); ok {
+		return st.Err()
+	}
+
+	return status.Error(codes.Internal, "registration failed, please try again")
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/saarwasserman/users/internal/data"
+)
+
+func TestCompensateRegistration(t *testing.T) {
+	ctx := context.Background()
+
+	// steps that record their compensations, the ones in failures fail with
+	// their error
+	newSteps := func(compensated *[]string, failures map[string]error) []registrationStep {
+		step := func(name string) registrationStep {
+			return registrationStep{
+				name: name,
+				compensate: func(ctx context.Context, userId int64) error {
+					if err := failures[name]; err != nil {
+						return err
+					}
+
+					*compensated = append(*compensated, name)
+					return nil
+				},
+			}
+		}
+
+		return []registrationStep{{name: "first"}, step("second"), step("third"), step("fourth")}
+	}
+
+	start := func(t *testing.T, app *application, step string) *data.Registration {
+		t.Helper()
+
+		registration, err := app.models.Registrations.Start(ctx, &data.User{Name: "Alice", Email: "alice@dinghy.test"}, data.RegistrationKindPassword, "first")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		registration.Step = step
+
+		err = app.models.Registrations.Update(registration)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return registration
+	}
+
+	t.Run("ReverseOrder", func(t *testing.T) {
+		app, _ := newTestApplication(t)
+
+		var compensated []string
+		steps := newSteps(&compensated, nil)
+
+		registration := start(t, app, "third")
+
+		err := app.compensateRegistration(ctx, registration, steps)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// steps after the last completed one never ran
+		if !slices.Equal(compensated, []string{"third", "second"}) {
+			t.Fatalf("got %v, want [third second]", compensated)
+		}
+
+		if registration.Status != data.RegistrationRolledBack {
+			t.Fatalf("got %s, want rolled back", registration.Status)
+		}
+
+		_, err = app.models.Users.GetByUserIdContext(ctx, registration.UserID)
+		if !errors.Is(err, data.ErrRecordNotFound) {
+			t.Fatalf("got %v, want the user deleted", err)
+		}
+	})
+
+	t.Run("ResumesFromFailure", func(t *testing.T) {
+		app, _ := newTestApplication(t)
+
+		var compensated []string
+		failures := map[string]error{"second": errors.New("auth is down")}
+		steps := newSteps(&compensated, failures)
+
+		registration := start(t, app, "fourth")
+
+		err := app.compensateRegistration(ctx, registration, steps)
+		if err == nil {
+			t.Fatal("compensation succeeded")
+		}
+
+		// the progress is kept for the next attempt
+		if registration.Status != data.RegistrationCompensating || registration.Step != "second" {
+			t.Fatalf("got registration %s at %s, want it compensating at second", registration.Status, registration.Step)
+		}
+
+		// undone already, as if by the failed attempt
+		failures["second"] = status.Error(codes.NotFound, "no password")
+
+		err = app.compensateRegistration(ctx, registration, steps)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !slices.Equal(compensated, []string{"fourth", "third"}) {
+			t.Fatalf("got %v, want [fourth third]", compensated)
+		}
+
+		if registration.Status != data.RegistrationRolledBack {
+			t.Fatalf("got %s, want rolled back", registration.Status)
+		}
+	})
+
+	t.Run("DropsQueuedMessages", func(t *testing.T) {
+		app, _ := newTestApplication(t)
+		registrations := app.models.Registrations.(*data.MemoryRegistrationRepository)
+
+		steps := app.registrationSteps("pa55word1234")
+
+		registration, err := app.models.Registrations.Start(ctx, &data.User{Name: "Alice", Email: "alice@dinghy.test"}, data.RegistrationKindPassword, registrationStepUserCreated)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = app.runRegistration(ctx, registration, steps)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(registrations.Messages()) != 1 {
+			t.Fatal("want the activation email queued")
+		}
+
+		err = app.compensateRegistration(ctx, registration, steps)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the token it carries was revoked along with the user
+		if len(registrations.Messages()) != 0 {
+			t.Fatal("activation email is still queued")
+		}
+	})
+}
+
+func TestRunRegistration(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("UndoesFailedStep", func(t *testing.T) {
+		app, _ := newTestApplication(t)
+
+		var compensated []string
+
+		step := func(name string, failure error) registrationStep {
+			return registrationStep{
+				name: name,
+				run: func(ctx context.Context, userId int64) ([]*data.OutboxMessage, error) {
+					return nil, failure
+				},
+				compensate: func(ctx context.Context, userId int64) error {
+					compensated = append(compensated, name)
+					return nil
+				},
+			}
+		}
+
+		// the third step fails after taking effect, e.g. its response was lost
+		steps := []registrationStep{{name: "first"}, step("second", nil), step("third", errors.New("connection reset")), step("fourth", nil)}
+
+		registration, err := app.models.Registrations.Start(ctx, &data.User{Name: "Alice", Email: "alice@dinghy.test"}, data.RegistrationKindPassword, "first")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = app.runRegistration(ctx, registration, steps)
+		if err == nil {
+			t.Fatal("registration succeeded")
+		}
+
+		err = app.compensateRegistration(ctx, registration, steps)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !slices.Equal(compensated, []string{"third", "second"}) {
+			t.Fatalf("got %v, want [third second]", compensated)
+		}
+	})
+}
+
+func TestRollBackActivatedUser(t *testing.T) {
+	ctx := context.Background()
+
+	app, _ := newTestApplication(t)
+	registrations := app.models.Registrations.(*data.MemoryRegistrationRepository)
+
+	registration, err := app.models.Registrations.Start(ctx, &data.User{Name: "Alice", Email: "alice@dinghy.test"}, data.RegistrationKindPassword, registrationStepUserCreated)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = app.setActivated(ctx, registration.UserID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = app.models.Registrations.RollBack(registration)
+	if !errors.Is(err, data.ErrRecordNotFound) {
+		t.Fatalf("got %v, want ErrRecordNotFound", err)
+	}
+
+	stored, err := registrations.Get(registration.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stored.Status == data.RegistrationRolledBack {
+		t.Fatal("rollback recorded although the user was kept")
+	}
+
+	_, err = app.models.Users.GetByUserIdContext(ctx, registration.UserID)
+	if err != nil {
+		t.Fatalf("got %v, want the activated user kept", err)
+	}
+}
+
+func TestRegistrationError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want codes.Code
+	}{
+		{"Status", status.Error(codes.InvalidArgument, "password is too common"), codes.InvalidArgument},
+		{"Canceled", context.Canceled, codes.Canceled},
+		{"DeadlineExceeded", context.DeadlineExceeded, codes.DeadlineExceeded},
+		{"Other", errors.New("connection reset"), codes.Internal},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := status.Code(registrationError(tt.err)); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	"github.com/saarwasserman/users/internal/data"
+	"github.com/saarwasserman/users/internal/validator"
+	"github.com/saarwasserman/users/protogen/auth"
+	"github.com/saarwasserman/users/protogen/users"
+)
+
+// startSession records a newly issued authentication token as a session of
+// the user, with the address and user agent of the device it was issued to
+func (app *application) startSession(ctx context.Context, userId int64, tokenPlaintext string) (*data.Session, error) {
+	now := time.Now()
+
+	session := &data.Session{
+		UserID:   userId,
+		Expiry:   now.Add(app.config.session.maxLifetime),
+		ClientIP: clientIP(ctx),
+	}
+
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get("user-agent"); len(values) > 0 {
+			session.UserAgent = values[0]
+		}
+	}
+
+	err := app.models.Sessions.Insert(session, tokenPlaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	err = app.recordActivity(ctx, session, now)
+	if err != nil {
+		return nil, err
+	}
+
+	return session, nil
+}
+
+// issueSessionTokens starts a new session for the user, with a short-lived
+// access token and the first refresh token of the session's token family
+func (app *application) issueSessionTokens(ctx context.Context, userId int64) (*users.LoginResponse, error) {
+	accessToken, err := app.auth.CreateToken(ctx, &auth.TokenCreationRequest{
+		Scope:  data.ScopeAuthentication,
+		UserId: userId,
+		Ttl:    durationpb.New(app.config.session.accessTokenTTL),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := app.startSession(ctx, userId, accessToken.TokenPlaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	refreshToken, err := app.createRefreshToken(ctx, session)
+	if err != nil {
+		return nil, err
+	}
+
+	return &users.LoginResponse{
+		TokenPlaintext:        accessToken.TokenPlaintext,
+		RefreshTokenPlaintext: refreshToken,
+	}, nil
+}
+
+func (app *application) createRefreshToken(ctx context.Context, session *data.Session) (string, error) {
+	refreshToken, err := app.auth.CreateToken(ctx, &auth.TokenCreationRequest{
+		Scope:  data.ScopeRefresh,
+		UserId: session.UserID,
+		Ttl:    durationpb.New(time.Until(session.Expiry)),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	err = app.models.RefreshTokens.Insert(session.ID, refreshToken.TokenPlaintext)
+	if err != nil {
+		return "", err
+	}
+
+	return refreshToken.TokenPlaintext, nil
+}
+
+func (app *application) RefreshToken(ctx context.Context, req *users.RefreshTokenRequest) (*users.LoginResponse, error) {
+	v := validator.New()
+
+	if data.ValidateTokenPlaintext(v, req.RefreshTokenPlaintext); !v.Valid() {
+		return nil, status.Errorf(codes.InvalidArgument, "error %s", v.Errors)
+	}
+
+	authRes, err := app.auth.Authenticate(ctx, &auth.AuthenticationRequest{
+		TokenScope:     data.ScopeRefresh,
+		TokenPlaintext: req.RefreshTokenPlaintext,
+	})
+	if err != nil {
+		switch {
+		case isInvalidTokenError(err):
+			return nil, status.Error(codes.Unauthenticated, "invalid or expired refresh token")
+		default:
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	refreshToken, err := app.models.RefreshTokens.GetForToken(req.RefreshTokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			// its session was revoked, along with the whole token family
+			return nil, status.Error(codes.Unauthenticated, "invalid or expired refresh token")
+		default:
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	// a rotated token is presented again, either the client or an attacker
+	// holds a stolen copy. there is no telling which, so the whole family goes
+	if refreshToken.RotatedAt != nil {
+		return nil, app.revokeTokenFamily(refreshToken.SessionID, authRes.UserId)
+	}
+
+	session, err := app.models.Sessions.Get(refreshToken.SessionID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return nil, status.Error(codes.Unauthenticated, "invalid or expired refresh token")
+		default:
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	// refreshing doesn't extend a session past the inactivity time
+	err = app.checkIdle(ctx, session, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = app.models.Users.GetByUserIdContext(ctx, session.UserID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return nil, status.Error(codes.Unauthenticated, "invalid or expired refresh token")
+		default:
+			return nil, queryError(err)
+		}
+	}
+
+	// the token is only burnt once the session is known to be usable, so a
+	// refresh that is turned down can be retried with the same token
+	err = app.models.RefreshTokens.MarkRotated(req.RefreshTokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			// rotated by a concurrent call in the meantime
+			return nil, app.revokeTokenFamily(refreshToken.SessionID, authRes.UserId)
+		default:
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	accessToken, err := app.rotateAccessToken(ctx, session)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	newRefreshToken, err := app.createRefreshToken(ctx, session)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &users.LoginResponse{
+		TokenPlaintext:        accessToken,
+		RefreshTokenPlaintext: newRefreshToken,
+	}, nil
+}
+
+// rotateAccessToken moves the session to a new access token, the one it had
+// stops being accepted
+func (app *application) rotateAccessToken(ctx context.Context, session *data.Session) (string, error) {
+	accessToken, err := app.auth.CreateToken(ctx, &auth.TokenCreationRequest{
+		Scope:  data.ScopeAuthentication,
+		UserId: session.UserID,
+		Ttl:    durationpb.New(app.config.session.accessTokenTTL),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	err = app.models.Sessions.UpdateToken(session, accessToken.TokenPlaintext)
+	if err != nil {
+		return "", err
+	}
+
+	err = app.recordActivity(ctx, session, time.Now())
+	if err != nil {
+		return "", err
+	}
+
+	return accessToken.TokenPlaintext, nil
+}
+
+func (app *application) revokeTokenFamily(sessionId, userId int64) error {
+	app.logger.PrintInfo("refresh token reuse detected, revoking session", map[string]string{
+		"session_id": strconv.FormatInt(sessionId, 10),
+		"user_id":    strconv.FormatInt(userId, 10),
+	})
+
+	err := app.models.Sessions.DeleteForUser(sessionId, userId)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	return status.Error(codes.Unauthenticated, "refresh token was already used, the session was revoked")
+}
+
+// getSession returns the live session of the token, revoked and expired
+// sessions are rejected even if the auth service still knows the token
+func (app *application) getSession(ctx context.Context, tokenPlaintext string) (*data.Session, error) {
+	session, err := app.models.Sessions.GetForToken(tokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return nil, status.Error(codes.Unauthenticated, "session was revoked or expired")
+		default:
+			app.logger.PrintError(err, nil)
+			return nil, status.Error(codes.Internal, "failed to fetch session")
+		}
+	}
+
+	return session, nil
+}
+
+func (app *application) ListSessions(ctx context.Context, req *users.ListSessionsRequest) (*users.ListSessionsResponse, error) {
+	userId := app.contextGetUserId(ctx)
+	currentSessionId := app.contextGetSessionId(ctx)
+
+	sessions, err := app.models.Sessions.GetAllForUser(userId)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	res := &users.ListSessionsResponse{
+		Sessions: make([]*users.SessionDetails, 0, len(sessions)),
+	}
+
+	for _, session := range sessions {
+		// sessions without activity are idle and only kept until they expire
+		lastSeen, err := app.lastSeen(ctx, session)
+		switch {
+		case errors.Is(err, errActivityNotFound):
+			lastSeen = session.CreatedAt
+		case err != nil:
+			app.logger.PrintError(err, nil)
+			return nil, status.Error(codes.Internal, "failed to check session activity")
+		}
+
+		res.Sessions = append(res.Sessions, &users.SessionDetails{
+			Id:         session.ID,
+			CreatedAt:  session.CreatedAt.UnixMilli(),
+			LastSeenAt: lastSeen.UnixMilli(),
+			ClientIp:   session.ClientIP,
+			UserAgent:  session.UserAgent,
+			Current:    session.ID == currentSessionId,
+		})
+	}
+
+	return res, nil
+}
+
+func (app *application) RevokeSession(ctx context.Context, req *users.RevokeSessionRequest) (*users.RevokeSessionResponse, error) {
+	userId := app.contextGetUserId(ctx)
+
+	v := validator.New()
+
+	if v.Check(req.SessionId > 0, "session_id", "must be provided"); !v.Valid() {
+		return nil, status.Errorf(codes.InvalidArgument, "error %s", v.Errors)
+	}
+
+	err := app.models.Sessions.DeleteForUser(req.SessionId, userId)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return nil, status.Error(codes.NotFound, "session not found")
+		default:
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	return &users.RevokeSessionResponse{}, nil
+}
+
+func (app *application) RevokeOtherSessions(ctx context.Context, req *users.RevokeOtherSessionsRequest) (*users.RevokeOtherSessionsResponse, error) {
+	userId := app.contextGetUserId(ctx)
+
+	err := app.models.Sessions.DeleteAllForUser(userId, app.contextGetSessionId(ctx))
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &users.RevokeOtherSessionsResponse{}, nil
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"github.com/saarwasserman/users/internal/data"
+	"github.com/saarwasserman/users/protogen/users"
+)
+
+// startTestSession starts a session of the user and returns it along with a
+// context of a call made with it
+func startTestSession(t *testing.T, app *application, userId int64) (context.Context, *data.Session) {
+	t.Helper()
+
+	session, err := app.startSession(context.Background(), userId, fmt.Sprintf("token-%d-%s", userId, t.Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := app.contextSetUserId(context.Background(), userId)
+	ctx = app.contextSetSessionId(ctx, session.ID)
+
+	return ctx, session
+}
+
+func TestStartSession(t *testing.T) {
+	app, _ := newTestApplication(t)
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("user-agent", "dinghy/1.0"))
+	ctx = peer.NewContext(ctx, &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5000}})
+
+	session, err := app.startSession(ctx, 1, "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := app.models.Sessions.GetForToken("token")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stored.ID != session.ID || stored.ClientIP != "192.0.2.1" || stored.UserAgent != "dinghy/1.0" {
+		t.Fatalf("got session %+v, want it started from 192.0.2.1 by dinghy/1.0", stored)
+	}
+
+	// a new session is active right away
+	err = app.touchSession(ctx, stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestListSessions(t *testing.T) {
+	app, _ := newTestApplication(t)
+
+	_, first := startTestSession(t, app, 1)
+	ctx, current := startTestSession(t, app, 1)
+	startTestSession(t, app, 2)
+
+	res, err := app.ListSessions(ctx, &users.ListSessionsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(res.Sessions) != 2 {
+		t.Fatalf("got %d sessions, want the user's 2", len(res.Sessions))
+	}
+
+	// newest first
+	if res.Sessions[0].Id != current.ID || res.Sessions[1].Id != first.ID {
+		t.Fatalf("got sessions %d and %d, want %d and %d", res.Sessions[0].Id, res.Sessions[1].Id, current.ID, first.ID)
+	}
+
+	if !res.Sessions[0].Current || res.Sessions[1].Current {
+		t.Fatal("the session of the call is not the only current one")
+	}
+
+	if res.Sessions[0].LastSeenAt == 0 {
+		t.Fatal("last seen is not set")
+	}
+}
+
+func TestRevokeSession(t *testing.T) {
+	t.Run("Own", func(t *testing.T) {
+		app, _ := newTestApplication(t)
+
+		_, other := startTestSession(t, app, 1)
+		ctx, _ := startTestSession(t, app, 1)
+
+		_, err := app.RevokeSession(ctx, &users.RevokeSessionRequest{SessionId: other.ID})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = app.models.Sessions.Get(other.ID)
+		if !errors.Is(err, data.ErrRecordNotFound) {
+			t.Fatalf("got %v, want the session revoked", err)
+		}
+	})
+
+	t.Run("OtherUsers", func(t *testing.T) {
+		app, _ := newTestApplication(t)
+
+		_, other := startTestSession(t, app, 2)
+		ctx, _ := startTestSession(t, app, 1)
+
+		_, err := app.RevokeSession(ctx, &users.RevokeSessionRequest{SessionId: other.ID})
+		if status.Code(err) != codes.NotFound {
+			t.Fatalf("got %v, want NotFound", err)
+		}
+
+		_, err = app.models.Sessions.Get(other.ID)
+		if err != nil {
+			t.Fatalf("the other user's session was revoked: %v", err)
+		}
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		app, _ := newTestApplication(t)
+
+		ctx, _ := startTestSession(t, app, 1)
+
+		_, err := app.RevokeSession(ctx, &users.RevokeSessionRequest{})
+		if status.Code(err) != codes.InvalidArgument {
+			t.Fatalf("got %v, want InvalidArgument", err)
+		}
+	})
+}
+
+func TestRevokeOtherSessions(t *testing.T) {
+	app, _ := newTestApplication(t)
+
+	startTestSession(t, app, 1)
+	startTestSession(t, app, 1)
+	ctx, current := startTestSession(t, app, 1)
+	startTestSession(t, app, 2)
+
+	_, err := app.RevokeOtherSessions(ctx, &users.RevokeOtherSessionsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sessions, err := app.models.Sessions.GetAllForUser(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sessions) != 1 || sessions[0].ID != current.ID {
+		t.Fatalf("got %d sessions, want only the current one", len(sessions))
+	}
+
+	sessions, err = app.models.Sessions.GetAllForUser(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sessions) != 1 {
+		t.Fatal("sessions of another user were revoked")
+	}
+}
+
+func TestLogout(t *testing.T) {
+	t.Run("Current", func(t *testing.T) {
+		app, _ := newTestApplication(t)
+
+		_, other := startTestSession(t, app, 1)
+		ctx, current := startTestSession(t, app, 1)
+
+		_, err := app.Logout(ctx, &users.LogoutRequest{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := app.models.Sessions.Get(current.ID); !errors.Is(err, data.ErrRecordNotFound) {
+			t.Fatalf("got %v, want the current session ended", err)
+		}
+
+		if _, err := app.models.Sessions.Get(other.ID); err != nil {
+			t.Fatalf("another session was ended: %v", err)
+		}
+	})
+
+	t.Run("AllSessions", func(t *testing.T) {
+		app, _ := newTestApplication(t)
+
+		startTestSession(t, app, 1)
+		ctx, _ := startTestSession(t, app, 1)
+
+		_, err := app.Logout(ctx, &users.LogoutRequest{AllSessions: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sessions, err := app.models.Sessions.GetAllForUser(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(sessions) != 0 {
+			t.Fatalf("got %d sessions, want none", len(sessions))
+		}
+	})
+}
+
+// loginTestUser inserts a user and signs them in, returning the tokens issued
+// to the new session
+func loginTestUser(t *testing.T, app *application) *users.LoginResponse {
+	t.Helper()
+
+	ctx := context.Background()
+
+	user := &data.User{Name: "Alice", Email: "alice@dinghy.test", Activated: true}
+	err := app.models.Users.InsertContext(ctx, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := app.issueSessionTokens(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return res
+}
+
+func TestRefreshToken(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Rotates", func(t *testing.T) {
+		app, _ := newTestApplication(t)
+
+		login := loginTestUser(t, app)
+
+		res, err := app.RefreshToken(ctx, &users.RefreshTokenRequest{RefreshTokenPlaintext: login.RefreshTokenPlaintext})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if res.RefreshTokenPlaintext == login.RefreshTokenPlaintext || res.TokenPlaintext == login.TokenPlaintext {
+			t.Fatal("tokens were not rotated")
+		}
+
+		_, err = app.getSession(ctx, login.TokenPlaintext)
+		if status.Code(err) != codes.Unauthenticated {
+			t.Fatalf("got %v, want the previous access token rejected", err)
+		}
+
+		_, err = app.getSession(ctx, res.TokenPlaintext)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = app.RefreshToken(ctx, &users.RefreshTokenRequest{RefreshTokenPlaintext: res.RefreshTokenPlaintext})
+		if err != nil {
+			t.Fatalf("the rotated refresh token is not accepted: %v", err)
+		}
+	})
+
+	t.Run("ReuseRevokesFamily", func(t *testing.T) {
+		app, _ := newTestApplication(t)
+
+		login := loginTestUser(t, app)
+
+		res, err := app.RefreshToken(ctx, &users.RefreshTokenRequest{RefreshTokenPlaintext: login.RefreshTokenPlaintext})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = app.RefreshToken(ctx, &users.RefreshTokenRequest{RefreshTokenPlaintext: login.RefreshTokenPlaintext})
+		if status.Code(err) != codes.Unauthenticated {
+			t.Fatalf("got %v, want the reused token rejected", err)
+		}
+
+		// the latest token of the family goes along with the session
+		_, err = app.RefreshToken(ctx, &users.RefreshTokenRequest{RefreshTokenPlaintext: res.RefreshTokenPlaintext})
+		if status.Code(err) != codes.Unauthenticated {
+			t.Fatalf("got %v, want the latest token revoked", err)
+		}
+
+		_, err = app.getSession(ctx, res.TokenPlaintext)
+		if status.Code(err) != codes.Unauthenticated {
+			t.Fatalf("got %v, want the session revoked", err)
+		}
+	})
+
+	t.Run("Idle", func(t *testing.T) {
+		app, _ := newTestApplication(t)
+
+		login := loginTestUser(t, app)
+
+		session, err := app.getSession(ctx, login.TokenPlaintext)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = app.recordActivity(ctx, session, time.Now().Add(-time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = app.RefreshToken(ctx, &users.RefreshTokenRequest{RefreshTokenPlaintext: login.RefreshTokenPlaintext})
+		if reason := sessionErrorReason(err); reason != reasonSessionIdle {
+			t.Fatalf("got %v, want %s", err, reasonSessionIdle)
+		}
+
+		// the turned down token is not burnt
+		token, err := app.models.RefreshTokens.GetForToken(login.RefreshTokenPlaintext)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if token.RotatedAt != nil {
+			t.Fatal("refresh token was rotated")
+		}
+	})
+
+	t.Run("RevokedSession", func(t *testing.T) {
+		app, _ := newTestApplication(t)
+
+		login := loginTestUser(t, app)
+
+		session, err := app.getSession(ctx, login.TokenPlaintext)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = app.models.Sessions.DeleteForUser(session.ID, session.UserID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = app.RefreshToken(ctx, &users.RefreshTokenRequest{RefreshTokenPlaintext: login.RefreshTokenPlaintext})
+		if status.Code(err) != codes.Unauthenticated {
+			t.Fatalf("got %v, want Unauthenticated", err)
+		}
+	})
+
+	t.Run("AccessToken", func(t *testing.T) {
+		app, _ := newTestApplication(t)
+
+		login := loginTestUser(t, app)
+
+		_, err := app.RefreshToken(ctx, &users.RefreshTokenRequest{RefreshTokenPlaintext: login.TokenPlaintext})
+		if status.Code(err) != codes.Unauthenticated {
+			t.Fatalf("got %v, want an access token refused", err)
+		}
+	})
+}
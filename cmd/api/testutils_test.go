@@ -0,0 +1,1352 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/saarwasserman/users/internal/data"
+	"github.com/saarwasserman/users/internal/jsonlog"
+	"github.com/saarwasserman/users/internal/webauthn"
+	"github.com/saarwasserman/users/protogen/auth"
+)
+
+// fakeAuth stands in for the authentication service, keeping passwords,
+// permissions and tokens in memory. failures maps a method name to the error
+// calls of it fail with. methods it doesn't implement panic through the nil
+// embedded client
+type fakeAuth struct {
+	auth.AuthenticationClient
+
+	mu          sync.Mutex
+	failures    map[string]error
+	calls       []string
+	passwords   map[int64]string
+	permissions map[int64][]string
+	tokens      map[string]fakeToken
+	lastToken   int
+}
+
+type fakeToken struct {
+	scope  string
+	userId int64
+}
+
+func newFakeAuth() *fakeAuth {
+	return &fakeAuth{
+		failures:    make(map[string]error),
+		passwords:   make(map[int64]string),
+		permissions: make(map[int64][]string),
+		tokens:      make(map[string]fakeToken),
+	}
+}
+
+// call records a call of the method and returns the error it should fail with
+func (f *fakeAuth) call(method string) error {
+	f.calls = append(f.calls, method)
+	return f.failures[method]
+}
+
+func (f *fakeAuth) Calls() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]string(nil), f.calls...)
+}
+
+func (f *fakeAuth) SetPassword(ctx context.Context, in *auth.SetPasswordRequest, opts ...grpc.CallOption) (*auth.SetPasswordResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("SetPassword"); err != nil {
+		return nil, err
+	}
+
+	f.passwords[in.UserId] = in.Password
+	return &auth.SetPasswordResponse{}, nil
+}
+
+func (f *fakeAuth) CheckPassword(ctx context.Context, in *auth.CheckPasswordRequest, opts ...grpc.CallOption) (*auth.CheckPasswordResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("CheckPassword"); err != nil {
+		return nil, err
+	}
+
+	password, ok := f.passwords[in.UserId]
+	return &auth.CheckPasswordResponse{Matches: ok && password == in.Password}, nil
+}
+
+func (f *fakeAuth) DeletePassword(ctx context.Context, in *auth.PasswordDeletionRequest, opts ...grpc.CallOption) (*auth.PasswordDeletionResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("DeletePassword"); err != nil {
+		return nil, err
+	}
+
+	delete(f.passwords, in.UserId)
+	return &auth.PasswordDeletionResponse{}, nil
+}
+
+func (f *fakeAuth) AddPermissionForUser(ctx context.Context, in *auth.AddPermissionForUserRequest, opts ...grpc.CallOption) (*auth.AddPermissionForUserResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("AddPermissionForUser"); err != nil {
+		return nil, err
+	}
+
+	f.permissions[in.UserId] = append(f.permissions[in.UserId], in.Codes...)
+	return &auth.AddPermissionForUserResponse{}, nil
+}
+
+func (f *fakeAuth) DeleteAllPermissionsForUser(ctx context.Context, in *auth.PermissionsDeletionRequest, opts ...grpc.CallOption) (*auth.PermissionsDeletionResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("DeleteAllPermissionsForUser"); err != nil {
+		return nil, err
+	}
+
+	delete(f.permissions, in.UserId)
+	return &auth.PermissionsDeletionResponse{}, nil
+}
+
+func (f *fakeAuth) GetPermissionsForUser(ctx context.Context, in *auth.GetPermissionsForUserRequest, opts ...grpc.CallOption) (*auth.GetPermissionsForUserResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("GetPermissionsForUser"); err != nil {
+		return nil, err
+	}
+
+	return &auth.GetPermissionsForUserResponse{Codes: append([]string(nil), f.permissions[in.UserId]...)}, nil
+}
+
+func (f *fakeAuth) CreateToken(ctx context.Context, in *auth.TokenCreationRequest, opts ...grpc.CallOption) (*auth.TokenCreationResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("CreateToken"); err != nil {
+		return nil, err
+	}
+
+	f.lastToken++
+
+	token := fmt.Sprintf("%026d", f.lastToken)
+	f.tokens[token] = fakeToken{scope: in.Scope, userId: in.UserId}
+
+	return &auth.TokenCreationResponse{TokenPlaintext: token}, nil
+}
+
+// Authenticate accepts the tokens created by CreateToken for the scope and not
+// deleted since
+func (f *fakeAuth) Authenticate(ctx context.Context, in *auth.AuthenticationRequest, opts ...grpc.CallOption) (*auth.AuthenticationResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("Authenticate"); err != nil {
+		return nil, err
+	}
+
+	token, ok := f.tokens[in.TokenPlaintext]
+	if !ok || token.scope != in.TokenScope {
+		return nil, status.Error(codes.Unauthenticated, "invalid or expired token")
+	}
+
+	return &auth.AuthenticationResponse{UserId: token.userId}, nil
+}
+
+func (f *fakeAuth) DeleteAllTokensForUser(ctx context.Context, in *auth.TokensDeletionRequest, opts ...grpc.CallOption) (*auth.TokensDeletionResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("DeleteAllTokensForUser"); err != nil {
+		return nil, err
+	}
+
+	for plaintext, token := range f.tokens {
+		if token.userId == in.UserId && token.scope == in.Scope {
+			delete(f.tokens, plaintext)
+		}
+	}
+
+	return &auth.TokensDeletionResponse{}, nil
+}
+
+// fakeOutbox keeps outbox messages in memory. ClaimDue hands out the pending
+// ones regardless of when they are due
+type fakeOutbox struct {
+	mu       sync.Mutex
+	messages map[int64]*data.OutboxMessage
+	lastId   int64
+}
+
+func newFakeOutbox() *fakeOutbox {
+	return &fakeOutbox{messages: make(map[int64]*data.OutboxMessage)}
+}
+
+func (f *fakeOutbox) Enqueue(messages ...*data.OutboxMessage) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, message := range messages {
+		f.lastId++
+		message.ID = f.lastId
+		f.messages[message.ID] = message
+	}
+
+	return nil
+}
+
+func (f *fakeOutbox) ClaimDue(limit int, lease time.Duration) ([]*data.OutboxMessage, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	messages := []*data.OutboxMessage{}
+
+	for _, message := range f.messages {
+		if message.Status == data.OutboxPending && len(messages) < limit {
+			messages = append(messages, message)
+		}
+	}
+
+	return messages, nil
+}
+
+func (f *fakeOutbox) Delete(id int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.messages[id]; !ok {
+		return data.ErrRecordNotFound
+	}
+
+	delete(f.messages, id)
+	return nil
+}
+
+func (f *fakeOutbox) Fail(message *data.OutboxMessage, lastError string, nextAttemptAt time.Time) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	message.Attempts++
+	message.LastError = lastError
+	message.NextAttemptAt = nextAttemptAt
+	return nil
+}
+
+func (f *fakeOutbox) Bury(message *data.OutboxMessage, lastError string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	message.Status = data.OutboxDead
+	message.Attempts++
+	message.LastError = lastError
+	message.Payload = nil
+	return nil
+}
+
+func (f *fakeOutbox) DeleteDead(createdBefore time.Time) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for id, message := range f.messages {
+		if message.Status == data.OutboxDead && message.CreatedAt.Before(createdBefore) {
+			delete(f.messages, id)
+		}
+	}
+
+	return nil
+}
+
+func (f *fakeOutbox) GetAllForUser(userId int64) ([]*data.OutboxMessage, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	messages := []*data.OutboxMessage{}
+
+	for id := int64(1); id <= f.lastId; id++ {
+		if message, ok := f.messages[id]; ok && message.UserID == userId {
+			messages = append(messages, message)
+		}
+	}
+
+	return messages, nil
+}
+
+// Get returns the message with the id, or nil once it was deleted
+func (f *fakeOutbox) Get(id int64) *data.OutboxMessage {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.messages[id]
+}
+
+// openOutboxPayload decodes the payload of the message into dst
+func openOutboxPayload(t *testing.T, app *application, message *data.OutboxMessage, dst any) {
+	t.Helper()
+
+	encoded, err := message.OpenPayload(app.outboxCipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = json.Unmarshal(encoded, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// fakeSessions keeps sessions in memory. users is where IsKnownAddress looks
+// up the account of an email
+type fakeSessions struct {
+	mu       sync.Mutex
+	users    data.UserRepository
+	sessions map[int64]*data.Session
+	lastId   int64
+}
+
+func newFakeSessions(users data.UserRepository) *fakeSessions {
+	return &fakeSessions{
+		users:    users,
+		sessions: make(map[int64]*data.Session),
+	}
+}
+
+func sessionTokenHash(tokenPlaintext string) []byte {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+	return tokenHash[:]
+}
+
+// live returns the stored session with the id unless it expired
+func (f *fakeSessions) live(sessionId int64) (*data.Session, bool) {
+	session, ok := f.sessions[sessionId]
+	if !ok || !session.Expiry.After(time.Now()) {
+		return nil, false
+	}
+
+	return session, true
+}
+
+func (f *fakeSessions) Insert(session *data.Session, tokenPlaintext string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.lastId++
+
+	session.ID = f.lastId
+	session.CreatedAt = time.Now()
+	session.TokenHash = sessionTokenHash(tokenPlaintext)
+
+	stored := *session
+	f.sessions[session.ID] = &stored
+
+	return nil
+}
+
+func (f *fakeSessions) GetForToken(tokenPlaintext string) (*data.Session, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	tokenHash := sessionTokenHash(tokenPlaintext)
+
+	for id := range f.sessions {
+		session, ok := f.live(id)
+		if ok && bytes.Equal(session.TokenHash, tokenHash) {
+			c := *session
+			return &c, nil
+		}
+	}
+
+	return nil, data.ErrRecordNotFound
+}
+
+func (f *fakeSessions) IsKnownAddress(email, clientIP string) (bool, error) {
+	user, err := f.users.GetByEmailContext(context.Background(), email)
+	if err != nil {
+		if errors.Is(err, data.ErrRecordNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for id := range f.sessions {
+		session, ok := f.live(id)
+		if ok && session.UserID == user.ID && session.ClientIP == clientIP {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (f *fakeSessions) GetAllForUser(userId int64) ([]*data.Session, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	sessions := []*data.Session{}
+
+	for id := range f.sessions {
+		session, ok := f.live(id)
+		if ok && session.UserID == userId {
+			c := *session
+			sessions = append(sessions, &c)
+		}
+	}
+
+	// newest first
+	slices.SortFunc(sessions, func(a, b *data.Session) int {
+		if order := b.CreatedAt.Compare(a.CreatedAt); order != 0 {
+			return order
+		}
+		return cmp.Compare(b.ID, a.ID)
+	})
+
+	return sessions, nil
+}
+
+func (f *fakeSessions) DeleteForUser(sessionId, userId int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	session, ok := f.sessions[sessionId]
+	if !ok || session.UserID != userId {
+		return data.ErrRecordNotFound
+	}
+
+	delete(f.sessions, sessionId)
+	return nil
+}
+
+func (f *fakeSessions) DeleteAllForUser(userId, exceptSessionId int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for id, session := range f.sessions {
+		if session.UserID == userId && id != exceptSessionId {
+			delete(f.sessions, id)
+		}
+	}
+
+	return nil
+}
+
+func (f *fakeSessions) Get(sessionId int64) (*data.Session, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	session, ok := f.live(sessionId)
+	if !ok {
+		return nil, data.ErrRecordNotFound
+	}
+
+	c := *session
+	return &c, nil
+}
+
+func (f *fakeSessions) UpdateToken(session *data.Session, tokenPlaintext string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	stored, ok := f.sessions[session.ID]
+	if !ok {
+		return data.ErrRecordNotFound
+	}
+
+	stored.TokenHash = sessionTokenHash(tokenPlaintext)
+	session.TokenHash = stored.TokenHash
+
+	return nil
+}
+
+// fakeIdempotencyKeys keeps idempotency keys in memory
+type fakeIdempotencyKeys struct {
+	mu   sync.Mutex
+	keys map[string]*data.IdempotencyKey
+}
+
+func newFakeIdempotencyKeys() *fakeIdempotencyKeys {
+	return &fakeIdempotencyKeys{keys: make(map[string]*data.IdempotencyKey)}
+}
+
+func idempotencyKeyId(userId int64, key string) string {
+	return fmt.Sprintf("%d:%s", userId, key)
+}
+
+func (f *fakeIdempotencyKeys) Reserve(key *data.IdempotencyKey, staleAfter time.Duration) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	id := idempotencyKeyId(key.UserID, key.Key)
+
+	if stored, ok := f.keys[id]; ok && stored.Expiry.After(time.Now()) {
+		return data.ErrDuplicateIdempotencyKey
+	}
+
+	key.CreatedAt = time.Now()
+
+	stored := *key
+	f.keys[id] = &stored
+
+	return nil
+}
+
+func (f *fakeIdempotencyKeys) Get(userId int64, key string) (*data.IdempotencyKey, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	stored, ok := f.keys[idempotencyKeyId(userId, key)]
+	if !ok {
+		return nil, data.ErrRecordNotFound
+	}
+
+	c := *stored
+	return &c, nil
+}
+
+func (f *fakeIdempotencyKeys) Complete(userId int64, key string, response []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	stored, ok := f.keys[idempotencyKeyId(userId, key)]
+	if !ok || stored.Response != nil {
+		return data.ErrRecordNotFound
+	}
+
+	stored.Response = response
+	return nil
+}
+
+func (f *fakeIdempotencyKeys) Release(userId int64, key string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	id := idempotencyKeyId(userId, key)
+
+	if stored, ok := f.keys[id]; ok && stored.Response == nil {
+		delete(f.keys, id)
+	}
+
+	return nil
+}
+
+func (f *fakeIdempotencyKeys) DeleteExpired() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for id, stored := range f.keys {
+		if stored.Expiry.Before(time.Now()) {
+			delete(f.keys, id)
+		}
+	}
+
+	return nil
+}
+
+// newTestApplication returns an application keeping users, registrations,
+// outbox messages, idempotency keys, sessions, refresh tokens, login throttles,
+// email changes, TOTP secrets, recovery codes, passkeys and identities in
+// memory and talking to a fake authentication service
+func newTestApplication(t *testing.T) (*application, *fakeAuth) {
+	t.Helper()
+
+	users := data.NewMemoryUserRepository()
+	outbox := newFakeOutbox()
+	sessions := newFakeSessions(users)
+	recoveryCodes := newFakeRecoveryCodes()
+	fake := newFakeAuth()
+
+	outboxCipher, err := newEphemeralCipher()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idempotencyHashKey, err := randomKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secrets, err := newEphemeralCipher()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	relyingParty := webauthn.RelyingParty{
+		ID:                      "dinghy.test",
+		Name:                    "Dinghy",
+		Origins:                 []string{"https://dinghy.test"},
+		RequireUserVerification: true,
+	}
+
+	var cfg config
+	cfg.limiter.rps = 100
+	cfg.limiter.burst = 100
+	cfg.limiter.sensitiveRps = 100
+	cfg.limiter.sensitiveBurst = 100
+	cfg.deletion.gracePeriod = 30 * 24 * time.Hour
+	cfg.session.inactivityTime = 5
+	cfg.session.maxLifetime = 24 * time.Hour
+	cfg.session.accessTokenTTL = 15 * time.Minute
+	cfg.lockout.threshold = 5
+	cfg.lockout.ipThreshold = 20
+	cfg.lockout.window = time.Hour
+	cfg.lockout.backoff = time.Second
+	cfg.lockout.duration = 15 * time.Minute
+	cfg.lockout.resetAfter = 24 * time.Hour
+	cfg.mfa.issuer = "Dinghy"
+	cfg.mfa.skew = 1
+
+	app := &application{
+		config: cfg,
+		logger: jsonlog.New(io.Discard, jsonlog.LevelOff),
+		models: data.Models{
+			Users:           users,
+			Registrations:   data.NewMemoryRegistrationRepository(users),
+			Outbox:          outbox,
+			LoginThrottles:  newFakeLoginThrottles(outbox),
+			EmailChanges:    newFakeEmailChanges(outbox),
+			TOTP:            newFakeTOTP(recoveryCodes),
+			RecoveryCodes:   recoveryCodes,
+			Passkeys:        newFakePasskeys(),
+			Identities:      newFakeIdentities(),
+			IdempotencyKeys: newFakeIdempotencyKeys(),
+			Sessions:        sessions,
+			RefreshTokens:   newFakeRefreshTokens(sessions),
+		},
+		auth:               fake,
+		passwords:          authPasswordVerifier{client: fake},
+		limiter:            newRateLimiter(cfg),
+		permissions:        newPermissionCache(time.Minute),
+		activity:           newMemoryActivityStore(),
+		secrets:            secrets,
+		webauthn:           relyingParty,
+		outboxCipher:       outboxCipher,
+		idempotencyHashKey: idempotencyHashKey,
+	}
+
+	return app, fake
+}
+
+// testPassword is the password of users inserted by insertTestUser
+const testPassword = "pa55word1234"
+
+// insertTestUser inserts an activated user with a password and returns
+// them along with the context of a call made by them
+func insertTestUser(t *testing.T, app *application, fake *fakeAuth) (*data.User, context.Context) {
+	t.Helper()
+
+	ctx := context.Background()
+
+	user := &data.User{Name: "Alice", Email: "alice@dinghy.test", Activated: true}
+	err := app.models.Users.InsertContext(ctx, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = fake.SetPassword(ctx, &auth.SetPasswordRequest{UserId: user.ID, Password: testPassword})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return user, app.contextSetUserId(ctx, user.ID)
+}
+
+// adminContext returns the context of a call made by an admin. permissions
+// are checked by the interceptors, so any user will do
+func adminContext(app *application) context.Context {
+	return app.contextSetUserId(context.Background(), 100)
+}
+
+// waitFor waits for work done in the background until done reports it is
+// finished, failing the test if it takes too long
+func waitFor(t *testing.T, done func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for background work")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// fakeRefreshTokens keeps refresh tokens in memory. like the foreign key in
+// the database, the tokens of a deleted session are gone with it
+type fakeRefreshTokens struct {
+	mu       sync.Mutex
+	sessions data.SessionRepository
+	tokens   map[string]*data.RefreshToken
+}
+
+func newFakeRefreshTokens(sessions data.SessionRepository) *fakeRefreshTokens {
+	return &fakeRefreshTokens{
+		sessions: sessions,
+		tokens:   make(map[string]*data.RefreshToken),
+	}
+}
+
+func (f *fakeRefreshTokens) Insert(sessionId int64, tokenPlaintext string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.tokens[string(sessionTokenHash(tokenPlaintext))] = &data.RefreshToken{
+		SessionID: sessionId,
+		CreatedAt: time.Now(),
+	}
+
+	return nil
+}
+
+func (f *fakeRefreshTokens) get(tokenPlaintext string) (*data.RefreshToken, error) {
+	token, ok := f.tokens[string(sessionTokenHash(tokenPlaintext))]
+	if !ok {
+		return nil, data.ErrRecordNotFound
+	}
+
+	_, err := f.sessions.Get(token.SessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+func (f *fakeRefreshTokens) GetForToken(tokenPlaintext string) (*data.RefreshToken, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	token, err := f.get(tokenPlaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	c := *token
+	return &c, nil
+}
+
+func (f *fakeRefreshTokens) MarkRotated(tokenPlaintext string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	token, err := f.get(tokenPlaintext)
+	if err != nil {
+		if errors.Is(err, data.ErrRecordNotFound) {
+			return data.ErrEditConflict
+		}
+		return err
+	}
+
+	if token.RotatedAt != nil {
+		return data.ErrEditConflict
+	}
+
+	now := time.Now()
+	token.RotatedAt = &now
+
+	return nil
+}
+
+// fakeLoginThrottles keeps login throttles in memory, the messages of a lock
+// go to the outbox
+type fakeLoginThrottles struct {
+	mu        sync.Mutex
+	outbox    data.OutboxRepository
+	throttles map[string]*data.LoginThrottle
+}
+
+func newFakeLoginThrottles(outbox data.OutboxRepository) *fakeLoginThrottles {
+	return &fakeLoginThrottles{
+		outbox:    outbox,
+		throttles: make(map[string]*data.LoginThrottle),
+	}
+}
+
+func loginThrottleId(kind, subject string) string {
+	return kind + ":" + subject
+}
+
+func (f *fakeLoginThrottles) Get(kind, subject string) (*data.LoginThrottle, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	throttle, ok := f.throttles[loginThrottleId(kind, subject)]
+	if !ok {
+		return &data.LoginThrottle{Kind: kind, Subject: subject}, nil
+	}
+
+	c := *throttle
+	return &c, nil
+}
+
+func (f *fakeLoginThrottles) RecordFailure(kind, subject string, resetAfter time.Duration) (*data.LoginThrottle, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := time.Now()
+
+	throttle, ok := f.throttles[loginThrottleId(kind, subject)]
+	switch {
+	case !ok:
+		throttle = &data.LoginThrottle{Kind: kind, Subject: subject, Failures: 1}
+		f.throttles[loginThrottleId(kind, subject)] = throttle
+	case throttle.LastFailureAt.Before(now.Add(-resetAfter)):
+		throttle.Failures = 1
+	default:
+		throttle.Failures++
+	}
+
+	throttle.LastFailureAt = now
+
+	c := *throttle
+	return &c, nil
+}
+
+func (f *fakeLoginThrottles) Lock(throttle *data.LoginThrottle, until time.Time, messages ...*data.OutboxMessage) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	stored, ok := f.throttles[loginThrottleId(throttle.Kind, throttle.Subject)]
+	if !ok {
+		return data.ErrRecordNotFound
+	}
+
+	stored.Failures = 0
+	stored.Lockouts++
+	stored.LockedUntil = &until
+
+	*throttle = *stored
+
+	return f.outbox.Enqueue(messages...)
+}
+
+func (f *fakeLoginThrottles) Delete(kind, subject string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.throttles, loginThrottleId(kind, subject))
+	return nil
+}
+
+func (f *fakeLoginThrottles) DeleteInactive(before time.Time) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for id, throttle := range f.throttles {
+		last := throttle.LastFailureAt
+		if throttle.LockedUntil != nil && throttle.LockedUntil.After(last) {
+			last = *throttle.LockedUntil
+		}
+
+		if last.Before(before) {
+			delete(f.throttles, id)
+		}
+	}
+
+	return nil
+}
+
+// fakeEmailChanges keeps pending email changes in memory, the messages
+// announcing a change go to the outbox
+type fakeEmailChanges struct {
+	mu      sync.Mutex
+	outbox  data.OutboxRepository
+	changes map[int64]*data.EmailChange
+}
+
+func newFakeEmailChanges(outbox data.OutboxRepository) *fakeEmailChanges {
+	return &fakeEmailChanges{
+		outbox:  outbox,
+		changes: make(map[int64]*data.EmailChange),
+	}
+}
+
+func (f *fakeEmailChanges) Upsert(change *data.EmailChange, messages ...*data.OutboxMessage) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	change.CreatedAt = time.Now()
+
+	stored := *change
+	f.changes[change.UserID] = &stored
+
+	return f.outbox.Enqueue(messages...)
+}
+
+func (f *fakeEmailChanges) GetForUser(userId int64) (*data.EmailChange, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	change, ok := f.changes[userId]
+	if !ok || !change.Expiry.After(time.Now()) {
+		return nil, data.ErrRecordNotFound
+	}
+
+	c := *change
+	return &c, nil
+}
+
+func (f *fakeEmailChanges) DeleteForUser(userId int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.changes, userId)
+	return nil
+}
+
+// fakeTOTP keeps TOTP secrets in memory, replacing the recovery codes of the
+// user when a secret is confirmed or deleted
+type fakeTOTP struct {
+	mu            sync.Mutex
+	recoveryCodes data.RecoveryCodeRepository
+	credentials   map[int64]*data.TOTPCredential
+}
+
+func newFakeTOTP(recoveryCodes data.RecoveryCodeRepository) *fakeTOTP {
+	return &fakeTOTP{
+		recoveryCodes: recoveryCodes,
+		credentials:   make(map[int64]*data.TOTPCredential),
+	}
+}
+
+func (f *fakeTOTP) Upsert(credential *data.TOTPCredential) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if stored, ok := f.credentials[credential.UserID]; ok && stored.Confirmed {
+		return data.ErrEditConflict
+	}
+
+	credential.CreatedAt = time.Now()
+
+	f.credentials[credential.UserID] = &data.TOTPCredential{
+		UserID:           credential.UserID,
+		SecretCiphertext: credential.SecretCiphertext,
+		CreatedAt:        credential.CreatedAt,
+	}
+
+	return nil
+}
+
+func (f *fakeTOTP) GetForUser(userId int64) (*data.TOTPCredential, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	credential, ok := f.credentials[userId]
+	if !ok {
+		return nil, data.ErrRecordNotFound
+	}
+
+	c := *credential
+	return &c, nil
+}
+
+func (f *fakeTOTP) IsEnabled(userId int64) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	credential, ok := f.credentials[userId]
+	return ok && credential.Confirmed, nil
+}
+
+func (f *fakeTOTP) UseStep(credential *data.TOTPCredential, step int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	stored, ok := f.credentials[credential.UserID]
+	if !ok || !stored.Confirmed || stored.LastUsedStep >= step {
+		return data.ErrEditConflict
+	}
+
+	stored.LastUsedStep = step
+	credential.LastUsedStep = step
+
+	return nil
+}
+
+func (f *fakeTOTP) Confirm(credential *data.TOTPCredential, step int64, recoveryCodes []string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	stored, ok := f.credentials[credential.UserID]
+	if !ok || stored.Confirmed || stored.LastUsedStep >= step {
+		return data.ErrEditConflict
+	}
+
+	err := f.recoveryCodes.Replace(credential.UserID, recoveryCodes)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+
+	stored.LastUsedStep = step
+	stored.Confirmed = true
+	stored.ConfirmedAt = &now
+
+	*credential = *stored
+
+	return nil
+}
+
+func (f *fakeTOTP) Delete(userId int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.credentials[userId]; !ok {
+		return data.ErrRecordNotFound
+	}
+
+	delete(f.credentials, userId)
+
+	return f.recoveryCodes.Replace(userId, nil)
+}
+
+func (f *fakeTOTP) AnyConfirmed() (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, credential := range f.credentials {
+		if credential.Confirmed {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// fakeRecoveryCodes keeps recovery codes in memory by their normalized form
+type fakeRecoveryCodes struct {
+	mu    sync.Mutex
+	codes map[int64]map[string]*data.RecoveryCode
+}
+
+func newFakeRecoveryCodes() *fakeRecoveryCodes {
+	return &fakeRecoveryCodes{codes: make(map[int64]map[string]*data.RecoveryCode)}
+}
+
+func normalizeFakeRecoveryCode(code string) string {
+	return strings.NewReplacer("-", "", " ", "").Replace(strings.ToLower(code))
+}
+
+func (f *fakeRecoveryCodes) Replace(userId int64, codes []string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.codes[userId] = make(map[string]*data.RecoveryCode)
+
+	for _, code := range codes {
+		f.codes[userId][normalizeFakeRecoveryCode(code)] = &data.RecoveryCode{CreatedAt: time.Now()}
+	}
+
+	return nil
+}
+
+func (f *fakeRecoveryCodes) Use(userId int64, code string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	stored, ok := f.codes[userId][normalizeFakeRecoveryCode(code)]
+	if !ok || stored.UsedAt != nil {
+		return data.ErrRecordNotFound
+	}
+
+	now := time.Now()
+	stored.UsedAt = &now
+
+	return nil
+}
+
+func (f *fakeRecoveryCodes) CountUnused(userId int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	count := 0
+	for _, stored := range f.codes[userId] {
+		if stored.UsedAt == nil {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+func (f *fakeRecoveryCodes) GetAllForUser(userId int64) ([]*data.RecoveryCode, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	codes := []*data.RecoveryCode{}
+	for _, stored := range f.codes[userId] {
+		c := *stored
+		codes = append(codes, &c)
+	}
+
+	return codes, nil
+}
+
+// fakePasskeys keeps passkeys and ceremony challenges in memory
+type fakePasskeys struct {
+	mu         sync.Mutex
+	passkeys   []*data.Passkey
+	challenges map[string]fakeChallenge
+}
+
+type fakeChallenge struct {
+	ceremony string
+	userId   int64
+	expiry   time.Time
+}
+
+func newFakePasskeys() *fakePasskeys {
+	return &fakePasskeys{challenges: make(map[string]fakeChallenge)}
+}
+
+func (f *fakePasskeys) Insert(passkey *data.Passkey) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, stored := range f.passkeys {
+		if bytes.Equal(stored.CredentialID, passkey.CredentialID) {
+			return data.ErrDuplicatePasskey
+		}
+	}
+
+	passkey.CreatedAt = time.Now()
+
+	stored := *passkey
+	f.passkeys = append(f.passkeys, &stored)
+
+	return nil
+}
+
+func (f *fakePasskeys) Get(userId int64, credentialId []byte) (*data.Passkey, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, stored := range f.passkeys {
+		if stored.UserID == userId && bytes.Equal(stored.CredentialID, credentialId) {
+			c := *stored
+			return &c, nil
+		}
+	}
+
+	return nil, data.ErrRecordNotFound
+}
+
+func (f *fakePasskeys) GetAllForUser(userId int64) ([]*data.Passkey, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	passkeys := []*data.Passkey{}
+
+	for _, stored := range f.passkeys {
+		if stored.UserID == userId {
+			c := *stored
+			passkeys = append(passkeys, &c)
+		}
+	}
+
+	return passkeys, nil
+}
+
+func (f *fakePasskeys) UpdateSignCount(passkey *data.Passkey, signCount uint32) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, stored := range f.passkeys {
+		if stored.UserID == passkey.UserID && bytes.Equal(stored.CredentialID, passkey.CredentialID) && stored.SignCount == passkey.SignCount {
+			now := time.Now()
+
+			stored.SignCount = signCount
+			stored.LastUsedAt = &now
+
+			passkey.SignCount = signCount
+			passkey.LastUsedAt = &now
+
+			return nil
+		}
+	}
+
+	return data.ErrEditConflict
+}
+
+func (f *fakePasskeys) InsertChallenge(challenge []byte, ceremony string, userId int64, ttl time.Duration) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.challenges[string(challenge)] = fakeChallenge{
+		ceremony: ceremony,
+		userId:   userId,
+		expiry:   time.Now().Add(ttl),
+	}
+
+	return nil
+}
+
+func (f *fakePasskeys) ConsumeChallenge(challenge []byte, ceremony string, userId int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	stored, ok := f.challenges[string(challenge)]
+	if !ok || stored.ceremony != ceremony || stored.userId != userId || !stored.expiry.After(time.Now()) {
+		return data.ErrRecordNotFound
+	}
+
+	delete(f.challenges, string(challenge))
+
+	return nil
+}
+
+func (f *fakePasskeys) DeleteExpiredChallenges() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for challenge, stored := range f.challenges {
+		if stored.expiry.Before(time.Now()) {
+			delete(f.challenges, challenge)
+		}
+	}
+
+	return nil
+}
+
+// fakeIdentities keeps linked identities and sign-in states in memory
+type fakeIdentities struct {
+	mu         sync.Mutex
+	identities []*data.Identity
+	states     map[string]fakeOIDCState
+}
+
+type fakeOIDCState struct {
+	state  data.OIDCState
+	expiry time.Time
+}
+
+func newFakeIdentities() *fakeIdentities {
+	return &fakeIdentities{states: make(map[string]fakeOIDCState)}
+}
+
+func (f *fakeIdentities) Insert(identity *data.Identity) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, stored := range f.identities {
+		if stored.Provider == identity.Provider && (stored.Subject == identity.Subject || stored.UserID == identity.UserID) {
+			return data.ErrDuplicateIdentity
+		}
+	}
+
+	identity.CreatedAt = time.Now()
+
+	stored := *identity
+	f.identities = append(f.identities, &stored)
+
+	return nil
+}
+
+func (f *fakeIdentities) Get(provider, subject string) (*data.Identity, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, stored := range f.identities {
+		if stored.Provider == provider && stored.Subject == subject {
+			c := *stored
+			return &c, nil
+		}
+	}
+
+	return nil, data.ErrRecordNotFound
+}
+
+func (f *fakeIdentities) GetAllForUser(userId int64) ([]*data.Identity, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	identities := []*data.Identity{}
+
+	for _, stored := range f.identities {
+		if stored.UserID == userId {
+			c := *stored
+			identities = append(identities, &c)
+		}
+	}
+
+	return identities, nil
+}
+
+func (f *fakeIdentities) Delete(userId int64, provider string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for i, stored := range f.identities {
+		if stored.UserID == userId && stored.Provider == provider {
+			f.identities = slices.Delete(f.identities, i, i+1)
+			return nil
+		}
+	}
+
+	return data.ErrRecordNotFound
+}
+
+func (f *fakeIdentities) InsertState(statePlaintext string, state *data.OIDCState, ttl time.Duration) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.states[string(sessionTokenHash(statePlaintext))] = fakeOIDCState{
+		state:  *state,
+		expiry: time.Now().Add(ttl),
+	}
+
+	return nil
+}
+
+func (f *fakeIdentities) ConsumeState(statePlaintext string) (*data.OIDCState, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	stateHash := string(sessionTokenHash(statePlaintext))
+
+	stored, ok := f.states[stateHash]
+	if !ok || !stored.expiry.After(time.Now()) {
+		return nil, data.ErrRecordNotFound
+	}
+
+	delete(f.states, stateHash)
+
+	return &stored.state, nil
+}
+
+func (f *fakeIdentities) DeleteExpiredStates() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for stateHash, stored := range f.states {
+		if stored.expiry.Before(time.Now()) {
+			delete(f.states, stateHash)
+		}
+	}
+
+	return nil
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"strconv"
+	"time"
 
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
@@ -11,10 +12,14 @@ import (
 	"github.com/saarwasserman/users/internal/data"
 	"github.com/saarwasserman/users/internal/validator"
 	"github.com/saarwasserman/users/protogen/auth"
-	"github.com/saarwasserman/users/protogen/notifications"
 	"github.com/saarwasserman/users/protogen/users"
 )
 
+const invalidCredentialsMessage = "invalid authentication credentials"
+
+// permissions every new user starts with
+var initialPermissions = []string{"movies:read"}
+
 func (app *application) RegisterUser(ctx context.Context, req *users.UserRegisterRequest) (*users.UserDetailsResponse, error) {
 	user := &data.User{
 		Name:      req.Name,
@@ -31,50 +36,41 @@ func (app *application) RegisterUser(ctx context.Context, req *users.UserRegiste
 		return nil, status.Errorf(codes.InvalidArgument, "error %s", v.Errors)
 	}
 
-	err := app.models.Users.Insert(user)
+	registration, err := app.models.Registrations.Start(ctx, user, data.RegistrationKindPassword, registrationStepUserCreated)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrDuplicateEmail):
 			v.AddError("email", "a user with this email address already exists")
 			return nil, status.Errorf(codes.InvalidArgument, "error %s", v.Errors)
 		default:
-			return nil, status.Error(codes.Internal, err.Error())
+			return nil, queryError(err)
 		}
 	}
 
-	_, err = app.auth.SetPassword(ctx, &auth.SetPasswordRequest{
-		UserId:   user.ID,
-		Password: req.Password,
-	})
-	if err != nil {
-		return nil, status.Error(codes.Internal, "failed to set initial password")
-	}
+	steps := app.registrationSteps(req.Password)
 
-	// add initial permission
-	_, err = app.auth.AddPermissionForUser(ctx, &auth.AddPermissionForUserRequest{
-		UserId: user.ID,
-		Codes:  []string{"movies:read"},
-	})
+	err = app.runRegistration(ctx, registration, steps)
 	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
-	}
+		properties := map[string]string{
+			"registration_id": strconv.FormatInt(registration.ID, 10),
+			"user_id":         strconv.FormatInt(user.ID, 10),
+		}
 
-	tokenResponse, err := app.auth.CreateToken(ctx, &auth.TokenCreationRequest{
-		Scope:  data.ScopeActivation,
-		UserId: user.ID,
-	})
-	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
-	}
+		app.logger.PrintError(err, properties)
 
-	_, err = app.notifier.SendActivationEmail(context.Background(), &notifications.SendActivationEmailRequest{
-		Recipient: user.Email,
-		UserId:    strconv.FormatInt(user.ID, 10),
-		Token:     tokenResponse.TokenPlaintext,
-	})
-	if err != nil {
-		app.logger.PrintFatal(err, nil)
-		return nil, status.Error(codes.Internal, err.Error())
+		// undone right away so the email can be used again, the caller
+		// may have gone already
+		compensationCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+
+		registration.Error = err.Error()
+
+		compensationErr := app.compensateRegistration(compensationCtx, registration, steps)
+		if compensationErr != nil {
+			app.logger.PrintError(compensationErr, properties)
+		}
+
+		return nil, registrationError(err)
 	}
 
 	return &users.UserDetailsResponse{
@@ -83,6 +79,7 @@ func (app *application) RegisterUser(ctx context.Context, req *users.UserRegiste
 		Name:      user.Name,
 		CreatedAt: user.CreatedAt.UnixMilli(),
 		Activated: user.Activated,
+		Version:   int32(user.Version),
 	}, nil
 }
 
@@ -108,26 +105,26 @@ func (app *application) ActivateUser(ctx context.Context, req *users.UserActivat
 		}
 	}
 
-	user, err := app.models.Users.GetByUserId(authRes.UserId)
+	user, err := app.models.Users.GetByUserIdContext(ctx, authRes.UserId)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
 			v.AddError("token", "invalid or expired activation token")
 			return nil, status.Errorf(codes.InvalidArgument, "error: %s", v.Errors)
 		default:
-			return nil, status.Error(codes.Internal, err.Error())
+			return nil, queryError(err)
 		}
 	}
 
 	user.Activated = true
 
-	err = app.models.Users.Update(user)
+	err = app.models.Users.UpdateContext(ctx, user)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrEditConflict):
 			return nil, status.Error(codes.InvalidArgument, "unable to update the record due to an edit conflict, please try again")
 		default:
-			return nil, status.Error(codes.Internal, err.Error())
+			return nil, queryError(err)
 		}
 	}
 
@@ -142,6 +139,56 @@ func (app *application) ActivateUser(ctx context.Context, req *users.UserActivat
 		Name:      user.Name,
 		CreatedAt: user.CreatedAt.UnixMilli(),
 		Activated: user.Activated,
+		Version:   int32(user.Version),
+	}, nil
+}
+
+// ResendActivationEmail replaces the activation token of an account that
+// wasn't activated yet and emails the new one
+func (app *application) ResendActivationEmail(ctx context.Context, req *users.ResendActivationEmailRequest) (*users.ResendActivationEmailResponse, error) {
+	v := validator.New()
+
+	if data.ValidateEmail(v, req.Email); !v.Valid() {
+		return nil, status.Errorf(codes.InvalidArgument, "error %s", v.Errors)
+	}
+
+	err := app.rateLimitByEmail(ctx, req.Email, "ResendActivationEmail")
+	if err != nil {
+		return nil, err
+	}
+
+	// done in the background for the same reason as RequestPasswordReset
+	app.background(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		user, err := app.models.Users.GetByEmailContext(ctx, req.Email)
+		if err != nil {
+			if !errors.Is(err, data.ErrRecordNotFound) {
+				app.logger.PrintError(err, nil)
+			}
+			return
+		}
+
+		if user.Activated {
+			return
+		}
+
+		// only the latest email activates the account
+		message, err := app.activationEmail(ctx, user.ID)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+			return
+		}
+
+		err = app.models.Outbox.Enqueue(message)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+	})
+
+	return &users.ResendActivationEmailResponse{
+		Message: "if your account still needs to be activated, an email will be sent to you containing activation instructions",
 	}, nil
 }
 
@@ -149,13 +196,13 @@ func (app *application) GetUser(ctx context.Context, req *users.UserDetailsReque
 
 	userId := app.contextGetUserId(ctx)
 
-	user, err := app.models.Users.GetByUserId(userId)
+	user, err := app.models.Users.GetByUserIdContext(ctx, userId)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
 			return nil, status.Error(codes.Internal, "user not found")
 		default:
-			return nil, status.Error(codes.Internal, err.Error())
+			return nil, queryError(err)
 		}
 	}
 
@@ -165,34 +212,186 @@ func (app *application) GetUser(ctx context.Context, req *users.UserDetailsReque
 		Name:      user.Name,
 		CreatedAt: user.CreatedAt.UnixMilli(),
 		Activated: user.Activated,
+		Version:   int32(user.Version),
+	}, nil
+}
+
+func (app *application) UpdateUser(ctx context.Context, req *users.UpdateUserRequest) (*users.UserDetailsResponse, error) {
+
+	userId := app.contextGetUserId(ctx)
+
+	v := validator.New()
+
+	v.Check(req.Version > 0, "version", "must be provided")
+
+	if !v.Valid() {
+		return nil, status.Errorf(codes.InvalidArgument, "error %s", v.Errors)
+	}
+
+	user, err := app.models.Users.GetByUserIdContext(ctx, userId)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return nil, status.Error(codes.Internal, "user not found")
+		default:
+			return nil, queryError(err)
+		}
+	}
+
+	// the update only applies to the version the client read, Update
+	// rejects it if the record changed since
+	if int(req.Version) != user.Version {
+		return nil, status.Error(codes.Aborted, "unable to update the record due to an edit conflict, please try again")
+	}
+
+	// only the fields set by the client are updated
+	if req.Name != nil {
+		user.Name = *req.Name
+	}
+
+	if data.ValidateUser(v, user); !v.Valid() {
+		return nil, status.Errorf(codes.InvalidArgument, "error %s", v.Errors)
+	}
+
+	err = app.models.Users.UpdateContext(ctx, user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			return nil, status.Error(codes.Aborted, "unable to update the record due to an edit conflict, please try again")
+		default:
+			return nil, queryError(err)
+		}
+	}
+
+	return &users.UserDetailsResponse{
+		Id:        user.ID,
+		Email:     user.Email,
+		Name:      user.Name,
+		CreatedAt: user.CreatedAt.UnixMilli(),
+		Activated: user.Activated,
+		Version:   int32(user.Version),
 	}, nil
 }
 
 func (app *application) Login(ctx context.Context, req *users.LoginRequest) (*users.LoginResponse, error) {
-	user, err := app.models.Users.GetByEmail(req.Email)
+	v := validator.New()
+
+	data.ValidateEmail(v, req.Email)
+	data.ValidatePlaintextPassword(v, req.Password)
+
+	if !v.Valid() {
+		return nil, status.Errorf(codes.InvalidArgument, "error %s", v.Errors)
+	}
+
+	ip := clientIP(ctx)
+
+	err := app.checkLoginThrottles(ctx, req.Email, ip)
 	if err != nil {
-		app.logger.PrintError(err, nil)
 		return nil, err
 	}
 
-	tokenResponse, err := app.auth.CreateToken(ctx, &auth.TokenCreationRequest{
-		UserId: user.ID,
-		Scope:  data.ScopeAuthentication,
-	})
+	user, err := app.models.Users.GetByEmailContext(ctx, req.Email)
+	if errors.Is(err, data.ErrRecordNotFound) {
+		// accounts pending deletion are restored by logging in during the grace period
+		user, err = app.models.Users.GetPendingDeletionByEmailContext(ctx, req.Email, time.Now().Add(-app.config.deletion.gracePeriod))
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			dummyPasswordCheck(req.Password)
+			app.recordLoginFailure(req.Email, nil, ip)
+			return nil, status.Error(codes.Unauthenticated, invalidCredentialsMessage)
+		default:
+			app.logger.PrintError(err, nil)
+			return nil, queryError(err)
+		}
+	}
+
+	match, err := app.passwords.Verify(ctx, user.ID, req.Password)
 	if err != nil {
 		app.logger.PrintError(err, nil)
-		return nil, err
+		return nil, status.Error(codes.Internal, "failed to verify credentials")
 	}
 
-	return &users.LoginResponse{
-		TokenPlaintext: tokenResponse.TokenPlaintext,
-	}, nil
+	if !match {
+		app.recordLoginFailure(req.Email, user, ip)
+		return nil, status.Error(codes.Unauthenticated, invalidCredentialsMessage)
+	}
+
+	if !user.Activated {
+		return nil, status.Error(codes.PermissionDenied, "your user account must be activated to login")
+	}
+
+	return app.finishFirstFactor(ctx, user)
+}
+
+// finishFirstFactor continues a login whose first factor (a password, a magic
+// link or an identity provider) was verified: users with two-factor
+// authentication get an mfa challenge, everyone else a session. failures are
+// kept until the second step succeeds, or knowing the first factor would
+// allow guessing codes endlessly
+func (app *application) finishFirstFactor(ctx context.Context, user *data.User) (*users.LoginResponse, error) {
+	mfaEnabled, err := app.models.TOTP.IsEnabled(user.ID)
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	if mfaEnabled {
+		res, err := app.mfaChallenge(ctx, user.ID)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+			return nil, status.Error(codes.Internal, "failed to create mfa challenge")
+		}
+
+		return res, nil
+	}
+
+	return app.completeLogin(ctx, user)
+}
+
+// completeLogin starts a session for a user who proved who they are, restoring
+// the account if it is pending deletion
+func (app *application) completeLogin(ctx context.Context, user *data.User) (*users.LoginResponse, error) {
+	app.recordLoginSuccess(user.Email)
+
+	if user.DeletedAt != nil {
+		err := app.models.Users.RestoreContext(ctx, user)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrEditConflict):
+				return nil, status.Error(codes.Aborted, "unable to restore the account due to an edit conflict, please try again")
+			default:
+				return nil, queryError(err)
+			}
+		}
+
+		app.logger.PrintInfo("account deletion cancelled", map[string]string{"user_id": strconv.FormatInt(user.ID, 10)})
+	}
+
+	res, err := app.issueSessionTokens(ctx, user.ID)
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return nil, status.Error(codes.Internal, "failed to start session")
+	}
+
+	return res, nil
 }
 
 func (app *application) Logout(ctx context.Context, req *users.LogoutRequest) (*users.LogoutResponse, error) {
 
 	userId := app.contextGetUserId(ctx)
 
+	if !req.AllSessions {
+		err := app.models.Sessions.DeleteForUser(app.contextGetSessionId(ctx), userId)
+		if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+			app.logger.PrintError(err, nil)
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+
+		return &users.LogoutResponse{}, nil
+	}
+
 	_, err := app.auth.DeleteAllTokensForUser(ctx, &auth.TokensDeletionRequest{
 		Scope:  data.ScopeAuthentication,
 		UserId: userId,
@@ -202,5 +401,11 @@ func (app *application) Logout(ctx context.Context, req *users.LogoutRequest) (*
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
+	err = app.models.Sessions.DeleteAllForUser(userId, 0)
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
 	return &users.LogoutResponse{}, nil
 }
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/saarwasserman/users/internal/data"
+	"github.com/saarwasserman/users/protogen/auth"
+	"github.com/saarwasserman/users/protogen/notifications"
+	"github.com/saarwasserman/users/protogen/users"
+)
+
+func TestRegisterUser(t *testing.T) {
+	ctx := context.Background()
+
+	req := &users.UserRegisterRequest{
+		Name:     "Alice",
+		Email:    "alice@dinghy.test",
+		Password: "pa55word1234",
+	}
+
+	t.Run("Completes", func(t *testing.T) {
+		app, fake := newTestApplication(t)
+		registrations := app.models.Registrations.(*data.MemoryRegistrationRepository)
+
+		res, err := app.RegisterUser(ctx, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		user, err := app.models.Users.GetByEmailContext(ctx, req.Email)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if user.ID != res.Id || user.Activated {
+			t.Fatalf("got user %d activated %t, want user %d not activated", user.ID, user.Activated, res.Id)
+		}
+
+		if fake.passwords[user.ID] != req.Password {
+			t.Fatal("password was not set")
+		}
+
+		messages := registrations.Messages()
+		if len(messages) != 1 || messages[0].Kind != outboxActivationEmail {
+			t.Fatalf("got %d messages, want one activation email", len(messages))
+		}
+
+		registration, err := registrations.Get(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if registration.Status != data.RegistrationCompleted || registration.Step != registrationStepActivationSent {
+			t.Fatalf("got registration %s at %s, want it completed", registration.Status, registration.Step)
+		}
+	})
+
+	t.Run("RollsBack", func(t *testing.T) {
+		app, fake := newTestApplication(t)
+		registrations := app.models.Registrations.(*data.MemoryRegistrationRepository)
+
+		fake.failures["AddPermissionForUser"] = status.Error(codes.Unavailable, "auth is down")
+
+		_, err := app.RegisterUser(ctx, req)
+		if status.Code(err) != codes.Unavailable {
+			t.Fatalf("got %v, want the status of the failed step", err)
+		}
+
+		_, err = app.models.Users.GetByEmailContext(ctx, req.Email)
+		if !errors.Is(err, data.ErrRecordNotFound) {
+			t.Fatalf("got %v, want the user deleted", err)
+		}
+
+		if len(fake.passwords) != 0 {
+			t.Fatal("password was not deleted")
+		}
+
+		registration, err := registrations.Get(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if registration.Status != data.RegistrationRolledBack {
+			t.Fatalf("got registration %s, want it rolled back", registration.Status)
+		}
+
+		// the email is free to register again
+		delete(fake.failures, "AddPermissionForUser")
+
+		_, err = app.RegisterUser(ctx, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("KeepsStepStatus", func(t *testing.T) {
+		app, fake := newTestApplication(t)
+
+		fake.failures["SetPassword"] = status.Error(codes.InvalidArgument, "password is too common")
+
+		_, err := app.RegisterUser(ctx, req)
+		if status.Code(err) != codes.InvalidArgument {
+			t.Fatalf("got %v, want InvalidArgument", err)
+		}
+	})
+}
+
+func TestResendActivationEmail(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Resend", func(t *testing.T) {
+		app, fake := newTestApplication(t)
+		outbox := app.models.Outbox.(*fakeOutbox)
+
+		user := &data.User{Name: "Alice", Email: "alice@dinghy.test"}
+		err := app.models.Users.InsertContext(ctx, user)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		first, err := fake.CreateToken(ctx, &auth.TokenCreationRequest{Scope: data.ScopeActivation, UserId: user.ID})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = app.ResendActivationEmail(ctx, &users.ResendActivationEmailRequest{Email: user.Email})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		waitFor(t, func() bool { return outbox.Get(1) != nil })
+
+		message := outbox.Get(1)
+		if message.Kind != outboxActivationEmail || message.UserID != user.ID {
+			t.Fatalf("got %s for user %d, want an activation email for user %d", message.Kind, message.UserID, user.ID)
+		}
+
+		var payload notifications.SendActivationEmailRequest
+		openOutboxPayload(t, app, message, &payload)
+
+		_, err = fake.Authenticate(ctx, &auth.AuthenticationRequest{TokenScope: data.ScopeActivation, TokenPlaintext: payload.Token})
+		if err != nil {
+			t.Fatalf("the emailed token doesn't activate the account: %v", err)
+		}
+
+		// only the latest email activates the account
+		_, err = fake.Authenticate(ctx, &auth.AuthenticationRequest{TokenScope: data.ScopeActivation, TokenPlaintext: first.TokenPlaintext})
+		if status.Code(err) != codes.Unauthenticated {
+			t.Fatalf("got %v, want the earlier token revoked", err)
+		}
+	})
+
+	t.Run("Throttled", func(t *testing.T) {
+		app := newLimitedApplication(t, 100, 1)
+
+		req := &users.ResendActivationEmailRequest{Email: "alice@dinghy.test"}
+
+		_, err := app.ResendActivationEmail(ctx, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = app.ResendActivationEmail(ctx, req)
+		if status.Code(err) != codes.ResourceExhausted {
+			t.Fatalf("got %v, want ResourceExhausted", err)
+		}
+
+		_, err = app.ResendActivationEmail(ctx, &users.ResendActivationEmailRequest{Email: "bob@dinghy.test"})
+		if err != nil {
+			t.Fatalf("got %v, want another address let through", err)
+		}
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		app, _ := newTestApplication(t)
+
+		_, err := app.ResendActivationEmail(ctx, &users.ResendActivationEmailRequest{Email: "alice"})
+		if status.Code(err) != codes.InvalidArgument {
+			t.Fatalf("got %v, want InvalidArgument", err)
+		}
+	})
+}
+
+// racingUsers updates a user right after handing it out, the way a request
+// landing between the read and the write of another one would
+type racingUsers struct {
+	*data.MemoryUserRepository
+}
+
+func (r racingUsers) GetByUserIdContext(ctx context.Context, userId int64) (*data.User, error) {
+	user, err := r.MemoryUserRepository.GetByUserIdContext(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	racing := *user
+	racing.Name = "Mallory"
+
+	err = r.MemoryUserRepository.UpdateContext(ctx, &racing)
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+func TestUpdateUser(t *testing.T) {
+	t.Run("Update", func(t *testing.T) {
+		app, fake := newTestApplication(t)
+
+		user, ctx := insertTestUser(t, app, fake)
+
+		name := "Alicia"
+		res, err := app.UpdateUser(ctx, &users.UpdateUserRequest{Name: &name, Version: int32(user.Version)})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if res.Name != name || int(res.Version) != user.Version+1 {
+			t.Errorf("got %q at version %d, want %q at version %d", res.Name, res.Version, name, user.Version+1)
+		}
+
+		stored, err := app.models.Users.GetByUserIdContext(ctx, user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if stored.Name != name || stored.Email != user.Email {
+			t.Errorf("got %q <%s>, want %q <%s>", stored.Name, stored.Email, name, user.Email)
+		}
+	})
+
+	t.Run("Unset", func(t *testing.T) {
+		app, fake := newTestApplication(t)
+
+		user, ctx := insertTestUser(t, app, fake)
+
+		// fields the client leaves out keep their value
+		res, err := app.UpdateUser(ctx, &users.UpdateUserRequest{Version: int32(user.Version)})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if res.Name != user.Name {
+			t.Errorf("got name %q, want %q", res.Name, user.Name)
+		}
+	})
+
+	t.Run("StaleVersion", func(t *testing.T) {
+		app, fake := newTestApplication(t)
+
+		user, ctx := insertTestUser(t, app, fake)
+
+		name := "Alicia"
+		_, err := app.UpdateUser(ctx, &users.UpdateUserRequest{Name: &name, Version: int32(user.Version)})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// a second client still holding the first version
+		other := "Ally"
+		_, err = app.UpdateUser(ctx, &users.UpdateUserRequest{Name: &other, Version: int32(user.Version)})
+		if status.Code(err) != codes.Aborted {
+			t.Fatalf("got %v, want %v", err, codes.Aborted)
+		}
+
+		stored, err := app.models.Users.GetByUserIdContext(ctx, user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if stored.Name != name {
+			t.Errorf("got name %q, want %q", stored.Name, name)
+		}
+	})
+
+	t.Run("ConcurrentUpdate", func(t *testing.T) {
+		app, fake := newTestApplication(t)
+
+		memory := app.models.Users.(*data.MemoryUserRepository)
+		user, ctx := insertTestUser(t, app, fake)
+		app.models.Users = racingUsers{memory}
+
+		name := "Alicia"
+		_, err := app.UpdateUser(ctx, &users.UpdateUserRequest{Name: &name, Version: int32(user.Version)})
+		if status.Code(err) != codes.Aborted {
+			t.Fatalf("got %v, want %v", err, codes.Aborted)
+		}
+	})
+
+	t.Run("Validation", func(t *testing.T) {
+		app, fake := newTestApplication(t)
+
+		user, ctx := insertTestUser(t, app, fake)
+
+		empty := ""
+		tests := []struct {
+			name string
+			req  *users.UpdateUserRequest
+		}{
+			{"NoVersion", &users.UpdateUserRequest{}},
+			{"EmptyName", &users.UpdateUserRequest{Name: &empty, Version: int32(user.Version)}},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				_, err := app.UpdateUser(ctx, tt.req)
+				if status.Code(err) != codes.InvalidArgument {
+					t.Errorf("got %v, want %v", err, codes.InvalidArgument)
+				}
+			})
+		}
+	})
+}
+
+func TestLogin(t *testing.T) {
+	t.Run("Login", func(t *testing.T) {
+		app, fake := newTestApplication(t)
+
+		user, _ := insertTestUser(t, app, fake)
+
+		res, err := app.Login(context.Background(), &users.LoginRequest{Email: user.Email, Password: testPassword})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		session, err := app.models.Sessions.GetForToken(res.TokenPlaintext)
+		if err != nil {
+			t.Fatalf("the access token doesn't belong to a session: %v", err)
+		}
+
+		if session.UserID != user.ID {
+			t.Errorf("got a session of user %d, want %d", session.UserID, user.ID)
+		}
+
+		refreshToken, err := app.models.RefreshTokens.GetForToken(res.RefreshTokenPlaintext)
+		if err != nil {
+			t.Fatalf("the refresh token wasn't stored: %v", err)
+		}
+
+		if refreshToken.SessionID != session.ID {
+			t.Errorf("got a refresh token of session %d, want %d", refreshToken.SessionID, session.ID)
+		}
+	})
+
+	t.Run("IncorrectPassword", func(t *testing.T) {
+		app, fake := newTestApplication(t)
+
+		user, _ := insertTestUser(t, app, fake)
+
+		_, err := app.Login(context.Background(), &users.LoginRequest{Email: user.Email, Password: "wr0ng-pa55word"})
+		if status.Code(err) != codes.Unauthenticated {
+			t.Fatalf("got %v, want %v", err, codes.Unauthenticated)
+		}
+
+		// the failure counts towards the backoff
+		_, err = app.Login(context.Background(), &users.LoginRequest{Email: user.Email, Password: testPassword})
+		if status.Code(err) != codes.ResourceExhausted {
+			t.Fatalf("got %v right after a failure, want %v", err, codes.ResourceExhausted)
+		}
+	})
+
+	t.Run("UnknownEmail", func(t *testing.T) {
+		app, fake := newTestApplication(t)
+
+		user, _ := insertTestUser(t, app, fake)
+
+		_, incorrect := app.Login(context.Background(), &users.LoginRequest{Email: user.Email, Password: "wr0ng-pa55word"})
+		_, unknown := app.Login(context.Background(), &users.LoginRequest{Email: "bob@dinghy.test", Password: testPassword})
+
+		// an unknown email can't be told from an incorrect password
+		if status.Code(unknown) != codes.Unauthenticated || status.Convert(unknown).Message() != status.Convert(incorrect).Message() {
+			t.Errorf("got %v for an unknown email and %v for an incorrect password, want the same error", unknown, incorrect)
+		}
+	})
+
+	t.Run("NotActivated", func(t *testing.T) {
+		app, fake := newTestApplication(t)
+
+		ctx := context.Background()
+
+		user := &data.User{Name: "Alice", Email: "alice@dinghy.test"}
+		err := app.models.Users.InsertContext(ctx, user)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = fake.SetPassword(ctx, &auth.SetPasswordRequest{UserId: user.ID, Password: testPassword})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = app.Login(ctx, &users.LoginRequest{Email: user.Email, Password: testPassword})
+		if status.Code(err) != codes.PermissionDenied {
+			t.Fatalf("got %v, want %v", err, codes.PermissionDenied)
+		}
+
+		sessions, err := app.models.Sessions.GetAllForUser(user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(sessions) != 0 {
+			t.Errorf("got %d sessions, want none", len(sessions))
+		}
+	})
+
+	t.Run("AuthUnavailable", func(t *testing.T) {
+		app, fake := newTestApplication(t)
+
+		user, _ := insertTestUser(t, app, fake)
+		fake.failures["CheckPassword"] = status.Error(codes.Unavailable, "auth is down")
+
+		_, err := app.Login(context.Background(), &users.LoginRequest{Email: user.Email, Password: testPassword})
+		if status.Code(err) != codes.Internal {
+			t.Fatalf("got %v, want %v", err, codes.Internal)
+		}
+	})
+
+	t.Run("Validation", func(t *testing.T) {
+		app, _ := newTestApplication(t)
+
+		tests := []struct {
+			name string
+			req  *users.LoginRequest
+		}{
+			{"InvalidEmail", &users.LoginRequest{Email: "not-an-email", Password: testPassword}},
+			{"NoPassword", &users.LoginRequest{Email: "alice@dinghy.test"}},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				_, err := app.Login(context.Background(), tt.req)
+				if status.Code(err) != codes.InvalidArgument {
+					t.Errorf("got %v, want %v", err, codes.InvalidArgument)
+				}
+			})
+		}
+	})
+}
@@ -0,0 +1,108 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+type EmailChange struct {
+	UserID    int64     `json:"user_id"`
+	NewEmail  string    `json:"new_email"`
+	CreatedAt time.Time `json:"created_at"`
+	Expiry    time.Time `json:"expiry"`
+}
+
+// EmailChangeRepository stores the pending email change of each user.
+// expired changes are left out as if they were deleted
+type EmailChangeRepository interface {
+	Upsert(change *EmailChange, messages ...*OutboxMessage) error
+	GetForUser(userId int64) (*EmailChange, error)
+	DeleteForUser(userId int64) error
+}
+
+var _ EmailChangeRepository = EmailChangeModel{}
+
+type EmailChangeModel struct {
+	DB *sql.DB
+}
+
+// Upsert stores the pending change, replacing any earlier pending change of
+// the same user, along with the emails announcing it
+func (m EmailChangeModel) Upsert(change *EmailChange, messages ...*OutboxMessage) error {
+
+	query := `
+		INSERT INTO email_changes (user_id, new_email, expiry)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (user_id) DO UPDATE
+		SET new_email = EXCLUDED.new_email, created_at = NOW(), expiry = EXCLUDED.expiry
+		RETURNING created_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []any{change.UserID, change.NewEmail, change.Expiry}
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&change.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	err = insertOutboxMessages(ctx, tx, messages)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (m EmailChangeModel) GetForUser(userId int64) (*EmailChange, error) {
+
+	query := `
+		SELECT user_id, new_email, created_at, expiry
+		FROM email_changes
+		WHERE user_id = $1
+		AND expiry > $2`
+
+	var change EmailChange
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, userId, time.Now()).Scan(
+		&change.UserID,
+		&change.NewEmail,
+		&change.CreatedAt,
+		&change.Expiry)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &change, nil
+}
+
+func (m EmailChangeModel) DeleteForUser(userId int64) error {
+
+	query := `
+		DELETE FROM email_changes
+		WHERE user_id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userId)
+	return err
+}
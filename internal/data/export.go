@@ -0,0 +1,98 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+)
+
+// ExportFormatVersion is bumped whenever the layout of UserExport changes in
+// a way consumers of older exports need to know about
+const ExportFormatVersion = 1
+
+// UserExport is everything stored about a user, as handed to them on request
+type UserExport struct {
+	FormatVersion      int              `json:"format_version"`
+	GeneratedAt        time.Time        `json:"generated_at"`
+	User               *User            `json:"user"`
+	PendingEmailChange *EmailChange     `json:"pending_email_change,omitempty"`
+	Sessions           []*Session       `json:"sessions"`
+	TOTP               *TOTPCredential  `json:"totp,omitempty"`
+	Passkeys           []*Passkey       `json:"passkeys"`
+	Identities         []*Identity      `json:"identities"`
+	RecoveryCodes      []*RecoveryCode  `json:"recovery_codes"`
+	LoginThrottle      *LoginThrottle   `json:"login_throttle,omitempty"`
+	OutboxMessages     []*OutboxMessage `json:"outbox_messages"`
+}
+
+// ExportUser collects the user row and every record related to it. users
+// pending deletion are exported too, their data is kept until it is purged
+func (m Models) ExportUser(ctx context.Context, userId int64) (*UserExport, error) {
+	user, err := m.Users.GetByUserIdContext(ctx, userId)
+	if errors.Is(err, ErrRecordNotFound) {
+		user, err = m.Users.GetPendingDeletionContext(ctx, userId, time.Time{})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	export := &UserExport{
+		FormatVersion: ExportFormatVersion,
+		GeneratedAt:   time.Now().UTC(),
+		User:          user,
+	}
+
+	change, err := m.EmailChanges.GetForUser(userId)
+	switch {
+	case err == nil:
+		export.PendingEmailChange = change
+	case !errors.Is(err, ErrRecordNotFound):
+		return nil, err
+	}
+
+	export.Sessions, err = m.Sessions.GetAllForUser(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	credential, err := m.TOTP.GetForUser(userId)
+	switch {
+	case err == nil:
+		export.TOTP = credential
+	case !errors.Is(err, ErrRecordNotFound):
+		return nil, err
+	}
+
+	export.Passkeys, err = m.Passkeys.GetAllForUser(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	export.Identities, err = m.Identities.GetAllForUser(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	export.RecoveryCodes, err = m.RecoveryCodes.GetAllForUser(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	// failed logins are counted by email, whether or not it has an account
+	throttle, err := m.LoginThrottles.Get(ThrottleKindEmail, strings.ToLower(user.Email))
+	if err != nil {
+		return nil, err
+	}
+
+	if throttle.Failures > 0 || throttle.Lockouts > 0 {
+		export.LoginThrottle = throttle
+	}
+
+	export.OutboxMessages, err = m.Outbox.GetAllForUser(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	return export, nil
+}
@@ -0,0 +1,76 @@
+package data
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/saarwasserman/users/internal/validator"
+)
+
+const (
+	DefaultPageSize = 20
+	MaxPageSize     = 100
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Filters holds the paging and sorting of a listing. pages are keyset based
+// on (created_at, id) so the only sort choices are that order and its reverse
+type Filters struct {
+	Sort         string
+	SortSafelist []string
+	PageSize     int
+	Cursor       string
+}
+
+func ValidateFilters(v *validator.Validator, f Filters) {
+	v.Check(f.PageSize > 0, "page_size", "must be greater than zero")
+	v.Check(f.PageSize <= MaxPageSize, "page_size", "must be a maximum of 100")
+
+	v.Check(validator.In(f.Sort, f.SortSafelist...), "sort", "invalid sort value")
+
+	if f.Cursor != "" {
+		_, err := decodeCursor(f.Cursor, f.Sort)
+		v.Check(err == nil, "cursor", "invalid cursor")
+	}
+}
+
+func (f Filters) sortDirection() string {
+	if strings.HasPrefix(f.Sort, "-") {
+		return "DESC"
+	}
+
+	return "ASC"
+}
+
+// cursor marks the last row of a page. the sort is part of it so a cursor
+// can't be replayed against a differently ordered listing
+type cursor struct {
+	Sort      string    `json:"s"`
+	CreatedAt time.Time `json:"c"`
+	ID        int64     `json:"i"`
+}
+
+func encodeCursor(c cursor) string {
+	js, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(js)
+}
+
+func decodeCursor(s, sort string) (*cursor, error) {
+	js, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	var c cursor
+
+	err = json.Unmarshal(js, &c)
+	if err != nil || c.Sort != sort || c.ID <= 0 {
+		return nil, ErrInvalidCursor
+	}
+
+	return &c, nil
+}
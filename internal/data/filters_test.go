@@ -0,0 +1,70 @@
+package data
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/saarwasserman/users/internal/validator"
+)
+
+func TestCursor(t *testing.T) {
+	c := cursor{Sort: "-created_at", CreatedAt: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC), ID: 42}
+
+	decoded, err := decodeCursor(encodeCursor(c), "-created_at")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !decoded.CreatedAt.Equal(c.CreatedAt) || decoded.ID != c.ID {
+		t.Fatalf("got %+v, want %+v", decoded, c)
+	}
+
+	tests := []struct {
+		name   string
+		cursor string
+		sort   string
+	}{
+		{"OtherSort", encodeCursor(c), "created_at"},
+		{"NotBase64", "not a cursor!", "-created_at"},
+		{"NotJSON", "bm90IGpzb24", "-created_at"},
+		{"NoID", encodeCursor(cursor{Sort: "-created_at", CreatedAt: c.CreatedAt}), "-created_at"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := decodeCursor(tt.cursor, tt.sort)
+			if !errors.Is(err, ErrInvalidCursor) {
+				t.Fatalf("got %v, want ErrInvalidCursor", err)
+			}
+		})
+	}
+}
+
+func TestValidateFilters(t *testing.T) {
+	safelist := []string{"created_at", "-created_at"}
+
+	tests := []struct {
+		name    string
+		filters Filters
+		valid   bool
+	}{
+		{"Valid", Filters{Sort: "created_at", PageSize: 20}, true},
+		{"ZeroPageSize", Filters{Sort: "created_at", PageSize: 0}, false},
+		{"PageSizeTooLarge", Filters{Sort: "created_at", PageSize: MaxPageSize + 1}, false},
+		{"UnknownSort", Filters{Sort: "name", PageSize: 20}, false},
+		{"InvalidCursor", Filters{Sort: "created_at", PageSize: 20, Cursor: "bogus"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.filters.SortSafelist = safelist
+
+			v := validator.New()
+
+			if ValidateFilters(v, tt.filters); v.Valid() != tt.valid {
+				t.Fatalf("got valid %t, want %t: %v", v.Valid(), tt.valid, v.Errors)
+			}
+		})
+	}
+}
@@ -0,0 +1,170 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/saarwasserman/users/internal/validator"
+)
+
+var ErrDuplicateIdempotencyKey = errors.New("duplicate idempotency key")
+
+// IdempotencyKey records a call made with a client chosen key, so a retry of
+// the call gets the response of the first one instead of running it again.
+// keys are scoped to the user making the call. UserID is 0 for
+// unauthenticated calls, whose keys are scoped to the request instead.
+// Response is nil while the first call is still running
+type IdempotencyKey struct {
+	UserID      int64     `json:"user_id"`
+	Key         string    `json:"key"`
+	Method      string    `json:"method"`
+	RequestHash []byte    `json:"-"`
+	Response    []byte    `json:"-"`
+	CreatedAt   time.Time `json:"created_at"`
+	Expiry      time.Time `json:"expiry"`
+}
+
+// IdempotencyKeyRepository stores the idempotency keys and the responses of
+// the calls made with them
+type IdempotencyKeyRepository interface {
+	Reserve(key *IdempotencyKey, staleAfter time.Duration) error
+	Get(userId int64, key string) (*IdempotencyKey, error)
+	Complete(userId int64, key string, response []byte) error
+	Release(userId int64, key string) error
+	DeleteExpired() error
+}
+
+var _ IdempotencyKeyRepository = IdempotencyKeyModel{}
+
+type IdempotencyKeyModel struct {
+	DB *sql.DB
+}
+
+func ValidateIdempotencyKey(v *validator.Validator, key string) {
+	v.Check(key != "", "idempotency_key", "must be provided")
+	v.Check(len(key) <= 255, "idempotency_key", "must not be more than 255 bytes long")
+}
+
+// Reserve claims the key for a call about to run. it returns
+// ErrDuplicateIdempotencyKey if the key is already in use. a key whose call
+// never completed, e.g. because the server stopped, can be claimed again
+// once it is older than staleAfter
+func (m IdempotencyKeyModel) Reserve(key *IdempotencyKey, staleAfter time.Duration) error {
+
+	query := `
+		INSERT INTO idempotency_keys (user_id, key, method, request_hash, expiry)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (user_id, key) DO UPDATE
+		SET method = EXCLUDED.method, request_hash = EXCLUDED.request_hash, response = NULL, created_at = NOW(), expiry = EXCLUDED.expiry
+		WHERE idempotency_keys.expiry < NOW()
+			OR (idempotency_keys.response IS NULL AND idempotency_keys.created_at < NOW() - $6 * INTERVAL '1 millisecond')
+		RETURNING created_at`
+
+	args := []any{key.UserID, key.Key, key.Method, key.RequestHash, key.Expiry, staleAfter.Milliseconds()}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&key.CreatedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrDuplicateIdempotencyKey
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m IdempotencyKeyModel) Get(userId int64, key string) (*IdempotencyKey, error) {
+
+	query := `
+		SELECT user_id, key, method, request_hash, response, created_at, expiry
+		FROM idempotency_keys
+		WHERE user_id = $1 AND key = $2 AND expiry > NOW()`
+
+	var idempotencyKey IdempotencyKey
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, userId, key).Scan(
+		&idempotencyKey.UserID,
+		&idempotencyKey.Key,
+		&idempotencyKey.Method,
+		&idempotencyKey.RequestHash,
+		&idempotencyKey.Response,
+		&idempotencyKey.CreatedAt,
+		&idempotencyKey.Expiry)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &idempotencyKey, nil
+}
+
+// Complete stores the response of the call the key was reserved for
+func (m IdempotencyKeyModel) Complete(userId int64, key string, response []byte) error {
+
+	query := `
+		UPDATE idempotency_keys
+		SET response = $3
+		WHERE user_id = $1 AND key = $2 AND response IS NULL`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userId, key, response)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// Release frees a key whose call failed, so it can be retried with the same key
+func (m IdempotencyKeyModel) Release(userId int64, key string) error {
+
+	query := `
+		DELETE FROM idempotency_keys
+		WHERE user_id = $1 AND key = $2 AND response IS NULL`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userId, key)
+	return err
+}
+
+// DeleteExpired drops the keys past their expiry
+func (m IdempotencyKeyModel) DeleteExpired() error {
+
+	query := `
+		DELETE FROM idempotency_keys
+		WHERE expiry < NOW()`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query)
+	return err
+}
@@ -0,0 +1,242 @@
+package data
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+var ErrDuplicateIdentity = errors.New("duplicate identity")
+
+// Identity links an account of an external identity provider to a user
+type Identity struct {
+	Provider  string    `json:"provider"`
+	Subject   string    `json:"subject"`
+	UserID    int64     `json:"-"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// OIDCState is what is kept of a sign-in with a provider between sending the
+// user there and them coming back with a code
+type OIDCState struct {
+	Provider     string
+	Nonce        string
+	CodeVerifier string
+	// set when an account is being linked rather than signed in to
+	UserID int64
+}
+
+// IdentityRepository stores the provider accounts linked to users and the
+// state of sign-ins in progress
+type IdentityRepository interface {
+	Insert(identity *Identity) error
+	Get(provider, subject string) (*Identity, error)
+	GetAllForUser(userId int64) ([]*Identity, error)
+	Delete(userId int64, provider string) error
+	InsertState(statePlaintext string, state *OIDCState, ttl time.Duration) error
+	ConsumeState(statePlaintext string) (*OIDCState, error)
+	DeleteExpiredStates() error
+}
+
+var _ IdentityRepository = IdentityModel{}
+
+type IdentityModel struct {
+	DB *sql.DB
+}
+
+// Insert links the identity. it returns ErrDuplicateIdentity if the provider
+// account is linked already, or the user has an account of the provider linked
+func (m IdentityModel) Insert(identity *Identity) error {
+
+	query := `
+		INSERT INTO user_identities (provider, subject, user_id, email)
+		VALUES ($1, $2, $3, $4)
+		RETURNING created_at`
+
+	args := []any{identity.Provider, identity.Subject, identity.UserID, identity.Email}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&identity.CreatedAt)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "user_identities_pkey"`,
+			err.Error() == `pq: duplicate key value violates unique constraint "user_identities_user_id_provider_key"`:
+			return ErrDuplicateIdentity
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m IdentityModel) Get(provider, subject string) (*Identity, error) {
+
+	query := `
+		SELECT provider, subject, user_id, email, created_at
+		FROM user_identities
+		WHERE provider = $1 AND subject = $2`
+
+	var identity Identity
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, provider, subject).Scan(
+		&identity.Provider,
+		&identity.Subject,
+		&identity.UserID,
+		&identity.Email,
+		&identity.CreatedAt)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &identity, nil
+}
+
+func (m IdentityModel) GetAllForUser(userId int64) ([]*Identity, error) {
+
+	query := `
+		SELECT provider, subject, user_id, email, created_at
+		FROM user_identities
+		WHERE user_id = $1
+		ORDER BY created_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	identities := []*Identity{}
+
+	for rows.Next() {
+		var identity Identity
+
+		err := rows.Scan(
+			&identity.Provider,
+			&identity.Subject,
+			&identity.UserID,
+			&identity.Email,
+			&identity.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		identities = append(identities, &identity)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return identities, nil
+}
+
+func (m IdentityModel) Delete(userId int64, provider string) error {
+
+	query := `
+		DELETE FROM user_identities
+		WHERE user_id = $1 AND provider = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userId, provider)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// InsertState stores the state of a sign-in, keyed by a hash of the state
+// parameter sent to the provider
+func (m IdentityModel) InsertState(statePlaintext string, state *OIDCState, ttl time.Duration) error {
+
+	stateHash := sha256.Sum256([]byte(statePlaintext))
+
+	query := `
+		INSERT INTO oidc_states (state_hash, provider, nonce, code_verifier, user_id, expiry)
+		VALUES ($1, $2, $3, $4, NULLIF($5::bigint, 0), $6)`
+
+	args := []any{stateHash[:], state.Provider, state.Nonce, state.CodeVerifier, state.UserID, time.Now().Add(ttl)}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, args...)
+	return err
+}
+
+// ConsumeState deletes and returns the state of a sign-in, so each one can
+// be completed only once
+func (m IdentityModel) ConsumeState(statePlaintext string) (*OIDCState, error) {
+
+	stateHash := sha256.Sum256([]byte(statePlaintext))
+
+	query := `
+		DELETE FROM oidc_states
+		WHERE state_hash = $1 AND expiry > NOW()
+		RETURNING provider, nonce, code_verifier, COALESCE(user_id, 0)`
+
+	var state OIDCState
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, stateHash[:]).Scan(
+		&state.Provider,
+		&state.Nonce,
+		&state.CodeVerifier,
+		&state.UserID)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &state, nil
+}
+
+// DeleteExpiredStates drops the states of sign-ins that were never completed
+func (m IdentityModel) DeleteExpiredStates() error {
+
+	query := `
+		DELETE FROM oidc_states
+		WHERE expiry < NOW()`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query)
+	return err
+}
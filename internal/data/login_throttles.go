@@ -0,0 +1,173 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+const (
+	ThrottleKindEmail = "email"
+	ThrottleKindIP    = "ip"
+)
+
+// LoginThrottle counts the failed logins of an account (keyed by email so
+// unknown emails are throttled exactly like registered ones) or of a client address
+type LoginThrottle struct {
+	Kind          string     `json:"kind"`
+	Subject       string     `json:"subject"`
+	Failures      int        `json:"failures"`
+	Lockouts      int        `json:"lockouts"`
+	LastFailureAt time.Time  `json:"last_failure_at"`
+	LockedUntil   *time.Time `json:"locked_until,omitempty"`
+}
+
+// LoginThrottleRepository stores the failed logins and lockouts of accounts
+// and client addresses
+type LoginThrottleRepository interface {
+	Get(kind, subject string) (*LoginThrottle, error)
+	RecordFailure(kind, subject string, resetAfter time.Duration) (*LoginThrottle, error)
+	Lock(throttle *LoginThrottle, until time.Time, messages ...*OutboxMessage) error
+	Delete(kind, subject string) error
+	DeleteInactive(before time.Time) error
+}
+
+var _ LoginThrottleRepository = LoginThrottleModel{}
+
+type LoginThrottleModel struct {
+	DB *sql.DB
+}
+
+// Get returns the throttle of the subject, a zero throttle if it has no failures
+func (m LoginThrottleModel) Get(kind, subject string) (*LoginThrottle, error) {
+
+	query := `
+		SELECT kind, subject, failures, lockouts, last_failure_at, locked_until
+		FROM login_throttles
+		WHERE kind = $1 AND subject = $2`
+
+	throttle := LoginThrottle{Kind: kind, Subject: subject}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, kind, subject).Scan(
+		&throttle.Kind,
+		&throttle.Subject,
+		&throttle.Failures,
+		&throttle.Lockouts,
+		&throttle.LastFailureAt,
+		&throttle.LockedUntil)
+
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	return &throttle, nil
+}
+
+// RecordFailure adds a failure to the subject's count. failures older than
+// resetAfter are forgotten and the count starts over
+func (m LoginThrottleModel) RecordFailure(kind, subject string, resetAfter time.Duration) (*LoginThrottle, error) {
+
+	query := `
+		INSERT INTO login_throttles (kind, subject, failures, last_failure_at)
+		VALUES ($1, $2, 1, NOW())
+		ON CONFLICT (kind, subject) DO UPDATE
+		SET failures = CASE
+				WHEN login_throttles.last_failure_at < $3 THEN 1
+				ELSE login_throttles.failures + 1
+			END,
+			last_failure_at = NOW()
+		RETURNING kind, subject, failures, lockouts, last_failure_at, locked_until`
+
+	var throttle LoginThrottle
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, kind, subject, time.Now().Add(-resetAfter)).Scan(
+		&throttle.Kind,
+		&throttle.Subject,
+		&throttle.Failures,
+		&throttle.Lockouts,
+		&throttle.LastFailureAt,
+		&throttle.LockedUntil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &throttle, nil
+}
+
+// Lock locks the subject until the given time and starts a new failure
+// count, along with the messages letting the owner know
+func (m LoginThrottleModel) Lock(throttle *LoginThrottle, until time.Time, messages ...*OutboxMessage) error {
+
+	query := `
+		UPDATE login_throttles
+		SET failures = 0, lockouts = lockouts + 1, locked_until = $3
+		WHERE kind = $1 AND subject = $2
+		RETURNING failures, lockouts, locked_until`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, query, throttle.Kind, throttle.Subject, until).Scan(
+		&throttle.Failures,
+		&throttle.Lockouts,
+		&throttle.LockedUntil)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	err = insertOutboxMessages(ctx, tx, messages)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Delete clears the failures and lockouts of the subject
+func (m LoginThrottleModel) Delete(kind, subject string) error {
+
+	query := `
+		DELETE FROM login_throttles
+		WHERE kind = $1 AND subject = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, kind, subject)
+	return err
+}
+
+// DeleteInactive drops the throttles with no failure and no lockout since
+// the given time, so a subject that stays quiet starts over with no lockouts
+func (m LoginThrottleModel) DeleteInactive(before time.Time) error {
+
+	query := `
+		DELETE FROM login_throttles
+		WHERE GREATEST(last_failure_at, locked_until) < $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, before)
+	return err
+}
@@ -1,8 +1,10 @@
 package data
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"time"
 )
 
 var (
@@ -10,12 +12,46 @@ var (
 	ErrEditConflict   = errors.New("edit conflict")
 )
 
+// contextError reports a query that failed because its context ended, e.g.
+// the caller went away, with the context's error instead of the driver's
+func contextError(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+
+	return err
+}
+
 type Models struct {
-	Users UserModel
+	Users           UserRepository
+	EmailChanges    EmailChangeRepository
+	LoginThrottles  LoginThrottleRepository
+	Sessions        SessionRepository
+	RefreshTokens   RefreshTokenRepository
+	TOTP            TOTPCredentialRepository
+	RecoveryCodes   RecoveryCodeRepository
+	Passkeys        PasskeyRepository
+	Identities      IdentityRepository
+	Registrations   RegistrationRepository
+	Outbox          OutboxRepository
+	IdempotencyKeys IdempotencyKeyRepository
 }
 
-func NewModels(db *sql.DB) Models {
+// NewModels returns the models backed by db. queryTimeout bounds the queries
+// of the models that take a request context
+func NewModels(db *sql.DB, queryTimeout time.Duration) Models {
 	return Models{
-		Users: UserModel{DB: db},
+		Users:           UserModel{DB: db, Timeout: queryTimeout},
+		EmailChanges:    EmailChangeModel{DB: db},
+		LoginThrottles:  LoginThrottleModel{DB: db},
+		Sessions:        SessionModel{DB: db},
+		RefreshTokens:   RefreshTokenModel{DB: db},
+		TOTP:            TOTPCredentialModel{DB: db},
+		RecoveryCodes:   RecoveryCodeModel{DB: db},
+		Passkeys:        PasskeyModel{DB: db},
+		Identities:      IdentityModel{DB: db},
+		Registrations:   RegistrationModel{DB: db, Timeout: queryTimeout},
+		Outbox:          OutboxModel{DB: db},
+		IdempotencyKeys: IdempotencyKeyModel{DB: db},
 	}
 }
@@ -0,0 +1,354 @@
+package data
+
+import (
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// statuses of an outbox message. dead messages ran out of attempts and are
+// kept for inspection, they are not retried
+const (
+	OutboxPending = "pending"
+	OutboxDead    = "dead"
+)
+
+var errMalformedOutboxPayload = errors.New("malformed outbox payload")
+
+// OutboxMessage is a call to another service that must happen because of a
+// change made here. it is written in the same transaction as the change and
+// delivered later, at least once. IdempotencyKey stays the same across
+// attempts so the receiver can drop duplicates. Payload is encrypted, it
+// carries tokens, and is dropped once the message is dead. UserID is the
+// user the message is about, 0 if there is none
+type OutboxMessage struct {
+	ID             int64     `json:"id"`
+	IdempotencyKey string    `json:"idempotency_key"`
+	UserID         int64     `json:"user_id"`
+	Kind           string    `json:"kind"`
+	Payload        []byte    `json:"-"`
+	Status         string    `json:"status"`
+	Attempts       int       `json:"attempts"`
+	NextAttemptAt  time.Time `json:"next_attempt_at"`
+	LastError      string    `json:"last_error,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// NewOutboxMessage encodes the payload of a message of the given kind about
+// the user, gives it a new idempotency key and encrypts the payload with
+// aead. the key is authenticated along with it, so a payload copied to
+// another message doesn't decrypt
+func NewOutboxMessage(aead cipher.AEAD, kind string, userId int64, payload any) (*OutboxMessage, error) {
+	encoded, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	key := make([]byte, 16)
+
+	_, err = rand.Read(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	idempotencyKey := hex.EncodeToString(key)
+
+	return &OutboxMessage{
+		IdempotencyKey: idempotencyKey,
+		UserID:         userId,
+		Kind:           kind,
+		Payload:        aead.Seal(nonce, nonce, encoded, []byte(idempotencyKey)),
+		Status:         OutboxPending,
+	}, nil
+}
+
+// OpenPayload decrypts the encoded payload of the message
+func (message *OutboxMessage) OpenPayload(aead cipher.AEAD) ([]byte, error) {
+	if len(message.Payload) < aead.NonceSize() {
+		return nil, errMalformedOutboxPayload
+	}
+
+	nonce, ciphertext := message.Payload[:aead.NonceSize()], message.Payload[aead.NonceSize():]
+
+	return aead.Open(nil, nonce, ciphertext, []byte(message.IdempotencyKey))
+}
+
+// OutboxRepository keeps the outbox messages until they are delivered, or
+// the dead ones until they are purged
+type OutboxRepository interface {
+	Enqueue(messages ...*OutboxMessage) error
+	ClaimDue(limit int, lease time.Duration) ([]*OutboxMessage, error)
+	Delete(id int64) error
+	Fail(message *OutboxMessage, lastError string, nextAttemptAt time.Time) error
+	Bury(message *OutboxMessage, lastError string) error
+	DeleteDead(createdBefore time.Time) error
+	GetAllForUser(userId int64) ([]*OutboxMessage, error)
+}
+
+var _ OutboxRepository = OutboxModel{}
+
+type OutboxModel struct {
+	DB *sql.DB
+}
+
+// insertOutboxMessages writes the messages as part of the transaction of the
+// change that produced them
+func insertOutboxMessages(ctx context.Context, q rowQuerier, messages []*OutboxMessage) error {
+
+	query := `
+		INSERT INTO outbox (idempotency_key, user_id, kind, payload)
+		VALUES ($1, NULLIF($2::bigint, 0), $3, $4)
+		RETURNING id, status, next_attempt_at, created_at`
+
+	for _, message := range messages {
+		err := q.QueryRowContext(ctx, query, message.IdempotencyKey, message.UserID, message.Kind, message.Payload).Scan(
+			&message.ID,
+			&message.Status,
+			&message.NextAttemptAt,
+			&message.CreatedAt)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Enqueue writes messages that don't go along with a change of this service's
+// own data, e.g. ones following a change in another service
+func (m OutboxModel) Enqueue(messages ...*OutboxMessage) error {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = insertOutboxMessages(ctx, tx, messages)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// ClaimDue returns up to limit pending messages that are due, and postpones
+// them by lease so other dispatchers skip them while they are delivered. a
+// message whose dispatcher dies comes due again once the lease is over
+func (m OutboxModel) ClaimDue(limit int, lease time.Duration) ([]*OutboxMessage, error) {
+
+	query := `
+		UPDATE outbox
+		SET next_attempt_at = NOW() + $2 * INTERVAL '1 millisecond'
+		WHERE id IN (
+			SELECT id
+			FROM outbox
+			WHERE status = 'pending' AND next_attempt_at <= NOW()
+			ORDER BY next_attempt_at
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED)
+		RETURNING id, idempotency_key, COALESCE(user_id, 0), kind, payload, status, attempts, next_attempt_at, last_error, created_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, limit, lease.Milliseconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := []*OutboxMessage{}
+
+	for rows.Next() {
+		var message OutboxMessage
+
+		err := rows.Scan(
+			&message.ID,
+			&message.IdempotencyKey,
+			&message.UserID,
+			&message.Kind,
+			&message.Payload,
+			&message.Status,
+			&message.Attempts,
+			&message.NextAttemptAt,
+			&message.LastError,
+			&message.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		messages = append(messages, &message)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+// GetAllForUser returns the messages about the user that haven't been
+// purged yet, without their payloads
+func (m OutboxModel) GetAllForUser(userId int64) ([]*OutboxMessage, error) {
+
+	query := `
+		SELECT id, idempotency_key, user_id, kind, status, attempts, next_attempt_at, last_error, created_at
+		FROM outbox
+		WHERE user_id = $1
+		ORDER BY id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := []*OutboxMessage{}
+
+	for rows.Next() {
+		var message OutboxMessage
+
+		err := rows.Scan(
+			&message.ID,
+			&message.IdempotencyKey,
+			&message.UserID,
+			&message.Kind,
+			&message.Status,
+			&message.Attempts,
+			&message.NextAttemptAt,
+			&message.LastError,
+			&message.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		messages = append(messages, &message)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+// Delete drops a delivered message
+func (m OutboxModel) Delete(id int64) error {
+
+	query := `
+		DELETE FROM outbox
+		WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// Fail records a failed attempt to deliver the message and when to try again
+func (m OutboxModel) Fail(message *OutboxMessage, lastError string, nextAttemptAt time.Time) error {
+	return m.recordAttempt(message, OutboxPending, lastError, nextAttemptAt)
+}
+
+// Bury records the last failed attempt to deliver the message and moves it
+// to the dead letters. its payload is dropped, the tokens in it must not
+// outlive the delivery
+func (m OutboxModel) Bury(message *OutboxMessage, lastError string) error {
+	err := m.recordAttempt(message, OutboxDead, lastError, message.NextAttemptAt)
+	if err != nil {
+		return err
+	}
+
+	message.Payload = nil
+
+	return nil
+}
+
+// DeleteDead purges the dead messages created before the given time
+func (m OutboxModel) DeleteDead(createdBefore time.Time) error {
+
+	query := `
+		DELETE FROM outbox
+		WHERE status = $1 AND created_at < $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, OutboxDead, createdBefore)
+	return err
+}
+
+// deletePendingOutboxMessages drops the messages about the user that weren't
+// delivered yet, as part of the transaction deleting it. the rest go when the
+// user is purged, the user_id foreign key cascades
+func deletePendingOutboxMessages(ctx context.Context, e execer, userId int64) error {
+
+	query := `
+		DELETE FROM outbox
+		WHERE user_id = $1 AND status = $2`
+
+	_, err := e.ExecContext(ctx, query, userId, OutboxPending)
+	return contextError(ctx, err)
+}
+
+func (m OutboxModel) recordAttempt(message *OutboxMessage, status, lastError string, nextAttemptAt time.Time) error {
+
+	query := `
+		UPDATE outbox
+		SET status = $2, attempts = attempts + 1, last_error = $3, next_attempt_at = $4,
+			payload = CASE WHEN $2 = 'dead' THEN NULL ELSE payload END
+		WHERE id = $1
+		RETURNING status, attempts, last_error, next_attempt_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, message.ID, status, lastError, nextAttemptAt).Scan(
+		&message.Status,
+		&message.Attempts,
+		&message.LastError,
+		&message.NextAttemptAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,239 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+// WebAuthn ceremonies a challenge is issued for
+const (
+	CeremonyRegistration   = "registration"
+	CeremonyAuthentication = "authentication"
+)
+
+var ErrDuplicatePasskey = errors.New("duplicate passkey")
+
+// Passkey is a WebAuthn credential a user signs in with
+type Passkey struct {
+	UserID       int64      `json:"-"`
+	CredentialID []byte     `json:"credential_id"`
+	PublicKey    []byte     `json:"-"`
+	SignCount    uint32     `json:"-"`
+	Name         string     `json:"name"`
+	CreatedAt    time.Time  `json:"created_at"`
+	LastUsedAt   *time.Time `json:"last_used_at,omitempty"`
+}
+
+// PasskeyRepository stores the passkeys of users and the challenges of the
+// ceremonies registering and using them
+type PasskeyRepository interface {
+	Insert(passkey *Passkey) error
+	Get(userId int64, credentialId []byte) (*Passkey, error)
+	GetAllForUser(userId int64) ([]*Passkey, error)
+	UpdateSignCount(passkey *Passkey, signCount uint32) error
+	InsertChallenge(challenge []byte, ceremony string, userId int64, ttl time.Duration) error
+	ConsumeChallenge(challenge []byte, ceremony string, userId int64) error
+	DeleteExpiredChallenges() error
+}
+
+var _ PasskeyRepository = PasskeyModel{}
+
+type PasskeyModel struct {
+	DB *sql.DB
+}
+
+func (m PasskeyModel) Insert(passkey *Passkey) error {
+
+	query := `
+		INSERT INTO webauthn_credentials (user_id, credential_id, public_key, sign_count, name)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING created_at`
+
+	args := []any{passkey.UserID, passkey.CredentialID, passkey.PublicKey, passkey.SignCount, passkey.Name}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&passkey.CreatedAt)
+	if err != nil {
+		switch {
+		case strings.HasPrefix(err.Error(), "pq: duplicate key value violates unique constraint"):
+			return ErrDuplicatePasskey
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m PasskeyModel) Get(userId int64, credentialId []byte) (*Passkey, error) {
+
+	query := `
+		SELECT user_id, credential_id, public_key, sign_count, name, created_at, last_used_at
+		FROM webauthn_credentials
+		WHERE user_id = $1 AND credential_id = $2`
+
+	var passkey Passkey
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, userId, credentialId).Scan(
+		&passkey.UserID,
+		&passkey.CredentialID,
+		&passkey.PublicKey,
+		&passkey.SignCount,
+		&passkey.Name,
+		&passkey.CreatedAt,
+		&passkey.LastUsedAt)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &passkey, nil
+}
+
+func (m PasskeyModel) GetAllForUser(userId int64) ([]*Passkey, error) {
+
+	query := `
+		SELECT user_id, credential_id, public_key, sign_count, name, created_at, last_used_at
+		FROM webauthn_credentials
+		WHERE user_id = $1
+		ORDER BY created_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	passkeys := []*Passkey{}
+
+	for rows.Next() {
+		var passkey Passkey
+
+		err := rows.Scan(
+			&passkey.UserID,
+			&passkey.CredentialID,
+			&passkey.PublicKey,
+			&passkey.SignCount,
+			&passkey.Name,
+			&passkey.CreatedAt,
+			&passkey.LastUsedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		passkeys = append(passkeys, &passkey)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return passkeys, nil
+}
+
+// UpdateSignCount records a use of the passkey. it returns ErrEditConflict if
+// the stored counter moved in the meantime, i.e. the passkey was used
+// concurrently
+func (m PasskeyModel) UpdateSignCount(passkey *Passkey, signCount uint32) error {
+
+	query := `
+		UPDATE webauthn_credentials
+		SET sign_count = $4, last_used_at = NOW()
+		WHERE user_id = $1 AND credential_id = $2 AND sign_count = $3
+		RETURNING last_used_at`
+
+	args := []any{passkey.UserID, passkey.CredentialID, passkey.SignCount, signCount}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&passkey.LastUsedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	passkey.SignCount = signCount
+
+	return nil
+}
+
+// InsertChallenge stores a challenge issued for a ceremony. userId is 0 for
+// sign-in ceremonies, where the user is only known from the response
+func (m PasskeyModel) InsertChallenge(challenge []byte, ceremony string, userId int64, ttl time.Duration) error {
+
+	query := `
+		INSERT INTO webauthn_challenges (challenge, ceremony, user_id, expiry)
+		VALUES ($1, $2, NULLIF($3::bigint, 0), $4)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, challenge, ceremony, userId, time.Now().Add(ttl))
+	return err
+}
+
+// ConsumeChallenge deletes the challenge so it can be answered only once. it
+// returns ErrRecordNotFound if the challenge wasn't issued for this ceremony
+// and user, or expired
+func (m PasskeyModel) ConsumeChallenge(challenge []byte, ceremony string, userId int64) error {
+
+	query := `
+		DELETE FROM webauthn_challenges
+		WHERE challenge = $1 AND ceremony = $2
+		AND user_id IS NOT DISTINCT FROM NULLIF($3::bigint, 0)
+		AND expiry > NOW()`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, challenge, ceremony, userId)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// DeleteExpiredChallenges drops the challenges of abandoned ceremonies
+func (m PasskeyModel) DeleteExpiredChallenges() error {
+
+	query := `
+		DELETE FROM webauthn_challenges
+		WHERE expiry < NOW()`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query)
+	return err
+}
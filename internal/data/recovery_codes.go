@@ -0,0 +1,179 @@
+package data
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/saarwasserman/users/internal/validator"
+)
+
+// RecoveryCodeLength is the number of characters of a recovery code, not
+// counting the separator it is displayed with
+const RecoveryCodeLength = 10
+
+// RecoveryCode is what is kept of a recovery code besides its hash
+type RecoveryCode struct {
+	CreatedAt time.Time  `json:"created_at"`
+	UsedAt    *time.Time `json:"used_at,omitempty"`
+}
+
+// RecoveryCodeRepository stores the hashes of the recovery codes of users
+type RecoveryCodeRepository interface {
+	Replace(userId int64, codes []string) error
+	Use(userId int64, code string) error
+	CountUnused(userId int64) (int, error)
+	GetAllForUser(userId int64) ([]*RecoveryCode, error)
+}
+
+var _ RecoveryCodeRepository = RecoveryCodeModel{}
+
+type RecoveryCodeModel struct {
+	DB *sql.DB
+}
+
+// codes are accepted regardless of case and of the separators they're shown with
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
+
+func recoveryCodeHash(code string) []byte {
+	codeHash := sha256.Sum256([]byte(normalizeRecoveryCode(code)))
+	return codeHash[:]
+}
+
+func ValidateRecoveryCode(v *validator.Validator, code string) {
+	v.Check(code != "", "recovery_code", "must be provided")
+	v.Check(len(normalizeRecoveryCode(code)) == RecoveryCodeLength, "recovery_code", "must be 10 characters long")
+}
+
+// Replace stores the hashes of a new set of codes for the user, invalidating
+// all their previous codes
+func (m RecoveryCodeModel) Replace(userId int64, codes []string) error {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = replaceRecoveryCodes(ctx, tx, userId, codes)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// replaceRecoveryCodes replaces the codes of the user as part of a transaction
+func replaceRecoveryCodes(ctx context.Context, tx *sql.Tx, userId int64, codes []string) error {
+	_, err := tx.ExecContext(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userId)
+	if err != nil {
+		return err
+	}
+
+	for _, code := range codes {
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO recovery_codes (code_hash, user_id)
+			VALUES ($1, $2)
+			ON CONFLICT DO NOTHING`, recoveryCodeHash(code), userId)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Use marks the code as used. it returns ErrRecordNotFound if the user has no
+// such code or it was already used
+func (m RecoveryCodeModel) Use(userId int64, code string) error {
+
+	query := `
+		UPDATE recovery_codes
+		SET used_at = NOW()
+		WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userId, recoveryCodeHash(code))
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+func (m RecoveryCodeModel) CountUnused(userId int64) (int, error) {
+
+	query := `
+		SELECT COUNT(*)
+		FROM recovery_codes
+		WHERE user_id = $1 AND used_at IS NULL`
+
+	var count int
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, userId).Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// GetAllForUser returns the codes of the user, used ones included
+func (m RecoveryCodeModel) GetAllForUser(userId int64) ([]*RecoveryCode, error) {
+
+	query := `
+		SELECT created_at, used_at
+		FROM recovery_codes
+		WHERE user_id = $1
+		ORDER BY created_at, used_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	codes := []*RecoveryCode{}
+
+	for rows.Next() {
+		var code RecoveryCode
+
+		err := rows.Scan(&code.CreatedAt, &code.UsedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		codes = append(codes, &code)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
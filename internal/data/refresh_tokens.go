@@ -0,0 +1,108 @@
+package data
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// RefreshToken belongs to the token family of a session. only the latest
+// token of a family is valid, rotated ones are kept to detect their reuse
+type RefreshToken struct {
+	SessionID int64      `json:"session_id"`
+	CreatedAt time.Time  `json:"created_at"`
+	RotatedAt *time.Time `json:"rotated_at,omitempty"`
+}
+
+// RefreshTokenRepository stores refresh tokens by their hash. the tokens of a
+// session are gone once the session is deleted
+type RefreshTokenRepository interface {
+	Insert(sessionId int64, tokenPlaintext string) error
+	GetForToken(tokenPlaintext string) (*RefreshToken, error)
+	MarkRotated(tokenPlaintext string) error
+}
+
+var _ RefreshTokenRepository = RefreshTokenModel{}
+
+type RefreshTokenModel struct {
+	DB *sql.DB
+}
+
+func (m RefreshTokenModel) Insert(sessionId int64, tokenPlaintext string) error {
+
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+		INSERT INTO refresh_tokens (token_hash, session_id)
+		VALUES ($1, $2)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, tokenHash[:], sessionId)
+	return err
+}
+
+func (m RefreshTokenModel) GetForToken(tokenPlaintext string) (*RefreshToken, error) {
+
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+		SELECT session_id, created_at, rotated_at
+		FROM refresh_tokens
+		WHERE token_hash = $1`
+
+	var token RefreshToken
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, tokenHash[:]).Scan(
+		&token.SessionID,
+		&token.CreatedAt,
+		&token.RotatedAt)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &token, nil
+}
+
+// MarkRotated marks the token as used. it returns ErrEditConflict if the token
+// was already rotated, which means it is being reused
+func (m RefreshTokenModel) MarkRotated(tokenPlaintext string) error {
+
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+		UPDATE refresh_tokens
+		SET rotated_at = NOW()
+		WHERE token_hash = $1 AND rotated_at IS NULL`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, tokenHash[:])
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrEditConflict
+	}
+
+	return nil
+}
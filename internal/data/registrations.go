@@ -0,0 +1,272 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// statuses of a registration. pending registrations move forward step by
+// step, compensating ones undo their steps in reverse
+const (
+	RegistrationPending      = "pending"
+	RegistrationCompleted    = "completed"
+	RegistrationCompensating = "compensating"
+	RegistrationRolledBack   = "rolled_back"
+)
+
+// kinds of a registration, each has its own steps. users signing up with a
+// password, or with an account at an identity provider
+const (
+	RegistrationKindPassword = "password"
+	RegistrationKindIdentity = "identity"
+)
+
+// Registration records the progress of registering a user across this
+// service and the ones it calls, so a failure halfway can be undone or
+// finished later. Step is the last step that completed
+type Registration struct {
+	ID        int64     `json:"id"`
+	UserID    int64     `json:"user_id"`
+	Kind      string    `json:"kind"`
+	Step      string    `json:"step"`
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// RegistrationRepository records registrations. it inserts the user of a
+// registration when starting it and deletes it when rolling it back, along
+// with the registration itself, so it always goes with the UserRepository
+// keeping the same users: RegistrationModel with UserModel,
+// MemoryRegistrationRepository with MemoryUserRepository
+type RegistrationRepository interface {
+	Start(ctx context.Context, user *User, kind, step string) (*Registration, error)
+	Update(registration *Registration, messages ...*OutboxMessage) error
+	Claim(registration *Registration) error
+	RollBack(registration *Registration) error
+	GetUnfinished(updatedBefore time.Time, limit int) ([]*Registration, error)
+	DeleteFinished(finishedBefore time.Time) error
+}
+
+var _ RegistrationRepository = RegistrationModel{}
+
+// RegistrationModel runs Start, which inserts the user, with the context of
+// the caller bounded by Timeout, as UserModel does
+type RegistrationModel struct {
+	DB      *sql.DB
+	Timeout time.Duration
+}
+
+// Start inserts the user along with its registration of the given kind at the
+// given step, in one transaction so there is never a user without a
+// registration to undo it
+func (m RegistrationModel) Start(ctx context.Context, user *User, kind, step string) (*Registration, error) {
+
+	ctx, cancel := queryContext(ctx, m.Timeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	err = insertUser(ctx, tx, user)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `
+		INSERT INTO registrations (user_id, kind, step, status)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at, updated_at`
+
+	registration := &Registration{
+		UserID: user.ID,
+		Kind:   kind,
+		Step:   step,
+		Status: RegistrationPending,
+	}
+
+	err = tx.QueryRowContext(ctx, query, user.ID, kind, step, RegistrationPending).Scan(
+		&registration.ID,
+		&registration.CreatedAt,
+		&registration.UpdatedAt)
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	return registration, nil
+}
+
+// Update records the step and status of the registration, along with the
+// messages the step produced
+func (m RegistrationModel) Update(registration *Registration, messages ...*OutboxMessage) error {
+
+	query := `
+		UPDATE registrations
+		SET step = $2, status = $3, error = $4, updated_at = NOW()
+		WHERE id = $1
+		RETURNING updated_at`
+
+	args := []any{registration.ID, registration.Step, registration.Status, registration.Error}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&registration.UpdatedAt)
+	if err != nil {
+		return err
+	}
+
+	err = insertOutboxMessages(ctx, tx, messages)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Claim takes over an interrupted registration. it returns ErrEditConflict
+// if it was updated since it was read, i.e. someone else is working on it
+func (m RegistrationModel) Claim(registration *Registration) error {
+
+	query := `
+		UPDATE registrations
+		SET updated_at = NOW()
+		WHERE id = $1 AND updated_at = $2
+		RETURNING updated_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, registration.ID, registration.UpdatedAt).Scan(&registration.UpdatedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RollBack deletes the user of the registration, the outbox messages about it
+// going with it, and marks it rolled back, in one transaction. an activated
+// user finished registering even if the registration wasn't recorded as
+// completed, so it returns ErrRecordNotFound and records nothing if the user
+// was activated, or is gone
+func (m RegistrationModel) RollBack(registration *Registration) error {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = deleteUnactivatedUser(ctx, tx, registration.UserID)
+	if err != nil {
+		return err
+	}
+
+	err = tx.QueryRowContext(ctx, `
+		UPDATE registrations
+		SET status = $2, error = $3, updated_at = NOW()
+		WHERE id = $1
+		RETURNING updated_at`, registration.ID, RegistrationRolledBack, registration.Error).Scan(&registration.UpdatedAt)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	registration.Status = RegistrationRolledBack
+
+	return nil
+}
+
+// GetUnfinished returns the registrations that are still pending or being
+// compensated and weren't updated since the given time, i.e. whose request
+// was interrupted
+func (m RegistrationModel) GetUnfinished(updatedBefore time.Time, limit int) ([]*Registration, error) {
+
+	query := `
+		SELECT id, user_id, kind, step, status, error, created_at, updated_at
+		FROM registrations
+		WHERE status IN ($1, $2) AND updated_at < $3
+		ORDER BY id
+		LIMIT $4`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, RegistrationPending, RegistrationCompensating, updatedBefore, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	registrations := []*Registration{}
+
+	for rows.Next() {
+		var registration Registration
+
+		err := rows.Scan(
+			&registration.ID,
+			&registration.UserID,
+			&registration.Kind,
+			&registration.Step,
+			&registration.Status,
+			&registration.Error,
+			&registration.CreatedAt,
+			&registration.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		registrations = append(registrations, &registration)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return registrations, nil
+}
+
+// DeleteFinished removes the registrations that completed or were rolled back
+// before the given time, they have nothing left to recover
+func (m RegistrationModel) DeleteFinished(finishedBefore time.Time) error {
+
+	query := `
+		DELETE FROM registrations
+		WHERE status IN ($1, $2) AND updated_at < $3`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, RegistrationCompleted, RegistrationRolledBack, finishedBefore)
+	return err
+}
@@ -0,0 +1,173 @@
+package data
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"sync"
+	"time"
+)
+
+var _ RegistrationRepository = (*MemoryRegistrationRepository)(nil)
+
+// MemoryRegistrationRepository keeps registrations in memory, along with the
+// outbox messages their steps produced. it starts and rolls back users in the
+// MemoryUserRepository it was made with, as RegistrationModel does in the
+// users table
+type MemoryRegistrationRepository struct {
+	mu            sync.Mutex
+	users         *MemoryUserRepository
+	registrations map[int64]*Registration
+	messages      []*OutboxMessage
+	lastId        int64
+}
+
+func NewMemoryRegistrationRepository(users *MemoryUserRepository) *MemoryRegistrationRepository {
+	return &MemoryRegistrationRepository{
+		users:         users,
+		registrations: make(map[int64]*Registration),
+	}
+}
+
+func (r *MemoryRegistrationRepository) Start(ctx context.Context, user *User, kind, step string) (*Registration, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	err := r.users.InsertContext(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+
+	r.lastId++
+
+	now := memoryNow()
+
+	registration := &Registration{
+		ID:        r.lastId,
+		UserID:    user.ID,
+		Kind:      kind,
+		Step:      step,
+		Status:    RegistrationPending,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	stored := *registration
+	r.registrations[registration.ID] = &stored
+
+	return registration, nil
+}
+
+func (r *MemoryRegistrationRepository) Update(registration *Registration, messages ...*OutboxMessage) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored, ok := r.registrations[registration.ID]
+	if !ok {
+		return ErrRecordNotFound
+	}
+
+	registration.UpdatedAt = memoryNow()
+	*stored = *registration
+
+	r.messages = append(r.messages, messages...)
+
+	return nil
+}
+
+func (r *MemoryRegistrationRepository) Claim(registration *Registration) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored, ok := r.registrations[registration.ID]
+	if !ok || !stored.UpdatedAt.Equal(registration.UpdatedAt) {
+		return ErrEditConflict
+	}
+
+	stored.UpdatedAt = memoryNow()
+	registration.UpdatedAt = stored.UpdatedAt
+
+	return nil
+}
+
+func (r *MemoryRegistrationRepository) RollBack(registration *Registration) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored, ok := r.registrations[registration.ID]
+	if !ok {
+		return ErrRecordNotFound
+	}
+
+	err := r.users.deleteUnactivated(registration.UserID)
+	if err != nil {
+		return err
+	}
+
+	r.messages = slices.DeleteFunc(r.messages, func(message *OutboxMessage) bool {
+		return message.UserID == registration.UserID
+	})
+
+	registration.Status = RegistrationRolledBack
+	registration.UpdatedAt = memoryNow()
+	*stored = *registration
+
+	return nil
+}
+
+func (r *MemoryRegistrationRepository) GetUnfinished(updatedBefore time.Time, limit int) ([]*Registration, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	registrations := []*Registration{}
+
+	for _, registration := range r.registrations {
+		unfinished := registration.Status == RegistrationPending || registration.Status == RegistrationCompensating
+		if unfinished && registration.UpdatedAt.Before(updatedBefore) {
+			c := *registration
+			registrations = append(registrations, &c)
+		}
+	}
+
+	slices.SortFunc(registrations, func(a, b *Registration) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
+
+	return registrations[:min(limit, len(registrations))], nil
+}
+
+func (r *MemoryRegistrationRepository) DeleteFinished(finishedBefore time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for id, registration := range r.registrations {
+		finished := registration.Status == RegistrationCompleted || registration.Status == RegistrationRolledBack
+		if finished && registration.UpdatedAt.Before(finishedBefore) {
+			delete(r.registrations, id)
+		}
+	}
+
+	return nil
+}
+
+// Get returns the registration with the id, for tests to check its progress
+func (r *MemoryRegistrationRepository) Get(registrationId int64) (*Registration, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	registration, ok := r.registrations[registrationId]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+
+	c := *registration
+	return &c, nil
+}
+
+// Messages returns the outbox messages the steps of registrations produced
+func (r *MemoryRegistrationRepository) Messages() []*OutboxMessage {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return slices.Clone(r.messages)
+}
@@ -0,0 +1,276 @@
+package data
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Session is a login on one device. its token is only stored hashed. when it
+// was last used is kept along with the other session activity, not here
+type Session struct {
+	ID        int64     `json:"id"`
+	UserID    int64     `json:"user_id"`
+	TokenHash []byte    `json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+	Expiry    time.Time `json:"expiry"`
+	ClientIP  string    `json:"client_ip"`
+	UserAgent string    `json:"user_agent"`
+}
+
+// SessionRepository stores the sessions of users. sessions past their expiry
+// are left out as if they were deleted
+type SessionRepository interface {
+	Insert(session *Session, tokenPlaintext string) error
+	GetForToken(tokenPlaintext string) (*Session, error)
+	IsKnownAddress(email, clientIP string) (bool, error)
+	GetAllForUser(userId int64) ([]*Session, error)
+	DeleteForUser(sessionId, userId int64) error
+	DeleteAllForUser(userId, exceptSessionId int64) error
+	Get(sessionId int64) (*Session, error)
+	UpdateToken(session *Session, tokenPlaintext string) error
+}
+
+var _ SessionRepository = SessionModel{}
+
+type SessionModel struct {
+	DB *sql.DB
+}
+
+func (m SessionModel) Insert(session *Session, tokenPlaintext string) error {
+
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+		INSERT INTO sessions (user_id, token_hash, expiry, client_ip, user_agent)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []any{session.UserID, tokenHash[:], session.Expiry, session.ClientIP, session.UserAgent}
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&session.ID, &session.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	session.TokenHash = tokenHash[:]
+
+	return nil
+}
+
+func (m SessionModel) GetForToken(tokenPlaintext string) (*Session, error) {
+
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+		SELECT id, user_id, token_hash, created_at, expiry, client_ip, user_agent
+		FROM sessions
+		WHERE token_hash = $1
+		AND expiry > $2`
+
+	var session Session
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, tokenHash[:], time.Now()).Scan(
+		&session.ID,
+		&session.UserID,
+		&session.TokenHash,
+		&session.CreatedAt,
+		&session.Expiry,
+		&session.ClientIP,
+		&session.UserAgent)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &session, nil
+}
+
+// IsKnownAddress reports whether the account with the email has a session
+// started from the client address
+func (m SessionModel) IsKnownAddress(email, clientIP string) (bool, error) {
+
+	query := `
+		SELECT EXISTS (
+			SELECT 1
+			FROM sessions
+			INNER JOIN users ON users.id = sessions.user_id
+			WHERE users.email = $1
+			AND sessions.client_ip = $2
+			AND sessions.expiry > $3
+		)`
+
+	var known bool
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, email, clientIP, time.Now()).Scan(&known)
+	return known, err
+}
+
+func (m SessionModel) GetAllForUser(userId int64) ([]*Session, error) {
+
+	query := `
+		SELECT id, user_id, token_hash, created_at, expiry, client_ip, user_agent
+		FROM sessions
+		WHERE user_id = $1
+		AND expiry > $2
+		ORDER BY created_at DESC, id DESC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userId, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []*Session{}
+
+	for rows.Next() {
+		var session Session
+
+		err := rows.Scan(
+			&session.ID,
+			&session.UserID,
+			&session.TokenHash,
+			&session.CreatedAt,
+			&session.Expiry,
+			&session.ClientIP,
+			&session.UserAgent)
+		if err != nil {
+			return nil, err
+		}
+
+		sessions = append(sessions, &session)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+func (m SessionModel) DeleteForUser(sessionId, userId int64) error {
+
+	query := `
+		DELETE FROM sessions
+		WHERE id = $1 AND user_id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, sessionId, userId)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// DeleteAllForUser revokes the sessions of the user except the one with the
+// given id, pass 0 to revoke all of them
+func (m SessionModel) DeleteAllForUser(userId, exceptSessionId int64) error {
+
+	query := `
+		DELETE FROM sessions
+		WHERE user_id = $1 AND id <> $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userId, exceptSessionId)
+	return err
+}
+
+func (m SessionModel) Get(sessionId int64) (*Session, error) {
+
+	query := `
+		SELECT id, user_id, token_hash, created_at, expiry, client_ip, user_agent
+		FROM sessions
+		WHERE id = $1
+		AND expiry > $2`
+
+	var session Session
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, sessionId, time.Now()).Scan(
+		&session.ID,
+		&session.UserID,
+		&session.TokenHash,
+		&session.CreatedAt,
+		&session.Expiry,
+		&session.ClientIP,
+		&session.UserAgent)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &session, nil
+}
+
+// UpdateToken moves the session to a new access token, the old one stops
+// being accepted
+func (m SessionModel) UpdateToken(session *Session, tokenPlaintext string) error {
+
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+		UPDATE sessions
+		SET token_hash = $1
+		WHERE id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, tokenHash[:], session.ID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	session.TokenHash = tokenHash[:]
+
+	return nil
+}
@@ -5,8 +5,28 @@ import "github.com/saarwasserman/users/internal/validator"
 const (
 	ScopeActivation     = "activation"
 	ScopeAuthentication = "authentication"
+	ScopeRefresh        = "refresh"
+	ScopePasswordReset  = "password-reset"
+	ScopeEmailChange    = "email-change"
+	// sent to the old address so its owner can cancel a change they didn't ask for
+	ScopeEmailChangeCancel = "email-change-cancel"
+	// proves the password step of a login of a user with two-factor authentication
+	ScopeMFAChallenge = "mfa-challenge"
+	ScopeMagicLink    = "magic-link"
 )
 
+// Scopes lists every token scope issued for a user, for revoking them all at once
+var Scopes = []string{
+	ScopeActivation,
+	ScopeAuthentication,
+	ScopeRefresh,
+	ScopePasswordReset,
+	ScopeEmailChange,
+	ScopeEmailChangeCancel,
+	ScopeMFAChallenge,
+	ScopeMagicLink,
+}
+
 func ValidateTokenPlaintext(v *validator.Validator, tokenPlaintext string) {
 	v.Check(tokenPlaintext != "", "token", "must be provided")
 	v.Check(len(tokenPlaintext) == 26, "token", "must be 26 bytes long")
@@ -0,0 +1,266 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"regexp"
+	"time"
+
+	"github.com/saarwasserman/users/internal/validator"
+)
+
+// TOTPCredential is the authenticator app secret of a user. the secret is
+// stored encrypted, the model never sees it in the clear
+type TOTPCredential struct {
+	UserID           int64      `json:"-"`
+	SecretCiphertext []byte     `json:"-"`
+	Confirmed        bool       `json:"confirmed"`
+	LastUsedStep     int64      `json:"-"`
+	CreatedAt        time.Time  `json:"created_at"`
+	ConfirmedAt      *time.Time `json:"confirmed_at,omitempty"`
+}
+
+// TOTPCredentialRepository stores the authenticator app secrets of users.
+// confirming and deleting a secret replaces the user's recovery codes along
+// with it
+type TOTPCredentialRepository interface {
+	Upsert(credential *TOTPCredential) error
+	GetForUser(userId int64) (*TOTPCredential, error)
+	IsEnabled(userId int64) (bool, error)
+	UseStep(credential *TOTPCredential, step int64) error
+	Confirm(credential *TOTPCredential, step int64, recoveryCodes []string) error
+	Delete(userId int64) error
+	AnyConfirmed() (bool, error)
+}
+
+var _ TOTPCredentialRepository = TOTPCredentialModel{}
+
+type TOTPCredentialModel struct {
+	DB *sql.DB
+}
+
+// Upsert stores a new unconfirmed secret for the user, replacing an earlier
+// enrollment that was never confirmed. it returns ErrEditConflict if the user
+// already has a confirmed secret
+func (m TOTPCredentialModel) Upsert(credential *TOTPCredential) error {
+
+	query := `
+		INSERT INTO totp_credentials (user_id, secret_ciphertext)
+		VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE
+		SET secret_ciphertext = EXCLUDED.secret_ciphertext, last_used_step = 0, created_at = NOW()
+		WHERE totp_credentials.confirmed = false
+		RETURNING created_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, credential.UserID, credential.SecretCiphertext).Scan(&credential.CreatedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m TOTPCredentialModel) GetForUser(userId int64) (*TOTPCredential, error) {
+
+	query := `
+		SELECT user_id, secret_ciphertext, confirmed, last_used_step, created_at, confirmed_at
+		FROM totp_credentials
+		WHERE user_id = $1`
+
+	var credential TOTPCredential
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, userId).Scan(
+		&credential.UserID,
+		&credential.SecretCiphertext,
+		&credential.Confirmed,
+		&credential.LastUsedStep,
+		&credential.CreatedAt,
+		&credential.ConfirmedAt)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &credential, nil
+}
+
+// IsEnabled reports whether the user has a confirmed secret, i.e. whether
+// logging in requires a code
+func (m TOTPCredentialModel) IsEnabled(userId int64) (bool, error) {
+
+	query := `
+		SELECT EXISTS (
+			SELECT 1 FROM totp_credentials
+			WHERE user_id = $1 AND confirmed = true
+		)`
+
+	var enabled bool
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, userId).Scan(&enabled)
+	if err != nil {
+		return false, err
+	}
+
+	return enabled, nil
+}
+
+// UseStep records the time step of an accepted code of a confirmed secret.
+// it returns ErrEditConflict if a code of that step or a later one was
+// already used, so every code is accepted only once
+func (m TOTPCredentialModel) UseStep(credential *TOTPCredential, step int64) error {
+
+	query := `
+		UPDATE totp_credentials
+		SET last_used_step = $2
+		WHERE user_id = $1 AND confirmed = true AND last_used_step < $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, credential.UserID, step)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrEditConflict
+	}
+
+	credential.LastUsedStep = step
+
+	return nil
+}
+
+// Confirm enables the secret with the time step of its first accepted code
+// and gives the user their recovery codes, in one transaction so the user
+// never has two-factor authentication without a way to recover. it returns
+// ErrEditConflict if the secret was confirmed or its step used meanwhile
+func (m TOTPCredentialModel) Confirm(credential *TOTPCredential, step int64, recoveryCodes []string) error {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, `
+		UPDATE totp_credentials
+		SET last_used_step = $2, confirmed = true, confirmed_at = NOW()
+		WHERE user_id = $1 AND confirmed = false AND last_used_step < $2
+		RETURNING confirmed_at`, credential.UserID, step).Scan(&credential.ConfirmedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	err = replaceRecoveryCodes(ctx, tx, credential.UserID, recoveryCodes)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	credential.LastUsedStep = step
+	credential.Confirmed = true
+
+	return nil
+}
+
+// Delete removes the secret of the user along with their recovery codes, in
+// one transaction, turning two-factor authentication off
+func (m TOTPCredentialModel) Delete(userId int64) error {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `DELETE FROM totp_credentials WHERE user_id = $1`, userId)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	err = replaceRecoveryCodes(ctx, tx, userId, nil)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// AnyConfirmed reports whether any user has two-factor authentication enabled
+func (m TOTPCredentialModel) AnyConfirmed() (bool, error) {
+
+	query := `
+		SELECT EXISTS (
+			SELECT 1 FROM totp_credentials
+			WHERE confirmed = true
+		)`
+
+	var confirmed bool
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query).Scan(&confirmed)
+	if err != nil {
+		return false, err
+	}
+
+	return confirmed, nil
+}
+
+var totpCodeRX = regexp.MustCompile(`^[0-9]{6}$`)
+
+func ValidateTOTPCode(v *validator.Validator, code string) {
+	v.Check(code != "", "code", "must be provided")
+	v.Check(validator.Matches(code, totpCodeRX), "code", "must be 6 digits")
+}
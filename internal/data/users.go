@@ -5,6 +5,8 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"errors"
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/saarwasserman/users/internal/validator"
@@ -17,12 +19,13 @@ var (
 var AnonymousUser = &User{}
 
 type User struct {
-	ID        int64     `json:"id"`
-	CreatedAt time.Time `json:"created_at"`
-	Name      string    `json:"name"`
-	Email     string    `json:"email"`
-	Activated bool      `json:"activated"`
-	Version   int       `json:"-"`
+	ID        int64      `json:"id"`
+	CreatedAt time.Time  `json:"created_at"`
+	Name      string     `json:"name"`
+	Email     string     `json:"email"`
+	Activated bool       `json:"activated"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	Version   int        `json:"-"`
 }
 
 func (u *User) IsAnonymous() bool {
@@ -49,45 +52,129 @@ func ValidateUser(v *validator.Validator, user *User) {
 	// TODO: check password using auth service request
 }
 
+// UserRepository stores users. implementations return ErrRecordNotFound for
+// users that don't exist or are soft deleted, ErrEditConflict when the version
+// of the user doesn't match the stored one, and ErrDuplicateEmail when another
+// user, soft deleted or not, has the same email regardless of case
+type UserRepository interface {
+	Insert(user *User) error
+	InsertContext(ctx context.Context, user *User) error
+	GetByEmailContext(ctx context.Context, email string) (*User, error)
+	GetByUserIdContext(ctx context.Context, userId int64) (*User, error)
+	UpdateContext(ctx context.Context, user *User) error
+	GetPendingDeletionByEmailContext(ctx context.Context, email string, deletedAfter time.Time) (*User, error)
+	GetPendingDeletionContext(ctx context.Context, userId int64, deletedAfter time.Time) (*User, error)
+	SoftDeleteContext(ctx context.Context, user *User) error
+	RestoreContext(ctx context.Context, user *User) error
+	ClaimDeletedBeforeContext(ctx context.Context, deletedBefore time.Time, limit int, lease time.Duration) ([]int64, error)
+	DeleteContext(ctx context.Context, userId int64) error
+	ListContext(ctx context.Context, listFilters UserListFilters, filters Filters) ([]*User, string, error)
+}
+
+var _ UserRepository = UserModel{}
+
+// DefaultQueryTimeout bounds queries of models with no timeout set
+const DefaultQueryTimeout = 3 * time.Second
+
+// UserModel runs each query with the context of the caller, bounded by
+// Timeout so a query can't outlive it even if the caller has no deadline.
+// the methods without a context are there for callers that have none
 type UserModel struct {
-	DB *sql.DB
+	DB      *sql.DB
+	Timeout time.Duration
 }
 
-func (m UserModel) Insert(user *User) error {
+// queryContext returns the context a query runs in, which ends with the
+// caller's deadline or the model's timeout, whichever comes first
+func (m UserModel) queryContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return queryContext(ctx, m.Timeout)
+}
+
+func queryContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		timeout = DefaultQueryTimeout
+	}
+
+	return context.WithTimeout(ctx, timeout)
+}
+
+// rowQuerier is implemented by both *sql.DB and *sql.Tx
+type rowQuerier interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+func (m UserModel) InsertContext(ctx context.Context, user *User) error {
+
+	ctx, cancel := m.queryContext(ctx)
+	defer cancel()
+
+	return insertUser(ctx, m.DB, user)
+}
+
+func insertUser(ctx context.Context, q rowQuerier, user *User) error {
 
 	query := `
 		INSERT INTO users (name, email, activated)
 		VALUES ($1, $2, $3)
 		RETURNING id, created_at, version`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-
 	args := []any{user.Name, user.Email, user.Activated}
 
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Version)
+	err := q.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Version)
 	if err != nil {
 		switch {
 		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
 			return ErrDuplicateEmail
 		default:
-			return err
+			return contextError(ctx, err)
 		}
 	}
 
 	return nil
 }
 
-func (m UserModel) GetByEmail(email string) (*User, error) {
+// execer is implemented by both *sql.DB and *sql.Tx
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// deleteUnactivatedUser removes a user that never activated their account,
+// i.e. one whose registration is rolled back. it returns ErrRecordNotFound if
+// there is no such user, e.g. because it was activated
+func deleteUnactivatedUser(ctx context.Context, e execer, userId int64) error {
+
+	query := `
+		DELETE FROM users
+		WHERE id = $1 AND activated = false`
+
+	result, err := e.ExecContext(ctx, query, userId)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+func (m UserModel) GetByEmailContext(ctx context.Context, email string) (*User, error) {
 
 	query := `
 		SELECT id, created_at, name, email, activated, version
 		FROM users
-		WHERE email = $1`
+		WHERE email = $1
+		AND deleted_at IS NULL`
 
 	var user User
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := m.queryContext(ctx)
 	defer cancel()
 
 	err := m.DB.QueryRowContext(ctx, query, email).Scan(
@@ -103,23 +190,24 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 		case errors.Is(err, sql.ErrNoRows):
 			return nil, ErrRecordNotFound
 		default:
-			return nil, err
+			return nil, contextError(ctx, err)
 		}
 	}
 
 	return &user, nil
 }
 
-func (m UserModel) GetByUserId(userId int64) (*User, error) {
+func (m UserModel) GetByUserIdContext(ctx context.Context, userId int64) (*User, error) {
 
 	query := `
 		SELECT id, created_at, name, email, activated, version
 		FROM users
-		WHERE id = $1`
+		WHERE id = $1
+		AND deleted_at IS NULL`
 
 	var user User
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := m.queryContext(ctx)
 	defer cancel()
 
 	err := m.DB.QueryRowContext(ctx, query, userId).Scan(
@@ -135,18 +223,18 @@ func (m UserModel) GetByUserId(userId int64) (*User, error) {
 		case errors.Is(err, sql.ErrNoRows):
 			return nil, ErrRecordNotFound
 		default:
-			return nil, err
+			return nil, contextError(ctx, err)
 		}
 	}
 
 	return &user, nil
 }
 
-func (m UserModel) Update(user *User) error {
+func (m UserModel) UpdateContext(ctx context.Context, user *User) error {
 	query := `
 		UPDATE users
 		SET name = $1, email = $2, activated = $3, version = version + 1
-		WHERE id = $4 AND version = $5
+		WHERE id = $4 AND version = $5 AND deleted_at IS NULL
 		RETURNING version`
 
 	args := []any{
@@ -157,7 +245,7 @@ func (m UserModel) Update(user *User) error {
 		user.Version,
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := m.queryContext(ctx)
 	defer cancel()
 
 	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.Version)
@@ -168,14 +256,236 @@ func (m UserModel) Update(user *User) error {
 		case errors.Is(err, sql.ErrNoRows):
 			return ErrEditConflict
 		default:
-			return err
+			return contextError(ctx, err)
 		}
 	}
 
 	return nil
 }
 
-func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (int64, error) {
+// GetPendingDeletionByEmailContext returns a soft deleted user whose deletion was
+// requested after the given time, i.e. one that can still be restored
+func (m UserModel) GetPendingDeletionByEmailContext(ctx context.Context, email string, deletedAfter time.Time) (*User, error) {
+
+	query := `
+		SELECT id, created_at, name, email, activated, deleted_at, version
+		FROM users
+		WHERE email = $1
+		AND deleted_at > $2`
+
+	var user User
+
+	ctx, cancel := m.queryContext(ctx)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, email, deletedAfter).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Activated,
+		&user.DeletedAt,
+		&user.Version)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, contextError(ctx, err)
+		}
+	}
+
+	return &user, nil
+}
+
+// GetPendingDeletionContext is GetPendingDeletionByEmailContext by user id
+func (m UserModel) GetPendingDeletionContext(ctx context.Context, userId int64, deletedAfter time.Time) (*User, error) {
+
+	query := `
+		SELECT id, created_at, name, email, activated, deleted_at, version
+		FROM users
+		WHERE id = $1
+		AND deleted_at > $2`
+
+	var user User
+
+	ctx, cancel := m.queryContext(ctx)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, userId, deletedAfter).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Activated,
+		&user.DeletedAt,
+		&user.Version)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, contextError(ctx, err)
+		}
+	}
+
+	return &user, nil
+}
+
+// SoftDeleteContext marks the user as pending deletion. the row stays until Delete
+// is called so the deletion can be cancelled with Restore. the outbox messages
+// about the user not delivered yet are dropped, nothing is sent to an account
+// pending deletion
+func (m UserModel) SoftDeleteContext(ctx context.Context, user *User) error {
+	query := `
+		UPDATE users
+		SET deleted_at = NOW(), version = version + 1
+		WHERE id = $1 AND version = $2 AND deleted_at IS NULL
+		RETURNING deleted_at, version`
+
+	ctx, cancel := m.queryContext(ctx)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	var deletedAt *time.Time
+	var version int
+
+	err = tx.QueryRowContext(ctx, query, user.ID, user.Version).Scan(&deletedAt, &version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return contextError(ctx, err)
+		}
+	}
+
+	err = deletePendingOutboxMessages(ctx, tx, user.ID)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	user.DeletedAt = deletedAt
+	user.Version = version
+
+	return nil
+}
+
+func (m UserModel) RestoreContext(ctx context.Context, user *User) error {
+	query := `
+		UPDATE users
+		SET deleted_at = NULL, version = version + 1
+		WHERE id = $1 AND version = $2 AND deleted_at IS NOT NULL
+		RETURNING version`
+
+	ctx, cancel := m.queryContext(ctx)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, user.ID, user.Version).Scan(&user.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return contextError(ctx, err)
+		}
+	}
+
+	user.DeletedAt = nil
+
+	return nil
+}
+
+// ClaimDeletedBeforeContext claims up to limit users soft deleted before the
+// given time for purging, and returns their ids. a claimed user isn't
+// returned again until the lease is over, so purges running side by side
+// never work on the same users
+func (m UserModel) ClaimDeletedBeforeContext(ctx context.Context, deletedBefore time.Time, limit int, lease time.Duration) ([]int64, error) {
+
+	query := `
+		UPDATE users
+		SET purge_claimed_until = NOW() + $3 * INTERVAL '1 millisecond'
+		WHERE id IN (
+			SELECT id
+			FROM users
+			WHERE deleted_at <= $1
+			AND (purge_claimed_until IS NULL OR purge_claimed_until < NOW())
+			ORDER BY deleted_at
+			LIMIT $2
+			FOR UPDATE SKIP LOCKED)
+		RETURNING id`
+
+	ctx, cancel := m.queryContext(ctx)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, deletedBefore, limit, lease.Milliseconds())
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+	defer rows.Close()
+
+	userIds := []int64{}
+
+	for rows.Next() {
+		var userId int64
+
+		err := rows.Scan(&userId)
+		if err != nil {
+			return nil, err
+		}
+
+		userIds = append(userIds, userId)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	return userIds, nil
+}
+
+// DeleteContext permanently removes a soft deleted user, the outbox messages
+// about it going with it
+func (m UserModel) DeleteContext(ctx context.Context, userId int64) error {
+
+	query := `
+		DELETE FROM users
+		WHERE id = $1
+		AND deleted_at IS NOT NULL`
+
+	ctx, cancel := m.queryContext(ctx)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userId)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+func (m UserModel) GetForTokenContext(ctx context.Context, tokenScope, tokenPlaintext string) (int64, error) {
 
 	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
 
@@ -190,7 +500,7 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (int64, error)
 
 	var userId int64
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := m.queryContext(ctx)
 	defer cancel()
 
 	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&userId)
@@ -200,9 +510,158 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (int64, error)
 		case errors.Is(err, sql.ErrNoRows):
 			return -1, ErrRecordNotFound
 		default:
-			return -1, err
+			return -1, contextError(ctx, err)
 		}
 	}
 
 	return userId, nil
 }
+
+type UserListFilters struct {
+	Activated     *bool
+	CreatedAfter  *time.Time
+	CreatedBefore *time.Time
+	// matched as a substring of the email or the name, case insensitive
+	Search string
+}
+
+// ListContext returns a page of users matching the filters and the cursor of the next
+// page, which is empty on the last page
+func (m UserModel) ListContext(ctx context.Context, listFilters UserListFilters, filters Filters) ([]*User, string, error) {
+
+	comparison := ">"
+	if filters.sortDirection() == "DESC" {
+		comparison = "<"
+	}
+
+	query := fmt.Sprintf(`
+		SELECT id, created_at, name, email, activated, version
+		FROM users
+		WHERE deleted_at IS NULL
+		AND ($1::boolean IS NULL OR activated = $1)
+		AND ($2::timestamptz IS NULL OR created_at >= $2)
+		AND ($3::timestamptz IS NULL OR created_at < $3)
+		AND ($4 = '' OR email ILIKE '%%' || $4 || '%%' OR name ILIKE '%%' || $4 || '%%')
+		AND ($5::timestamptz IS NULL OR (created_at, id) %s ($5, $6))
+		ORDER BY created_at %s, id %s
+		LIMIT $7`, comparison, filters.sortDirection(), filters.sortDirection())
+
+	var afterCreatedAt *time.Time
+	var afterId int64
+
+	if filters.Cursor != "" {
+		c, err := decodeCursor(filters.Cursor, filters.Sort)
+		if err != nil {
+			return nil, "", err
+		}
+
+		afterCreatedAt = &c.CreatedAt
+		afterId = c.ID
+	}
+
+	// one extra row tells whether there is a next page
+	args := []any{
+		listFilters.Activated,
+		listFilters.CreatedAfter,
+		listFilters.CreatedBefore,
+		escapeLike(listFilters.Search),
+		afterCreatedAt,
+		afterId,
+		filters.PageSize + 1,
+	}
+
+	ctx, cancel := m.queryContext(ctx)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, "", contextError(ctx, err)
+	}
+	defer rows.Close()
+
+	users := []*User{}
+
+	for rows.Next() {
+		var user User
+
+		err := rows.Scan(
+			&user.ID,
+			&user.CreatedAt,
+			&user.Name,
+			&user.Email,
+			&user.Activated,
+			&user.Version)
+		if err != nil {
+			return nil, "", err
+		}
+
+		users = append(users, &user)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, "", contextError(ctx, err)
+	}
+
+	nextCursor := ""
+
+	if len(users) > filters.PageSize {
+		users = users[:filters.PageSize]
+		last := users[len(users)-1]
+		nextCursor = encodeCursor(cursor{Sort: filters.Sort, CreatedAt: last.CreatedAt, ID: last.ID})
+	}
+
+	return users, nextCursor, nil
+}
+
+// escapeLike makes LIKE wildcards in user input match literally
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+func (m UserModel) Insert(user *User) error {
+	return m.InsertContext(context.Background(), user)
+}
+
+func (m UserModel) GetByEmail(email string) (*User, error) {
+	return m.GetByEmailContext(context.Background(), email)
+}
+
+func (m UserModel) GetByUserId(userId int64) (*User, error) {
+	return m.GetByUserIdContext(context.Background(), userId)
+}
+
+func (m UserModel) Update(user *User) error {
+	return m.UpdateContext(context.Background(), user)
+}
+
+func (m UserModel) GetPendingDeletionByEmail(email string, deletedAfter time.Time) (*User, error) {
+	return m.GetPendingDeletionByEmailContext(context.Background(), email, deletedAfter)
+}
+
+func (m UserModel) GetPendingDeletion(userId int64, deletedAfter time.Time) (*User, error) {
+	return m.GetPendingDeletionContext(context.Background(), userId, deletedAfter)
+}
+
+func (m UserModel) SoftDelete(user *User) error {
+	return m.SoftDeleteContext(context.Background(), user)
+}
+
+func (m UserModel) Restore(user *User) error {
+	return m.RestoreContext(context.Background(), user)
+}
+
+func (m UserModel) ClaimDeletedBefore(deletedBefore time.Time, limit int, lease time.Duration) ([]int64, error) {
+	return m.ClaimDeletedBeforeContext(context.Background(), deletedBefore, limit, lease)
+}
+
+func (m UserModel) Delete(userId int64) error {
+	return m.DeleteContext(context.Background(), userId)
+}
+
+func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (int64, error) {
+	return m.GetForTokenContext(context.Background(), tokenScope, tokenPlaintext)
+}
+
+func (m UserModel) List(listFilters UserListFilters, filters Filters) ([]*User, string, error) {
+	return m.ListContext(context.Background(), listFilters, filters)
+}
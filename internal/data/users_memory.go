@@ -0,0 +1,367 @@
+package data
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+var _ UserRepository = (*MemoryUserRepository)(nil)
+
+// MemoryUserRepository keeps users in memory, for tests that shouldn't need
+// PostgreSQL. it behaves like UserModel, down to emails being unique
+// regardless of case and timestamps being rounded to the second
+type MemoryUserRepository struct {
+	mu     sync.Mutex
+	users  map[int64]*User
+	lastId int64
+
+	// end of the purge lease of claimed users
+	purgeClaims map[int64]time.Time
+}
+
+func NewMemoryUserRepository() *MemoryUserRepository {
+	return &MemoryUserRepository{
+		users:       make(map[int64]*User),
+		purgeClaims: make(map[int64]time.Time),
+	}
+}
+
+// memoryNow matches timestamp(0) columns, which keep whole seconds
+func memoryNow() time.Time {
+	return time.Now().Round(time.Second)
+}
+
+// copyUser keeps callers from changing stored users other than through the repository
+func copyUser(user *User) *User {
+	c := *user
+	if user.DeletedAt != nil {
+		deletedAt := *user.DeletedAt
+		c.DeletedAt = &deletedAt
+	}
+
+	return &c
+}
+
+// emailTaken reports whether a user other than exceptId has the email, as
+// the case insensitive unique constraint of the users table would
+func (r *MemoryUserRepository) emailTaken(email string, exceptId int64) bool {
+	for _, user := range r.users {
+		if user.ID != exceptId && strings.EqualFold(user.Email, email) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *MemoryUserRepository) Insert(user *User) error {
+	return r.InsertContext(context.Background(), user)
+}
+
+func (r *MemoryUserRepository) InsertContext(ctx context.Context, user *User) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.emailTaken(user.Email, 0) {
+		return ErrDuplicateEmail
+	}
+
+	r.lastId++
+
+	user.ID = r.lastId
+	user.CreatedAt = memoryNow()
+	user.DeletedAt = nil
+	user.Version = 1
+
+	r.users[user.ID] = copyUser(user)
+
+	return nil
+}
+
+func (r *MemoryUserRepository) GetByEmailContext(ctx context.Context, email string) (*User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, user := range r.users {
+		if user.DeletedAt == nil && strings.EqualFold(user.Email, email) {
+			return copyUser(user), nil
+		}
+	}
+
+	return nil, ErrRecordNotFound
+}
+
+func (r *MemoryUserRepository) GetByUserIdContext(ctx context.Context, userId int64) (*User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	user, ok := r.users[userId]
+	if !ok || user.DeletedAt != nil {
+		return nil, ErrRecordNotFound
+	}
+
+	return copyUser(user), nil
+}
+
+func (r *MemoryUserRepository) UpdateContext(ctx context.Context, user *User) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored, ok := r.users[user.ID]
+	if !ok || stored.Version != user.Version || stored.DeletedAt != nil {
+		return ErrEditConflict
+	}
+
+	if r.emailTaken(user.Email, user.ID) {
+		return ErrDuplicateEmail
+	}
+
+	stored.Name = user.Name
+	stored.Email = user.Email
+	stored.Activated = user.Activated
+	stored.Version++
+
+	user.Version = stored.Version
+
+	return nil
+}
+
+func (r *MemoryUserRepository) GetPendingDeletionByEmailContext(ctx context.Context, email string, deletedAfter time.Time) (*User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, user := range r.users {
+		if user.DeletedAt != nil && user.DeletedAt.After(deletedAfter) && strings.EqualFold(user.Email, email) {
+			return copyUser(user), nil
+		}
+	}
+
+	return nil, ErrRecordNotFound
+}
+
+func (r *MemoryUserRepository) GetPendingDeletionContext(ctx context.Context, userId int64, deletedAfter time.Time) (*User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	user, ok := r.users[userId]
+	if !ok || user.DeletedAt == nil || !user.DeletedAt.After(deletedAfter) {
+		return nil, ErrRecordNotFound
+	}
+
+	return copyUser(user), nil
+}
+
+func (r *MemoryUserRepository) SoftDeleteContext(ctx context.Context, user *User) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored, ok := r.users[user.ID]
+	if !ok || stored.Version != user.Version || stored.DeletedAt != nil {
+		return ErrEditConflict
+	}
+
+	deletedAt := memoryNow()
+
+	stored.DeletedAt = &deletedAt
+	stored.Version++
+
+	user.DeletedAt = &deletedAt
+	user.Version = stored.Version
+
+	return nil
+}
+
+func (r *MemoryUserRepository) RestoreContext(ctx context.Context, user *User) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored, ok := r.users[user.ID]
+	if !ok || stored.Version != user.Version || stored.DeletedAt == nil {
+		return ErrEditConflict
+	}
+
+	stored.DeletedAt = nil
+	stored.Version++
+
+	user.DeletedAt = nil
+	user.Version = stored.Version
+
+	return nil
+}
+
+func (r *MemoryUserRepository) ClaimDeletedBeforeContext(ctx context.Context, deletedBefore time.Time, limit int, lease time.Duration) ([]int64, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+
+	deleted := []*User{}
+
+	for _, user := range r.users {
+		if user.DeletedAt != nil && !user.DeletedAt.After(deletedBefore) && !now.Before(r.purgeClaims[user.ID]) {
+			deleted = append(deleted, user)
+		}
+	}
+
+	slices.SortFunc(deleted, func(a, b *User) int {
+		return a.DeletedAt.Compare(*b.DeletedAt)
+	})
+
+	userIds := []int64{}
+
+	for _, user := range deleted[:min(limit, len(deleted))] {
+		r.purgeClaims[user.ID] = now.Add(lease)
+		userIds = append(userIds, user.ID)
+	}
+
+	return userIds, nil
+}
+
+func (r *MemoryUserRepository) DeleteContext(ctx context.Context, userId int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	user, ok := r.users[userId]
+	if !ok || user.DeletedAt == nil {
+		return ErrRecordNotFound
+	}
+
+	delete(r.users, userId)
+	delete(r.purgeClaims, userId)
+
+	return nil
+}
+
+// deleteUnactivated removes the user unless it was activated, as rolling back
+// its registration does. it returns ErrRecordNotFound if there is no such user
+func (r *MemoryUserRepository) deleteUnactivated(userId int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	user, ok := r.users[userId]
+	if !ok || user.Activated {
+		return ErrRecordNotFound
+	}
+
+	delete(r.users, userId)
+	delete(r.purgeClaims, userId)
+
+	return nil
+}
+
+func (r *MemoryUserRepository) ListContext(ctx context.Context, listFilters UserListFilters, filters Filters) ([]*User, string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+
+	var after *cursor
+
+	if filters.Cursor != "" {
+		c, err := decodeCursor(filters.Cursor, filters.Sort)
+		if err != nil {
+			return nil, "", err
+		}
+
+		after = c
+	}
+
+	descending := filters.sortDirection() == "DESC"
+
+	// compare orders users by (created_at, id) in the direction of the sort
+	compare := func(createdAt time.Time, id int64, other cursor) int {
+		order := createdAt.Compare(other.CreatedAt)
+		if order == 0 {
+			order = cmp.Compare(id, other.ID)
+		}
+
+		if descending {
+			return -order
+		}
+
+		return order
+	}
+
+	search := strings.ToLower(listFilters.Search)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	users := []*User{}
+
+	for _, user := range r.users {
+		switch {
+		case user.DeletedAt != nil:
+			continue
+		case listFilters.Activated != nil && user.Activated != *listFilters.Activated:
+			continue
+		case listFilters.CreatedAfter != nil && user.CreatedAt.Before(*listFilters.CreatedAfter):
+			continue
+		case listFilters.CreatedBefore != nil && !user.CreatedAt.Before(*listFilters.CreatedBefore):
+			continue
+		case search != "" && !strings.Contains(strings.ToLower(user.Email), search) && !strings.Contains(strings.ToLower(user.Name), search):
+			continue
+		case after != nil && compare(user.CreatedAt, user.ID, *after) <= 0:
+			continue
+		}
+
+		users = append(users, copyUser(user))
+	}
+
+	slices.SortFunc(users, func(a, b *User) int {
+		return compare(a.CreatedAt, a.ID, cursor{CreatedAt: b.CreatedAt, ID: b.ID})
+	})
+
+	nextCursor := ""
+
+	if len(users) > filters.PageSize {
+		users = users[:filters.PageSize]
+		last := users[len(users)-1]
+		nextCursor = encodeCursor(cursor{Sort: filters.Sort, CreatedAt: last.CreatedAt, ID: last.ID})
+	}
+
+	return users, nextCursor, nil
+}
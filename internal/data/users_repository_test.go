@@ -0,0 +1,437 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"testing"
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+func TestMemoryUserRepository(t *testing.T) {
+	testUserRepository(t, func(t *testing.T) UserRepository {
+		return NewMemoryUserRepository()
+	})
+}
+
+// runs against the database of USERS_TEST_DB_DSN, which is emptied of users
+// before each test. skipped when not set
+func TestPostgresUserRepository(t *testing.T) {
+	dsn := os.Getenv("USERS_TEST_DB_DSN")
+	if dsn == "" {
+		t.Skip("USERS_TEST_DB_DSN not set")
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	testUserRepository(t, func(t *testing.T) UserRepository {
+		_, err := db.Exec(`TRUNCATE users CASCADE`)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return UserModel{DB: db}
+	})
+}
+
+// testUserRepository is the behavior every UserRepository must have.
+// newRepository returns an empty repository
+func testUserRepository(t *testing.T, newRepository func(t *testing.T) UserRepository) {
+	ctx := context.Background()
+
+	insert := func(t *testing.T, repo UserRepository, name, email string) *User {
+		t.Helper()
+
+		user := &User{Name: name, Email: email}
+
+		err := repo.InsertContext(ctx, user)
+		if err != nil {
+			t.Fatalf("insert %s: %s", email, err)
+		}
+
+		return user
+	}
+
+	t.Run("Insert", func(t *testing.T) {
+		repo := newRepository(t)
+
+		user := insert(t, repo, "Alice", "alice@dinghy.test")
+
+		if user.ID <= 0 || user.Version != 1 || user.CreatedAt.IsZero() {
+			t.Fatalf("got id %d, version %d, created at %s", user.ID, user.Version, user.CreatedAt)
+		}
+
+		other := insert(t, repo, "Bob", "bob@dinghy.test")
+		if other.ID == user.ID {
+			t.Fatalf("both users got id %d", user.ID)
+		}
+	})
+
+	t.Run("DuplicateEmail", func(t *testing.T) {
+		repo := newRepository(t)
+
+		insert(t, repo, "Alice", "alice@dinghy.test")
+
+		err := repo.InsertContext(ctx, &User{Name: "Alice", Email: "ALICE@Dinghy.test"})
+		if !errors.Is(err, ErrDuplicateEmail) {
+			t.Fatalf("got %v, want ErrDuplicateEmail", err)
+		}
+
+		bob := insert(t, repo, "Bob", "bob@dinghy.test")
+		bob.Email = "Alice@dinghy.test"
+
+		err = repo.UpdateContext(ctx, bob)
+		if !errors.Is(err, ErrDuplicateEmail) {
+			t.Fatalf("got %v, want ErrDuplicateEmail", err)
+		}
+	})
+
+	t.Run("Get", func(t *testing.T) {
+		repo := newRepository(t)
+
+		user := insert(t, repo, "Alice", "alice@dinghy.test")
+
+		byId, err := repo.GetByUserIdContext(ctx, user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if byId.Email != user.Email || byId.Name != user.Name || byId.Version != user.Version || !byId.CreatedAt.Equal(user.CreatedAt) {
+			t.Fatalf("got %+v, want %+v", byId, user)
+		}
+
+		byEmail, err := repo.GetByEmailContext(ctx, "Alice@DINGHY.test")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if byEmail.ID != user.ID {
+			t.Fatalf("got user %d, want %d", byEmail.ID, user.ID)
+		}
+
+		_, err = repo.GetByUserIdContext(ctx, user.ID+1000)
+		if !errors.Is(err, ErrRecordNotFound) {
+			t.Fatalf("got %v, want ErrRecordNotFound", err)
+		}
+
+		_, err = repo.GetByEmailContext(ctx, "nobody@dinghy.test")
+		if !errors.Is(err, ErrRecordNotFound) {
+			t.Fatalf("got %v, want ErrRecordNotFound", err)
+		}
+	})
+
+	t.Run("Update", func(t *testing.T) {
+		repo := newRepository(t)
+
+		user := insert(t, repo, "Alice", "alice@dinghy.test")
+		stale := *user
+
+		user.Name = "Alice Smith"
+		user.Activated = true
+
+		err := repo.UpdateContext(ctx, user)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if user.Version != 2 {
+			t.Fatalf("got version %d, want 2", user.Version)
+		}
+
+		stored, err := repo.GetByUserIdContext(ctx, user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if stored.Name != "Alice Smith" || !stored.Activated || stored.Version != 2 {
+			t.Fatalf("got %+v", stored)
+		}
+
+		err = repo.UpdateContext(ctx, &stale)
+		if !errors.Is(err, ErrEditConflict) {
+			t.Fatalf("got %v, want ErrEditConflict", err)
+		}
+	})
+
+	t.Run("Copies", func(t *testing.T) {
+		repo := newRepository(t)
+
+		user := insert(t, repo, "Alice", "alice@dinghy.test")
+		user.Name = "Mallory"
+
+		stored, err := repo.GetByUserIdContext(ctx, user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if stored.Name != "Alice" {
+			t.Fatalf("got name %q, want Alice", stored.Name)
+		}
+	})
+
+	t.Run("SoftDeleteAndRestore", func(t *testing.T) {
+		repo := newRepository(t)
+
+		user := insert(t, repo, "Alice", "alice@dinghy.test")
+		before := user.CreatedAt.Add(-time.Hour)
+
+		err := repo.SoftDeleteContext(ctx, user)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if user.DeletedAt == nil || user.Version != 2 {
+			t.Fatalf("got deleted at %v, version %d", user.DeletedAt, user.Version)
+		}
+
+		_, err = repo.GetByUserIdContext(ctx, user.ID)
+		if !errors.Is(err, ErrRecordNotFound) {
+			t.Fatalf("got %v, want ErrRecordNotFound", err)
+		}
+
+		_, err = repo.GetByEmailContext(ctx, user.Email)
+		if !errors.Is(err, ErrRecordNotFound) {
+			t.Fatalf("got %v, want ErrRecordNotFound", err)
+		}
+
+		// the email stays taken until the user is purged
+		err = repo.InsertContext(ctx, &User{Name: "Alice", Email: "alice@dinghy.test"})
+		if !errors.Is(err, ErrDuplicateEmail) {
+			t.Fatalf("got %v, want ErrDuplicateEmail", err)
+		}
+
+		pending, err := repo.GetPendingDeletionByEmailContext(ctx, "ALICE@dinghy.test", before)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if pending.ID != user.ID || pending.DeletedAt == nil {
+			t.Fatalf("got %+v", pending)
+		}
+
+		_, err = repo.GetPendingDeletionContext(ctx, user.ID, before)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// past the grace period
+		_, err = repo.GetPendingDeletionContext(ctx, user.ID, time.Now().Add(time.Hour))
+		if !errors.Is(err, ErrRecordNotFound) {
+			t.Fatalf("got %v, want ErrRecordNotFound", err)
+		}
+
+		err = repo.SoftDeleteContext(ctx, user)
+		if !errors.Is(err, ErrEditConflict) {
+			t.Fatalf("got %v, want ErrEditConflict", err)
+		}
+
+		err = repo.RestoreContext(ctx, pending)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if pending.DeletedAt != nil || pending.Version != 3 {
+			t.Fatalf("got deleted at %v, version %d", pending.DeletedAt, pending.Version)
+		}
+
+		_, err = repo.GetByUserIdContext(ctx, user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// user still holds the version from before the restore
+		err = repo.RestoreContext(ctx, user)
+		if !errors.Is(err, ErrEditConflict) {
+			t.Fatalf("got %v, want ErrEditConflict", err)
+		}
+	})
+
+	t.Run("Purge", func(t *testing.T) {
+		repo := newRepository(t)
+
+		var deleted []int64
+
+		for i := range 3 {
+			user := insert(t, repo, "User", fmt.Sprintf("user%d@dinghy.test", i))
+
+			err := repo.SoftDeleteContext(ctx, user)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			deleted = append(deleted, user.ID)
+		}
+
+		active := insert(t, repo, "Active", "active@dinghy.test")
+
+		err := repo.DeleteContext(ctx, active.ID)
+		if !errors.Is(err, ErrRecordNotFound) {
+			t.Fatalf("got %v, want ErrRecordNotFound", err)
+		}
+
+		userIds, err := repo.ClaimDeletedBeforeContext(ctx, time.Now().Add(-time.Hour), 10, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(userIds) != 0 {
+			t.Fatalf("got %v, want none", userIds)
+		}
+
+		userIds, err = repo.ClaimDeletedBeforeContext(ctx, time.Now().Add(time.Hour), 2, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(userIds) != 2 || !slices.Contains(deleted, userIds[0]) || !slices.Contains(deleted, userIds[1]) {
+			t.Fatalf("got %v, want 2 of %v", userIds, deleted)
+		}
+
+		// claimed users are left to the purge that claimed them
+		claimed, err := repo.ClaimDeletedBeforeContext(ctx, time.Now().Add(time.Hour), 10, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(claimed) != len(deleted)-2 || slices.Contains(claimed, userIds[0]) || slices.Contains(claimed, userIds[1]) {
+			t.Fatalf("got %v, want the users of %v other than %v", claimed, deleted, userIds)
+		}
+
+		for _, userId := range deleted {
+			err = repo.DeleteContext(ctx, userId)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		err = repo.DeleteContext(ctx, deleted[0])
+		if !errors.Is(err, ErrRecordNotFound) {
+			t.Fatalf("got %v, want ErrRecordNotFound", err)
+		}
+
+		// the email is free again
+		insert(t, repo, "User", "user0@dinghy.test")
+	})
+
+	t.Run("List", func(t *testing.T) {
+		repo := newRepository(t)
+
+		var all []int64
+
+		for i := range 5 {
+			user := insert(t, repo, fmt.Sprintf("User %d", i), fmt.Sprintf("user%d@dinghy.test", i))
+
+			// odd users are activated
+			if i%2 == 1 {
+				user.Activated = true
+
+				err := repo.UpdateContext(ctx, user)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			all = append(all, user.ID)
+		}
+
+		gone := insert(t, repo, "Gone", "gone@dinghy.test")
+
+		err := repo.SoftDeleteContext(ctx, gone)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		listAll := func(t *testing.T, listFilters UserListFilters, sort string) []int64 {
+			t.Helper()
+
+			filters := Filters{Sort: sort, PageSize: 2}
+
+			var userIds []int64
+
+			for {
+				users, nextCursor, err := repo.ListContext(ctx, listFilters, filters)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if len(users) > filters.PageSize {
+					t.Fatalf("got a page of %d users", len(users))
+				}
+
+				for _, user := range users {
+					userIds = append(userIds, user.ID)
+				}
+
+				if nextCursor == "" {
+					return userIds
+				}
+
+				filters.Cursor = nextCursor
+			}
+		}
+
+		userIds := listAll(t, UserListFilters{}, "created_at")
+		if !slices.Equal(userIds, all) {
+			t.Fatalf("got %v, want %v", userIds, all)
+		}
+
+		userIds = listAll(t, UserListFilters{}, "-created_at")
+		reversed := slices.Clone(all)
+		slices.Reverse(reversed)
+
+		if !slices.Equal(userIds, reversed) {
+			t.Fatalf("got %v, want %v", userIds, reversed)
+		}
+
+		activated := true
+
+		userIds = listAll(t, UserListFilters{Activated: &activated}, "created_at")
+		if !slices.Equal(userIds, []int64{all[1], all[3]}) {
+			t.Fatalf("got %v, want %v", userIds, []int64{all[1], all[3]})
+		}
+
+		userIds = listAll(t, UserListFilters{Search: "USER3@"}, "created_at")
+		if !slices.Equal(userIds, []int64{all[3]}) {
+			t.Fatalf("got %v, want %v", userIds, []int64{all[3]})
+		}
+
+		// wildcards match literally
+		userIds = listAll(t, UserListFilters{Search: "user_"}, "created_at")
+		if len(userIds) != 0 {
+			t.Fatalf("got %v, want none", userIds)
+		}
+
+		future := time.Now().Add(time.Hour)
+
+		userIds = listAll(t, UserListFilters{CreatedAfter: &future}, "created_at")
+		if len(userIds) != 0 {
+			t.Fatalf("got %v, want none", userIds)
+		}
+
+		_, _, err = repo.ListContext(ctx, UserListFilters{}, Filters{Sort: "created_at", PageSize: 2, Cursor: "not-a-cursor"})
+		if !errors.Is(err, ErrInvalidCursor) {
+			t.Fatalf("got %v, want ErrInvalidCursor", err)
+		}
+	})
+
+	t.Run("Canceled", func(t *testing.T) {
+		repo := newRepository(t)
+
+		canceled, cancel := context.WithCancel(ctx)
+		cancel()
+
+		_, err := repo.GetByEmailContext(canceled, "alice@dinghy.test")
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("got %v, want context.Canceled", err)
+		}
+	})
+}
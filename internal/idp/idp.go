@@ -0,0 +1,180 @@
+// Package idp signs users in with external OpenID Connect identity providers,
+// using the authorization code flow with PKCE
+package idp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// ErrInvalidResponse is wrapped by every error caused by what the provider or
+// the client sent, as opposed to the provider being unreachable
+var ErrInvalidResponse = errors.New("invalid identity provider response")
+
+type Config struct {
+	Name         string   `json:"name"`
+	Issuer       string   `json:"issuer"`
+	ClientID     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret"`
+	RedirectURL  string   `json:"redirect_url"`
+	Scopes       []string `json:"scopes"`
+	// overrides the key set advertised by the issuer's discovery document
+	JWKSURL string `json:"jwks_url"`
+}
+
+// LoadConfigs reads the provider list from a JSON file
+func LoadConfigs(path string) ([]Config, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var configs []Config
+
+	err = json.Unmarshal(raw, &configs)
+	if err != nil {
+		return nil, fmt.Errorf("identity providers file %s: %w", path, err)
+	}
+
+	for _, cfg := range configs {
+		if cfg.Name == "" || cfg.Issuer == "" || cfg.ClientID == "" || cfg.RedirectURL == "" {
+			return nil, fmt.Errorf("identity providers file %s: name, issuer, client_id and redirect_url are required", path)
+		}
+	}
+
+	return configs, nil
+}
+
+// Identity is the user as asserted by the provider's ID token
+type Identity struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+}
+
+// Provider discovers the issuer on first use rather than at startup, so an
+// unreachable provider doesn't keep the service from starting
+type Provider struct {
+	config Config
+
+	mu       sync.Mutex
+	oauth2   *oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+func NewProvider(config Config) *Provider {
+	return &Provider{config: config}
+}
+
+func (p *Provider) Name() string {
+	return p.config.Name
+}
+
+func (p *Provider) discover(ctx context.Context) (*oauth2.Config, *oidc.IDTokenVerifier, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.oauth2 != nil {
+		return p.oauth2, p.verifier, nil
+	}
+
+	provider, err := oidc.NewProvider(ctx, p.config.Issuer)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	verifierConfig := &oidc.Config{ClientID: p.config.ClientID}
+
+	verifier := provider.Verifier(verifierConfig)
+	if p.config.JWKSURL != "" {
+		// the key set refreshes in the background, outliving the request
+		verifier = oidc.NewVerifier(p.config.Issuer, oidc.NewRemoteKeySet(context.Background(), p.config.JWKSURL), verifierConfig)
+	}
+
+	scopes := p.config.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"email", "profile"}
+	}
+
+	p.oauth2 = &oauth2.Config{
+		ClientID:     p.config.ClientID,
+		ClientSecret: p.config.ClientSecret,
+		RedirectURL:  p.config.RedirectURL,
+		Endpoint:     provider.Endpoint(),
+		Scopes:       append([]string{oidc.ScopeOpenID}, scopes...),
+	}
+	p.verifier = verifier
+
+	return p.oauth2, p.verifier, nil
+}
+
+// AuthCodeURL returns the URL the user is sent to for signing in. state and
+// nonce come back in the redirect and the ID token, the verifier is kept
+// until the code is exchanged
+func (p *Provider) AuthCodeURL(ctx context.Context, state, nonce, verifier string) (string, error) {
+	config, _, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	return config.AuthCodeURL(state, oauth2.S256ChallengeOption(verifier), oidc.Nonce(nonce)), nil
+}
+
+// Exchange trades the authorization code for an ID token and returns the
+// identity it asserts, after checking its signature, issuer, audience,
+// expiry and nonce
+func (p *Provider) Exchange(ctx context.Context, code, verifier, nonce string) (*Identity, error) {
+	config, idTokenVerifier, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := config.Exchange(ctx, code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		var retrieveErr *oauth2.RetrieveError
+		if errors.As(err, &retrieveErr) {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidResponse, retrieveErr.Error())
+		}
+		return nil, err
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, fmt.Errorf("%w: no id token in the token response", ErrInvalidResponse)
+	}
+
+	idToken, err := idTokenVerifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidResponse, err.Error())
+	}
+
+	if idToken.Nonce != nonce {
+		return nil, fmt.Errorf("%w: nonce mismatch", ErrInvalidResponse)
+	}
+
+	var claims struct {
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+		Name          string `json:"name"`
+	}
+
+	err = idToken.Claims(&claims)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidResponse, err.Error())
+	}
+
+	return &Identity{
+		Subject:       idToken.Subject,
+		Email:         claims.Email,
+		EmailVerified: claims.EmailVerified,
+		Name:          claims.Name,
+	}, nil
+}
@@ -0,0 +1,287 @@
+package idp
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"golang.org/x/oauth2"
+)
+
+// fakeIssuer is a minimal OpenID provider: discovery, a key set and a token
+// endpoint redeeming codes handed out by authorize
+type fakeIssuer struct {
+	t      *testing.T
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	// served at /other-jwks, for configs overriding the key set
+	otherKey *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]issuedCode
+}
+
+type issuedCode struct {
+	challenge string
+	claims    map[string]any
+	key       *rsa.PrivateKey
+}
+
+func newFakeIssuer(t *testing.T) *fakeIssuer {
+	f := &fakeIssuer{
+		t:        t,
+		key:      newTestKey(t),
+		otherKey: newTestKey(t),
+		codes:    make(map[string]issuedCode),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", f.discovery)
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) { f.jwks(w, f.key) })
+	mux.HandleFunc("/other-jwks", func(w http.ResponseWriter, r *http.Request) { f.jwks(w, f.otherKey) })
+	mux.HandleFunc("/token", f.token)
+
+	f.server = httptest.NewServer(mux)
+	t.Cleanup(f.server.Close)
+
+	return f
+}
+
+func newTestKey(t *testing.T) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+func (f *fakeIssuer) discovery(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]any{
+		"issuer":                                f.server.URL,
+		"authorization_endpoint":                f.server.URL + "/authorize",
+		"token_endpoint":                        f.server.URL + "/token",
+		"jwks_uri":                              f.server.URL + "/jwks",
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+	})
+}
+
+func (f *fakeIssuer) jwks(w http.ResponseWriter, key *rsa.PrivateKey) {
+	json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+		{Key: &key.PublicKey, KeyID: "test", Algorithm: "RS256", Use: "sig"},
+	}})
+}
+
+// authorize does what the provider does once the user signed in: it hands
+// out a code for an ID token with the given claims
+func (f *fakeIssuer) authorize(authURL string, claims map[string]any, key *rsa.PrivateKey) (code, state string) {
+	u, err := url.Parse(authURL)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+
+	query := u.Query()
+
+	base := map[string]any{
+		"iss":   f.server.URL,
+		"aud":   query.Get("client_id"),
+		"nonce": query.Get("nonce"),
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(time.Hour).Unix(),
+	}
+
+	for name, value := range claims {
+		base[name] = value
+	}
+
+	randomBytes := make([]byte, 16)
+	rand.Read(randomBytes)
+	code = base64.RawURLEncoding.EncodeToString(randomBytes)
+
+	f.mu.Lock()
+	f.codes[code] = issuedCode{challenge: query.Get("code_challenge"), claims: base, key: key}
+	f.mu.Unlock()
+
+	return code, query.Get("state")
+}
+
+func (f *fakeIssuer) token(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	issued, ok := f.codes[r.FormValue("code")]
+	delete(f.codes, r.FormValue("code"))
+	f.mu.Unlock()
+
+	verifierHash := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+	if !ok || base64.RawURLEncoding.EncodeToString(verifierHash[:]) != issued.challenge {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid_grant"}`))
+		return
+	}
+
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: issued.key}, (&jose.SignerOptions{}).WithHeader("kid", "test"))
+	if err != nil {
+		f.t.Fatal(err)
+	}
+
+	payload, _ := json.Marshal(issued.claims)
+
+	jws, err := signer.Sign(payload)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+
+	idToken, err := jws.CompactSerialize()
+	if err != nil {
+		f.t.Fatal(err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"access_token": "access",
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     idToken,
+	})
+}
+
+func (f *fakeIssuer) provider() *Provider {
+	return NewProvider(Config{
+		Name:         "fake",
+		Issuer:       f.server.URL,
+		ClientID:     "users",
+		ClientSecret: "secret",
+		RedirectURL:  "https://dinghy.test/callback",
+	})
+}
+
+var userClaims = map[string]any{
+	"sub":            "subject-1",
+	"email":          "user@dinghy.test",
+	"email_verified": true,
+	"name":           "User",
+}
+
+func TestExchange(t *testing.T) {
+	ctx := context.Background()
+	issuer := newFakeIssuer(t)
+	provider := issuer.provider()
+
+	verifier := oauth2.GenerateVerifier()
+
+	authURL, err := provider.AuthCodeURL(ctx, "state-1", "nonce-1", verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, state := issuer.authorize(authURL, userClaims, issuer.key)
+	if state != "state-1" {
+		t.Errorf("got state %q back", state)
+	}
+
+	identity, err := provider.Exchange(ctx, code, verifier, "nonce-1")
+	if err != nil {
+		t.Fatalf("exchange failed: %v", err)
+	}
+
+	expected := Identity{Subject: "subject-1", Email: "user@dinghy.test", EmailVerified: true, Name: "User"}
+	if *identity != expected {
+		t.Errorf("got identity %+v and expected %+v", *identity, expected)
+	}
+}
+
+func TestExchangeJWKSOverride(t *testing.T) {
+	ctx := context.Background()
+	issuer := newFakeIssuer(t)
+
+	config := issuer.provider().config
+	config.JWKSURL = issuer.server.URL + "/other-jwks"
+	provider := NewProvider(config)
+
+	verifier := oauth2.GenerateVerifier()
+
+	authURL, err := provider.AuthCodeURL(ctx, "state", "nonce", verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, _ := issuer.authorize(authURL, userClaims, issuer.otherKey)
+
+	_, err = provider.Exchange(ctx, code, verifier, "nonce")
+	if err != nil {
+		t.Fatalf("exchange failed: %v", err)
+	}
+}
+
+func TestExchangeRejected(t *testing.T) {
+	ctx := context.Background()
+	issuer := newFakeIssuer(t)
+
+	tests := []struct {
+		name     string
+		claims   map[string]any
+		key      *rsa.PrivateKey
+		verifier string
+		nonce    string
+	}{
+		{name: "pkce verifier mismatch", verifier: oauth2.GenerateVerifier()},
+		{name: "nonce mismatch", nonce: "other-nonce"},
+		{name: "other audience", claims: map[string]any{"aud": "other-client"}},
+		{name: "other issuer", claims: map[string]any{"iss": "https://evil.test"}},
+		{name: "expired", claims: map[string]any{"exp": time.Now().Add(-time.Minute).Unix()}},
+		{name: "signed with unknown key", key: issuer.otherKey},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider := issuer.provider()
+
+			verifier := oauth2.GenerateVerifier()
+
+			authURL, err := provider.AuthCodeURL(ctx, "state", "nonce", verifier)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			claims := map[string]any{}
+			for name, value := range userClaims {
+				claims[name] = value
+			}
+			for name, value := range tt.claims {
+				claims[name] = value
+			}
+
+			key := issuer.key
+			if tt.key != nil {
+				key = tt.key
+			}
+
+			code, _ := issuer.authorize(authURL, claims, key)
+
+			if tt.verifier != "" {
+				verifier = tt.verifier
+			}
+
+			nonce := "nonce"
+			if tt.nonce != "" {
+				nonce = tt.nonce
+			}
+
+			_, err = provider.Exchange(ctx, code, verifier, nonce)
+			if !errors.Is(err, ErrInvalidResponse) {
+				t.Errorf("expected an invalid response error, got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package totp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// SHA1 test vectors of RFC 6238 appendix B, truncated to 6 digits
+func TestCode(t *testing.T) {
+	secret := []byte("12345678901234567890")
+
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for _, tt := range tests {
+		got := Code(secret, Step(time.Unix(tt.unix, 0)))
+		if got != tt.code {
+			t.Errorf("code at %d: got %s and expected %s", tt.unix, got, tt.code)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	previous := Code(secret, Step(now)-1)
+
+	step, ok := Validate(secret, previous, now, 1)
+	if !ok || step != Step(now)-1 {
+		t.Errorf("code of the previous step should be accepted with a skew of 1")
+	}
+
+	if _, ok := Validate(secret, previous, now, 0); ok {
+		t.Errorf("code of the previous step should be refused without skew")
+	}
+
+	if _, ok := Validate(secret, "12345", now, 1); ok {
+		t.Errorf("short code should be refused")
+	}
+}
+
+func TestURI(t *testing.T) {
+	uri := URI("Dinghy", "user@dinghy.test", []byte("12345678901234567890"))
+
+	if !strings.HasPrefix(uri, "otpauth://totp/Dinghy:user@dinghy.test?") {
+		t.Errorf("unexpected uri %s", uri)
+	}
+
+	if !strings.Contains(uri, "secret=GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ") {
+		t.Errorf("uri %s is missing the secret", uri)
+	}
+}
@@ -0,0 +1,125 @@
+package webauthn
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"math/big"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// COSE algorithms (https://www.iana.org/assignments/cose/cose.xhtml)
+const (
+	AlgES256 = -7
+	AlgEdDSA = -8
+	AlgRS256 = -257
+)
+
+// SupportedAlgorithms lists the algorithms accepted for new credentials, in
+// order of preference
+var SupportedAlgorithms = []int{AlgES256, AlgEdDSA, AlgRS256}
+
+// COSE key types and curves
+const (
+	keyTypeOKP = 1
+	keyTypeEC2 = 2
+	keyTypeRSA = 3
+
+	curveP256    = 1
+	curveEd25519 = 6
+)
+
+// coseKey holds the parameters of the supported key types, whose labels
+// overlap: -1 is the curve of EC2 and OKP keys and the modulus of RSA keys
+type coseKey struct {
+	KeyType   int             `cbor:"1,keyasint"`
+	Algorithm int             `cbor:"3,keyasint"`
+	Param1    cbor.RawMessage `cbor:"-1,keyasint"`
+	Param2    []byte          `cbor:"-2,keyasint"`
+	Param3    []byte          `cbor:"-3,keyasint"`
+}
+
+type publicKey struct {
+	algorithm int
+	key       crypto.PublicKey
+}
+
+func parsePublicKey(raw []byte) (*publicKey, error) {
+	var k coseKey
+
+	err := cbor.Unmarshal(raw, &k)
+	if err != nil {
+		return nil, verificationError("malformed public key")
+	}
+
+	switch {
+	case k.KeyType == keyTypeEC2 && k.Algorithm == AlgES256:
+		var curve int
+		if cbor.Unmarshal(k.Param1, &curve) != nil || curve != curveP256 || len(k.Param2) != 32 || len(k.Param3) != 32 {
+			return nil, verificationError("malformed ES256 public key")
+		}
+
+		key := &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(k.Param2),
+			Y:     new(big.Int).SetBytes(k.Param3),
+		}
+
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, verificationError("ES256 public key is not on the curve")
+		}
+
+		return &publicKey{algorithm: AlgES256, key: key}, nil
+
+	case k.KeyType == keyTypeOKP && k.Algorithm == AlgEdDSA:
+		var curve int
+		if cbor.Unmarshal(k.Param1, &curve) != nil || curve != curveEd25519 || len(k.Param2) != ed25519.PublicKeySize {
+			return nil, verificationError("malformed EdDSA public key")
+		}
+
+		return &publicKey{algorithm: AlgEdDSA, key: ed25519.PublicKey(k.Param2)}, nil
+
+	case k.KeyType == keyTypeRSA && k.Algorithm == AlgRS256:
+		var modulus []byte
+		if cbor.Unmarshal(k.Param1, &modulus) != nil || len(modulus) < 256 || len(k.Param2) == 0 || len(k.Param2) > 4 {
+			return nil, verificationError("malformed RS256 public key")
+		}
+
+		key := &rsa.PublicKey{
+			N: new(big.Int).SetBytes(modulus),
+			E: int(new(big.Int).SetBytes(k.Param2).Int64()),
+		}
+
+		return &publicKey{algorithm: AlgRS256, key: key}, nil
+
+	default:
+		return nil, verificationError("unsupported public key type %d with algorithm %d", k.KeyType, k.Algorithm)
+	}
+}
+
+func (k *publicKey) verify(message, signature []byte) error {
+	switch k.algorithm {
+	case AlgES256:
+		digest := sha256.Sum256(message)
+		if !ecdsa.VerifyASN1(k.key.(*ecdsa.PublicKey), digest[:], signature) {
+			return verificationError("invalid signature")
+		}
+
+	case AlgEdDSA:
+		if !ed25519.Verify(k.key.(ed25519.PublicKey), message, signature) {
+			return verificationError("invalid signature")
+		}
+
+	case AlgRS256:
+		digest := sha256.Sum256(message)
+		if rsa.VerifyPKCS1v15(k.key.(*rsa.PublicKey), crypto.SHA256, digest[:], signature) != nil {
+			return verificationError("invalid signature")
+		}
+	}
+
+	return nil
+}
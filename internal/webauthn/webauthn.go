@@ -0,0 +1,281 @@
+// Package webauthn verifies the responses of the WebAuthn registration and
+// authentication ceremonies (https://www.w3.org/TR/webauthn-2/), for
+// passkeys registered without attestation
+package webauthn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// ChallengeSize is the size of the random challenges signed by authenticators
+const ChallengeSize = 32
+
+// authenticator data flags
+const (
+	flagUserPresent      = 0x01
+	flagUserVerified     = 0x04
+	flagAttestedCredData = 0x40
+)
+
+// ErrVerification is wrapped by every error caused by the response of the
+// client, as opposed to internal failures
+var ErrVerification = errors.New("webauthn verification failed")
+
+func verificationError(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", ErrVerification, fmt.Sprintf(format, args...))
+}
+
+// RelyingParty describes this service to authenticators
+type RelyingParty struct {
+	ID      string
+	Name    string
+	Origins []string
+	// require the authenticator to verify the user (pin, biometrics), which
+	// makes a passkey a replacement for both a password and a second factor
+	RequireUserVerification bool
+}
+
+// Credential is a public key credential registered by a user
+type Credential struct {
+	ID        []byte
+	PublicKey []byte // COSE_Key
+	SignCount uint32
+}
+
+func NewChallenge() ([]byte, error) {
+	challenge := make([]byte, ChallengeSize)
+
+	_, err := rand.Read(challenge)
+	if err != nil {
+		return nil, err
+	}
+
+	return challenge, nil
+}
+
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+// ParseChallenge returns the challenge the client data was signed for, so
+// the ceremony it belongs to can be looked up before verifying it
+func ParseChallenge(clientDataJSON []byte) ([]byte, error) {
+	var cd clientData
+
+	err := json.Unmarshal(clientDataJSON, &cd)
+	if err != nil {
+		return nil, verificationError("malformed client data")
+	}
+
+	challenge, err := base64.RawURLEncoding.DecodeString(cd.Challenge)
+	if err != nil {
+		return nil, verificationError("malformed challenge")
+	}
+
+	return challenge, nil
+}
+
+func (rp RelyingParty) verifyClientData(clientDataJSON []byte, ceremony string, challenge []byte) error {
+	var cd clientData
+
+	err := json.Unmarshal(clientDataJSON, &cd)
+	if err != nil {
+		return verificationError("malformed client data")
+	}
+
+	if cd.Type != ceremony {
+		return verificationError("unexpected client data type %q", cd.Type)
+	}
+
+	signed, err := base64.RawURLEncoding.DecodeString(cd.Challenge)
+	if err != nil || subtle.ConstantTimeCompare(signed, challenge) != 1 {
+		return verificationError("challenge mismatch")
+	}
+
+	if !slices.Contains(rp.Origins, cd.Origin) {
+		return verificationError("unexpected origin %q", cd.Origin)
+	}
+
+	return nil
+}
+
+type authenticatorData struct {
+	rpIdHash  []byte
+	flags     byte
+	signCount uint32
+	// attested credential data, only present on registration
+	credentialId []byte
+	publicKey    []byte
+}
+
+func parseAuthenticatorData(raw []byte) (*authenticatorData, error) {
+	if len(raw) < 37 {
+		return nil, verificationError("authenticator data too short")
+	}
+
+	ad := &authenticatorData{
+		rpIdHash:  raw[:32],
+		flags:     raw[32],
+		signCount: binary.BigEndian.Uint32(raw[33:37]),
+	}
+
+	if ad.flags&flagAttestedCredData == 0 {
+		return ad, nil
+	}
+
+	// aaguid (16 bytes), credential id length (2 bytes), credential id, public key
+	rest := raw[37:]
+	if len(rest) < 18 {
+		return nil, verificationError("attested credential data too short")
+	}
+
+	idLength := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if len(rest) < idLength {
+		return nil, verificationError("credential id too short")
+	}
+
+	ad.credentialId = rest[:idLength]
+
+	// the public key is the first CBOR item after the id, extensions may follow
+	var publicKey cbor.RawMessage
+
+	_, err := cbor.UnmarshalFirst(rest[idLength:], &publicKey)
+	if err != nil {
+		return nil, verificationError("malformed credential public key")
+	}
+
+	ad.publicKey = publicKey
+
+	return ad, nil
+}
+
+func (rp RelyingParty) verifyAuthenticatorData(ad *authenticatorData) error {
+	rpIdHash := sha256.Sum256([]byte(rp.ID))
+	if !bytes.Equal(ad.rpIdHash, rpIdHash[:]) {
+		return verificationError("relying party id mismatch")
+	}
+
+	if ad.flags&flagUserPresent == 0 {
+		return verificationError("user was not present")
+	}
+
+	if rp.RequireUserVerification && ad.flags&flagUserVerified == 0 {
+		return verificationError("user was not verified")
+	}
+
+	return nil
+}
+
+type attestationObject struct {
+	Format   string          `cbor:"fmt"`
+	AttStmt  cbor.RawMessage `cbor:"attStmt"`
+	AuthData []byte          `cbor:"authData"`
+}
+
+// VerifyRegistration verifies the response of navigator.credentials.create()
+// to the given challenge, and returns the new credential
+func (rp RelyingParty) VerifyRegistration(challenge, clientDataJSON, attestation []byte) (*Credential, error) {
+	err := rp.verifyClientData(clientDataJSON, "webauthn.create", challenge)
+	if err != nil {
+		return nil, err
+	}
+
+	var obj attestationObject
+
+	err = cbor.Unmarshal(attestation, &obj)
+	if err != nil {
+		return nil, verificationError("malformed attestation object")
+	}
+
+	// only "none" is requested, browsers strip any other attestation then
+	if obj.Format != "none" {
+		return nil, verificationError("unsupported attestation format %q", obj.Format)
+	}
+
+	var stmt map[string]any
+
+	err = cbor.Unmarshal(obj.AttStmt, &stmt)
+	if err != nil || len(stmt) != 0 {
+		return nil, verificationError("attestation statement must be empty")
+	}
+
+	ad, err := parseAuthenticatorData(obj.AuthData)
+	if err != nil {
+		return nil, err
+	}
+
+	err = rp.verifyAuthenticatorData(ad)
+	if err != nil {
+		return nil, err
+	}
+
+	if ad.credentialId == nil {
+		return nil, verificationError("attested credential data missing")
+	}
+
+	// make sure the key is usable before storing it
+	_, err = parsePublicKey(ad.publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Credential{
+		ID:        ad.credentialId,
+		PublicKey: ad.publicKey,
+		SignCount: ad.signCount,
+	}, nil
+}
+
+// VerifyAssertion verifies the response of navigator.credentials.get() to
+// the given challenge, signed by the credential, and returns the new value
+// of its signature counter
+func (rp RelyingParty) VerifyAssertion(credential *Credential, challenge, clientDataJSON, rawAuthData, signature []byte) (uint32, error) {
+	err := rp.verifyClientData(clientDataJSON, "webauthn.get", challenge)
+	if err != nil {
+		return 0, err
+	}
+
+	ad, err := parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return 0, err
+	}
+
+	err = rp.verifyAuthenticatorData(ad)
+	if err != nil {
+		return 0, err
+	}
+
+	publicKey, err := parsePublicKey(credential.PublicKey)
+	if err != nil {
+		return 0, err
+	}
+
+	clientDataHash := sha256.Sum256(clientDataJSON)
+
+	err = publicKey.verify(append(slices.Clone(rawAuthData), clientDataHash[:]...), signature)
+	if err != nil {
+		return 0, err
+	}
+
+	// authenticators that don't count always send 0, others must move forward,
+	// or the credential was cloned
+	if (ad.signCount != 0 || credential.SignCount != 0) && ad.signCount <= credential.SignCount {
+		return 0, verificationError("signature counter did not increase, the authenticator may be cloned")
+	}
+
+	return ad.signCount, nil
+}
@@ -0,0 +1,272 @@
+package webauthn
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+const testOrigin = "https://dinghy.test"
+
+var testRP = RelyingParty{
+	ID:                      "dinghy.test",
+	Name:                    "Dinghy",
+	Origins:                 []string{testOrigin},
+	RequireUserVerification: true,
+}
+
+// softAuthenticator is a software ES256 authenticator, doing what a security
+// key or a platform authenticator does during the ceremonies
+type softAuthenticator struct {
+	t            *testing.T
+	key          *ecdsa.PrivateKey
+	credentialId []byte
+	signCount    uint32
+	flags        byte
+}
+
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	credentialId := make([]byte, 16)
+	rand.Read(credentialId)
+
+	return &softAuthenticator{
+		t:            t,
+		key:          key,
+		credentialId: credentialId,
+		flags:        flagUserPresent | flagUserVerified,
+	}
+}
+
+func (a *softAuthenticator) clientData(ceremony string, challenge []byte, origin string) []byte {
+	clientDataJSON, err := json.Marshal(map[string]any{
+		"type":      ceremony,
+		"challenge": base64.RawURLEncoding.EncodeToString(challenge),
+		"origin":    origin,
+	})
+	if err != nil {
+		a.t.Fatal(err)
+	}
+
+	return clientDataJSON
+}
+
+func (a *softAuthenticator) authenticatorData(rpId string, flags byte, attested []byte) []byte {
+	rpIdHash := sha256.Sum256([]byte(rpId))
+
+	authData := append([]byte{}, rpIdHash[:]...)
+	authData = append(authData, flags)
+	authData = binary.BigEndian.AppendUint32(authData, a.signCount)
+
+	return append(authData, attested...)
+}
+
+func (a *softAuthenticator) publicKey() []byte {
+	x := make([]byte, 32)
+	y := make([]byte, 32)
+	a.key.X.FillBytes(x)
+	a.key.Y.FillBytes(y)
+
+	publicKey, err := cbor.Marshal(map[int]any{1: keyTypeEC2, 3: AlgES256, -1: curveP256, -2: x, -3: y})
+	if err != nil {
+		a.t.Fatal(err)
+	}
+
+	return publicKey
+}
+
+func (a *softAuthenticator) create(rpId string, challenge []byte, origin string) (clientDataJSON, attestation []byte) {
+	attested := make([]byte, 16) // zero aaguid
+	attested = binary.BigEndian.AppendUint16(attested, uint16(len(a.credentialId)))
+	attested = append(attested, a.credentialId...)
+	attested = append(attested, a.publicKey()...)
+
+	attestation, err := cbor.Marshal(map[string]any{
+		"fmt":      "none",
+		"attStmt":  map[string]any{},
+		"authData": a.authenticatorData(rpId, a.flags|flagAttestedCredData, attested),
+	})
+	if err != nil {
+		a.t.Fatal(err)
+	}
+
+	return a.clientData("webauthn.create", challenge, origin), attestation
+}
+
+func (a *softAuthenticator) get(rpId string, challenge []byte, origin string) (clientDataJSON, authData, signature []byte) {
+	a.signCount++
+
+	clientDataJSON = a.clientData("webauthn.get", challenge, origin)
+	authData = a.authenticatorData(rpId, a.flags, nil)
+
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		a.t.Fatal(err)
+	}
+
+	return clientDataJSON, authData, signature
+}
+
+func newTestChallenge(t *testing.T) []byte {
+	challenge, err := NewChallenge()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return challenge
+}
+
+func register(t *testing.T, a *softAuthenticator) *Credential {
+	challenge := newTestChallenge(t)
+
+	clientDataJSON, attestation := a.create(testRP.ID, challenge, testOrigin)
+
+	credential, err := testRP.VerifyRegistration(challenge, clientDataJSON, attestation)
+	if err != nil {
+		t.Fatalf("registration failed: %v", err)
+	}
+
+	return credential
+}
+
+func TestRegistration(t *testing.T) {
+	a := newSoftAuthenticator(t)
+
+	credential := register(t, a)
+
+	if string(credential.ID) != string(a.credentialId) {
+		t.Errorf("credential id mismatch")
+	}
+
+	_, err := parsePublicKey(credential.PublicKey)
+	if err != nil {
+		t.Errorf("stored public key doesn't parse: %v", err)
+	}
+}
+
+func TestRegistrationRejected(t *testing.T) {
+	challenge := newTestChallenge(t)
+
+	tests := []struct {
+		name   string
+		mutate func(a *softAuthenticator) (clientDataJSON, attestation []byte)
+	}{
+		{"other challenge", func(a *softAuthenticator) ([]byte, []byte) {
+			return a.create(testRP.ID, newTestChallenge(t), testOrigin)
+		}},
+		{"other origin", func(a *softAuthenticator) ([]byte, []byte) {
+			return a.create(testRP.ID, challenge, "https://evil.test")
+		}},
+		{"other relying party", func(a *softAuthenticator) ([]byte, []byte) {
+			return a.create("evil.test", challenge, testOrigin)
+		}},
+		{"user not verified", func(a *softAuthenticator) ([]byte, []byte) {
+			a.flags = flagUserPresent
+			return a.create(testRP.ID, challenge, testOrigin)
+		}},
+		{"assertion type", func(a *softAuthenticator) ([]byte, []byte) {
+			_, attestation := a.create(testRP.ID, challenge, testOrigin)
+			return a.clientData("webauthn.get", challenge, testOrigin), attestation
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientDataJSON, attestation := tt.mutate(newSoftAuthenticator(t))
+
+			_, err := testRP.VerifyRegistration(challenge, clientDataJSON, attestation)
+			if !errors.Is(err, ErrVerification) {
+				t.Errorf("expected a verification error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestAssertion(t *testing.T) {
+	a := newSoftAuthenticator(t)
+	credential := register(t, a)
+
+	for i := 0; i < 2; i++ {
+		challenge := newTestChallenge(t)
+
+		clientDataJSON, authData, signature := a.get(testRP.ID, challenge, testOrigin)
+
+		parsed, err := ParseChallenge(clientDataJSON)
+		if err != nil || string(parsed) != string(challenge) {
+			t.Fatalf("challenge doesn't round trip: %v", err)
+		}
+
+		signCount, err := testRP.VerifyAssertion(credential, challenge, clientDataJSON, authData, signature)
+		if err != nil {
+			t.Fatalf("assertion %d failed: %v", i, err)
+		}
+
+		if signCount != a.signCount {
+			t.Errorf("got sign count %d and expected %d", signCount, a.signCount)
+		}
+
+		credential.SignCount = signCount
+	}
+}
+
+func TestAssertionRejected(t *testing.T) {
+	a := newSoftAuthenticator(t)
+	credential := register(t, a)
+	challenge := newTestChallenge(t)
+
+	t.Run("bad signature", func(t *testing.T) {
+		clientDataJSON, authData, signature := a.get(testRP.ID, challenge, testOrigin)
+		signature[len(signature)-1] ^= 0xff
+
+		_, err := testRP.VerifyAssertion(credential, challenge, clientDataJSON, authData, signature)
+		if !errors.Is(err, ErrVerification) {
+			t.Errorf("expected a verification error, got %v", err)
+		}
+	})
+
+	t.Run("other key", func(t *testing.T) {
+		other := newSoftAuthenticator(t)
+		clientDataJSON, authData, signature := other.get(testRP.ID, challenge, testOrigin)
+
+		_, err := testRP.VerifyAssertion(credential, challenge, clientDataJSON, authData, signature)
+		if !errors.Is(err, ErrVerification) {
+			t.Errorf("expected a verification error, got %v", err)
+		}
+	})
+
+	t.Run("other challenge", func(t *testing.T) {
+		clientDataJSON, authData, signature := a.get(testRP.ID, newTestChallenge(t), testOrigin)
+
+		_, err := testRP.VerifyAssertion(credential, challenge, clientDataJSON, authData, signature)
+		if !errors.Is(err, ErrVerification) {
+			t.Errorf("expected a verification error, got %v", err)
+		}
+	})
+
+	t.Run("sign count regression", func(t *testing.T) {
+		clientDataJSON, authData, signature := a.get(testRP.ID, challenge, testOrigin)
+
+		cloned := *credential
+		cloned.SignCount = a.signCount
+
+		_, err := testRP.VerifyAssertion(&cloned, challenge, clientDataJSON, authData, signature)
+		if !errors.Is(err, ErrVerification) {
+			t.Errorf("expected a verification error, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS users_deleted_at_idx;
+ALTER TABLE users DROP COLUMN IF EXISTS purge_claimed_until;
+ALTER TABLE users DROP COLUMN IF EXISTS deleted_at;
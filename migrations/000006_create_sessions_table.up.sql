@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS sessions (
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    token_hash bytea UNIQUE NOT NULL,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    expiry timestamp(0) with time zone NOT NULL,
+    client_ip text NOT NULL DEFAULT '',
+    user_agent text NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS sessions_user_id_idx ON sessions (user_id);
@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS recovery_codes (
+    code_hash bytea NOT NULL,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    used_at timestamp(0) with time zone,
+    PRIMARY KEY (user_id, code_hash)
+);
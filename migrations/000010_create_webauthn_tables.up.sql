@@ -0,0 +1,18 @@
+CREATE TABLE IF NOT EXISTS webauthn_credentials (
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    credential_id bytea NOT NULL,
+    public_key bytea NOT NULL,
+    sign_count bigint NOT NULL DEFAULT 0,
+    name text NOT NULL DEFAULT '',
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    last_used_at timestamp(0) with time zone,
+    PRIMARY KEY (user_id, credential_id)
+);
+CREATE UNIQUE INDEX IF NOT EXISTS webauthn_credentials_credential_id_idx ON webauthn_credentials (credential_id);
+
+CREATE TABLE IF NOT EXISTS webauthn_challenges (
+    challenge bytea PRIMARY KEY,
+    ceremony text NOT NULL,
+    user_id bigint REFERENCES users ON DELETE CASCADE,
+    expiry timestamp(0) with time zone NOT NULL
+);
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS registrations (
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL,
+    kind text NOT NULL DEFAULT 'password',
+    step text NOT NULL,
+    status text NOT NULL,
+    error text NOT NULL DEFAULT '',
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    updated_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS registrations_unfinished_idx ON registrations (updated_at) WHERE status IN ('pending', 'compensating');
@@ -76,7 +76,7 @@ func init() {
 
 	defer db.Close()
 
-	models := data.NewModels(db)
+	models := data.NewModels(db, data.DefaultQueryTimeout)
 
 	testUser := &data.User{
 		Name:      "Test Auth User",